@@ -13,13 +13,39 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"unicode"
 
 	"github.com/biogo/external"
 )
 
+// Version returns the version reported by the NCBI+ BLAST executable
+// cmd when it is invoked with the -version flag.
+func Version(cmd string) (string, error) {
+	out, err := exec.Command(cmd, "-version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", cmd, err)
+	}
+	return ParseVersion(out), nil
+}
+
+// ParseVersion returns the version in the output of an NCBI+ BLAST
+// executable invoked with the -version flag.
+func ParseVersion(out []byte) string {
+	line := out
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		line = out[:i]
+	}
+	// The first line is of the form "blastn: 2.10.1+".
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		line = line[i+1:]
+	}
+	return string(bytes.TrimSpace(line))
+}
+
 type MakeDB struct {
 	// Usage: makeblastdb -dbtype <type> -out <file>
 	//
@@ -27,21 +53,26 @@ type MakeDB struct {
 	//
 	Cmd string `buildarg:"{{if .}}{{.}}{{else}}makeblastdb{{end}}"` // blastn
 
-	In          string `buildarg:"{{with .}}-in{{split}}{{.}}{{end}}"`                 // -in <s>
-	Out         string `buildarg:"{{with .}}-out{{split}}{{.}}{{end}}"`                // -out <s>
-	InputType   string `buildarg:"{{with .}}-input_type{{split}}{{.}}{{end}}"`         // -input_type <s>
-	DBType      string `buildarg:"{{with .}}-dbtype{{split}}{{.}}{{end}}"`             // -dbtype <s>
-	Title       string `buildarg:"{{with .}}-title{{split}}{{.}}{{end}}"`              // -title <s>
-	ParseSeqids bool   `buildarg:"{{if .}}-parse_seqids{{end}}"`                       // -parse_seqids
-	HashIndex   bool   `buildarg:"{{if .}}-hash_index{{end}}"`                         // -hash_index
-	MaskData    string `buildarg:"{{with .}}-mask_data{{split}}{{.}}{{.}}{{end}}"`     // -mask_data <s>
-	MaxFileSize string `buildarg:"{{with .}}-max_file_size{{split}}{{.}}{{.}}{{end}}"` // -max_file_size <s>
-	TaxID       int    `buildarg:"{{with .}}-taxid{{split}}{{.}}{{end}}"`              // -taxid <n>
-	TaxIDMap    string `buildarg:"{{with .}}-taxid_map{{split}}{{.}}{{end}}"`          // -taxid_map <s>
-	LogFile     string `buildarg:"{{with .}}-logfile{{split}}{{.}}{{end}}"`            // -logfile <s>
+	In          string `buildarg:"{{with .}}-in{{split}}{{.}}{{end}}"`            // -in <s>
+	Out         string `buildarg:"{{with .}}-out{{split}}{{.}}{{end}}"`           // -out <s>
+	InputType   string `buildarg:"{{with .}}-input_type{{split}}{{.}}{{end}}"`    // -input_type <s>
+	DBType      string `buildarg:"{{with .}}-dbtype{{split}}{{.}}{{end}}"`        // -dbtype <s>
+	Title       string `buildarg:"{{with .}}-title{{split}}{{.}}{{end}}"`         // -title <s>
+	ParseSeqids bool   `buildarg:"{{if .}}-parse_seqids{{end}}"`                  // -parse_seqids
+	HashIndex   bool   `buildarg:"{{if .}}-hash_index{{end}}"`                    // -hash_index
+	MaskData    string `buildarg:"{{with .}}-mask_data{{split}}{{.}}{{end}}"`     // -mask_data <s>
+	MaxFileSize string `buildarg:"{{with .}}-max_file_size{{split}}{{.}}{{end}}"` // -max_file_size <s>
+	TaxID       int    `buildarg:"{{with .}}-taxid{{split}}{{.}}{{end}}"`         // -taxid <n>
+	TaxIDMap    string `buildarg:"{{with .}}-taxid_map{{split}}{{.}}{{end}}"`     // -taxid_map <s>
+	LogFile     string `buildarg:"{{with .}}-logfile{{split}}{{.}}{{end}}"`       // -logfile <s>
 
 	// ExtraFlags will be passed through to makeblastdb as flags.
+	// It is split into arguments according to SplitFlags.
 	ExtraFlags string
+
+	// ExtraArgs will be passed through to makeblastdb as
+	// arguments without splitting.
+	ExtraArgs []string
 }
 
 func (m MakeDB) BuildCommand() (*exec.Cmd, error) {
@@ -51,12 +82,12 @@ func (m MakeDB) BuildCommand() (*exec.Cmd, error) {
 	if m.Out == "" {
 		return nil, errors.New("makeblastdb: missing out filename")
 	}
-	var extra []string
-	if m.ExtraFlags != "" {
-		extra = strings.Split(m.ExtraFlags, " ")
+	extra, err := SplitFlags(m.ExtraFlags)
+	if err != nil {
+		return nil, fmt.Errorf("makeblastdb: %w", err)
 	}
 	cl := external.Must(external.Build(m))
-	return exec.Command(cl[0], append(cl[1:], extra...)...), nil
+	return exec.Command(cl[0], append(append(cl[1:], extra...), m.ExtraArgs...)...), nil
 }
 
 type Nucleic struct {
@@ -83,27 +114,135 @@ type Nucleic struct {
 	ParseDeflines bool    `buildarg:"{{if .}}-parse_deflines{{end}}"`                // -parse_deflines
 
 	// Input:
-	Query    string `buildarg:"-query{{split}}{{.}}"`                  // -query <s>
-	Subject  string `buildarg:"{{if .}}-subject{{split}}{{.}}{{end}}"` // -subject <s>
-	Database string `buildarg:"{{if .}}-db{{split}}{{.}}{{end}}"`      // -db <s>
+	Query      string `buildarg:"-query{{split}}{{.}}"`                       // -query <s>
+	Subject    string `buildarg:"{{if .}}-subject{{split}}{{.}}{{end}}"`      // -subject <s>
+	Database   string `buildarg:"{{if .}}-db{{split}}{{.}}{{end}}"`           // -db <s>
+	DBSoftMask string `buildarg:"{{if .}}-db_soft_mask{{split}}{{.}}{{end}}"` // -db_soft_mask <s>
 
 	// Output:
 	OutFormat int `buildarg:"{{if .}}-outfmt{{split}}{{.}}{{end}}"` // -outfmt <n>
 
+	// OutColumns specifies the columns of tabular output
+	// formats. If it is empty, the standard columns are used.
+	// Columns supported by ParseTabularColumns are listed in
+	// TabularColumns.
+	OutColumns []string
+
 	// Performance:
 	Threads int `buildarg:"{{if .}}-num_threads{{split}}{{.}}{{end}}"` // -num_threads <n>
 
 	// ExtraFlags will be passed through to blastn as flags.
+	// It is split into arguments according to SplitFlags.
 	ExtraFlags string
+
+	// ExtraArgs will be passed through to blastn as arguments
+	// without splitting.
+	ExtraArgs []string
 }
 
 func (n Nucleic) BuildCommand() (*exec.Cmd, error) {
+	extra, err := SplitFlags(n.ExtraFlags)
+	if err != nil {
+		return nil, fmt.Errorf("blastn: %w", err)
+	}
 	cl := external.Must(external.Build(n, template.FuncMap{"dust": dust}))
-	var extra []string
-	if n.ExtraFlags != "" {
-		extra = strings.Split(n.ExtraFlags, " ")
+	if len(n.OutColumns) != 0 {
+		if n.OutFormat < 6 || 7 < n.OutFormat {
+			return nil, fmt.Errorf("blastn: output columns with non-tabular output format %d", n.OutFormat)
+		}
+		for i, a := range cl {
+			if a == "-outfmt" {
+				cl[i+1] = strings.Join(append([]string{cl[i+1]}, n.OutColumns...), " ")
+				break
+			}
+		}
+	}
+	return exec.Command(cl[0], append(append(cl[1:], extra...), n.ExtraArgs...)...), nil
+}
+
+// SplitFlags splits s into arguments using shell-like rules. Arguments are
+// separated by unquoted white space. Single quotes preserve the literal value
+// of the characters they enclose, and double quotes preserve the literal value
+// of enclosed characters except for backslash escapes of double quotes and
+// backslashes. An unquoted backslash preserves the literal value of the next
+// character.
+func SplitFlags(s string) ([]string, error) {
+	var (
+		args  []string
+		arg   strings.Builder
+		inArg bool
+		quote rune
+		esc   bool
+	)
+	for _, r := range s {
+		switch {
+		case esc:
+			if quote == '"' && r != '"' && r != '\\' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+			esc = false
+		case r == '\\' && quote != '\'':
+			esc = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if esc {
+		return nil, errors.New("trailing backslash in flags")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in flags", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// DustAlgorithmID is the filtering algorithm ID given to masks produced
+// by dustmasker with default parameters when they are added to a database.
+const DustAlgorithmID = "11"
+
+type DustMasker struct {
+	// Usage: dustmasker -in <file> -out <file>
+	//
+	// For details relating to options and parameters, see the BLAST manual.
+	//
+	Cmd string `buildarg:"{{if .}}{{.}}{{else}}dustmasker{{end}}"` // dustmasker
+
+	In          string `buildarg:"{{with .}}-in{{split}}{{.}}{{end}}"`     // -in <s>
+	Out         string `buildarg:"{{with .}}-out{{split}}{{.}}{{end}}"`    // -out <s>
+	OutFormat   string `buildarg:"{{with .}}-outfmt{{split}}{{.}}{{end}}"` // -outfmt <s>
+	Level       int    `buildarg:"{{if .}}-level{{split}}{{.}}{{end}}"`    // -level <n>
+	Window      int    `buildarg:"{{if .}}-window{{split}}{{.}}{{end}}"`   // -window <n>
+	Linker      int    `buildarg:"{{if .}}-linker{{split}}{{.}}{{end}}"`   // -linker <n>
+	ParseSeqids bool   `buildarg:"{{if .}}-parse_seqids{{end}}"`           // -parse_seqids
+}
+
+func (d DustMasker) BuildCommand() (*exec.Cmd, error) {
+	if d.In == "" {
+		return nil, errors.New("dustmasker: missing in filename")
 	}
-	return exec.Command(cl[0], append(cl[1:], extra...)...), nil
+	cl := external.Must(external.Build(d))
+	return exec.Command(cl[0], cl[1:]...), nil
 }
 
 // Dust options.
@@ -140,6 +279,17 @@ type Record struct {
 
 	Strand int8
 
+	// QueryLength and SubjectLength are the
+	// lengths of the query and subject
+	// sequences if they were requested.
+	QueryLength   int `json:",omitempty"`
+	SubjectLength int `json:",omitempty"`
+
+	// BTOP is the BLAST traceback operations
+	// string for the alignment if it was
+	// requested.
+	BTOP string `json:",omitempty"`
+
 	// Iteration is the blast Iteration
 	// that gave the blast hit.
 	Iteration int `json:",omitempty"`
@@ -152,97 +302,237 @@ type Record struct {
 	SumScore float64 `json:",omitempty"`
 }
 
+// ParseTabular parses the standard columns of BLAST tabular output
+// formats 6 and 7 from r, labelling records with the given iteration.
 func ParseTabular(r io.Reader, iteration int) ([]Record, error) {
-	// column indices for default blast output tabular format 6 and 7.
-	const (
-		QueryAccVer = iota
-		SubjectAccVer
-		PctIdentity
-		AlignmentLength
-		Mismatches
-		GapOpens
-		QueryStart
-		QueryEnd
-		SubjectStart
-		SubjectEnd
-		EValue
-		BitScore
-		numFields
-	)
+	return ParseTabularColumns(r, iteration, nil)
+}
+
+// StdColumns are the columns of the std tabular output column specifier.
+var StdColumns = []string{
+	"qaccver", "saccver", "pident", "length", "mismatch", "gapopen",
+	"qstart", "qend", "sstart", "send", "evalue", "bitscore",
+}
+
+// TabularColumns are the tabular output columns that can be parsed by
+// ParseTabularColumns in addition to std.
+var TabularColumns = func() []string {
+	cols := make([]string, 0, len(tabularColumns))
+	for c := range tabularColumns {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	return cols
+}()
+
+// tabularColumns are the parsers for supported tabular output columns.
+var tabularColumns = map[string]func(r *Record, f []byte) error{
+	"qseqid":   func(r *Record, f []byte) error { r.QueryAccVer = string(f); return nil },
+	"qaccver":  func(r *Record, f []byte) error { r.QueryAccVer = string(f); return nil },
+	"sseqid":   func(r *Record, f []byte) error { r.SubjectAccVer = string(f); return nil },
+	"saccver":  func(r *Record, f []byte) error { r.SubjectAccVer = string(f); return nil },
+	"pident":   func(r *Record, f []byte) error { return parseFloat(&r.PctIdentity, f) },
+	"length":   func(r *Record, f []byte) error { return parseInt(&r.AlignmentLength, f) },
+	"mismatch": func(r *Record, f []byte) error { return parseInt(&r.Mismatches, f) },
+	"gapopen":  func(r *Record, f []byte) error { return parseInt(&r.GapOpens, f) },
+	"qstart": func(r *Record, f []byte) error {
+		err := parseInt(&r.QueryStart, f)
+		r.QueryStart-- // Use zero-based indexing internally.
+		return err
+	},
+	"qend": func(r *Record, f []byte) error { return parseInt(&r.QueryEnd, f) },
+	"sstart": func(r *Record, f []byte) error {
+		err := parseInt(&r.SubjectStart, f)
+		r.SubjectStart-- // Use zero-based indexing internally.
+		return err
+	},
+	"send":     func(r *Record, f []byte) error { return parseInt(&r.SubjectEnd, f) },
+	"evalue":   func(r *Record, f []byte) error { return parseFloat(&r.EValue, f) },
+	"bitscore": func(r *Record, f []byte) error { return parseFloat(&r.BitScore, f) },
+	"qlen":     func(r *Record, f []byte) error { return parseInt(&r.QueryLength, f) },
+	"slen":     func(r *Record, f []byte) error { return parseInt(&r.SubjectLength, f) },
+	"sstrand": func(r *Record, f []byte) error {
+		switch string(f) {
+		case "plus":
+			r.Strand = 1
+		case "minus":
+			r.Strand = -1
+		default:
+			return fmt.Errorf("invalid strand: %q", f)
+		}
+		return nil
+	},
+	"btop": func(r *Record, f []byte) error { r.BTOP = string(f); return nil },
+}
+
+// requiredColumns are the columns that must be present for a valid Record.
+var requiredColumns = [][]string{
+	{"qaccver", "qseqid"}, {"saccver", "sseqid"},
+	{"qstart"}, {"qend"}, {"sstart"}, {"send"},
+}
+
+// ParseTabularColumns parses BLAST tabular output formats 6 and 7 from
+// r with the given columns, labelling records with the given iteration.
+// The columns are the column specifiers following the format number in
+// the blastn -outfmt option and may include std. If columns is empty,
+// the standard columns are parsed. The query and subject identifier and
+// coordinate columns must be present.
+//
+// Malformed lines are skipped. If any lines were skipped, the records of
+// the well-formed lines are returned with a *SkippedError describing the
+// skipped lines.
+func ParseTabularColumns(r io.Reader, iteration int, columns []string) ([]Record, error) {
+	parsers, strand, err := columnParsers(columns)
+	if err != nil {
+		return nil, err
+	}
 
-	var recs []Record
+	var (
+		recs    []Record
+		skipped SkippedError
+		n       int
+	)
 	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, bufio.MaxScanTokenSize<<8)
 	for sc.Scan() {
+		n++
 		line := sc.Bytes()
 		if bytes.HasPrefix(line, []byte("#")) {
 			// Allow format 7 as well.
 			continue
 		}
-		f := bytes.Split(line, []byte("\t"))
-		if len(f) != numFields {
-			return recs, fmt.Errorf("unexpected number of fields: %q", f)
+		r, err := parseTabularLine(line, parsers, strand)
+		if err != nil {
+			skipped.add(&LineError{Line: n, Text: string(line), Err: err})
+			continue
 		}
+		r.Iteration = iteration
+		recs = append(recs, r)
+	}
+	err = sc.Err()
+	if err == nil && skipped.Skipped != 0 {
+		err = &skipped
+	}
+	return recs, err
+}
 
+// parseTabularLine parses a line of tabular output with the given column
+// parsers. If strand is false, the strand is inferred from the subject
+// coordinates.
+func parseTabularLine(line []byte, parsers []func(*Record, []byte) error, strand bool) (Record, error) {
+	var r Record
+	f := bytes.Split(line, []byte("\t"))
+	if len(f) != len(parsers) {
+		return r, fmt.Errorf("unexpected number of fields: got %d, want %d", len(f), len(parsers))
+	}
+	for i, parse := range parsers {
 		// For some reason, NCBI think it's reasonable to sometimes
 		// contaminate numeric fields with flanking whitespace.
 		// So we trim whitespace from all fields just in case.
-		r := Record{
-			QueryAccVer:   string(bytes.TrimSpace(f[QueryAccVer])),
-			SubjectAccVer: string(bytes.TrimSpace(f[SubjectAccVer])),
-			Iteration:     iteration,
-		}
-		var err error
-		r.PctIdentity, err = strconv.ParseFloat(string(bytes.TrimSpace(f[PctIdentity])), 64)
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.AlignmentLength, err = strconv.Atoi(string(bytes.TrimSpace(f[AlignmentLength])))
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.Mismatches, err = strconv.Atoi(string(bytes.TrimSpace(f[Mismatches])))
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.GapOpens, err = strconv.Atoi(string(bytes.TrimSpace(f[GapOpens])))
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.QueryStart, err = strconv.Atoi(string(bytes.TrimSpace(f[QueryStart])))
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.QueryStart-- // Use zero-based indexing internally.
-		r.QueryEnd, err = strconv.Atoi(string(bytes.TrimSpace(f[QueryEnd])))
+		err := parse(&r, bytes.TrimSpace(f[i]))
 		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.SubjectStart, err = strconv.Atoi(string(bytes.TrimSpace(f[SubjectStart])))
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.SubjectStart-- // Use zero-based indexing internally.
-		r.SubjectEnd, err = strconv.Atoi(string(bytes.TrimSpace(f[SubjectEnd])))
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.EValue, err = strconv.ParseFloat(string(bytes.TrimSpace(f[EValue])), 64)
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
-		}
-		r.BitScore, err = strconv.ParseFloat(string(bytes.TrimSpace(f[BitScore])), 64)
-		if err != nil {
-			return recs, fmt.Errorf("error in line: %s: %w", line, err)
+			return r, err
 		}
+	}
+	if !strand {
 		r.Strand = 1
 		if r.SubjectEnd < r.SubjectStart {
 			r.Strand = -1
 		}
-		if r.QueryEnd < r.QueryStart {
-			panic("inverted query")
+	}
+	if r.QueryEnd < r.QueryStart {
+		return r, fmt.Errorf("inverted query coordinates: %d-%d", r.QueryStart+1, r.QueryEnd)
+	}
+	return r, nil
+}
+
+// LineError is an error in a line of BLAST output.
+type LineError struct {
+	// Line is the one-based line number
+	// and Text is the text of the line.
+	Line int
+	Text string
+
+	Err error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v: %q", e.Line, e.Err, e.Text)
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
+
+// maxLineErrors is the maximum number of line errors retained by a
+// SkippedError.
+const maxLineErrors = 10
+
+// SkippedError is returned with the parsed records when malformed lines
+// have been skipped.
+type SkippedError struct {
+	// Skipped is the number of lines skipped.
+	Skipped int
+
+	// Errors holds the errors for the first
+	// skipped lines.
+	Errors []*LineError
+}
+
+// add records a skipped line.
+func (e *SkippedError) add(err *LineError) {
+	e.Skipped++
+	if len(e.Errors) < maxLineErrors {
+		e.Errors = append(e.Errors, err)
+	}
+}
+
+func (e *SkippedError) Error() string {
+	if e.Skipped == 1 {
+		return fmt.Sprintf("skipped malformed %v", e.Errors[0])
+	}
+	return fmt.Sprintf("skipped %d malformed lines, first at %v", e.Skipped, e.Errors[0])
+}
+
+// columnParsers returns the parsers for the given tabular output columns
+// and whether the columns include the subject strand.
+func columnParsers(columns []string) (parsers []func(*Record, []byte) error, strand bool, err error) {
+	if len(columns) == 0 {
+		columns = StdColumns
+	}
+	seen := make(map[string]bool)
+	for _, c := range columns {
+		cols := []string{c}
+		if c == "std" {
+			cols = StdColumns
+		}
+		for _, c := range cols {
+			p, ok := tabularColumns[c]
+			if !ok {
+				return nil, false, fmt.Errorf("unsupported tabular output column: %q", c)
+			}
+			parsers = append(parsers, p)
+			seen[c] = true
 		}
-		recs = append(recs, r)
 	}
-	err := sc.Err()
-	return recs, err
+	for _, alts := range requiredColumns {
+		var ok bool
+		for _, c := range alts {
+			ok = ok || seen[c]
+		}
+		if !ok {
+			return nil, false, fmt.Errorf("missing required tabular output column: %q", alts[0])
+		}
+	}
+	return parsers, seen["sstrand"], nil
+}
+
+func parseInt(dst *int, f []byte) error {
+	var err error
+	*dst, err = strconv.Atoi(string(f))
+	return err
+}
+
+func parseFloat(dst *float64, f []byte) error {
+	var err error
+	*dst, err = strconv.ParseFloat(string(f), 64)
+	return err
 }
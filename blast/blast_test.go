@@ -0,0 +1,224 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blast
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var parseTabularTests = []struct {
+	name    string
+	columns []string
+	input   string
+
+	want        []Record
+	wantSkipped []int
+}{
+	{
+		name: "std",
+		input: `# BLASTN 2.10.1+
+# Fields: query acc.ver, subject acc.ver, % identity, alignment length, mismatches, gap opens, q. start, q. end, s. start, s. end, evalue, bit score
+L1HS	chr1	97.50	200	5	0	1	200	1001	1200	1e-80	350
+L1HS	chr1	 90.00 	100	10	1	11	110	2100	2001	2.5e-30	120.5
+`,
+		want: []Record{
+			{
+				QueryAccVer: "L1HS", SubjectAccVer: "chr1",
+				PctIdentity: 97.5, AlignmentLength: 200, Mismatches: 5, GapOpens: 0,
+				QueryStart: 0, QueryEnd: 200, SubjectStart: 1000, SubjectEnd: 1200,
+				EValue: 1e-80, BitScore: 350, Strand: 1, Iteration: 3,
+			},
+			{
+				QueryAccVer: "L1HS", SubjectAccVer: "chr1",
+				PctIdentity: 90, AlignmentLength: 100, Mismatches: 10, GapOpens: 1,
+				QueryStart: 10, QueryEnd: 110, SubjectStart: 2099, SubjectEnd: 2001,
+				EValue: 2.5e-30, BitScore: 120.5, Strand: -1, Iteration: 3,
+			},
+		},
+	},
+	{
+		name:    "custom",
+		columns: strings.Fields("std qlen slen sstrand btop"),
+		input: `AluY	chr2	99.00	300	3	0	1	300	501	800	1e-150	550	311	5000	plus	100AG199
+AluY	chr2	98.00	100	2	0	5	104	900	801	1e-40	180	311	5000	minus	50CT49
+`,
+		want: []Record{
+			{
+				QueryAccVer: "AluY", SubjectAccVer: "chr2",
+				PctIdentity: 99, AlignmentLength: 300, Mismatches: 3,
+				QueryStart: 0, QueryEnd: 300, SubjectStart: 500, SubjectEnd: 800,
+				EValue: 1e-150, BitScore: 550, Strand: 1,
+				QueryLength: 311, SubjectLength: 5000, BTOP: "100AG199", Iteration: 3,
+			},
+			{
+				QueryAccVer: "AluY", SubjectAccVer: "chr2",
+				PctIdentity: 98, AlignmentLength: 100, Mismatches: 2,
+				QueryStart: 4, QueryEnd: 104, SubjectStart: 899, SubjectEnd: 801,
+				EValue: 1e-40, BitScore: 180, Strand: -1,
+				QueryLength: 311, SubjectLength: 5000, BTOP: "50CT49", Iteration: 3,
+			},
+		},
+	},
+	{
+		name:    "reordered",
+		columns: strings.Fields("sseqid qseqid sstart send qstart qend bitscore"),
+		input:   "chr3\tMIR\t100\t199\t1\t100\t90\n",
+		want: []Record{
+			{
+				QueryAccVer: "MIR", SubjectAccVer: "chr3",
+				QueryStart: 0, QueryEnd: 100, SubjectStart: 99, SubjectEnd: 199,
+				BitScore: 90, Strand: 1, Iteration: 3,
+			},
+		},
+	},
+	{
+		name: "malformed",
+		input: `L1HS	chr1	97.50	200	5	0	1	200	1001	1200	1e-80	350
+L1HS	chr1	97.50	200	5	0	1	200	1001	1200	1e-80
+L1HS	chr1	97.50	200	5	0	one	200	1001	1200	1e-80	350
+L1HS	chr1	97.50	200	5	0	200	1	1001	1200	1e-80	350
+
+L1HS	chr1	97.50	200	5	0	1	200	1001	1200	1e-80	350.5
+`,
+		want: []Record{
+			{
+				QueryAccVer: "L1HS", SubjectAccVer: "chr1",
+				PctIdentity: 97.5, AlignmentLength: 200, Mismatches: 5,
+				QueryStart: 0, QueryEnd: 200, SubjectStart: 1000, SubjectEnd: 1200,
+				EValue: 1e-80, BitScore: 350, Strand: 1, Iteration: 3,
+			},
+			{
+				QueryAccVer: "L1HS", SubjectAccVer: "chr1",
+				PctIdentity: 97.5, AlignmentLength: 200, Mismatches: 5,
+				QueryStart: 0, QueryEnd: 200, SubjectStart: 1000, SubjectEnd: 1200,
+				EValue: 1e-80, BitScore: 350.5, Strand: 1, Iteration: 3,
+			},
+		},
+		wantSkipped: []int{2, 3, 4, 5},
+	},
+	{
+		name:        "invalid strand",
+		columns:     strings.Fields("qaccver saccver qstart qend sstart send sstrand"),
+		input:       "L1HS\tchr1\t1\t200\t1001\t1200\tN/A\n",
+		wantSkipped: []int{1},
+	},
+	{
+		name:        "many malformed",
+		input:       strings.Repeat("malformed\n", 12),
+		wantSkipped: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+	},
+}
+
+func TestParseTabularColumns(t *testing.T) {
+	for _, test := range parseTabularTests {
+		got, err := ParseTabularColumns(strings.NewReader(test.input), 3, test.columns)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected records for %s:\ngot: %+v\nwant:%+v", test.name, got, test.want)
+		}
+		if test.wantSkipped == nil {
+			if err != nil {
+				t.Errorf("unexpected error for %s: %v", test.name, err)
+			}
+			continue
+		}
+		var skipped *SkippedError
+		if !errors.As(err, &skipped) {
+			t.Errorf("expected skipped lines error for %s: got:%v", test.name, err)
+			continue
+		}
+		if skipped.Skipped != len(test.wantSkipped) {
+			t.Errorf("unexpected number of skipped lines for %s: got:%d want:%d", test.name, skipped.Skipped, len(test.wantSkipped))
+		}
+		wantErrors := test.wantSkipped
+		if len(wantErrors) > maxLineErrors {
+			wantErrors = wantErrors[:maxLineErrors]
+		}
+		var lines []int
+		for _, e := range skipped.Errors {
+			lines = append(lines, e.Line)
+			text := strings.Split(test.input, "\n")[e.Line-1]
+			if e.Text != text {
+				t.Errorf("unexpected text for %s line %d: got:%q want:%q", test.name, e.Line, e.Text, text)
+			}
+			if e.Err == nil {
+				t.Errorf("missing error for %s line %d", test.name, e.Line)
+			}
+		}
+		if !reflect.DeepEqual(lines, wantErrors) {
+			t.Errorf("unexpected skipped lines for %s: got:%v want:%v", test.name, lines, wantErrors)
+		}
+	}
+}
+
+var columnErrorTests = []struct {
+	columns []string
+	want    string
+}{
+	{columns: strings.Fields("std staxids"), want: `unsupported tabular output column: "staxids"`},
+	{columns: strings.Fields("qaccver saccver qstart qend sstart"), want: `missing required tabular output column: "send"`},
+	{columns: strings.Fields("sseqid qstart qend sstart send"), want: `missing required tabular output column: "qaccver"`},
+}
+
+func TestParseTabularColumnsErrors(t *testing.T) {
+	const line = "L1HS\tchr1\t97.50\t200\t5\t0\t1\t200\t1001\t1200\t1e-80\t350\n"
+	for _, test := range columnErrorTests {
+		got, err := ParseTabularColumns(strings.NewReader(line), 1, test.columns)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("unexpected error for columns %q: got:%v want:%s", test.columns, err, test.want)
+		}
+		if got != nil {
+			t.Errorf("unexpected records for columns %q: %+v", test.columns, got)
+		}
+	}
+}
+
+var splitFlagsTests = []struct {
+	flags   string
+	want    []string
+	wantErr string
+}{
+	{flags: "", want: nil},
+	{flags: " \t\n", want: nil},
+	{flags: "-a b", want: []string{"-a", "b"}},
+	{flags: " -word_size  11\t-penalty -3 ", want: []string{"-word_size", "11", "-penalty", "-3"}},
+	{flags: `-a ''`, want: []string{"-a", ""}},
+	{flags: `"" ''`, want: []string{"", ""}},
+	{flags: `-a "b c"`, want: []string{"-a", "b c"}},
+	{flags: `-a 'b "c" d'`, want: []string{"-a", `b "c" d`}},
+	{flags: `-a "b 'c' d"`, want: []string{"-a", `b 'c' d`}},
+	{flags: `-a "b \"c\" d"`, want: []string{"-a", `b "c" d`}},
+	{flags: `-a "b\\c"`, want: []string{"-a", `b\c`}},
+	{flags: `-a "b\nc"`, want: []string{"-a", `b\nc`}},
+	{flags: `-a 'b\c'`, want: []string{"-a", `b\c`}},
+	{flags: `-a b\ c`, want: []string{"-a", "b c"}},
+	{flags: `-a \'b\"`, want: []string{"-a", `'b"`}},
+	{flags: `-a b"c d"e'f g'`, want: []string{"-a", "bc def g"}},
+	{flags: `-a "b`, wantErr: "unterminated \" quote in flags"},
+	{flags: `-a 'b`, wantErr: "unterminated ' quote in flags"},
+	{flags: `-a "b\"`, wantErr: "unterminated \" quote in flags"},
+	{flags: `-a b\`, wantErr: "trailing backslash in flags"},
+}
+
+func TestSplitFlags(t *testing.T) {
+	for _, test := range splitFlagsTests {
+		got, err := SplitFlags(test.flags)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("unexpected error for %q: got:%v want:%s", test.flags, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.flags, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected arguments for %q: got:%q want:%q", test.flags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JSONReader reads BLAST single-file JSON output (-outfmt 15)
+// incrementally so that memory use is bounded by the size of the
+// largest query report rather than the size of the complete output.
+type JSONReader struct {
+	dec     *json.Decoder
+	started bool
+	n       int
+}
+
+// NewJSONReader returns a JSONReader that reads BLAST JSON from r.
+func NewJSONReader(r io.Reader) *JSONReader {
+	return &JSONReader{dec: json.NewDecoder(r)}
+}
+
+// ReadIteration returns the search results for the next query in the
+// output as an Iteration, or io.EOF when no queries remain. Iterations
+// are numbered from one in the order they are read.
+func (r *JSONReader) ReadIteration() (*Iteration, error) {
+	if !r.started {
+		err := r.start()
+		if err != nil {
+			return nil, err
+		}
+		r.started = true
+	}
+	if !r.dec.More() {
+		return nil, io.EOF
+	}
+	var rep jsonReport
+	err := r.dec.Decode(&rep)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	r.n++
+	return rep.Report.Results.Search.iteration(r.n), nil
+}
+
+// start reads the output up to the first element of the BlastOutput2 array.
+func (r *JSONReader) start() error {
+	err := r.delim('{')
+	if err != nil {
+		return err
+	}
+	for r.dec.More() {
+		t, err := r.dec.Token()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if t == "BlastOutput2" {
+			return unexpectedEOF(r.delim('['))
+		}
+		var skip json.RawMessage
+		err = r.dec.Decode(&skip)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	return errors.New("blast: missing BlastOutput2 in JSON output")
+}
+
+// delim reads the JSON delimiter d.
+func (r *JSONReader) delim(d json.Delim) error {
+	t, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != d {
+		return fmt.Errorf("blast: unexpected JSON token %v: expected %v", t, d)
+	}
+	return nil
+}
+
+// jsonReport is the report for a single query in BLAST JSON output.
+type jsonReport struct {
+	Report struct {
+		Results struct {
+			Search jsonSearch `json:"search"`
+		} `json:"results"`
+	} `json:"report"`
+}
+
+type jsonSearch struct {
+	QueryID    *string   `json:"query_id"`
+	QueryTitle *string   `json:"query_title"`
+	QueryLen   *int      `json:"query_len"`
+	Hits       []jsonHit `json:"hits"`
+	Stat       *jsonStat `json:"stat"`
+}
+
+func (s jsonSearch) iteration(n int) *Iteration {
+	it := Iteration{
+		N:        n,
+		QueryId:  s.QueryID,
+		QueryDef: s.QueryTitle,
+		QueryLen: s.QueryLen,
+		Hits:     make([]Hit, 0, len(s.Hits)),
+	}
+	if s.Stat != nil {
+		it.Statistics = &Statistics{
+			DbNum:    s.Stat.DbNum,
+			DbLen:    s.Stat.DbLen,
+			HspLen:   s.Stat.HspLen,
+			EffSpace: s.Stat.EffSpace,
+			Kappa:    s.Stat.Kappa,
+			Lambda:   s.Stat.Lambda,
+			Entropy:  s.Stat.Entropy,
+		}
+	}
+	for _, h := range s.Hits {
+		var hit Hit
+		if len(h.Description) != 0 {
+			hit.Def = h.Description[0].Title
+		}
+		hit.Hsps = make([]Hsp, len(h.Hsps))
+		for i, hsp := range h.Hsps {
+			if hsp.Gaps == nil {
+				// Match the XML output which
+				// always includes the gap count.
+				hsp.Gaps = new(int)
+			}
+			hit.Hsps[i] = Hsp{
+				BitScore:    hsp.BitScore,
+				EValue:      hsp.EValue,
+				QueryFrom:   hsp.QueryFrom,
+				QueryTo:     hsp.QueryTo,
+				HitFrom:     hsp.HitFrom,
+				HitTo:       hsp.HitTo,
+				HspIdentity: hsp.Identity,
+				HspGaps:     hsp.Gaps,
+				AlignLen:    hsp.AlignLen,
+			}
+		}
+		it.Hits = append(it.Hits, hit)
+	}
+	return &it
+}
+
+type jsonHit struct {
+	Description []struct {
+		Title string `json:"title"`
+	} `json:"description"`
+	Hsps []jsonHsp `json:"hsps"`
+}
+
+type jsonHsp struct {
+	BitScore  float64 `json:"bit_score"`
+	EValue    float64 `json:"evalue"`
+	QueryFrom int     `json:"query_from"`
+	QueryTo   int     `json:"query_to"`
+	HitFrom   int     `json:"hit_from"`
+	HitTo     int     `json:"hit_to"`
+	Identity  *int    `json:"identity"`
+	Gaps      *int    `json:"gaps"`
+	AlignLen  *int    `json:"align_len"`
+}
+
+type jsonStat struct {
+	DbNum    int     `json:"db_num"`
+	DbLen    int64   `json:"db_len"`
+	HspLen   int     `json:"hsp_len"`
+	EffSpace float64 `json:"eff_space"`
+	Kappa    float64 `json:"kappa"`
+	Lambda   float64 `json:"lambda"`
+	Entropy  float64 `json:"entropy"`
+}
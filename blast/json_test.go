@@ -0,0 +1,75 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blast
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONReaderReadIteration(t *testing.T) {
+	_, want := readOutput(t, "reciprocal.xml")
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "reciprocal.json"))
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+
+	var got []Iteration
+	r := NewJSONReader(bytes.NewReader(data))
+	for {
+		it, err := r.ReadIteration()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading iteration %d: %v", len(got)+1, err)
+		}
+		// The XML decoder does not allocate
+		// hits for iterations without hits.
+		if len(it.Hits) == 0 {
+			it.Hits = nil
+		}
+		got = append(got, *it)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected iterations:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
+
+func TestJSONReaderTruncated(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "reciprocal.json"))
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	data = bytes.TrimSpace(data)
+
+	// Output truncated after it has started and
+	// before the end of the BlastOutput2 array
+	// must not read as complete.
+	end := bytes.LastIndex(data, []byte("]"))
+	for n := 1; n < end; n++ {
+		r := NewJSONReader(bytes.NewReader(data[:n]))
+		for err = nil; err == nil; {
+			_, err = r.ReadIteration()
+		}
+		if err == io.EOF {
+			t.Errorf("unexpected complete read of output truncated at %d: %q", n, data[n-min(n, 20):n])
+		}
+	}
+}
+
+func TestJSONReaderMissingOutput(t *testing.T) {
+	const want = "blast: missing BlastOutput2 in JSON output"
+	r := NewJSONReader(strings.NewReader(`{"BlastOutput": [{"report": {}}]}`))
+	_, err := r.ReadIteration()
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: got:%v want:%s", err, want)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blast
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// Reader reads BLAST XML output incrementally so that memory use is
+// bounded by the size of the largest Hit rather than the size of the
+// complete output.
+type Reader struct {
+	dec   *xml.Decoder
+	it    *Iteration
+	state int
+}
+
+// Reader states.
+const (
+	betweenIterations = iota
+	inHits
+)
+
+// NewReader returns a Reader that reads BLAST XML from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: xml.NewDecoder(r)}
+}
+
+// Iteration returns the next Iteration in the output. The Hits and
+// Statistics of the returned Iteration are not populated; hits are read
+// with Hit, and Statistics is filled when Hit returns io.EOF. Any unread
+// hits of the previous Iteration are skipped. Iteration returns io.EOF
+// when no iterations remain.
+func (r *Reader) Iteration() (*Iteration, error) {
+	err := r.finish()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		start, ok := t.(xml.StartElement)
+		if ok && start.Name.Local == "Iteration" {
+			break
+		}
+	}
+	r.it = &Iteration{}
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "Iteration_iter-num":
+				err = r.dec.DecodeElement(&r.it.N, &t)
+			case "Iteration_query-ID":
+				r.it.QueryId = new(string)
+				err = r.dec.DecodeElement(r.it.QueryId, &t)
+			case "Iteration_query-def":
+				r.it.QueryDef = new(string)
+				err = r.dec.DecodeElement(r.it.QueryDef, &t)
+			case "Iteration_query-len":
+				r.it.QueryLen = new(int)
+				err = r.dec.DecodeElement(r.it.QueryLen, &t)
+			case "Iteration_hits":
+				r.state = inHits
+				return r.it, nil
+			case "Iteration_stat":
+				err = r.decodeStatistics(&t)
+			default:
+				err = r.dec.Skip()
+			}
+			if err != nil {
+				return nil, err
+			}
+		case xml.EndElement:
+			// The iteration has no hits.
+			r.state = betweenIterations
+			return r.it, nil
+		}
+	}
+}
+
+// Hit returns the next Hit of the current Iteration. When no hits
+// remain, the remainder of the Iteration is read and Hit returns io.EOF.
+func (r *Reader) Hit() (*Hit, error) {
+	if r.state != inHits {
+		return nil, io.EOF
+	}
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "Hit" {
+				err = r.dec.Skip()
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			var h Hit
+			err = r.dec.DecodeElement(&h, &t)
+			if err != nil {
+				return nil, err
+			}
+			return &h, nil
+		case xml.EndElement:
+			// The end of Iteration_hits.
+			err = r.tail()
+			if err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+	}
+}
+
+// ReadIteration returns the next complete Iteration in the output,
+// or io.EOF when no iterations remain.
+func (r *Reader) ReadIteration() (*Iteration, error) {
+	it, err := r.Iteration()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := r.Hit()
+		if err == io.EOF {
+			return it, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.Hits = append(it.Hits, *h)
+	}
+}
+
+// finish skips any unread hits of the current iteration.
+func (r *Reader) finish() error {
+	if r.state != inHits {
+		return nil
+	}
+	err := r.dec.Skip()
+	if err != nil {
+		return err
+	}
+	return r.tail()
+}
+
+// tail reads the elements of the current iteration that follow its hits.
+func (r *Reader) tail() error {
+	for {
+		t, err := r.dec.Token()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "Iteration_stat" {
+				err = r.decodeStatistics(&t)
+			} else {
+				err = r.dec.Skip()
+			}
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			// The end of Iteration.
+			r.state = betweenIterations
+			return nil
+		}
+	}
+}
+
+// decodeStatistics decodes the Iteration_stat element starting at start
+// into the current iteration.
+func (r *Reader) decodeStatistics(start *xml.StartElement) error {
+	var s struct {
+		Statistics *Statistics `xml:"Statistics"`
+	}
+	err := r.dec.DecodeElement(&s, start)
+	if err != nil {
+		return err
+	}
+	r.it.Statistics = s.Statistics
+	return nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF if err is io.EOF and
+// err otherwise.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
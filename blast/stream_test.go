@@ -0,0 +1,141 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blast
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readOutput returns the iterations of the BLAST XML output in the
+// testdata file name decoded as a complete document.
+func readOutput(t *testing.T, name string) ([]byte, []Iteration) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read test data: %v", err)
+	}
+	var o Output
+	err = xml.Unmarshal(data, &o)
+	if err != nil {
+		t.Fatalf("failed to decode test data: %v", err)
+	}
+	if len(o.Iterations) == 0 {
+		t.Fatal("no iterations in test data")
+	}
+	return data, o.Iterations
+}
+
+func TestReaderReadIteration(t *testing.T) {
+	data, want := readOutput(t, "reciprocal.xml")
+
+	var got []Iteration
+	r := NewReader(bytes.NewReader(data))
+	for {
+		it, err := r.ReadIteration()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading iteration %d: %v", len(got)+1, err)
+		}
+		got = append(got, *it)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected iterations:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
+
+func TestReaderHit(t *testing.T) {
+	data, want := readOutput(t, "reciprocal.xml")
+
+	// Read only the first hit of each iteration
+	// and check that the remaining hits are skipped.
+	r := NewReader(bytes.NewReader(data))
+	for i, w := range want {
+		it, err := r.Iteration()
+		if err != nil {
+			t.Fatalf("unexpected error reading iteration %d: %v", i+1, err)
+		}
+		if it.N != w.N || *it.QueryDef != *w.QueryDef || *it.QueryLen != *w.QueryLen {
+			t.Errorf("unexpected iteration %d: got:%+v want:%+v", i+1, it, w)
+		}
+		if it.Hits != nil || it.Statistics != nil {
+			t.Errorf("unexpected hits or statistics before hits are read for iteration %d", i+1)
+		}
+		h, err := r.Hit()
+		if len(w.Hits) == 0 {
+			if err != io.EOF {
+				t.Errorf("unexpected error for iteration %d without hits: got:%v want:%v", i+1, err, io.EOF)
+			}
+			if !reflect.DeepEqual(it.Statistics, w.Statistics) {
+				t.Errorf("unexpected statistics for iteration %d: got:%+v want:%+v", i+1, it.Statistics, w.Statistics)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading hit of iteration %d: %v", i+1, err)
+		}
+		if !reflect.DeepEqual(*h, w.Hits[0]) {
+			t.Errorf("unexpected first hit of iteration %d:\ngot: %+v\nwant:%+v", i+1, *h, w.Hits[0])
+		}
+		if len(w.Hits) == 1 {
+			// Statistics are filled when the
+			// hits are exhausted.
+			_, err = r.Hit()
+			if err != io.EOF {
+				t.Errorf("unexpected error after last hit of iteration %d: got:%v want:%v", i+1, err, io.EOF)
+			}
+			if !reflect.DeepEqual(it.Statistics, w.Statistics) {
+				t.Errorf("unexpected statistics for iteration %d: got:%+v want:%+v", i+1, it.Statistics, w.Statistics)
+			}
+		}
+	}
+	_, err := r.Iteration()
+	if err != io.EOF {
+		t.Errorf("unexpected error after last iteration: got:%v want:%v", err, io.EOF)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	data, _ := readOutput(t, "reciprocal.xml")
+	data = bytes.TrimSpace(data)
+
+	// Output truncated after the root element
+	// has started must not read as complete.
+	start := bytes.Index(data, []byte("<BlastOutput>")) + len("<BlastOutput>")
+	for n := start; n < len(data); n++ {
+		r := NewReader(bytes.NewReader(data[:n]))
+		var err error
+		for err == nil {
+			_, err = r.ReadIteration()
+		}
+		if err == io.EOF {
+			t.Errorf("unexpected complete read of output truncated at %d: %q", n, data[n-min(n, 20):n])
+		}
+	}
+}
+
+func TestUnexpectedEOF(t *testing.T) {
+	if err := unexpectedEOF(io.EOF); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error for io.EOF: got:%v want:%v", err, io.ErrUnexpectedEOF)
+	}
+	want := &xml.SyntaxError{Msg: "unexpected EOF", Line: 1}
+	if err := unexpectedEOF(want); err != want {
+		t.Errorf("unexpected error for %v: got:%v", want, err)
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
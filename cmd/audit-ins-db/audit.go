@@ -15,14 +15,16 @@
 // of ins and will remain after ins completes an analysis if it is given the
 // -work flag.
 // Each of the databases must be named as described here for audit-ins-db to
-// understand their contents. Output from audit-ins-db is a JSON stream on stdout.
+// understand their contents, and databases without a valid store header are
+// refused. Output from audit-ins-db is a JSON stream on stdout.
 //
 // forward.db and reverse.db
 //
 // The forward.db and reverse.db files contains BLAST hit results in JSON
 // corresponding to the following Go struct. The query fields refer to the
 // identified repeat family and the subject fields refer to the identified
-// genomic region.
+// genomic region. Hits held in the binary or snappy value encodings are
+// decoded and written as JSON.
 //  struct {
 //  	SubjectAccVer string
 //  	SubjectLeft   int64
@@ -61,14 +63,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"flag"
-	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 
-	"modernc.org/kv"
-
 	"github.com/kortschak/ins/internal/store"
 )
 
@@ -85,46 +83,35 @@ func main() {
 		os.Exit(2)
 	}
 
-	var enc *json.Encoder
-	if base == "regions.db" {
-		enc = json.NewEncoder(os.Stdout)
-	}
+	enc := json.NewEncoder(os.Stdout)
 
-	orderFor := map[string]func(x, y []byte) int{
-		"forward.db":          store.GroupByQueryOrderSubjectLeft,
-		"regions.db":          store.GroupByQueryOrderSubjectLeft,
-		"reverse.db":          store.BySubjectPosition,
-		"reverse-unculled.db": store.BySubjectPosition,
+	kindFor := map[string]string{
+		"forward.db":          store.Forward,
+		"regions.db":          store.Regions,
+		"reverse.db":          store.Reverse,
+		"reverse-unculled.db": store.Reverse,
 	}
-	opts := &kv.Options{Compare: orderFor[base]}
-	db, err := kv.Open(*path, opts)
+	db, err := store.Open(*path, kindFor[base])
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	it, err := db.SeekFirst()
-	if err != nil {
-		if err == io.EOF {
-			return
-		}
-		log.Fatal(err)
-	}
-	for {
-		k, v, err := it.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Fatal(err)
-		}
+	c := store.Iterate(db)
+	for c.Next() {
 		switch base {
 		case "forward.db", "reverse.db":
-			os.Stdout.Write(v)
-			fmt.Println()
+			rec, err := c.Record()
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = enc.Encode(rec)
+			if err != nil {
+				log.Fatal(err)
+			}
 		case "regions.db", "reverse-unculled.db":
-			r := store.UnmarshalBlastRecordKey(k)
-			n := int64(order.Uint64(v))
+			r := c.Key()
+			n := int64(order.Uint64(c.Value()))
 			err = enc.Encode(region{
 				SubjectAccVer: r.SubjectAccVer,
 				SubjectLeft:   r.SubjectLeft,
@@ -140,6 +127,9 @@ func main() {
 			panic("unreachable")
 		}
 	}
+	if c.Err() != nil {
+		log.Fatal(c.Err())
+	}
 }
 
 type region struct {
@@ -0,0 +1,228 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"os/exec"
+	"sort"
+)
+
+// cell is a non-zero cell of a confusion matrix.
+type cell struct {
+	A, B  string
+	Bases int
+}
+
+// cells returns the non-zero cells of the confusion matrix, sorted by
+// descending base count. Empty names are labeled with none.
+func (c confusion) cells(none string) []cell {
+	label := func(s string) string {
+		if s == "" {
+			return none
+		}
+		return s
+	}
+	var cells []cell
+	for n, v := range c.agree {
+		cells = append(cells, cell{A: n, B: n, Bases: v})
+	}
+	for n, v := range c.discord {
+		cells = append(cells, cell{A: label(n.a), B: label(n.b), Bases: v})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Bases != cells[j].Bases {
+			return cells[i].Bases > cells[j].Bases
+		}
+		if cells[i].A != cells[j].A {
+			return cells[i].A < cells[j].A
+		}
+		return cells[i].B < cells[j].B
+	})
+	return cells
+}
+
+// renderedGraph is a discordance graph for an HTML report. Exactly one
+// of SVG and DOT is set.
+type renderedGraph struct {
+	SVG template.HTML
+	DOT string
+}
+
+// htmlOut writes a self-contained HTML report of the comparison to path.
+func htmlOut(path, aFile, bFile string, r report, classes, types confusion, classStyle, typeStyle dotStyle, none string) error {
+	classGraph, err := renderGraph(aFile, bFile, classes, classStyle, none)
+	if err != nil {
+		return err
+	}
+	typeGraph, err := renderGraph(aFile, bFile, types, typeStyle, none)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = reportTemplate.Execute(f, struct {
+		A, B       string
+		Report     report
+		Classes    []cell
+		Types      []cell
+		ClassGraph renderedGraph
+		TypeGraph  renderedGraph
+	}{
+		A:          aFile,
+		B:          bFile,
+		Report:     r,
+		Classes:    classes.cells(none),
+		Types:      types.cells(none),
+		ClassGraph: classGraph,
+		TypeGraph:  typeGraph,
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// renderGraph returns the discordance graph for c, rendered to SVG if the
+// Graphviz dot command is available.
+func renderGraph(aFile, bFile string, c confusion, style dotStyle, none string) (renderedGraph, error) {
+	b, err := dotGraph(aFile, bFile, c, style, none)
+	if err != nil {
+		return renderedGraph{}, err
+	}
+	if _, err := exec.LookPath("dot"); err != nil {
+		return renderedGraph{DOT: string(b)}, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("dot", "-Tsvg")
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return renderedGraph{}, fmt.Errorf("dot: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	svg := stdout.Bytes()
+	// Drop the XML declaration and doctype
+	// so the SVG can be placed inline.
+	if i := bytes.Index(svg, []byte("<svg")); i >= 0 {
+		svg = svg[i:]
+	}
+	return renderedGraph{SVG: template.HTML(svg)}, nil
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(n, total int) string {
+		if total == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f", 100*float64(n)/float64(total))
+	},
+	"total": func(r record) int {
+		return r.Agree + r.AMissing + r.BMissing + r.Mismatch + r.Partial
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cmpint: {{.A}} vs {{.B}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; }
+td.n { text-align: right; font-family: monospace; }
+table.sortable th { cursor: pointer; background: #eee; }
+div.scroll { max-height: 40em; overflow-y: auto; display: inline-block; }
+pre { background: #f6f6f6; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Annotation comparison</h1>
+<p>a: <code>{{.A}}</code><br>b: <code>{{.B}}</code></p>
+
+<h2>Summary</h2>
+<table class="sortable">
+<thead><tr><th>category</th><th>class bases</th><th>class %</th><th>type bases</th><th>type %</th></tr></thead>
+<tbody>
+{{- $c := .Report.Class}}{{$t := .Report.Type}}{{$ct := total $c}}{{$tt := total $t}}
+<tr><td>agree</td><td class="n">{{$c.Agree}}</td><td class="n">{{percent $c.Agree $ct}}</td><td class="n">{{$t.Agree}}</td><td class="n">{{percent $t.Agree $tt}}</td></tr>
+<tr><td>partial</td><td class="n">{{$c.Partial}}</td><td class="n">{{percent $c.Partial $ct}}</td><td class="n">{{$t.Partial}}</td><td class="n">{{percent $t.Partial $tt}}</td></tr>
+<tr><td>mismatch</td><td class="n">{{$c.Mismatch}}</td><td class="n">{{percent $c.Mismatch $ct}}</td><td class="n">{{$t.Mismatch}}</td><td class="n">{{percent $t.Mismatch $tt}}</td></tr>
+<tr><td>a missing</td><td class="n">{{$c.AMissing}}</td><td class="n">{{percent $c.AMissing $ct}}</td><td class="n">{{$t.AMissing}}</td><td class="n">{{percent $t.AMissing $tt}}</td></tr>
+<tr><td>b missing</td><td class="n">{{$c.BMissing}}</td><td class="n">{{percent $c.BMissing $ct}}</td><td class="n">{{$t.BMissing}}</td><td class="n">{{percent $t.BMissing $tt}}</td></tr>
+</tbody>
+</table>
+{{- with .Report.Class.Levels}}
+
+<h2>Class agreement by hierarchy level</h2>
+<table class="sortable">
+<thead><tr><th>level</th><th>agree</th><th>disagree</th><th>unresolved</th></tr></thead>
+<tbody>
+{{- range .}}
+<tr><td class="n">{{.Level}}</td><td class="n">{{.Agree}}</td><td class="n">{{.Disagree}}</td><td class="n">{{.Unresolved}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+
+<h2>Class confusion</h2>
+<div class="scroll">
+<table class="sortable">
+<thead><tr><th>a class</th><th>b class</th><th>bases</th></tr></thead>
+<tbody>
+{{- range .Classes}}
+<tr><td>{{.A}}</td><td>{{.B}}</td><td class="n">{{.Bases}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</div>
+
+<h2>Type confusion</h2>
+<div class="scroll">
+<table class="sortable">
+<thead><tr><th>a type</th><th>b type</th><th>bases</th></tr></thead>
+<tbody>
+{{- range .Types}}
+<tr><td>{{.A}}</td><td>{{.B}}</td><td class="n">{{.Bases}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</div>
+
+<h2>Class discordance graph</h2>
+{{with .ClassGraph}}{{if .SVG}}{{.SVG}}{{else}}<pre>{{.DOT}}</pre>{{end}}{{end}}
+
+<h2>Type discordance graph</h2>
+{{with .TypeGraph}}{{if .SVG}}{{.SVG}}{{else}}<pre>{{.DOT}}</pre>{{end}}{{end}}
+
+<script>
+document.querySelectorAll("table.sortable").forEach(function(table) {
+	table.querySelectorAll("th").forEach(function(th, col) {
+		var asc = false;
+		th.addEventListener("click", function() {
+			asc = !asc;
+			var body = table.tBodies[0];
+			var rows = Array.from(body.rows);
+			rows.sort(function(a, b) {
+				var x = a.cells[col].textContent, y = b.cells[col].textContent;
+				var nx = parseFloat(x), ny = parseFloat(y);
+				var c = (!isNaN(nx) && !isNaN(ny)) ? nx - ny : x.localeCompare(y);
+				return asc ? c : -c;
+			});
+			rows.forEach(function(r) { body.appendChild(r); });
+		});
+	});
+});
+</script>
+</body>
+</html>
+`))
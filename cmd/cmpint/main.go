@@ -10,9 +10,40 @@
 // These analyses are done for both the repeat type and the repeat class,
 // and are emitted on stdout as a JSON object.
 //
+// Classes are compared at each level of their hierarchy, where levels are
+// separated by slashes and subclasses are named by their parent followed
+// by a hyphen, so LINE/L1-Tx1 has the levels LINE, LINE/L1 and
+// LINE/L1-Tx1. Differing classes where one is an ancestor of the other,
+// such as LINE/L1 and LINE/L1-Tx1, are counted as partial matches rather
+// than mismatches, and the bases annotated in both inputs that agree or
+// disagree at each level are reported.
+//
 // If a dot flag is provided, descriptions of the discordances between the
 // feature sets as a graph in DOT format, with edge weights representing
-// counts of mismatched bases.
+// counts of mismatched bases. Edges with fewer bases than the dot-min flag
+// are omitted. With the dot-norm flag, edges are weighted by the fraction
+// of the bases assigned to either of their families that are discordant
+// between the pair, and with the dot-color flag, nodes are colored by
+// their top-level class.
+//
+// Features with a score below the min-score flag or a length below the
+// min-length flag in either input are ignored, so that comparisons can be
+// restricted to confident annotations.
+//
+// If the sorted flag is set, the inputs must be sorted by sequence name in
+// byte order, for example with LC_ALL=C sort -k1,1, and the comparison is
+// made one sequence at a time to limit memory use with large genomes.
+//
+// If an html flag is provided, a self-contained HTML report is written
+// holding the agreement summary, sortable tables of the bases assigned to
+// each pair of classes and types, and the discordance graphs. The graphs
+// are rendered as SVG if the Graphviz dot command is available, and are
+// otherwise included as DOT text.
+//
+// Classes from annotations made with libraries using different
+// classification vocabularies may be normalized to a common scheme with
+// the class-scheme and class-map flags so that naming differences are not
+// counted as mismatches.
 package main
 
 import (
@@ -32,30 +63,67 @@ import (
 	"gonum.org/v1/gonum/graph/encoding"
 	"gonum.org/v1/gonum/graph/encoding/dot"
 	"gonum.org/v1/gonum/graph/simple"
+
+	"github.com/kortschak/ins/internal/classify"
 )
 
 func main() {
 	aFile := flag.String("a", "", "specify the input file a name (required)")
 	bFile := flag.String("b", "", "specify the input file b name (required)")
 	out := flag.String("dot", "", "specify prefix for DOT files describing disagreements")
+	dotMin := flag.Int("dot-min", 0, "specify the minimum number of discordant bases for an edge in DOT output")
+	dotNorm := flag.Bool("dot-norm", false, "specify that DOT edge weights are normalized by family abundance")
+	dotColor := flag.Bool("dot-color", false, "specify that DOT nodes are colored by top-level class")
+	html := flag.String("html", "", "specify a file name for an HTML report of the comparison")
 	none := flag.String("none", "none", "specify label for 'no annotation")
+	classScheme := flag.String("class-scheme", "", "specify the classification scheme that classes are normalized to before comparison (dfam, repbase or wicker)")
+	classMap := flag.String("class-map", "", "specify a tab-separated file of class mappings that override the built-in classification scheme table")
+	minScore := flag.Float64("min-score", 0, "specify the minimum score of features to compare")
+	minLength := flag.Int("min-length", 0, "specify the minimum length of features to compare")
+	sorted := flag.Bool("sorted", false, "specify that inputs are sorted by sequence name and are processed one sequence at a time")
 
 	flag.Parse()
 	if *aFile == "" || *bFile == "" {
 		flag.Usage()
 		os.Exit(2)
 	}
+	norm, err := classify.New(*classScheme)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *classMap != "" {
+		err = norm.ReadFile(*classMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	normTypeClassOf := func(f *gff.Feature) (typ, class string, err error) {
+		typ, class, err = typeClassOf(f)
+		return typ, norm.Class(class), err
+	}
+	ignore := func(f *gff.Feature) bool {
+		if f.Len() < *minLength {
+			return true
+		}
+		return *minScore != 0 && (f.FeatScore == nil || *f.FeatScore < *minScore)
+	}
 
 	chrs := make(map[string]bool)
+	aClassOf := make(map[string]string)
+	bClassOf := make(map[string]string)
 	types := make(map[string]*step.Vector)
 	classes := make(map[string]*step.Vector)
-	err := steps(*aFile, func(f *gff.Feature) error {
+	addA := func(f *gff.Feature) error {
+		if ignore(f) {
+			return nil
+		}
 		chrs[f.SeqName] = true
 
-		typ, class, err := typeClassOf(f)
+		typ, class, err := normTypeClassOf(f)
 		if err != nil {
 			return err
 		}
+		aClassOf[typ] = class
 
 		tv, ok := types[f.SeqName]
 		if !ok {
@@ -96,17 +164,18 @@ func main() {
 			return c
 		})
 		return err
-	})
-	if err != nil {
-		log.Fatal(err)
 	}
-	err = steps(*bFile, func(f *gff.Feature) error {
+	addB := func(f *gff.Feature) error {
+		if ignore(f) {
+			return nil
+		}
 		chrs[f.SeqName] = true
 
-		typ, class, err := typeClassOf(f)
+		typ, class, err := normTypeClassOf(f)
 		if err != nil {
 			return err
 		}
+		bClassOf[typ] = class
 
 		tv, ok := types[f.SeqName]
 		if !ok {
@@ -147,27 +216,32 @@ func main() {
 			return c
 		})
 		return err
-	})
-	if err != nil {
-		log.Fatal(err)
 	}
 
-	// FIXME: do we need this; currently not
-	var chroms []string
-	for c := range chrs {
-		chroms = append(chroms, c)
-	}
-	sort.Strings(chroms)
-
-	// Process classes.
+	// Class and type agreement counts.
 	var (
 		classAgree      int
 		aMissingClass   int
 		bMissingClass   int
 		classMismatch   int
+		classPartial    int
+		classLevels     []level
 		classMismatches = make(map[names]int)
+		classAgreements = make(map[string]int)
 	)
-	for _, chr := range chroms {
+	var (
+		typeAgree      int
+		aMissingType   int
+		bMissingType   int
+		typeMismatch   int
+		typeMismatches = make(map[names]int)
+		typeAgreements = make(map[string]int)
+	)
+	tally := func(chr string) {
+		if _, ok := classes[chr]; !ok {
+			// All features on chr were ignored.
+			return
+		}
 		classes[chr].Do(func(start, end int, e step.Equaler) {
 			c := e.(pair)
 			if c.isZero() {
@@ -177,6 +251,7 @@ func main() {
 			switch {
 			case c.a == c.b:
 				classAgree += len
+				classAgreements[c.a] += len
 			case c.a == "":
 				aMissingClass += len
 				classMismatches[names{a: "", b: c.b}] += len
@@ -184,21 +259,19 @@ func main() {
 				bMissingClass += len
 				classMismatches[names{a: c.a, b: ""}] += len
 			default:
-				classMismatch += len
+				ha, hb := hierarchy(c.a), hierarchy(c.b)
+				if isAncestor(ha, hb) || isAncestor(hb, ha) {
+					classPartial += len
+				} else {
+					classMismatch += len
+				}
 				classMismatches[c.names] += len
 			}
+			if c.a != "" && c.b != "" {
+				classLevels = countLevels(classLevels, hierarchy(c.a), hierarchy(c.b), len)
+			}
 		})
-	}
 
-	// Process types.
-	var (
-		typeAgree      int
-		aMissingType   int
-		bMissingType   int
-		typeMismatch   int
-		typeMismatches = make(map[names]int)
-	)
-	for _, chr := range chroms {
 		types[chr].Do(func(start, end int, e step.Equaler) {
 			t := e.(pair)
 			if t.isZero() {
@@ -208,6 +281,7 @@ func main() {
 			switch {
 			case t.a == t.b:
 				typeAgree += len
+				typeAgreements[t.a] += len
 			case t.a == "":
 				aMissingType += len
 				typeMismatches[names{a: "", b: t.b}] += len
@@ -221,23 +295,44 @@ func main() {
 		})
 	}
 
-	type record struct {
-		Agree    int `json:"agree"`
-		AMissing int `json:"a-missing"`
-		BMissing int `json:"b-missing"`
-		Mismatch int `json:"mismatch"`
-	}
-	type report struct {
-		Class record `json:"class"`
-		Type  record `json:"type"`
+	if *sorted {
+		err = mergeSteps(*aFile, *bFile, addA, addB, func(chr string) {
+			tally(chr)
+			delete(classes, chr)
+			delete(types, chr)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		err = steps(*aFile, addA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = steps(*bFile, addB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// FIXME: do we need this; currently not
+		var chroms []string
+		for c := range chrs {
+			chroms = append(chroms, c)
+		}
+		sort.Strings(chroms)
+		for _, chr := range chroms {
+			tally(chr)
+		}
 	}
 
-	m, err := json.Marshal(report{
+	r := report{
 		Class: record{
 			Agree:    classAgree,
 			AMissing: aMissingClass,
 			BMissing: bMissingClass,
 			Mismatch: classMismatch,
+			Partial:  classPartial,
+			Levels:   classLevels,
 		},
 		Type: record{
 			Agree:    typeAgree,
@@ -245,17 +340,41 @@ func main() {
 			BMissing: bMissingType,
 			Mismatch: typeMismatch,
 		},
-	})
+	}
+	m, err := json.Marshal(r)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Printf("%s\n", m)
+
+	classConfusion := confusion{agree: classAgreements, discord: classMismatches}
+	typeConfusion := confusion{agree: typeAgreements, discord: typeMismatches}
+	classStyle := dotStyle{minBases: *dotMin, normalize: *dotNorm}
+	typeStyle := classStyle
+	if *dotColor {
+		colors := classColors(classConfusion)
+		classStyle.color = func(_ bool, class string) string {
+			return colors[topLevel(class)]
+		}
+		typeStyle.color = func(a bool, typ string) string {
+			if a {
+				return colors[topLevel(aClassOf[typ])]
+			}
+			return colors[topLevel(bClassOf[typ])]
+		}
+	}
 	if *out != "" {
-		err = dotOut(*out+".class.dot", *aFile, *bFile, classMismatches, *none)
+		err = dotOut(*out+".class.dot", *aFile, *bFile, classConfusion, classStyle, *none)
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = dotOut(*out+".type.dot", *aFile, *bFile, typeMismatches, *none)
+		err = dotOut(*out+".type.dot", *aFile, *bFile, typeConfusion, typeStyle, *none)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *html != "" {
+		err = htmlOut(*html, *aFile, *bFile, r, classConfusion, typeConfusion, classStyle, typeStyle, *none)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -279,6 +398,127 @@ func steps(path string, fn func(*gff.Feature) error) error {
 	return sc.Error()
 }
 
+// mergeSteps calls fnA and fnB for each feature of the GFF files at the
+// paths a and b, which must be sorted by sequence name, and then calls
+// done with the sequence name when all features on a sequence in both
+// files have been processed.
+func mergeSteps(a, b string, fnA, fnB func(*gff.Feature) error, done func(seq string)) error {
+	ga, err := newGroupReader(a)
+	if err != nil {
+		return err
+	}
+	defer ga.close()
+	gb, err := newGroupReader(b)
+	if err != nil {
+		return err
+	}
+	defer gb.close()
+
+	for {
+		sa, okA := ga.peek()
+		sb, okB := gb.peek()
+		if !okA && !okB {
+			break
+		}
+		seq := sa
+		if !okA || (okB && sb < sa) {
+			seq = sb
+		}
+		if okA && sa == seq {
+			err = ga.each(fnA)
+			if err != nil {
+				return err
+			}
+		}
+		if okB && sb == seq {
+			err = gb.each(fnB)
+			if err != nil {
+				return err
+			}
+		}
+		done(seq)
+	}
+	err = ga.err()
+	if err != nil {
+		return err
+	}
+	return gb.err()
+}
+
+// groupReader reads runs of GFF features on the same sequence from a file
+// sorted by sequence name.
+type groupReader struct {
+	path string
+	f    *os.File
+	sc   *featio.Scanner
+
+	next *gff.Feature
+	last string
+	fail error
+}
+
+func newGroupReader(path string) (*groupReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &groupReader{path: path, f: f, sc: featio.NewScanner(gff.NewReader(f))}
+	g.advance()
+	return g, nil
+}
+
+// advance reads the next feature, checking that features are sorted.
+func (g *groupReader) advance() {
+	g.next = nil
+	if g.fail != nil || !g.sc.Next() {
+		return
+	}
+	f := g.sc.Feat().(*gff.Feature)
+	if f.SeqName < g.last {
+		g.fail = fmt.Errorf("%s: features not sorted by sequence name: %q after %q", g.path, f.SeqName, g.last)
+		return
+	}
+	g.last = f.SeqName
+	g.next = f
+}
+
+// peek returns the sequence name of the next run of features and whether
+// there are any features remaining.
+func (g *groupReader) peek() (seq string, ok bool) {
+	if g.next == nil {
+		return "", false
+	}
+	return g.next.SeqName, true
+}
+
+// each calls fn for each feature in the next run of features.
+func (g *groupReader) each(fn func(*gff.Feature) error) error {
+	if g.next == nil {
+		return nil
+	}
+	seq := g.next.SeqName
+	for g.next != nil && g.next.SeqName == seq {
+		err := fn(g.next)
+		if err != nil {
+			return err
+		}
+		g.advance()
+	}
+	return g.err()
+}
+
+// err returns any error encountered while reading.
+func (g *groupReader) err() error {
+	if g.fail != nil {
+		return g.fail
+	}
+	return g.sc.Error()
+}
+
+func (g *groupReader) close() error {
+	return g.f.Close()
+}
+
 func typeClassOf(f *gff.Feature) (typ, class string, err error) {
 	attr := f.FeatAttributes.Get("Repeat")
 	fields := strings.Split(attr, " ")
@@ -288,6 +528,64 @@ func typeClassOf(f *gff.Feature) (typ, class string, err error) {
 	return fields[0], fields[1], nil
 }
 
+// level is the agreement between classes at a level of the classification
+// hierarchy for bases annotated in both inputs.
+type level struct {
+	Level      int `json:"level"`
+	Agree      int `json:"agree"`
+	Disagree   int `json:"disagree"`
+	Unresolved int `json:"unresolved"` // Only one input is classified to the level.
+}
+
+// hierarchy returns the levels of the classification hierarchy of class,
+// from most general to most specific.
+func hierarchy(class string) []string {
+	var (
+		levels []string
+		prefix string
+	)
+	for i, part := range strings.Split(class, "/") {
+		if i != 0 {
+			prefix += "/"
+		}
+		sub := strings.Split(part, "-")
+		for j := range sub {
+			levels = append(levels, prefix+strings.Join(sub[:j+1], "-"))
+		}
+		prefix += part
+	}
+	return levels
+}
+
+// isAncestor returns whether the class with hierarchy a is an ancestor of
+// the class with hierarchy b.
+func isAncestor(a, b []string) bool {
+	return len(a) < len(b) && a[len(a)-1] == b[len(a)-1]
+}
+
+// countLevels adds n bases with classes of hierarchies a and b to the
+// per-level agreement counts in levels, returning the updated counts.
+func countLevels(levels []level, a, b []string, n int) []level {
+	depth := len(a)
+	if len(b) > depth {
+		depth = len(b)
+	}
+	for len(levels) < depth {
+		levels = append(levels, level{Level: len(levels) + 1})
+	}
+	for i := 0; i < depth; i++ {
+		switch {
+		case i >= len(a) || i >= len(b):
+			levels[i].Unresolved += n
+		case a[i] == b[i]:
+			levels[i].Agree += n
+		default:
+			levels[i].Disagree += n
+		}
+	}
+	return levels
+}
+
 // pair is a step vector element with two string values
 // which are either repeat element type or class.
 type pair struct {
@@ -309,17 +607,108 @@ func (p pair) Equal(e step.Equaler) bool {
 	return p.names == e.(pair).names
 }
 
-func dotOut(path, aFile, bFile string, edges map[names]int, none string) error {
-	g := newNameGraph(none)
-	for p, w := range edges {
-		e := edge{
-			f: g.nodeFor(aFile, p.a),
-			t: g.nodeFor(bFile, p.b),
-			w: float64(w),
+// report is the agreement summary of a comparison.
+type report struct {
+	Class record `json:"class"`
+	Type  record `json:"type"`
+}
+
+// record is the number of bases in each agreement category.
+type record struct {
+	Agree    int     `json:"agree"`
+	AMissing int     `json:"a-missing"`
+	BMissing int     `json:"b-missing"`
+	Mismatch int     `json:"mismatch"`
+	Partial  int     `json:"partial,omitempty"`
+	Levels   []level `json:"levels,omitempty"`
+}
+
+// confusion is the number of bases assigned to each pair of names.
+type confusion struct {
+	agree   map[string]int
+	discord map[names]int
+}
+
+// abundance returns the number of bases assigned to each name in the a
+// and b inputs.
+func (c confusion) abundance() (a, b map[string]int) {
+	a = make(map[string]int)
+	b = make(map[string]int)
+	for n, v := range c.agree {
+		a[n] += v
+		b[n] += v
+	}
+	for n, v := range c.discord {
+		if n.a != "" {
+			a[n.a] += v
 		}
-		g.SetWeightedEdge(e)
+		if n.b != "" {
+			b[n.b] += v
+		}
+	}
+	return a, b
+}
+
+// dotStyle holds DOT graph rendering options.
+type dotStyle struct {
+	// minBases is the minimum number of
+	// bases for an edge to be included.
+	minBases int
+
+	// normalize specifies that edge weights
+	// are the fraction of the bases assigned
+	// to either of the edge's names that are
+	// assigned to the pair.
+	normalize bool
+
+	// color returns the color of the node
+	// for name in the a or b input. If color
+	// is nil or returns the empty string the
+	// node is not colored.
+	color func(a bool, name string) string
+}
+
+// palette is the set of colors used to distinguish top-level classes.
+var palette = []string{
+	"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf",
+}
+
+// classColors returns a mapping from the top-level classes in c to node
+// colors. Colors are assigned in class name order and are reused if there
+// are more classes than colors in the palette.
+func classColors(c confusion) map[string]string {
+	seen := make(map[string]bool)
+	for n := range c.agree {
+		seen[topLevel(n)] = true
+	}
+	for n := range c.discord {
+		seen[topLevel(n.a)] = true
+		seen[topLevel(n.b)] = true
+	}
+	delete(seen, "")
+	tops := make([]string, 0, len(seen))
+	for t := range seen {
+		tops = append(tops, t)
+	}
+	sort.Strings(tops)
+	colors := make(map[string]string, len(tops))
+	for i, t := range tops {
+		colors[t] = palette[i%len(palette)]
+	}
+	return colors
+}
+
+// topLevel returns the top level of the classification hierarchy of class.
+func topLevel(class string) string {
+	if class == "" {
+		return ""
 	}
-	b, err := dot.Marshal(g, "discord", "", "\t")
+	return hierarchy(class)[0]
+}
+
+func dotOut(path, aFile, bFile string, c confusion, style dotStyle, none string) error {
+	b, err := dotGraph(aFile, bFile, c, style, none)
 	if err != nil {
 		return err
 	}
@@ -330,6 +719,46 @@ func dotOut(path, aFile, bFile string, edges map[names]int, none string) error {
 	return nil
 }
 
+// dotGraph returns the DOT description of the discordances in c.
+func dotGraph(aFile, bFile string, c confusion, style dotStyle, none string) ([]byte, error) {
+	var aAbund, bAbund map[string]int
+	if style.normalize {
+		aAbund, bAbund = c.abundance()
+	}
+	color := func(a bool, name string) string {
+		if style.color == nil || name == "" {
+			return ""
+		}
+		return style.color(a, name)
+	}
+	g := newNameGraph(none)
+	for p, n := range c.discord {
+		if n < style.minBases {
+			continue
+		}
+		w := float64(n)
+		if style.normalize {
+			// Unannotated bases are not a
+			// family, so only the annotated
+			// name's abundance is used.
+			union := aAbund[p.a] + bAbund[p.b]
+			if p.a != "" && p.b != "" {
+				union -= n
+			}
+			w /= float64(union)
+		}
+		e := edge{
+			f: g.nodeFor(aFile, p.a, color(true, p.a)),
+			t: g.nodeFor(bFile, p.b, color(false, p.b)),
+			w: w,
+
+			normalized: style.normalize,
+		}
+		g.SetWeightedEdge(e)
+	}
+	return dot.Marshal(g, "discord", "", "\t")
+}
+
 type nameGraph struct {
 	*simple.WeightedUndirectedGraph
 	idFor map[string]int64
@@ -344,7 +773,7 @@ func newNameGraph(none string) nameGraph {
 	}
 }
 
-func (g nameGraph) nodeFor(file, s string) graph.Node {
+func (g nameGraph) nodeFor(file, s, color string) graph.Node {
 	if s == "" {
 		s = g.none
 	}
@@ -355,28 +784,49 @@ func (g nameGraph) nodeFor(file, s string) graph.Node {
 	}
 	id = g.WeightedUndirectedGraph.NewNode().ID()
 	g.idFor[s] = id
-	n := node{id: id, name: s}
+	n := node{id: id, name: s, color: color}
 	g.AddNode(n)
 	return n
 }
 
 type node struct {
-	id   int64
-	name string
+	id    int64
+	name  string
+	color string
 }
 
 func (n node) ID() int64     { return n.id }
 func (n node) DOTID() string { return n.name }
+func (n node) Attributes() []encoding.Attribute {
+	if n.color == "" {
+		return nil
+	}
+	return []encoding.Attribute{{Key: "style", Value: "filled"}, {Key: "fillcolor", Value: n.color}}
+}
 
 type edge struct {
 	f, t graph.Node
 	w    float64
+
+	// normalized indicates that w is a
+	// fraction rather than a base count.
+	normalized bool
 }
 
-func (e edge) From() graph.Node         { return e.f }
-func (e edge) To() graph.Node           { return e.t }
-func (e edge) ReversedEdge() graph.Edge { return edge{f: e.t, t: e.f, w: e.w} }
-func (e edge) Weight() float64          { return e.w }
+func (e edge) From() graph.Node { return e.f }
+func (e edge) To() graph.Node   { return e.t }
+func (e edge) ReversedEdge() graph.Edge {
+	return edge{f: e.t, t: e.f, w: e.w, normalized: e.normalized}
+}
+func (e edge) Weight() float64 { return e.w }
 func (e edge) Attributes() []encoding.Attribute {
+	if e.normalized {
+		// Graphviz dot requires integer weights,
+		// so fractions are shown by line width.
+		return []encoding.Attribute{
+			{Key: "label", Value: fmt.Sprintf("%.3g", e.w)},
+			{Key: "penwidth", Value: fmt.Sprintf("%.2f", 1+4*e.w)},
+		}
+	}
 	return []encoding.Attribute{{Key: "weight", Value: fmt.Sprint(e.w)}}
 }
@@ -4,15 +4,22 @@
 
 // cull is a tool to remove lower scoring features from a GFF file.
 // It discards features that are completely contained within a higher scoring
-// feature. Features without a score are not considered but retained in the
-// set of features.
+// feature on the same sequence. Features without a score are not considered
+// but retained in the set of features.
 //
-// usage: cull < infile.gff > outfile.gff
+// If a reference GFF file is provided with the -ref flag, features that are
+// completely contained within a higher scoring reference feature are also
+// discarded. Reference features are not written to the output. This allows
+// annotations from different tools to be merged, provided that their scores
+// are comparable.
+//
+// usage: cull [-ref reference.gff] < infile.gff > outfile.gff
 package main
 
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -22,22 +29,31 @@ import (
 )
 
 func main() {
+	ref := flag.String("ref", "", "specify a GFF file of reference features that cull contained features")
 	flag.Usage = func() {
-		fmt.Println(`usage: cull < infile.gff > outfile.gff`)
+		fmt.Println(`usage: cull [-ref reference.gff] < infile.gff > outfile.gff`)
+		flag.PrintDefaults()
 		os.Exit(0)
 	}
 	flag.Parse()
-	r := gff.NewReader(os.Stdin)
-	sc := featio.NewScanner(r)
-	var feats []*gff.Feature
-	for sc.Next() {
-		feats = append(feats, sc.Feat().(*gff.Feature))
-	}
-	if err := sc.Error(); err != nil {
+	feats, err := readFeatures(os.Stdin)
+	if err != nil {
 		log.Fatal(err)
 	}
+	var refs []*gff.Feature
+	if *ref != "" {
+		f, err := os.Open(*ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+		refs, err = readFeatures(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", *ref, err)
+		}
+	}
 	w := gff.NewWriter(os.Stdout, 60, true)
-	for _, f := range cullContained(feats) {
+	for _, f := range cullContained(feats, refs) {
 		_, err := w.Write(f)
 		if err != nil {
 			log.Fatal(err)
@@ -45,25 +61,46 @@ func main() {
 	}
 }
 
+// readFeatures returns the GFF features read from r.
+func readFeatures(r io.Reader) ([]*gff.Feature, error) {
+	sc := featio.NewScanner(gff.NewReader(r))
+	var feats []*gff.Feature
+	for sc.Next() {
+		feats = append(feats, sc.Feat().(*gff.Feature))
+	}
+	return feats, sc.Error()
+}
+
 // cullContained returns a copy of hits with all hits that are completely contained by
-// a higher scoring hit removed.
-func cullContained(hits []*gff.Feature) []*gff.Feature {
-	var tree interval.IntTree
-	for i, f := range hits {
-		if f.FeatScore == nil {
-			continue
-		}
-		err := tree.Insert(subjectInterval{uid: uintptr(i), Feature: f}, true)
-		if err != nil {
-			log.Fatal(err)
+// a higher scoring hit or reference feature on the same sequence removed.
+func cullContained(hits, refs []*gff.Feature) []*gff.Feature {
+	trees := make(map[string]*interval.IntTree)
+	var uid uintptr
+	for _, feats := range [][]*gff.Feature{hits, refs} {
+		for _, f := range feats {
+			uid++
+			if f.FeatScore == nil {
+				continue
+			}
+			t, ok := trees[f.SeqName]
+			if !ok {
+				t = &interval.IntTree{}
+				trees[f.SeqName] = t
+			}
+			err := t.Insert(subjectInterval{uid: uid, Feature: f}, true)
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
-	tree.AdjustRanges()
+	for _, t := range trees {
+		t.AdjustRanges()
+	}
 	var culled []*gff.Feature
 outer:
 	for _, f := range hits {
 		if f.FeatScore != nil {
-			o := tree.Get(subjectInterval{Feature: f})
+			o := trees[f.SeqName].Get(subjectInterval{Feature: f})
 			for _, h := range o {
 				if *h.(subjectInterval).FeatScore > *f.FeatScore {
 					continue outer
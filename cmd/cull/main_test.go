@@ -0,0 +1,84 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/biogo/biogo/io/featio/gff"
+)
+
+// feat returns a scored GFF feature on seq from start to end.
+func feat(seq string, start, end int, score float64) *gff.Feature {
+	return &gff.Feature{SeqName: seq, FeatStart: start, FeatEnd: end, FeatScore: &score}
+}
+
+var (
+	chr1Outer    = feat("chr1", 100, 1000, 500)
+	chr1Inner    = feat("chr1", 200, 300, 50)
+	chr1Higher   = feat("chr1", 400, 500, 600)
+	chr1Overlap  = feat("chr1", 900, 1100, 50)
+	chr2Inner    = feat("chr2", 200, 300, 50)
+	chr2Unscored = &gff.Feature{SeqName: "chr2", FeatStart: 150, FeatEnd: 160}
+	refOuter     = feat("chr2", 100, 400, 100)
+	refInner     = feat("chr1", 950, 1050, 500)
+)
+
+var cullContainedTests = []struct {
+	name string
+	hits []*gff.Feature
+	refs []*gff.Feature
+	want []*gff.Feature
+}{
+	{
+		name: "empty",
+		want: nil,
+	},
+	{
+		name: "contained",
+		hits: []*gff.Feature{chr1Outer, chr1Inner, chr1Higher, chr1Overlap},
+		want: []*gff.Feature{chr1Outer, chr1Higher, chr1Overlap},
+	},
+	{
+		// The chr2 hit lies within the coordinates of a
+		// higher scoring chr1 hit, but is on a different
+		// sequence and so is not contained by it.
+		name: "other sequence",
+		hits: []*gff.Feature{chr1Outer, chr2Inner, chr2Unscored},
+		want: []*gff.Feature{chr1Outer, chr2Inner, chr2Unscored},
+	},
+	{
+		name: "reference",
+		hits: []*gff.Feature{chr1Outer, chr1Inner, chr2Inner, chr2Unscored},
+		refs: []*gff.Feature{refOuter, refInner},
+		want: []*gff.Feature{chr1Outer, chr2Unscored},
+	},
+	{
+		name: "reference other sequence",
+		hits: []*gff.Feature{chr2Inner},
+		refs: []*gff.Feature{chr1Outer},
+		want: []*gff.Feature{chr2Inner},
+	},
+}
+
+func TestCullContained(t *testing.T) {
+	for _, test := range cullContainedTests {
+		got := cullContained(test.hits, test.refs)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected culled features for %s test: got:%v want:%v", test.name, spans(got), spans(test.want))
+		}
+	}
+}
+
+// spans returns the sequence positions of feats for reporting.
+func spans(feats []*gff.Feature) []string {
+	s := make([]string, len(feats))
+	for i, f := range feats {
+		s[i] = fmt.Sprintf("%s:%d-%d", f.SeqName, f.FeatStart, f.FeatEnd)
+	}
+	return s
+}
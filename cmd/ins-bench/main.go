@@ -0,0 +1,483 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ins-bench program measures the accuracy of ins on synthetic genomes.
+// It generates a random genome with copies of the consensus sequences of a
+// repeat library planted at a set of divergences, annotates the genome with
+// ins using the same library, and scores the annotation against the planted
+// truth set. The scores are emitted on stdout as a JSON object.
+//
+// A planted copy is detected when at least the -detect fraction of its bases
+// are annotated with its family. Base level scores count bases annotated
+// with the correct family as true positives, bases annotated outside planted
+// copies or with the wrong family as false positives and planted bases that
+// are not annotated with their family as false negatives.
+//
+// usage: ins-bench -lib library.fa [options] [-- ins flags]
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/io/seqio"
+	"github.com/biogo/biogo/io/seqio/fasta"
+	"github.com/biogo/biogo/seq/linear"
+)
+
+func main() {
+	lib := flag.String("lib", "", "specify the repeat library to plant and search (required)")
+	length := flag.Int("len", 1e6, "specify the length of random sequence between planted copies in total")
+	copies := flag.Int("copies", 5, "specify the number of copies of each family planted at each divergence")
+	divs := flag.String("div", "0,5,10,20", "specify a comma-separated list of percent divergences of planted copies")
+	detect := flag.Float64("detect", 0.5, "specify the fraction of a planted copy that must be annotated with its family for it to be detected")
+	seed := flag.Int64("seed", 1, "specify the random seed for genome generation")
+	dir := flag.String("dir", "", "specify the directory for the synthetic genome and annotations (default is a temporary directory)")
+	ins := flag.String("ins", "ins", "specify the ins executable")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -lib library.fa [options] [-- ins flags]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *lib == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var divergences []float64
+	for _, d := range strings.Split(*divs, ",") {
+		v, err := strconv.ParseFloat(d, 64)
+		if err != nil || v < 0 || v > 100 {
+			log.Fatalf("invalid divergence: %q", d)
+		}
+		divergences = append(divergences, v)
+	}
+	if *detect <= 0 || *detect > 1 {
+		log.Fatalf("invalid detection fraction: %v", *detect)
+	}
+
+	consensi, err := readLibrary(*lib)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(consensi) == 0 {
+		log.Fatalf("no sequences in %s", *lib)
+	}
+
+	if *dir == "" {
+		*dir, err = ioutil.TempDir("", "ins-bench-")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	genome := filepath.Join(*dir, "genome.fa")
+	rnd := rand.New(rand.NewSource(*seed))
+	truth, genomeLen, err := plant(genome, consensi, divergences, *copies, *length, rnd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeTruth(filepath.Join(*dir, "truth.gtf"), truth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	annotation := filepath.Join(*dir, "genome.gtf")
+	out, err := os.Create(annotation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(*ins, append([]string{"-query", genome, "-lib", *lib}, flag.Args()...)...)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	log.Print(cmd)
+	err = cmd.Run()
+	if err != nil {
+		log.Fatalf("ins failed: %v", err)
+	}
+	err = out.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	calls, err := readCalls(annotation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(score(truth, calls, genomeLen, divergences, *detect))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// consensus is a repeat library sequence.
+type consensus struct {
+	name, class string
+	seq         []byte
+}
+
+// readLibrary returns the sequences of the library fasta file at path.
+func readLibrary(path string) ([]consensus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lib []consensus
+	sc := seqio.NewScanner(fasta.NewReader(f, linear.NewSeq("", nil, alphabet.DNAredundant)))
+	for sc.Next() {
+		s := sc.Seq().(*linear.Seq)
+		c := consensus{name: s.ID, class: strings.Fields(s.Desc + " Unknown")[0]}
+		c.seq = make([]byte, len(s.Seq))
+		for i, l := range s.Seq {
+			c.seq[i] = byte(l)
+		}
+		lib = append(lib, c)
+	}
+	return lib, sc.Error()
+}
+
+// element is a planted repeat copy. Coordinates are zero-based half-open.
+type element struct {
+	seq        string
+	start, end int
+	strand     int8
+	family     string
+	class      string
+	divergence float64
+}
+
+const bases = "ACGT"
+
+// plant writes a random genome to the fasta file at path with copies of
+// each consensus planted at each divergence, separated by random sequence
+// of the given total length. It returns the planted elements and the
+// length of the genome.
+func plant(path string, lib []consensus, divs []float64, copies, length int, rnd *rand.Rand) ([]element, int, error) {
+	type planting struct {
+		c   consensus
+		div float64
+	}
+	var planted []planting
+	for _, c := range lib {
+		for _, d := range divs {
+			for i := 0; i < copies; i++ {
+				planted = append(planted, planting{c: c, div: d})
+			}
+		}
+	}
+	rnd.Shuffle(len(planted), func(i, j int) { planted[i], planted[j] = planted[j], planted[i] })
+
+	const name = "synthetic"
+	var (
+		genome []byte
+		truth  []element
+	)
+	spacer := length / (len(planted) + 1)
+	for _, p := range planted {
+		genome = appendRandom(genome, spacer, rnd)
+		s := mutate(p.c.seq, p.div, rnd)
+		strand := int8(1)
+		if rnd.Intn(2) == 0 {
+			strand = -1
+			revComp(s)
+		}
+		truth = append(truth, element{
+			seq:        name,
+			start:      len(genome),
+			end:        len(genome) + len(s),
+			strand:     strand,
+			family:     p.c.name,
+			class:      p.c.class,
+			divergence: p.div,
+		})
+		genome = append(genome, s...)
+	}
+	genome = appendRandom(genome, length-spacer*len(planted), rnd)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, ">%s\n", name)
+	for i := 0; i < len(genome); i += 60 {
+		w.Write(genome[i:min(i+60, len(genome))])
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return truth, len(genome), f.Close()
+}
+
+// appendRandom appends n random bases to dst.
+func appendRandom(dst []byte, n int, rnd *rand.Rand) []byte {
+	for i := 0; i < n; i++ {
+		dst = append(dst, bases[rnd.Intn(len(bases))])
+	}
+	return dst
+}
+
+// mutate returns a copy of s with the given percentage of positions
+// substituted with a different base.
+func mutate(s []byte, div float64, rnd *rand.Rand) []byte {
+	m := append([]byte(nil), s...)
+	for i := range m {
+		if rnd.Float64()*100 >= div {
+			continue
+		}
+		b := bases[rnd.Intn(len(bases))]
+		for b == upper(m[i]) {
+			b = bases[rnd.Intn(len(bases))]
+		}
+		m[i] = b
+	}
+	return m
+}
+
+func upper(b byte) byte {
+	if 'a' <= b && b <= 'z' {
+		return b - ('a' - 'A')
+	}
+	return b
+}
+
+// revComp reverse complements s in place.
+func revComp(s []byte) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = complement(s[j]), complement(s[i])
+	}
+	if len(s)%2 == 1 {
+		s[len(s)/2] = complement(s[len(s)/2])
+	}
+}
+
+func complement(b byte) byte {
+	switch upper(b) {
+	case 'A':
+		return 'T'
+	case 'C':
+		return 'G'
+	case 'G':
+		return 'C'
+	case 'T':
+		return 'A'
+	}
+	return 'N'
+}
+
+// writeTruth writes the planted elements to the GTF file at path.
+func writeTruth(path string, truth []element) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range truth {
+		strand := "+"
+		if e.strand < 0 {
+			strand = "-"
+		}
+		fmt.Fprintf(w, "%s\tins-bench\tplanted_repeat\t%d\t%d\t.\t%s\t.\tRepeat \"%s %s\" ; Divergence \"%g\"\n",
+			e.seq, e.start+1, e.end, strand, e.family, e.class, e.divergence)
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// call is an annotated interval. Coordinates are zero-based half-open.
+type call struct {
+	seq        string
+	start, end int
+	family     string
+}
+
+// readCalls returns the repeat annotations in the ins GTF output at path.
+func readCalls(path string) ([]call, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var calls []call
+	sc := featio.NewScanner(gff.NewReader(f))
+	for sc.Next() {
+		feat := sc.Feat().(*gff.Feature)
+		if feat.Feature != "repeat" {
+			continue
+		}
+		fields := strings.Fields(feat.FeatAttributes.Get("Repeat"))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing repeat attribute: %v", feat)
+		}
+		calls = append(calls, call{seq: feat.SeqName, start: feat.FeatStart, end: feat.FeatEnd, family: fields[0]})
+	}
+	return calls, sc.Error()
+}
+
+// scores is the accuracy of an annotation.
+type scores struct {
+	Divergence float64 `json:"divergence"`
+	Elements   int     `json:"elements"`
+	Detected   int     `json:"detected"`
+
+	// Sensitivity is the fraction of planted
+	// elements that were detected.
+	Sensitivity float64 `json:"sensitivity"`
+
+	// BaseSensitivity is the fraction of planted
+	// bases annotated with the correct family.
+	BaseSensitivity float64 `json:"base_sensitivity"`
+}
+
+// report is the result of a benchmark run.
+type report struct {
+	ByDivergence []scores `json:"by_divergence"`
+
+	TruePositiveBases  int `json:"true_positive_bases"`
+	FalsePositiveBases int `json:"false_positive_bases"`
+	FalseNegativeBases int `json:"false_negative_bases"`
+
+	// Specificity is the fraction of bases outside
+	// planted elements that were not annotated.
+	Specificity float64 `json:"specificity"`
+
+	// Precision is the fraction of annotated bases
+	// annotated with the correct family.
+	Precision float64 `json:"precision"`
+}
+
+// score returns the accuracy of calls against the planted truth set in a
+// genome of the given length.
+func score(truth []element, calls []call, genome int, divs []float64, detect float64) report {
+	// Label each base of each sequence with the
+	// planted family, if any, and count the bases
+	// annotated with each family.
+	type label struct {
+		family  string
+		element int
+	}
+	planted := make(map[string][]label)
+	for i, e := range truth {
+		l := planted[e.seq]
+		for len(l) < e.end {
+			l = append(l, label{element: -1})
+		}
+		for p := e.start; p < e.end; p++ {
+			l[p] = label{family: e.family, element: i}
+		}
+		planted[e.seq] = l
+	}
+
+	// Resolve overlapping calls to a single
+	// family per base, preferring earlier calls.
+	called := make(map[string]map[int]string)
+	sort.SliceStable(calls, func(i, j int) bool { return calls[i].start < calls[j].start })
+	for _, c := range calls {
+		m, ok := called[c.seq]
+		if !ok {
+			m = make(map[int]string)
+			called[c.seq] = m
+		}
+		for p := c.start; p < c.end; p++ {
+			if _, ok := m[p]; !ok {
+				m[p] = c.family
+			}
+		}
+	}
+
+	var r report
+	correct := make([]int, len(truth))
+	var repeatBases int
+	for _, l := range planted {
+		for _, b := range l {
+			if b.element >= 0 {
+				repeatBases++
+			}
+		}
+	}
+	for seq, m := range called {
+		l := planted[seq]
+		for p, fam := range m {
+			if p < len(l) && l[p].element >= 0 {
+				if l[p].family == fam {
+					correct[l[p].element]++
+					r.TruePositiveBases++
+					continue
+				}
+			}
+			r.FalsePositiveBases++
+		}
+	}
+	r.FalseNegativeBases = repeatBases - r.TruePositiveBases
+
+	for _, d := range divs {
+		s := scores{Divergence: d}
+		var planted, found int
+		for i, e := range truth {
+			if e.divergence != d {
+				continue
+			}
+			s.Elements++
+			n := e.end - e.start
+			planted += n
+			found += correct[i]
+			if float64(correct[i]) >= detect*float64(n) {
+				s.Detected++
+			}
+		}
+		if s.Elements != 0 {
+			s.Sensitivity = float64(s.Detected) / float64(s.Elements)
+		}
+		if planted != 0 {
+			s.BaseSensitivity = float64(found) / float64(planted)
+		}
+		r.ByDivergence = append(r.ByDivergence, s)
+	}
+
+	if background := genome - repeatBases; background > 0 {
+		var wrongPlace int
+		for seq, m := range called {
+			l := planted[seq]
+			for p := range m {
+				if p >= len(l) || l[p].element < 0 {
+					wrongPlace++
+				}
+			}
+		}
+		r.Specificity = 1 - float64(wrongPlace)/float64(background)
+	}
+	if annotated := r.TruePositiveBases + r.FalsePositiveBases; annotated != 0 {
+		r.Precision = float64(r.TruePositiveBases) / float64(annotated)
+	}
+	return r
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,770 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ins-convert program converts the JSON feature output of ins to other
+// annotation formats without re-running the pipeline. It reads the JSON
+// stream written by ins -json or -json-array from stdin, or the files given
+// as arguments, and writes the features to stdout in GTF, GFF3, BED, UCSC
+// rmsk table or RepeatMasker .out format.
+//
+// Attributes follow the conventions of the ins GTF output. Family classes
+// and consensus lengths are taken from the libraries given with -lib, or
+// from the JSON output when a family is not in the libraries. Without
+// either, families have the Unknown class and the unaligned remainder of
+// the consensus is reported as zero. The rmsk
+// and .out formats report the remainder of the genomic sequence after each
+// annotation and need the sequence lengths given by -sizes, a chrom.sizes
+// file or fasta index.
+//
+// usage: ins-convert -format gff3 -lib library.fa <out.json >out.gff3
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// unknownClass is the class of families without a class in the library.
+const unknownClass = "Unknown"
+
+// sliceValue is a multi-value flag value.
+type sliceValue []string
+
+// Set adds the string to the sliceValue.
+func (s *sliceValue) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// String satisfies the flag.Value interface.
+func (s *sliceValue) String() string {
+	return fmt.Sprintf("%q", []string(*s))
+}
+
+func main() {
+	format := flag.String("format", "gtf", "specify the output format (gtf, gff3, bed, rmsk or out)")
+	var libs sliceValue
+	flag.Var(&libs, "lib", "specify the libraries used for the annotation to obtain family classes and lengths (may be present more than once)")
+	sizes := flag.String("sizes", "", "specify a chrom.sizes file or fasta index giving the query sequence lengths (required for rmsk and out)")
+	rmCoords := flag.Bool("rm-coords", false, "specify that GTF Repeat attribute consensus coordinates are ordered as in RepeatMasker .out files")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage of %[1]s:
+  $ %[1]s [options] [out.json ...] >out.<format>
+
+Options:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var w writer
+	switch *format {
+	case "gtf":
+		w = &gtfWriter{rmCoords: *rmCoords}
+	case "gff3":
+		w = &gff3Writer{}
+	case "bed":
+		w = bedWriter{}
+	case "rmsk":
+		w = rmskWriter{}
+	case "out":
+		w = &outWriter{}
+	default:
+		log.Fatalf("unknown format: %q", *format)
+	}
+	details := make(map[string]detail)
+	for _, path := range libs {
+		err := readLibrary(path, details)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var lengths map[string]int
+	if *sizes != "" {
+		var err error
+		lengths, err = readSizes(*sizes)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *format == "rmsk" || *format == "out" {
+		log.Fatalf("%s format requires sequence lengths: use -sizes", *format)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	c := converter{w: w, out: out, details: details, lengths: lengths}
+	if flag.NArg() == 0 {
+		err := c.convert(os.Stdin, "stdin")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = c.convert(f, path)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := out.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// detail is the class and consensus length of a library family.
+type detail struct {
+	class  string
+	length int
+}
+
+// readLibrary adds the classes and lengths of the sequences in the library
+// fasta file at path to details. The class is the first word after the
+// sequence identifier.
+func readLibrary(path string, details map[string]detail) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var name string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, bufio.MaxScanTokenSize<<8)
+	for sc.Scan() {
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		if b[0] != '>' {
+			d := details[name]
+			d.length += len(b)
+			details[name] = d
+			continue
+		}
+		fields := strings.Fields(string(b[1:]))
+		if len(fields) == 0 {
+			return fmt.Errorf("%s: missing sequence identifier", path)
+		}
+		name = fields[0]
+		var d detail
+		if len(fields) > 1 {
+			d.class = fields[1]
+		}
+		details[name] = d
+	}
+	return sc.Err()
+}
+
+// readSizes returns the sequence lengths in the first two columns of the
+// chrom.sizes file or fasta index at path.
+func readSizes(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lengths := make(map[string]int)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: missing length at line %d", path, line)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid length at line %d: %w", path, line, err)
+		}
+		lengths[fields[0]] = n
+	}
+	return lengths, sc.Err()
+}
+
+// record is a feature of the ins JSON output. It holds the fields of all
+// the kinds of feature written by ins.
+type record struct {
+	blast.Record
+
+	// Header is the provenance header
+	// at the start of the output.
+	Header *header `json:"ins"`
+
+	// Library fields.
+	Class           string
+	ConsensusLength int
+
+	// Truncated is the number of forward
+	// hits omitted from the merged region
+	// that gave the hit.
+	Truncated int
+
+	// Annotation fields.
+	ReferenceCopy bool
+	Screen        string
+	GeneOverlap   string
+	NearestGene   string
+	GeneDistance  *int
+
+	// Secondary assignment fields.
+	Primary    string
+	Rank       int
+	ScoreRatio float64
+
+	// Tandem array fields.
+	Feature string
+	Period  int
+	Unit    string
+	Copies  float64
+}
+
+// header is the provenance of an annotation set.
+type header struct {
+	Version     string    `json:"version"`
+	Mode        string    `json:"mode"`
+	Libraries   []string  `json:"libraries"`
+	Date        time.Time `json:"date"`
+	CommandLine []string  `json:"command_line"`
+}
+
+// kind returns the feature type of r.
+func (r *record) kind() string {
+	switch {
+	case r.Feature != "":
+		return r.Feature
+	case r.Primary != "":
+		return "secondary_repeat"
+	case r.Screen != "":
+		return r.Screen
+	case r.ReferenceCopy:
+		return "reference_copy"
+	}
+	return "repeat"
+}
+
+// converter converts ins JSON output with a writer.
+type converter struct {
+	w       writer
+	out     *bufio.Writer
+	details map[string]detail
+	lengths map[string]int
+	headed  bool
+}
+
+// convert converts the JSON stream read from r, named name. The stream
+// may be newline-delimited JSON or a single JSON array.
+func (c *converter) convert(r io.Reader, name string) error {
+	br := bufio.NewReader(r)
+	array, err := isArray(br)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	dec := json.NewDecoder(br)
+	if array {
+		_, err = dec.Token()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for n := 1; ; n++ {
+		if array && !dec.More() {
+			_, err = dec.Token()
+			if err != nil {
+				return fmt.Errorf("%s: unterminated feature array: %w", name, err)
+			}
+			return nil
+		}
+		var rec record
+		err = dec.Decode(&rec)
+		if err != nil {
+			if err == io.EOF && !array {
+				return nil
+			}
+			return fmt.Errorf("%s: invalid feature %d: %w", name, n, err)
+		}
+		if rec.Header != nil {
+			if !c.headed {
+				err = c.w.header(c.out, *rec.Header)
+				if err != nil {
+					return err
+				}
+				c.headed = true
+			}
+			continue
+		}
+		if rec.SubjectAccVer == "" {
+			return fmt.Errorf("%s: feature %d has no sequence", name, n)
+		}
+		repeat, ok := c.details[rec.QueryAccVer]
+		if !ok {
+			repeat = detail{class: rec.Class, length: rec.ConsensusLength}
+		}
+		err = c.w.write(c.out, &rec, repeat, c.lengths[rec.SubjectAccVer])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isArray returns whether the first non-space byte of r opens a JSON
+// array, without consuming it.
+func isArray(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0] == '[', nil
+		}
+	}
+}
+
+// writer writes features in an output format.
+type writer interface {
+	// header writes the provenance header h.
+	header(w io.Writer, h header) error
+
+	// write writes r, a hit to a family with
+	// the given details on a sequence of the
+	// given length.
+	write(w io.Writer, r *record, repeat detail, length int) error
+}
+
+// span returns the zero-based half-open genomic interval of r.
+func span(r *record) (left, right int) {
+	if r.SubjectEnd < r.SubjectStart {
+		return r.SubjectEnd, r.SubjectStart
+	}
+	return r.SubjectStart, r.SubjectEnd
+}
+
+// consensusSpan is the position of an alignment in a consensus sequence.
+// The begin and end fields are one-based and left is the number of bases
+// of the consensus after end.
+type consensusSpan struct {
+	begin, end, left int
+}
+
+// consensusCoords returns the position of the alignment r in a consensus
+// of the given length, or of the length recorded in r if length is zero.
+func consensusCoords(r *record, length int) consensusSpan {
+	if length == 0 {
+		length = r.QueryLength
+	}
+	start, end := r.QueryStart, r.QueryEnd
+	if end < start {
+		start, end = end, start
+	}
+	left := length - end
+	if left < 0 {
+		left = 0
+	}
+	return consensusSpan{begin: start + 1, end: end, left: left}
+}
+
+// String returns the span formatted as begin, end and left.
+func (c consensusSpan) String() string {
+	return fmt.Sprintf("%d %d %d", c.begin, c.end, c.left)
+}
+
+// repeatMasker returns the span formatted as in RepeatMasker .out files
+// for an alignment on the given strand.
+func (c consensusSpan) repeatMasker(strand int8) string {
+	if strand < 0 {
+		return fmt.Sprintf("(%d) %d %d", c.left, c.end, c.begin)
+	}
+	return fmt.Sprintf("%d %d (%d)", c.begin, c.end, c.left)
+}
+
+// stableID returns the ins stable identifier of r.
+func stableID(r *record) string {
+	left, right := span(r)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\t%d\t%d\t%s\t%d", r.SubjectAccVer, left, right, r.QueryAccVer, r.Strand)
+	return "ins-" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// className returns the class of repeat, or unknownClass if it has none.
+func className(repeat detail) string {
+	if repeat.class == "" {
+		return unknownClass
+	}
+	return repeat.class
+}
+
+// gtfWriter writes features as ins GTF.
+type gtfWriter struct {
+	rmCoords bool
+	enc      *gff.Writer
+}
+
+// encoder returns the GTF writer for w.
+func (g *gtfWriter) encoder(w io.Writer) *gff.Writer {
+	if g.enc == nil {
+		g.enc = gff.NewWriter(w, 60, true)
+	}
+	return g.enc
+}
+
+func (g *gtfWriter) header(w io.Writer, h header) error {
+	enc := g.encoder(w)
+	_, err := enc.WriteMetaData("source-version ins " + h.Version)
+	if err != nil {
+		return err
+	}
+	_, err = enc.WriteMetaData(h.Date)
+	if err != nil {
+		return err
+	}
+	_, err = enc.WriteComment("mode: " + h.Mode)
+	if err != nil {
+		return err
+	}
+	for _, l := range h.Libraries {
+		_, err = enc.WriteComment("library: " + l)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = enc.WriteComment("command: " + strings.Join(h.CommandLine, " "))
+	return err
+}
+
+func (g *gtfWriter) write(w io.Writer, r *record, repeat detail, _ int) error {
+	left, right := span(r)
+	feat := &gff.Feature{
+		SeqName:    r.SubjectAccVer,
+		Source:     "ins",
+		Feature:    r.kind(),
+		FeatStart:  left,
+		FeatEnd:    right,
+		FeatScore:  &r.BitScore,
+		FeatStrand: seq.Strand(r.Strand),
+		FeatFrame:  gff.NoFrame,
+	}
+	if r.Feature != "" {
+		feat.FeatScore = &r.PctIdentity
+		feat.FeatAttributes = gff.Attributes{
+			{Tag: "Period", Value: fmt.Sprint(r.Period)},
+			{Tag: "Unit", Value: r.Unit},
+			{Tag: "Copies", Value: fmt.Sprintf("%.1f", r.Copies)},
+		}
+	} else {
+		span := consensusCoords(r, repeat.length)
+		pos := span.String()
+		if g.rmCoords {
+			pos = span.repeatMasker(r.Strand)
+		}
+		feat.FeatAttributes = gff.Attributes{
+			{Tag: "Repeat", Value: fmt.Sprintf("%s %s %s", r.QueryAccVer, repeat.class, pos)},
+			{Tag: "ID", Value: stableID(r)},
+			{Tag: "UID", Value: fmt.Sprint(r.UID)},
+			{Tag: "SumScore", Value: fmt.Sprintf("%.4f", r.SumScore)},
+		}
+		if r.Truncated != 0 {
+			feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "Truncated", Value: fmt.Sprint(r.Truncated)})
+		}
+		if r.GeneOverlap != "" {
+			feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "GeneOverlap", Value: r.GeneOverlap})
+			if r.NearestGene != "" && r.GeneDistance != nil {
+				feat.FeatAttributes = append(feat.FeatAttributes,
+					gff.Attribute{Tag: "NearestGene", Value: r.NearestGene},
+					gff.Attribute{Tag: "GeneDistance", Value: fmt.Sprint(*r.GeneDistance)},
+				)
+			}
+		}
+		if r.Primary != "" {
+			feat.FeatAttributes = append(feat.FeatAttributes,
+				gff.Attribute{Tag: "Rank", Value: fmt.Sprint(r.Rank)},
+				gff.Attribute{Tag: "ScoreRatio", Value: fmt.Sprintf("%.4f", r.ScoreRatio)},
+				gff.Attribute{Tag: "Primary", Value: r.Primary},
+			)
+		}
+	}
+	_, err := g.encoder(w).Write(feat)
+	if err != nil {
+		return fmt.Errorf("failed to write feature: %w", err)
+	}
+	return nil
+}
+
+// gff3Writer writes features as GFF3. Repeat families are given as the
+// Name and Target attributes, with the consensus coordinates of the
+// alignment in the Target.
+type gff3Writer struct {
+	headed bool
+}
+
+// start writes the GFF3 version pragma if it has not been written.
+func (g *gff3Writer) start(w io.Writer) error {
+	if g.headed {
+		return nil
+	}
+	g.headed = true
+	_, err := fmt.Fprintln(w, "##gff-version 3")
+	return err
+}
+
+func (g *gff3Writer) header(w io.Writer, h header) error {
+	err := g.start(w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "#!source-version ins %s\n", h.Version)
+	fmt.Fprintf(w, "# mode: %s\n", h.Mode)
+	for _, l := range h.Libraries {
+		fmt.Fprintf(w, "# library: %s\n", l)
+	}
+	_, err = fmt.Fprintf(w, "# command: %s\n", strings.Join(h.CommandLine, " "))
+	return err
+}
+
+func (g *gff3Writer) write(w io.Writer, r *record, repeat detail, _ int) error {
+	err := g.start(w)
+	if err != nil {
+		return err
+	}
+	left, right := span(r)
+	score := r.BitScore
+	var attrs []string
+	attr := func(tag, val string) {
+		attrs = append(attrs, tag+"="+gff3Escape(val))
+	}
+	if r.Feature != "" {
+		score = r.PctIdentity
+		attr("Period", fmt.Sprint(r.Period))
+		attr("Unit", r.Unit)
+		attr("Copies", fmt.Sprintf("%.1f", r.Copies))
+	} else {
+		span := consensusCoords(r, repeat.length)
+		strand := "+"
+		if r.Strand < 0 {
+			strand = "-"
+		}
+		attr("ID", stableID(r))
+		attr("Name", r.QueryAccVer)
+		attrs = append(attrs, fmt.Sprintf("Target=%s %d %d %s", gff3Escape(r.QueryAccVer), span.begin, span.end, strand))
+		attr("Class", className(repeat))
+		attr("UID", fmt.Sprint(r.UID))
+		attr("SumScore", fmt.Sprintf("%.4f", r.SumScore))
+		if r.Truncated != 0 {
+			attr("Truncated", fmt.Sprint(r.Truncated))
+		}
+		if r.GeneOverlap != "" {
+			attr("GeneOverlap", r.GeneOverlap)
+			if r.NearestGene != "" && r.GeneDistance != nil {
+				attr("NearestGene", r.NearestGene)
+				attr("GeneDistance", fmt.Sprint(*r.GeneDistance))
+			}
+		}
+		if r.Primary != "" {
+			attr("Rank", fmt.Sprint(r.Rank))
+			attr("ScoreRatio", fmt.Sprintf("%.4f", r.ScoreRatio))
+			attr("Primary", r.Primary)
+		}
+	}
+	_, err = fmt.Fprintf(w, "%s\tins\t%s\t%d\t%d\t%g\t%s\t.\t%s\n",
+		gff3Escape(r.SubjectAccVer), r.kind(), left+1, right, score, strandString(r.Strand), strings.Join(attrs, ";"))
+	return err
+}
+
+// gff3Escape returns s with the characters reserved in GFF3 columns and
+// attribute values escaped.
+func gff3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c < 0x20, c == 0x7f, c == '%', c == ';', c == '=', c == '&', c == ',', c == '\t':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// strandString returns the GFF strand character of strand.
+func strandString(strand int8) string {
+	switch {
+	case strand > 0:
+		return "+"
+	case strand < 0:
+		return "-"
+	}
+	return "."
+}
+
+// bedWriter writes features as BED6 with the family as the name and the
+// bit score, capped at 1000, as the score. Tandem arrays are named by
+// their feature type.
+type bedWriter struct{}
+
+func (bedWriter) header(io.Writer, header) error { return nil }
+
+func (bedWriter) write(w io.Writer, r *record, _ detail, _ int) error {
+	left, right := span(r)
+	name := r.QueryAccVer
+	if r.Feature != "" {
+		name = r.Feature
+	}
+	score := int(math.Round(r.BitScore))
+	if score > 1000 {
+		score = 1000
+	}
+	_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%s\n", r.SubjectAccVer, left, right, name, score, strandString(r.Strand))
+	return err
+}
+
+// rmskWriter writes repeat features as rows of the UCSC rmsk table in the
+// same form as ins -rmsk. Secondary assignments and tandem arrays are not
+// written.
+type rmskWriter struct{}
+
+func (rmskWriter) header(io.Writer, header) error { return nil }
+
+func (rmskWriter) write(w io.Writer, r *record, repeat detail, length int) error {
+	if r.Feature != "" || r.Primary != "" {
+		return nil
+	}
+	start, end := span(r)
+	class, family := rmskClass(repeat.class)
+	span := consensusCoords(r, repeat.length)
+	strand := "+"
+	repStart := span.begin
+	repEnd := span.end
+	repLeft := -span.left
+	if r.Strand < 0 {
+		strand = "-"
+		repStart, repLeft = repLeft, repStart
+	}
+	_, err := fmt.Fprintf(w, "%d\t%d\t%d\t0\t0\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+		ucscBin(start, end),
+		int(math.Round(r.BitScore)),
+		int(math.Round(10*(100-r.PctIdentity))),
+		r.SubjectAccVer, start, end, -(length - end),
+		strand,
+		r.QueryAccVer, class, family,
+		repStart, repEnd, repLeft,
+		r.UID,
+	)
+	return err
+}
+
+// rmskClass returns the rmsk repClass and repFamily for a RepeatMasker
+// library class. Classes without a family use the class as the family.
+func rmskClass(c string) (class, family string) {
+	if c == "" {
+		c = unknownClass
+	}
+	i := strings.Index(c, "/")
+	if i < 0 {
+		return c, c
+	}
+	return c[:i], strings.ReplaceAll(c[i+1:], "/", "_")
+}
+
+// ucscBin returns the UCSC bin for the zero-based half-open interval
+// [start, end), using the extended binning scheme for intervals ending
+// beyond 512Mb.
+func ucscBin(start, end int) int {
+	const (
+		firstShift = 17
+		nextShift  = 3
+
+		// extendedBase is the offset of the first
+		// bin of the extended binning scheme.
+		extendedBase = 4681
+	)
+	base := 0
+	offsets := []int{512 + 64 + 8 + 1, 64 + 8 + 1, 8 + 1, 1, 0}
+	if end > 1<<29 {
+		base = extendedBase
+		offsets = []int{4096 + 512 + 64 + 8 + 1, 512 + 64 + 8 + 1, 64 + 8 + 1, 8 + 1, 1, 0}
+	}
+	start >>= firstShift
+	end = (end - 1) >> firstShift
+	for _, off := range offsets {
+		if start == end {
+			return base + off + start
+		}
+		start >>= nextShift
+		end >>= nextShift
+	}
+	return base
+}
+
+// outWriter writes repeat features in RepeatMasker .out format. BLAST does
+// not distinguish insertions from deletions, so the percent deletion and
+// insertion columns are reported as zero. Secondary assignments and tandem
+// arrays are not written.
+type outWriter struct {
+	headed bool
+}
+
+// start writes the column headings if they have not been written.
+func (o *outWriter) start(w io.Writer) error {
+	if o.headed {
+		return nil
+	}
+	o.headed = true
+	_, err := fmt.Fprint(w, `   SW   perc perc perc  query      position in query           matching       repeat              position  in  repeat
+score   div. del. ins.  sequence    begin     end    (left)    repeat         class/family         begin  end (left)   ID
+
+`)
+	return err
+}
+
+func (o *outWriter) header(w io.Writer, _ header) error { return o.start(w) }
+
+func (o *outWriter) write(w io.Writer, r *record, repeat detail, length int) error {
+	err := o.start(w)
+	if err != nil {
+		return err
+	}
+	if r.Feature != "" || r.Primary != "" {
+		return nil
+	}
+	start, end := span(r)
+	strand := "+"
+	if r.Strand < 0 {
+		strand = "C"
+	}
+	_, err = fmt.Fprintf(w, "%6d %5.1f %4.1f %4.1f  %-10s %8d %8d %9s  %s  %-14s %-20s %s %6d\n",
+		int(math.Round(r.BitScore)),
+		100-r.PctIdentity, 0.0, 0.0,
+		r.SubjectAccVer, start+1, end, fmt.Sprintf("(%d)", length-end),
+		strand, r.QueryAccVer, className(repeat),
+		consensusCoords(r, repeat.length).repeatMasker(r.Strand),
+		r.UID,
+	)
+	return err
+}
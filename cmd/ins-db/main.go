@@ -0,0 +1,99 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ins-db program maintains the data stores held in ins working
+// directories.
+//
+// The migrate subcommand upgrades forward.db, regions.db, reverse.db,
+// reverse-unculled.db, culled.db and secondary.db stores written by earlier
+// versions of ins to the current store format so that they may be used with
+// -recover and the pipeline stage subcommands. Each store is migrated in
+// place and the original is retained with an .orig suffix. The kind of the
+// store is determined by its file name unless given with -kind.
+//
+// usage: ins-db migrate [-kind forward|regions|reverse|secondary] <store.db>...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/kortschak/ins/internal/store"
+)
+
+// kindFor is the kind of store held in each named working directory
+// store file.
+var kindFor = map[string]string{
+	"forward.db":          store.Forward,
+	"regions.db":          store.Regions,
+	"reverse.db":          store.Reverse,
+	"reverse-unculled.db": store.Reverse,
+	"culled.db":           store.Reverse,
+	"secondary.db":        store.Secondary,
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("ins-db: ")
+	if len(os.Args) < 2 || os.Args[1] != "migrate" {
+		fmt.Fprintln(os.Stderr, "usage: ins-db migrate [-kind forward|regions|reverse|secondary] <store.db>...")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	kind := flags.String("kind", "", "specify the kind of the stores (default determined by file name)")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range flags.Args() {
+		k := *kind
+		if k == "" {
+			var ok bool
+			k, ok = kindFor[filepath.Base(path)]
+			if !ok {
+				log.Fatalf("cannot determine kind of %s: use -kind", path)
+			}
+		}
+		n, err := migrate(path, k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("migrated %d records in %s", n, path)
+	}
+}
+
+// migrate upgrades the store of the given kind at path to the current
+// format, retaining the original at path.orig.
+func migrate(path, kind string) (int, error) {
+	tmp := path + ".migrate"
+	err := os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	n, err := store.Migrate(tmp, path, kind, version())
+	if err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	err = os.Rename(path, path+".orig")
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp, path)
+}
+
+// version returns the module version of the ins-db binary.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+	return info.Main.Version
+}
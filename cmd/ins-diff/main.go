@@ -0,0 +1,335 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The ins-diff program reports repeat insertion polymorphisms between two
+// assemblies. It takes the ins GTF annotations of assemblies a and b and a
+// whole-genome alignment of a to b in PAF format, for example from minimap2,
+// and classifies each annotated element of each assembly by projecting its
+// flanks onto the other assembly.
+//
+// An element whose flanks are adjacent in the other assembly is an insertion
+// present only in its own assembly. An element whose flanks are separated by
+// a distance similar to its length is shared if the other assembly has an
+// annotation of the same family between the flanks, and is otherwise
+// reported as unannotated in the other assembly. Elements whose flanks can
+// not both be projected onto the same sequence and strand are unresolved.
+//
+// Results are written to stdout as tab-separated values with a header line.
+//
+// usage: ins-diff -a a.gtf -b b.gtf -paf a-to-b.paf
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+)
+
+func main() {
+	aFile := flag.String("a", "", "specify the ins GTF annotation of assembly a (required)")
+	bFile := flag.String("b", "", "specify the ins GTF annotation of assembly b (required)")
+	pafFile := flag.String("paf", "", "specify the PAF alignment of assembly a to assembly b (required)")
+	flank := flag.Int("flank", 20, "specify the distance from element ends of projected flanking positions")
+	tol := flag.Float64("tol", 0.2, "specify the tolerance for flank separation as a fraction of element length")
+	flag.Parse()
+	if *aFile == "" || *bFile == "" || *pafFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *flank < 0 || *tol <= 0 || *tol >= 1 {
+		log.Fatal("invalid flank distance or tolerance")
+	}
+
+	a, err := readElements(*aFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := readElements(*bFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	aToB, err := readPAF(*pafFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bToA := aToB.invert()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintln(w, "assembly\tseq\tstart\tend\tstrand\tfamily\tstatus\tother_seq\tother_start\tother_end")
+	for _, side := range []struct {
+		name      string
+		elements  []element
+		other     map[string][]element
+		alignment alignment
+	}{
+		{name: "a", elements: a, other: bySeq(b), alignment: aToB},
+		{name: "b", elements: b, other: bySeq(a), alignment: bToA},
+	} {
+		for _, e := range side.elements {
+			c := classify(e, side.other, side.alignment, *flank, *tol)
+			otherStart, otherEnd := ".", "."
+			if c.otherSeq != "" {
+				otherStart, otherEnd = strconv.Itoa(c.otherStart+1), strconv.Itoa(c.otherEnd)
+			} else {
+				c.otherSeq = "."
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				side.name, e.seq, e.start+1, e.end, strandString(e.strand), e.family,
+				c.status, c.otherSeq, otherStart, otherEnd)
+		}
+	}
+}
+
+// element is an annotated repeat. Coordinates are zero-based half-open.
+type element struct {
+	seq        string
+	start, end int
+	strand     int8
+	family     string
+}
+
+// readElements returns the repeat elements of the ins GTF file at path.
+// Fragments of grouped elements are ignored.
+func readElements(path string) ([]element, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var elements []element
+	sc := featio.NewScanner(gff.NewReader(f))
+	for sc.Next() {
+		feat := sc.Feat().(*gff.Feature)
+		if feat.Feature != "repeat" {
+			continue
+		}
+		fields := strings.Fields(feat.FeatAttributes.Get("Repeat"))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing repeat attribute: %v", feat)
+		}
+		elements = append(elements, element{
+			seq:    feat.SeqName,
+			start:  feat.FeatStart,
+			end:    feat.FeatEnd,
+			strand: int8(feat.FeatStrand),
+			family: fields[0],
+		})
+	}
+	return elements, sc.Error()
+}
+
+// bySeq returns the elements grouped by sequence and sorted by start.
+func bySeq(elements []element) map[string][]element {
+	m := make(map[string][]element)
+	for _, e := range elements {
+		m[e.seq] = append(m[e.seq], e)
+	}
+	for _, s := range m {
+		sort.Slice(s, func(i, j int) bool { return s[i].start < s[j].start })
+	}
+	return m
+}
+
+// block is an aligned block between a source and a target sequence.
+// Coordinates are zero-based half-open.
+type block struct {
+	src, dst         string
+	srcStart, srcEnd int
+	dstStart, dstEnd int
+	strand           int8
+}
+
+// alignment is a set of aligned blocks grouped by source sequence and
+// sorted by source start.
+type alignment map[string][]block
+
+// readPAF returns the alignment blocks in the PAF file at path.
+func readPAF(path string) (alignment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	aln := make(alignment)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<26)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 12 {
+			return nil, fmt.Errorf("%s:%d: too few PAF fields", path, line)
+		}
+		var (
+			b    block
+			nums [4]int
+		)
+		for i, col := range []int{2, 3, 7, 8} {
+			nums[i], err = strconv.Atoi(fields[col])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		b.src, b.dst = fields[0], fields[5]
+		b.srcStart, b.srcEnd, b.dstStart, b.dstEnd = nums[0], nums[1], nums[2], nums[3]
+		switch fields[4] {
+		case "+":
+			b.strand = 1
+		case "-":
+			b.strand = -1
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid strand %q", path, line, fields[4])
+		}
+		aln[b.src] = append(aln[b.src], b)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	aln.sort()
+	return aln, nil
+}
+
+func (a alignment) sort() {
+	for _, s := range a {
+		sort.Slice(s, func(i, j int) bool { return s[i].srcStart < s[j].srcStart })
+	}
+}
+
+// invert returns the alignment with source and target exchanged.
+func (a alignment) invert() alignment {
+	inv := make(alignment)
+	for _, blocks := range a {
+		for _, b := range blocks {
+			inv[b.dst] = append(inv[b.dst], block{
+				src: b.dst, dst: b.src,
+				srcStart: b.dstStart, srcEnd: b.dstEnd,
+				dstStart: b.srcStart, dstEnd: b.srcEnd,
+				strand: b.strand,
+			})
+		}
+	}
+	inv.sort()
+	return inv
+}
+
+// project returns the position in the target of pos in the source sequence
+// seq using the longest block containing pos. The position within a block
+// is interpolated linearly.
+func (a alignment) project(seq string, pos int) (dst string, dstPos int, strand int8, ok bool) {
+	blocks := a[seq]
+	n := sort.Search(len(blocks), func(i int) bool { return blocks[i].srcStart > pos })
+	var best *block
+	for i := n - 1; i >= 0; i-- {
+		b := &blocks[i]
+		if pos < b.srcEnd && (best == nil || b.srcEnd-b.srcStart > best.srcEnd-best.srcStart) {
+			best = b
+		}
+	}
+	if best == nil {
+		return "", 0, 0, false
+	}
+	off := int(float64(pos-best.srcStart) * float64(best.dstEnd-best.dstStart) / float64(best.srcEnd-best.srcStart))
+	if best.strand < 0 {
+		return best.dst, best.dstEnd - 1 - off, best.strand, true
+	}
+	return best.dst, best.dstStart + off, best.strand, true
+}
+
+// class is the polymorphism classification of an element.
+type class struct {
+	status               string
+	otherSeq             string
+	otherStart, otherEnd int
+}
+
+// Element polymorphism status values.
+const (
+	present     = "present"     // Only present in the element's assembly.
+	shared      = "shared"      // Present in both assemblies.
+	unannotated = "unannotated" // Sequence present but not annotated in the other assembly.
+	unresolved  = "unresolved"  // Flanks could not be projected consistently.
+)
+
+// classify returns the classification of e with respect to the elements of
+// the other assembly using the alignment to the other assembly.
+func classify(e element, other map[string][]element, aln alignment, flank int, tol float64) class {
+	lseq, lpos, lstrand, lok := aln.project(e.seq, e.start-1-flank)
+	rseq, rpos, rstrand, rok := aln.project(e.seq, e.end+flank)
+	if !lok || !rok || lseq != rseq || lstrand != rstrand {
+		return class{status: unresolved}
+	}
+	if lstrand < 0 {
+		lpos, rpos = rpos, lpos
+	}
+
+	// The projected positions are separated by the
+	// flanking sequence in addition to any sequence
+	// corresponding to the element.
+	start, end := lpos+flank+1, rpos-flank
+	length := e.end - e.start
+	slack := int(tol * float64(length))
+	switch inserted := end - start; {
+	case inserted < -slack:
+		return class{status: unresolved}
+	case inserted < slack:
+		return class{status: present, otherSeq: lseq, otherStart: start, otherEnd: start}
+	case abs(inserted-length) <= slack:
+		c := class{status: unannotated, otherSeq: lseq, otherStart: start, otherEnd: end}
+		for _, o := range other[lseq] {
+			if o.start >= end {
+				break
+			}
+			if o.family == e.family && overlap(o, start, end) >= (1-tol)*float64(min(o.end-o.start, inserted)) {
+				c.status = shared
+				break
+			}
+		}
+		return c
+	default:
+		return class{status: unresolved}
+	}
+}
+
+// overlap returns the number of bases of e within [start, end).
+func overlap(e element, start, end int) float64 {
+	return float64(min(e.end, end) - max(e.start, start))
+}
+
+func strandString(s int8) string {
+	switch {
+	case s > 0:
+		return "+"
+	case s < 0:
+		return "-"
+	}
+	return "."
+}
+
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,248 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/seq/linear"
+	"github.com/biogo/hts/fai"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// liftover is a component to object coordinate mapping obtained from an
+// AGP file.
+type liftover struct {
+	// objects is the ordered set of objects described by the AGP.
+	objects []string
+	// partsOf holds the parts of each object in order.
+	partsOf map[string][]agpPart
+	// placed holds the placement of each component in an object.
+	placed map[string][]agpPart
+}
+
+// agpPart is a single AGP line. Coordinates are zero-based half-open.
+type agpPart struct {
+	object           string
+	objStart, objEnd int
+
+	// gap is true for N and U component types.
+	gap bool
+
+	component          string
+	compStart, compEnd int
+	strand             int8
+}
+
+// readAGP reads an AGP v2 file from the provided path.
+func readAGP(path string) (*liftover, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := liftover{
+		partsOf: make(map[string][]agpPart),
+		placed:  make(map[string][]agpPart),
+	}
+	sc := bufio.NewScanner(f)
+	var line int
+	for sc.Scan() {
+		line++
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 || b[0] == '#' {
+			continue
+		}
+		fields := strings.Split(string(b), "\t")
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("agp: too few fields at line %d: %q", line, b)
+		}
+		var p agpPart
+		p.object = fields[0]
+		p.objStart, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("agp: invalid object start at line %d: %w", line, err)
+		}
+		p.objStart-- // Use zero-based indexing internally.
+		p.objEnd, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("agp: invalid object end at line %d: %w", line, err)
+		}
+		switch fields[4] {
+		case "N", "U":
+			p.gap = true
+		default:
+			if len(fields) < 9 {
+				return nil, fmt.Errorf("agp: too few fields at line %d: %q", line, b)
+			}
+			p.component = fields[5]
+			p.compStart, err = strconv.Atoi(fields[6])
+			if err != nil {
+				return nil, fmt.Errorf("agp: invalid component start at line %d: %w", line, err)
+			}
+			p.compStart-- // Use zero-based indexing internally.
+			p.compEnd, err = strconv.Atoi(fields[7])
+			if err != nil {
+				return nil, fmt.Errorf("agp: invalid component end at line %d: %w", line, err)
+			}
+			if p.compEnd-p.compStart != p.objEnd-p.objStart {
+				return nil, fmt.Errorf("agp: component and object lengths differ at line %d", line)
+			}
+			p.strand = 1
+			if fields[8] == "-" {
+				p.strand = -1
+			}
+			l.placed[p.component] = append(l.placed[p.component], p)
+		}
+		if _, ok := l.partsOf[p.object]; !ok {
+			l.objects = append(l.objects, p.object)
+		}
+		l.partsOf[p.object] = append(l.partsOf[p.object], p)
+	}
+	err = sc.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// liftRecord returns r with its subject coordinates lifted from component
+// to object coordinates. If the subject interval of r is not completely
+// placed by the AGP, r is returned unaltered and ok is false.
+func (l *liftover) liftRecord(r blast.Record) (lifted blast.Record, ok bool) {
+	left, right := r.SubjectStart, r.SubjectEnd
+	if right < left {
+		left, right = right, left
+	}
+	for _, p := range l.placed[r.SubjectAccVer] {
+		if left < p.compStart || p.compEnd < right {
+			continue
+		}
+		strand := r.Strand
+		if p.strand < 0 {
+			left, right = p.objStart+p.compEnd-right, p.objStart+p.compEnd-left
+			strand = -strand
+		} else {
+			left, right = p.objStart+left-p.compStart, p.objStart+right-p.compStart
+		}
+		r.SubjectAccVer = p.object
+		r.Strand = strand
+		if strand < 0 {
+			r.SubjectStart, r.SubjectEnd = right, left
+		} else {
+			r.SubjectStart, r.SubjectEnd = left, right
+		}
+		return r, true
+	}
+	return r, false
+}
+
+// objectLengths returns the lengths of the objects described by the AGP.
+func (l *liftover) objectLengths() map[string]int {
+	lengths := make(map[string]int, len(l.objects))
+	for _, obj := range l.objects {
+		parts := l.partsOf[obj]
+		if len(parts) != 0 {
+			lengths[obj] = parts[len(parts)-1].objEnd
+		}
+	}
+	return lengths
+}
+
+// liftFasta writes the object sequences described by the AGP to dst using
+// the component sequences in the fasta file at path. Gaps are filled with N
+// and components that are not placed in any object are written unaltered
+// after the objects.
+func (l *liftover) liftFasta(dst, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	idx, err := fai.NewIndex(src)
+	if err != nil {
+		return err
+	}
+	fa := fai.NewFile(src, idx)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	for _, obj := range l.objects {
+		var b []byte
+		for _, p := range l.partsOf[obj] {
+			if p.gap {
+				b = append(b, bytes.Repeat([]byte{'N'}, p.objEnd-p.objStart)...)
+				continue
+			}
+			s, err := fa.SeqRange(p.component, p.compStart, p.compEnd)
+			if err != nil {
+				return fmt.Errorf("agp: %s: %w", p.component, err)
+			}
+			c, err := ioutil.ReadAll(s)
+			if err != nil {
+				return err
+			}
+			if p.strand < 0 {
+				revComp(c)
+			}
+			b = append(b, c...)
+		}
+		fmt.Fprintf(w, "%60a\n", linear.NewSeq(obj, alphabet.BytesToLetters(b), alphabet.DNAredundant))
+	}
+	var unplaced []string
+	for name := range idx {
+		if _, ok := l.placed[name]; !ok {
+			unplaced = append(unplaced, name)
+		}
+	}
+	sort.Strings(unplaced)
+	for _, name := range unplaced {
+		s, err := fa.Seq(name)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%60a\n", linear.NewSeq(name, alphabet.BytesToLetters(b), alphabet.DNAredundant))
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// revComp reverse complements the DNA sequence in b in place.
+func revComp(b []byte) {
+	for i, j := 0, len(b)-1; i <= j; i, j = i+1, j-1 {
+		b[i], b[j] = complement(b[j]), complement(b[i])
+	}
+}
+
+// complement returns the complement of the IUPAC nucleotide c, preserving
+// case. Bytes that are not nucleotide letters are returned unaltered.
+func complement(c byte) byte {
+	l, ok := alphabet.DNAredundant.Complement(alphabet.Letter(c))
+	if !ok {
+		return c
+	}
+	return byte(l)
+}
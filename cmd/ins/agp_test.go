@@ -0,0 +1,354 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// testAGP places ctgA on the plus strand and ctgB on the minus strand of
+// scaffold1, and the middle of ctgC and the end of ctgA on scaffold2. The
+// components are separated by gaps.
+const testAGP = `##agp-version	2.0
+# ORGANISM: Test
+
+scaffold1	1	10	1	W	ctgA	1	10	+
+scaffold1	11	15	2	N	5	scaffold	yes	paired-ends
+scaffold1	16	23	3	W	ctgB	1	8	-
+scaffold2	1	5	1	W	ctgC	3	7	+
+scaffold2	6	15	2	U	10	contig	no	na
+scaffold2	16	20	3	W	ctgA	11	15	+
+`
+
+// testComponents holds the component sequences for testAGP. ctgD is not
+// placed.
+const testComponents = `>ctgA
+ACGTTGCAACGGATC
+>ctgB
+AAACCGGT
+>ctgC
+TTGCATGA
+>ctgD
+CCCC
+`
+
+// readTestAGP writes the AGP text to dir and returns the liftover read
+// from it.
+func readTestAGP(t *testing.T, dir, agp string) (*liftover, error) {
+	t.Helper()
+	path := filepath.Join(dir, "test.agp")
+	err := ioutil.WriteFile(path, []byte(agp), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write AGP: %v", err)
+	}
+	return readAGP(path)
+}
+
+func TestReadAGP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-agp-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := readTestAGP(t, dir, testAGP)
+	if err != nil {
+		t.Fatalf("unexpected error reading AGP: %v", err)
+	}
+
+	var (
+		a1 = agpPart{object: "scaffold1", objStart: 0, objEnd: 10, component: "ctgA", compStart: 0, compEnd: 10, strand: 1}
+		g1 = agpPart{object: "scaffold1", objStart: 10, objEnd: 15, gap: true}
+		b1 = agpPart{object: "scaffold1", objStart: 15, objEnd: 23, component: "ctgB", compStart: 0, compEnd: 8, strand: -1}
+		c2 = agpPart{object: "scaffold2", objStart: 0, objEnd: 5, component: "ctgC", compStart: 2, compEnd: 7, strand: 1}
+		g2 = agpPart{object: "scaffold2", objStart: 5, objEnd: 15, gap: true}
+		a2 = agpPart{object: "scaffold2", objStart: 15, objEnd: 20, component: "ctgA", compStart: 10, compEnd: 15, strand: 1}
+	)
+	want := &liftover{
+		objects: []string{"scaffold1", "scaffold2"},
+		partsOf: map[string][]agpPart{
+			"scaffold1": {a1, g1, b1},
+			"scaffold2": {c2, g2, a2},
+		},
+		placed: map[string][]agpPart{
+			"ctgA": {a1, a2},
+			"ctgB": {b1},
+			"ctgC": {c2},
+		},
+	}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("unexpected liftover:\ngot: %+v\nwant:%+v", l, want)
+	}
+
+	gotLengths := l.objectLengths()
+	wantLengths := map[string]int{"scaffold1": 23, "scaffold2": 20}
+	if !reflect.DeepEqual(gotLengths, wantLengths) {
+		t.Errorf("unexpected object lengths: got:%v want:%v", gotLengths, wantLengths)
+	}
+}
+
+var readAGPErrorTests = []struct {
+	name string
+	agp  string
+	want string
+}{
+	{
+		name: "too few fields",
+		agp:  "scaffold1\t1\t10\t1\tW\tctgA\t1\n",
+		want: `agp: too few fields at line 1: "scaffold1\t1\t10\t1\tW\tctgA\t1"`,
+	},
+	{
+		name: "too few component fields",
+		agp:  "# comment\nscaffold1\t1\t10\t1\tW\tctgA\t1\t10\n",
+		want: `agp: too few fields at line 2: "scaffold1\t1\t10\t1\tW\tctgA\t1\t10"`,
+	},
+	{
+		name: "invalid object start",
+		agp:  "scaffold1\tone\t10\t1\tW\tctgA\t1\t10\t+\n",
+		want: `agp: invalid object start at line 1: strconv.Atoi: parsing "one": invalid syntax`,
+	},
+	{
+		name: "invalid component end",
+		agp:  "scaffold1\t1\t10\t1\tW\tctgA\t1\tten\t+\n",
+		want: `agp: invalid component end at line 1: strconv.Atoi: parsing "ten": invalid syntax`,
+	},
+	{
+		name: "length mismatch",
+		agp:  "scaffold1\t1\t10\t1\tW\tctgA\t1\t10\t+\nscaffold1\t11\t20\t2\tW\tctgB\t1\t11\t-\n",
+		want: "agp: component and object lengths differ at line 2",
+	},
+}
+
+func TestReadAGPErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-agp-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range readAGPErrorTests {
+		l, err := readTestAGP(t, dir, test.agp)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("unexpected error for %s: got:%v want:%s", test.name, err, test.want)
+		}
+		if l != nil {
+			t.Errorf("unexpected liftover for %s: %+v", test.name, l)
+		}
+	}
+}
+
+// lifted returns a blast.Record for a hit of L1 on the subject id with
+// subject coordinates from start to end. A reverse strand hit has start
+// greater than end.
+func lifted(id string, start, end int) blast.Record {
+	strand := int8(1)
+	if end < start {
+		strand = -1
+	}
+	return blast.Record{
+		QueryAccVer: "L1", QueryStart: 0, QueryEnd: 100,
+		SubjectAccVer: id, SubjectStart: start, SubjectEnd: end, Strand: strand,
+		BitScore: 50,
+	}
+}
+
+var liftRecordTests = []struct {
+	name   string
+	rec    blast.Record
+	want   blast.Record
+	wantOK bool
+}{
+	{
+		name:   "plus component",
+		rec:    lifted("ctgA", 2, 5),
+		want:   lifted("scaffold1", 2, 5),
+		wantOK: true,
+	},
+	{
+		name:   "plus component reverse hit",
+		rec:    lifted("ctgA", 5, 2),
+		want:   lifted("scaffold1", 5, 2),
+		wantOK: true,
+	},
+	{
+		name:   "whole plus component",
+		rec:    lifted("ctgA", 0, 10),
+		want:   lifted("scaffold1", 0, 10),
+		wantOK: true,
+	},
+	{
+		name:   "minus component",
+		rec:    lifted("ctgB", 0, 3),
+		want:   lifted("scaffold1", 23, 20),
+		wantOK: true,
+	},
+	{
+		name:   "minus component reverse hit",
+		rec:    lifted("ctgB", 3, 0),
+		want:   lifted("scaffold1", 20, 23),
+		wantOK: true,
+	},
+	{
+		name:   "whole minus component",
+		rec:    lifted("ctgB", 8, 0),
+		want:   lifted("scaffold1", 15, 23),
+		wantOK: true,
+	},
+	{
+		name:   "partially placed component",
+		rec:    lifted("ctgC", 2, 7),
+		want:   lifted("scaffold2", 0, 5),
+		wantOK: true,
+	},
+	{
+		name:   "second placement",
+		rec:    lifted("ctgA", 14, 11),
+		want:   lifted("scaffold2", 19, 16),
+		wantOK: true,
+	},
+	{
+		name: "spanning placements",
+		rec:  lifted("ctgA", 8, 12),
+		want: lifted("ctgA", 8, 12),
+	},
+	{
+		name: "past component end",
+		rec:  lifted("ctgB", 9, 4),
+		want: lifted("ctgB", 9, 4),
+	},
+	{
+		name: "before placed part",
+		rec:  lifted("ctgC", 1, 5),
+		want: lifted("ctgC", 1, 5),
+	},
+	{
+		name: "after placed part",
+		rec:  lifted("ctgC", 8, 6),
+		want: lifted("ctgC", 8, 6),
+	},
+	{
+		name: "unplaced component",
+		rec:  lifted("ctgD", 0, 4),
+		want: lifted("ctgD", 0, 4),
+	},
+}
+
+func TestLiftRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-agp-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := readTestAGP(t, dir, testAGP)
+	if err != nil {
+		t.Fatalf("unexpected error reading AGP: %v", err)
+	}
+	for _, test := range liftRecordTests {
+		got, ok := l.liftRecord(test.rec)
+		if ok != test.wantOK {
+			t.Errorf("unexpected ok for %s: got:%t want:%t", test.name, ok, test.wantOK)
+		}
+		if got != test.want {
+			t.Errorf("unexpected record for %s:\ngot: %+v\nwant:%+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLiftFasta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-agp-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := readTestAGP(t, dir, testAGP)
+	if err != nil {
+		t.Fatalf("unexpected error reading AGP: %v", err)
+	}
+	src := filepath.Join(dir, "components.fa")
+	err = ioutil.WriteFile(src, []byte(testComponents), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write components: %v", err)
+	}
+	dst := filepath.Join(dir, "objects.fa")
+	err = l.liftFasta(dst, src)
+	if err != nil {
+		t.Fatalf("unexpected error lifting sequences: %v", err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("failed to read lifted sequences: %v", err)
+	}
+
+	// Gaps are filled with N, ctgB is reverse
+	// complemented and the unplaced ctgD is
+	// written after the objects.
+	const want = `>scaffold1
+ACGTTGCAACNNNNNACCGGTTT
+>scaffold2
+GCATGNNNNNNNNNNGGATC
+>ctgD
+CCCC
+`
+	if string(got) != want {
+		t.Errorf("unexpected lifted sequences:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLiftFastaMissingComponent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-agp-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := readTestAGP(t, dir, testAGP)
+	if err != nil {
+		t.Fatalf("unexpected error reading AGP: %v", err)
+	}
+	src := filepath.Join(dir, "components.fa")
+	err = ioutil.WriteFile(src, []byte(">ctgA\nACGTTGCAACGGATC\n"), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write components: %v", err)
+	}
+	err = l.liftFasta(filepath.Join(dir, "objects.fa"), src)
+	if err == nil || !strings.HasPrefix(err.Error(), "agp: ctgB: ") {
+		t.Errorf("unexpected error for missing component: got:%v want prefix:%s", err, "agp: ctgB: ")
+	}
+}
+
+var revCompTests = []struct {
+	seq  string
+	want string
+}{
+	{seq: "", want: ""},
+	{seq: "A", want: "T"},
+	{seq: "AC", want: "GT"},
+	{seq: "ACG", want: "CGT"},
+	{seq: "ACGT", want: "ACGT"},
+	{seq: "AACGTN", want: "NACGTT"},
+	{seq: "acgtn", want: "nacgt"},
+	{seq: "AcgT", want: "AcgT"},
+	{seq: "RYKMSWBDHV", want: "BDHVWSKMRY"},
+	{seq: "A-C*", want: "*G-T"},
+}
+
+func TestRevComp(t *testing.T) {
+	for _, test := range revCompTests {
+		b := []byte(test.seq)
+		revComp(b)
+		if string(b) != test.want {
+			t.Errorf("unexpected reverse complement of %q: got:%q want:%q", test.seq, b, test.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+
+	"modernc.org/kv"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/seq/linear"
+	"github.com/biogo/hts/fai"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// anyFamily is the family of merged regions grouped across families.
+// Hits of all families on either strand are reported for these regions.
+const anyFamily = "*"
+
+// genomeSpan is a merged region of a subject sequence without a family
+// or strand.
+type genomeSpan struct {
+	subject     string
+	left, right int
+
+	// omitted is the number of forward hits
+	// omitted from the merged regions of the
+	// span by the region hit cap.
+	omitted int
+}
+
+// mergeAcrossFamilies returns the merged regions in db joined into spans
+// where they overlap, irrespective of their family and strand. The spans
+// are sorted by subject and position.
+func mergeAcrossFamilies(db *kv.DB) ([]genomeSpan, error) {
+	var spans []genomeSpan
+	c := store.Iterate(db)
+	for c.Next() {
+		k := c.Key()
+		spans = append(spans, genomeSpan{
+			subject: k.SubjectAccVer,
+			left:    int(k.SubjectLeft),
+			right:   int(k.SubjectRight),
+			omitted: regionOmitted(c.Value()),
+		})
+	}
+	if c.Err() != nil {
+		return nil, c.Err()
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].subject != spans[j].subject {
+			return spans[i].subject < spans[j].subject
+		}
+		return spans[i].left < spans[j].left
+	})
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n != 0 && merged[n-1].subject == s.subject && s.left < merged[n-1].right {
+			last := &merged[n-1]
+			last.right = max(last.right, s.right)
+			last.omitted += s.omitted
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged, nil
+}
+
+// searchAnyFamily searches the merged regions in regions, joined across
+// families by mergeAcrossFamilies, with all the libraries of the pass so
+// that each genomic region is extracted and searched once. The sequences
+// of the regions are read from qfa which is indexed by qidx. Hits are
+// added to dst and the number of hits found is returned. Per-family
+// reciprocal search parameters are not applied.
+func (p pass) searchAnyFamily(dst, regions *kv.DB, qfa *seqCache, qidx fai.Index, dir string) (int, error) {
+	spans, err := mergeAcrossFamilies(regions)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("merged regions into %d regions across families", len(spans))
+
+	var (
+		buf   bytes.Buffer
+		size  groupSize
+		descs = make(map[string]regionDesc)
+		batch int
+		n     int
+	)
+	search := func() error {
+		libraries, err := p.libraries()
+		if err != nil {
+			return err
+		}
+		sizes := map[regionGroup]groupSize{{family: anyFamily}: size}
+		name := fmt.Sprintf("reciprocal-%d", batch)
+		var reported int
+		err = p.saver(dir).saveRegions(name, descs)
+		if err != nil {
+			return err
+		}
+		err = runBlastReport(p.reciprocal, name, &buf, libraries, dir, p.saver(dir), p.mflags, p.bflags, p.maxReport, p.ids, p.logger, func(o *blast.Output) error {
+			recs, skipped := reportBlast([]*blast.Output{o}, descs, sizes, p.verbose)
+			if skipped != 0 {
+				warnf("%s: skipped %d hits to unknown regions", name, skipped)
+			}
+			reported += len(recs)
+			for i := range recs {
+				recs[i].QueryAccVer = p.ids.original(recs[i].QueryAccVer)
+			}
+			err := store.PutAnnotated(dst, recs)
+			if err != nil {
+				return err
+			}
+			return checkMem(p.maxMem)
+		})
+		if err != nil {
+			return err
+		}
+		logFields(fields{"batch": batch, "regions": size.n}, "got %d reciprocal hits for %d regions", reported, size.n)
+		if p.maxTmp != 0 {
+			err = removeDB(filepath.Join(dir, name+"-working"))
+			if err != nil {
+				return err
+			}
+		}
+		n += reported
+		log.Printf("holding %d total remapped hits", n)
+		buf.Reset()
+		size = groupSize{}
+		descs = make(map[string]regionDesc)
+		batch++
+		return nil
+	}
+	for i, g := range spans {
+		left, right := flankRegion(g.left, g.right, p.flank, qidx[g.subject].Length)
+		b, err := qfa.seqRange(g.subject, left, right)
+		if err != nil {
+			return n, err
+		}
+		s := linear.NewSeq(fmt.Sprintf("region_%d", i+1), alphabet.BytesToLetters(b), alphabet.DNAredundant)
+		fmt.Fprintf(&buf, "%60a\n", s)
+		descs[s.ID] = regionDesc{left: left, right: right, group: regionGroup{family: anyFamily}, subject: g.subject, truncated: g.omitted}
+		size.len += int64(len(b))
+		size.n++
+		if size.len >= p.batchSize {
+			err = search()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	if size.n != 0 {
+		err = search()
+	}
+	return n, err
+}
@@ -0,0 +1,273 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// writeBAM writes the annotations in hits as alignments of the genomic
+// copies to their library consensus sequences in the BAM file at path,
+// and a BAM index beside it. Library sequence lengths are given by details
+// and genomic sequences are read from fa. Annotations must carry BLAST
+// traceback operations; annotations without them are skipped. Alignments
+// are sorted by consensus and position.
+func writeBAM(path string, hits []blast.Record, fa *seqCache, details map[string]detail) error {
+	names := make([]string, 0, len(details))
+	for name, d := range details {
+		if d.length != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	refs := make(map[string]*sam.Reference, len(names))
+	refList := make([]*sam.Reference, len(names))
+	for i, name := range names {
+		ref, err := sam.NewReference(name, "", "", details[name].length, nil, nil)
+		if err != nil {
+			return err
+		}
+		refs[name] = ref
+		refList[i] = ref
+	}
+	h, err := sam.NewHeader(nil, refList)
+	if err != nil {
+		return err
+	}
+	h.SortOrder = sam.Coordinate
+	prog := sam.NewProgram("ins", "ins", "", "", insVersion())
+	err = h.AddProgram(prog)
+	if err != nil {
+		return err
+	}
+
+	var (
+		recs    []*sam.Record
+		skipped int
+	)
+	for _, hit := range hits {
+		ref, ok := refs[hit.QueryAccVer]
+		if !ok || hit.BTOP == "" {
+			skipped++
+			continue
+		}
+		rec, err := bamRecord(hit, ref, fa)
+		if err != nil {
+			warnf("skipping alignment of %s to %s: %v", hit.SubjectAccVer, hit.QueryAccVer, err)
+			skipped++
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	if skipped != 0 {
+		log.Printf("skipped %d annotations without alignments for BAM output", skipped)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		ri, rj := recs[i].Ref.ID(), recs[j].Ref.ID()
+		if ri != rj {
+			return ri < rj
+		}
+		return recs[i].Pos < recs[j].Pos
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w, err := bam.NewWriter(f, h, 1)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, rec := range recs {
+		err = w.Write(rec)
+		if err != nil {
+			w.Close()
+			f.Close()
+			return err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return indexBAM(path)
+}
+
+// bamRecord returns the alignment of the genomic copy of hit to the library
+// consensus ref. Genomic copies on the minus strand are reverse complemented
+// and flagged as reversed.
+func bamRecord(hit blast.Record, ref *sam.Reference, fa *seqCache) (*sam.Record, error) {
+	cigar, err := btopCigar(hit.BTOP)
+	if err != nil {
+		return nil, err
+	}
+	start, end := subjectSpan(hit)
+	b, err := fa.seqRange(hit.SubjectAccVer, start, end)
+	if err != nil {
+		return nil, err
+	}
+	seq := bytes.ToUpper(b)
+	if hit.Strand < 0 {
+		revComp(seq)
+	}
+	refLen, readLen := sam.Cigar(cigar).Lengths()
+	if refLen != hit.QueryEnd-hit.QueryStart || readLen != len(seq) {
+		return nil, fmt.Errorf("traceback spans %d library and %d genomic bases for an alignment of %d and %d", refLen, readLen, hit.QueryEnd-hit.QueryStart, len(seq))
+	}
+	qual := make([]byte, len(seq))
+	for i := range qual {
+		qual[i] = 0xff
+	}
+	var aux []sam.Aux
+	for _, a := range []struct {
+		tag string
+		val interface{}
+	}{
+		{tag: "AS", val: int32(math.Round(hit.BitScore))},
+		{tag: "NM", val: int32(btopEdits(hit.BTOP))},
+	} {
+		v, err := sam.NewAux(sam.NewTag(a.tag), a.val)
+		if err != nil {
+			return nil, err
+		}
+		aux = append(aux, v)
+	}
+	name := fmt.Sprintf("%s:%d-%d", hit.SubjectAccVer, start+1, end)
+	rec, err := sam.NewRecord(name, ref, nil, hit.QueryStart, -1, 0, 255, cigar, seq, qual, aux)
+	if err != nil {
+		return nil, err
+	}
+	if hit.Strand < 0 {
+		rec.Flags |= sam.Reverse
+	}
+	return rec, nil
+}
+
+// btopCigar returns the CIGAR operations of the BLAST traceback operations
+// string b with the library sequence as the reference and the genomic copy
+// as the read. Matches and mismatches are both reported as alignment
+// matches.
+func btopCigar(b string) ([]sam.CigarOp, error) {
+	var (
+		cigar []sam.CigarOp
+		typ   sam.CigarOpType
+		n     int
+	)
+	add := func(t sam.CigarOpType, l int) {
+		if t == typ {
+			n += l
+			return
+		}
+		if n != 0 {
+			cigar = append(cigar, sam.NewCigarOp(typ, n))
+		}
+		typ, n = t, l
+	}
+	for i := 0; i < len(b); {
+		j := i
+		for j < len(b) && '0' <= b[j] && b[j] <= '9' {
+			j++
+		}
+		if j != i {
+			l, err := strconv.Atoi(b[i:j])
+			if err != nil {
+				return nil, err
+			}
+			add(sam.CigarMatch, l)
+			i = j
+			continue
+		}
+		if i+2 > len(b) {
+			return nil, fmt.Errorf("truncated traceback operation at %d: %q", i, b)
+		}
+		switch {
+		case b[i] == '-' && b[i+1] == '-':
+			return nil, fmt.Errorf("invalid traceback operation at %d: %q", i, b)
+		case b[i] == '-':
+			add(sam.CigarInsertion, 1)
+		case b[i+1] == '-':
+			add(sam.CigarDeletion, 1)
+		default:
+			add(sam.CigarMatch, 1)
+		}
+		i += 2
+	}
+	if n != 0 {
+		cigar = append(cigar, sam.NewCigarOp(typ, n))
+	}
+	return cigar, nil
+}
+
+// btopEdits returns the number of mismatched and gapped positions in the
+// BLAST traceback operations string b.
+func btopEdits(b string) int {
+	var n int
+	for i := 0; i < len(b); {
+		if '0' <= b[i] && b[i] <= '9' {
+			i++
+			continue
+		}
+		n++
+		i += 2
+	}
+	return n
+}
+
+// indexBAM writes a BAM index for the coordinate sorted BAM file at path
+// to path.bai.
+func indexBAM(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := bam.NewReader(f, 1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var idx bam.Index
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		err = idx.Add(rec, r.LastChunk())
+		if err != nil {
+			return err
+		}
+	}
+	dst, err := os.Create(path + ".bai")
+	if err != nil {
+		return err
+	}
+	err = bam.WriteIndex(dst, &idx)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -7,8 +7,6 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -22,133 +20,194 @@ import (
 
 	"modernc.org/kv"
 
-	"github.com/biogo/biogo/alphabet"
-	"github.com/biogo/biogo/io/seqio"
-	"github.com/biogo/biogo/io/seqio/fasta"
-	"github.com/biogo/biogo/seq/linear"
-
 	"github.com/kortschak/ins/blast"
 	"github.com/kortschak/ins/internal/store"
 )
 
 const (
-	xmlFmt = 5
-	tabFmt = 6
+	xmlFmt  = 5
+	tabFmt  = 6
+	jsonFmt = 15
 )
 
 // runBlastTabular runs a BLAST search of the sequences in libs against a database
 // constructed from the sequences in query with details from g. The BLAST parameters
-// are provided by search. The strings mflags and bflags are passed to makeblastdb
-// and blastn as flags without interpretation or checking. If logger is not nil,
-// output from the blast executable is written to it.
-func runBlastTabular(search blast.Nucleic, query *os.File, libs []library, mx map[string]fragment, mflags, bflags string, logger io.Writer) (*kv.DB, error) {
+// are provided by search. The arguments in mflags and bflags are passed to
+// makeblastdb and blastn without interpretation or checking. Libraries grouped
+// by splitLibrary are searched with their own parameters. If maskData is not
+// empty, it is used to soft-mask the database constructed from query. If logger
+// is not nil, output from the blast executable is written to it. The iterative
+// search of each library ends when conv is satisfied. Databases of the unmasked
+// query are taken from and added to cache, and the raw output of each iteration
+// is saved by save.
+func runBlastTabular(search blast.Nucleic, query *os.File, libs []library, mx map[string]fragment, maskData string, conv convergence, cache dbCache, save blastSaver, mflags, bflags []string, logger io.Writer) (*kv.DB, error) {
 	search.OutFormat = tabFmt
 
-	opts := &kv.Options{Compare: store.GroupByQueryOrderSubjectLeft}
-	hits, err := kv.Create(filepath.Join(filepath.Dir(query.Name()), "forward.db"), opts)
+	hits, err := store.Create(filepath.Join(filepath.Dir(query.Name()), "forward.db"), store.Forward, insVersion())
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 
-	for _, lib := range libs {
-		working, err := workingFile(query, "-working")
+	for i, lib := range libs {
+		search := search
+		if g, ok := lib.(grouped); ok {
+			search = g.search
+			search.OutFormat = tabFmt
+		}
+		working, err := workingFile(query, query.Name()+"-working")
 		if err != nil {
 			return nil, err
 		}
-		for n := 0; n < maxIters; n++ {
-			mkdb, err := blast.MakeDB{DBType: "nucl", In: working, Out: working, ExtraFlags: mflags}.BuildCommand()
-			if err != nil {
-				return nil, err
+		// Keep the working sequence in memory so that
+		// it is not re-read for each iteration.
+		g, err := readGenome(working)
+		if err != nil {
+			return nil, err
+		}
+		for n := 0; n < conv.maxIters; n++ {
+			mkdb := blast.MakeDB{DBType: "nucl", In: working, Out: working, MaskData: maskData, ExtraArgs: mflags}
+			if n == 0 {
+				err = cache.makeDB(mkdb, logger)
+			} else {
+				// Masked working sequences are not
+				// searched again, so are not cached.
+				err = makeDB(mkdb, logger)
 			}
-			log.Print(mkdb)
-			mkdb.Stdout = logger
-			mkdb.Stderr = logger
-			err = mkdb.Run()
 			if err != nil {
 				return nil, err
 			}
 
 			search.Database = working
+			if maskData != "" {
+				search.DBSoftMask = blast.DustAlgorithmID
+			}
 			search.Query = lib.name()
-			search.ExtraFlags = bflags
-			blastn, err := search.BuildCommand()
+			search.ExtraArgs = bflags
+			var lastHits []blast.Record
+			err = exe.stream(search, stdinLibrary(lib), logger, save.tee(fmt.Sprintf("forward-%d-%d.tsv", i, n), func(r io.Reader) error {
+				var err error
+				lastHits, err = blast.ParseTabularColumns(r, n, search.OutColumns)
+				return warnSkipped(fmt.Sprintf("blast iteration %d of %s", n, lib.name()), err)
+			}))
 			if err != nil {
 				return nil, err
 			}
+			logFields(fields{"library": lib.name(), "iteration": n}, "blast iteration %d found %d new matches", n, len(lastHits))
 
-			log.Print(blastn)
-			blastn.Stdin = lib.stream()
-			blastn.Stderr = logger
-			stdout, err := blastn.StdoutPipe()
-			if err != nil {
-				return nil, err
+			if len(lastHits) == 0 {
+				break
 			}
-			err = blastn.Start()
+
+			log.Printf("masking %s", working)
+			newBases := g.mask(lastHits, 'N')
+			err = g.write(working)
 			if err != nil {
 				return nil, err
 			}
 
-			lastHits, err := blast.ParseTabular(stdout, n)
+			log.Print("remapping coordinates")
+			newHits, err := conv.putHits(hits, remapCoords(lastHits, mx))
 			if err != nil {
 				return nil, err
 			}
-			log.Printf("blast iteration %d found %d new matches", n, len(lastHits))
 
-			err = blastn.Wait()
+			err = lib.reset()
 			if err != nil {
 				return nil, err
 			}
 
-			if len(lastHits) == 0 {
+			if conv.done(newHits, newBases) {
+				logFields(fields{"library": lib.name(), "iteration": n}, "blast iteration %d masked %d new bases: search converged", n, newBases)
 				break
 			}
+		}
+	}
+	return hits, nil
+}
 
-			err = mask(working, lastHits, 'N')
-			if err != nil {
-				return nil, err
-			}
+// convergence holds the criteria for ending an iterative forward search
+// and for discarding hits rediscovered by later iterations. Zero thresholds
+// are not applied.
+type convergence struct {
+	// maxIters is the maximum number
+	// of search iterations.
+	maxIters int
+
+	// minHits and minBases are the minimum
+	// number of hits and newly masked bases
+	// in an iteration for the search to
+	// continue.
+	minHits  int
+	minBases int
+
+	// dedup is the fraction of the length
+	// of a hit overlapped by a stored hit
+	// of the same family on the same strand
+	// for the hit to be discarded.
+	dedup float64
+}
 
-			log.Print("remapping coordinates")
-			remapCoords(lastHits, mx)
-			const batch = 100
-			for i, h := range lastHits {
-				if i%batch == 0 {
-					err = hits.BeginTransaction()
-					if err != nil {
-						return nil, err
-					}
-				}
-				key := store.MarshalBlastRecordKey(h)
-				// Keep a record of the actual hit purely for
-				// correctness auditing; the key has enough
-				// information for what we need.
-				value, err := json.Marshal(h)
-				if err != nil {
-					return nil, err
-				}
-				err = hits.Set(key, value)
-				if err != nil {
-					return nil, err
-				}
-				if i%batch == batch-1 || i == len(lastHits)-1 {
-					err = hits.Commit()
-					if err != nil {
-						return nil, err
-					}
-				}
-			}
+// putHits stores the hits found by a forward search iteration in db,
+// discarding duplicates of stored hits according to c, and returns the
+// number of hits stored.
+func (c convergence) putHits(db *kv.DB, hits []blast.Record) (int, error) {
+	if c.dedup == 0 {
+		return len(hits), store.PutRecords(db, hits)
+	}
+	omitted, err := store.PutNewRecords(db, hits, c.dedup)
+	if omitted != 0 {
+		log.Printf("discarded %d duplicate matches", omitted)
+	}
+	return len(hits) - omitted, err
+}
 
-			err = lib.reset()
-			if err != nil {
-				return nil, err
-			}
+// done returns whether an iteration finding the given number of hits and
+// masking the given number of new bases ends the search.
+func (c convergence) done(hits, bases int) bool {
+	return (c.minHits > 0 && hits < c.minHits) || (c.minBases > 0 && bases < c.minBases)
+}
+
+// dustMask identifies low-complexity regions in the sequences of query using
+// dustmasker, returning the path to the mask data for use with makeblastdb.
+// If logger is not nil, output from dustmasker is written to it.
+func dustMask(query *os.File, logger io.Writer) (string, error) {
+	out := query.Name() + ".dust.asnb"
+	err := exe.run(blast.DustMasker{In: query.Name(), Out: out, OutFormat: "maskinfo_asn1_bin"}, nil, nil, logger)
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// parseDust returns the blastn dust options described by s. An empty
+// s returns nil, leaving the blastn default.
+func parseDust(s string) (*blast.Dust, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "yes":
+		return &blast.Dust{Filter: true}, nil
+	case "no":
+		return &blast.Dust{Filter: false}, nil
+	}
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return nil, fmt.Errorf("invalid dust options: %q", s)
+	}
+	d := blast.Dust{Filter: true}
+	for i, p := range []*int{&d.Level, &d.Window, &d.Linker} {
+		var err error
+		*p, err = strconv.Atoi(f[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid dust options: %q: %w", s, err)
 		}
 	}
-	return hits, nil
+	return &d, nil
 }
 
-func workingFile(src *os.File, suffix string) (name string, err error) {
-	dst, err := os.Create(src.Name() + suffix)
+// workingFile copies the contents of src to a new file with the given name.
+func workingFile(src *os.File, name string) (string, error) {
+	dst, err := os.Create(name)
 	if err != nil {
 		return "", err
 	}
@@ -167,75 +226,99 @@ func workingFile(src *os.File, suffix string) (name string, err error) {
 	return dst.Name(), nil
 }
 
-// runBlastXML runs a BLAST search of the sequences in libs against a database
-// constructed from the sequences in query with details from g. The BLAST parameters
-// are provided by search. The strings mflags and bflags are passed to makeblastdb
-// and blastn as flags without interpretation or checking. Work is done in workdir
+// runBlastReport runs a BLAST search of the sequences in libs against a database
+// named name constructed from the sequences in query. The BLAST parameters
+// are provided by search, which must specify XML or single-file JSON output.
+// The arguments in mflags and bflags are passed to
+// makeblastdb and blastn without interpretation or checking. Work is done in workdir
 // and if logger is not nil, output from the blast executable is written to it.
-func runBlastXML(search blast.Nucleic, g store.BlastRecordKey, query io.Reader, libs []library, workdir, mflags, bflags string, logger io.Writer) ([]*blast.Output, error) {
-	search.OutFormat = xmlFmt
+// Results are streamed to fn one iteration at a time. The raw output of each
+// search is saved by save. If maxReport is not zero, a warning is reported
+// for each library sequence, named by its original identifier in ids, with
+// more than maxReport bytes of output.
+func runBlastReport(search blast.Nucleic, name string, query io.Reader, libs []library, workdir string, save blastSaver, mflags, bflags []string, maxReport int64, ids idMap, logger io.Writer, fn func(*blast.Output) error) error {
+	ext := "xml"
+	newReader := func(r io.Reader) iterationReader { return blast.NewReader(r) }
+	if search.OutFormat == jsonFmt {
+		ext = "json"
+		newReader = func(r io.Reader) iterationReader { return blast.NewJSONReader(r) }
+	}
 
-	working := filepath.Join(workdir, g.QueryAccVer+"-working")
-	mkdb, err := blast.MakeDB{DBType: "nucl", In: "-", Title: g.QueryAccVer, Out: working, ExtraFlags: mflags}.BuildCommand()
+	working := filepath.Join(workdir, name+"-working")
+	seqs, err := ioutil.ReadAll(query)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Printf("%v < <%s %+d matches>", mkdb, g.QueryAccVer, g.Strand)
-	mkdb.Stdin = query
-	mkdb.Stdout = logger
-	mkdb.Stderr = logger
-	err = mkdb.Run()
+	log.Printf("building database %s", name)
+	err = exe.run(blast.MakeDB{DBType: "nucl", In: "-", Title: name, Out: working, ExtraArgs: mflags}, stdinBytes(seqs), nil, logger)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var results []*blast.Output
-	for _, lib := range libs {
+	for i, lib := range libs {
 		search.Database = working
 		search.Query = lib.name()
-		search.ExtraFlags = bflags
-		blastn, err := search.BuildCommand()
+		search.ExtraArgs = bflags
+		out := fmt.Sprintf("%s-%d.%s", name, i, ext)
+		// Results are passed to fn as they are decoded, so
+		// a failed search can not be retried.
+		err = exe.once().stream(search, stdinLibrary(lib), logger, save.tee(out, func(stdout io.Reader) error {
+			r := &countReader{r: stdout}
+			var last int64
+			return streamIterations(newReader(r), func(o *blast.Output) error {
+				// The count includes the read-ahead
+				// of the decoder, so is approximate.
+				size := r.n - last
+				last = r.n
+				if maxReport != 0 && size > maxReport {
+					warnf("reciprocal output for %s in %s exceeds %d bytes: %d bytes", ids.original(*o.Iterations[0].QueryId), out, maxReport, size)
+				}
+				return fn(o)
+			})
+		}))
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+	return nil
+}
 
-		log.Print(blastn)
-		blastn.Stdin = lib.stream()
-		blastn.Stderr = logger
-		stdout, err := blastn.StdoutPipe()
-		if err != nil {
-			return nil, err
-		}
-		err = blastn.Start()
-		if err != nil {
-			return nil, err
-		}
+// iterationReader is a BLAST output reader.
+type iterationReader interface {
+	ReadIteration() (*blast.Iteration, error)
+}
 
-		dec := xml.NewDecoder(stdout)
-		var o blast.Output
-		err = dec.Decode(&o)
+// streamIterations reads BLAST iterations from r, passing each
+// iteration with hits to fn as a single iteration blast.Output.
+func streamIterations(r iterationReader, fn func(*blast.Output) error) error {
+	for {
+		it, err := r.ReadIteration()
 		if err != nil {
-			return nil, err
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
-
-		err = blastn.Wait()
+		if len(it.Hits) == 0 || it.QueryId == nil {
+			continue
+		}
+		err = fn(&blast.Output{Iterations: []blast.Iteration{*it}})
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
+}
 
-		i := 0
-		for _, it := range o.Iterations {
-			if len(it.Hits) == 0 || it.QueryId == nil {
-				continue
-			}
-			o.Iterations[i] = it
-			i++
-		}
-		o.Iterations = o.Iterations[:i]
+// countReader is an io.Reader that counts the bytes read from it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
 
-		results = append(results, &o)
-	}
-	return results, nil
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
 }
 
 var hitID int64
@@ -245,81 +328,140 @@ func nextID() int64 {
 	return hitID
 }
 
-// reportBlast converts BLAST results into blast.Records based on the
-// coordinates of a genome region g.
-func reportBlast(results []*blast.Output, queryAccVer string, queryStrand int8, verbose bool) []blast.Record {
-	var remapped []blast.Record
+// regionGroup identifies the merged regions of a family on a strand.
+type regionGroup struct {
+	family string
+	strand int8
+}
+
+// groupSize is the total sequence length and number of sequences
+// of a group of merged regions.
+type groupSize struct {
+	len int64
+	n   int
+}
+
+// iteration returns it with the database statistics replaced by the size
+// of the group so that sum scores do not depend on the other groups
+// searched in the same database.
+func (s groupSize) iteration(it blast.Iteration) blast.Iteration {
+	if s.n == 0 || it.Statistics == nil {
+		return it
+	}
+	stat := *it.Statistics
+	stat.DbLen = s.len
+	stat.DbNum = s.n
+	it.Statistics = &stat
+	return it
+}
+
+// reportBlast converts BLAST results into annotated blast.Records based on
+// the coordinates and subject identifiers of the genome regions in regions,
+// keyed by the surrogate region identifiers that begin the hit definitions.
+// The number of forward hits omitted from each region by the region hit
+// cap is recorded in the Truncated annotation.
+// Hits to regions grouped for a family other than the query are ignored
+// unless the regions were grouped across families, in which case hits are
+// reported for both strands. Sum scores are calculated with the database
+// size of each region's group in sizes. Hits to unknown regions are
+// skipped and their number is returned.
+func reportBlast(results []*blast.Output, regions map[string]regionDesc, sizes map[regionGroup]groupSize, verbose bool) (remapped []store.Annotated, skipped int) {
 	for _, o := range results {
 		for _, it := range o.Iterations {
 			for _, hit := range it.Hits {
-				def := hit.Def
-				i := strings.Index(def, " ")
-				desc := strings.Fields(hit.Def[i+1:])
-				left, err := strconv.Atoi(desc[0])
-				if err != nil {
-					panic("invalid left range:" + hit.Def)
+				var id string
+				if f := strings.Fields(hit.Def); len(f) != 0 {
+					id = f[0]
 				}
-				right, err := strconv.Atoi(desc[1])
-				if err != nil {
-					panic("invalid right range:" + hit.Def)
+				region, ok := regions[id]
+				if !ok {
+					skipped++
+					log.Printf("skipping hit to unknown region: %q", hit.Def)
+					continue
 				}
-
-				if *it.QueryId != queryAccVer {
-					break
+				group := region.group
+				left := region.left
+				id = region.subject
+				truncated := region.truncated
+
+				queryAccVer := group.family
+				strands := []int8{group.strand}
+				if group.family == anyFamily {
+					queryAccVer = *it.QueryId
+					strands = []int8{1, -1}
+				} else if *it.QueryId != group.family {
+					continue
 				}
-
-				id := strings.TrimSuffix(def[:i], fmt.Sprintf("_%d_%d", left, right))
-				uid := nextID()
-				score := sumScore(hit, it, queryStrand)
-				for _, hsp := range hit.Hsps {
-					strand := int8(1)
-					if hsp.HitFrom > hsp.HitTo {
-						strand = -1
+				for _, queryStrand := range strands {
+					uid := nextID()
+					score := sumScore(hit, sizes[group].iteration(it), queryStrand)
+					for _, hsp := range hit.Hsps {
+						strand := int8(1)
+						if hsp.HitFrom > hsp.HitTo {
+							strand = -1
+						}
+
+						// Remap coordinates onto original subject.
+						hsp.HitFrom += left
+						hsp.HitTo += left
+
+						// TODO: Integrate this into highest scoring reciprocal logic.
+						if strand != queryStrand {
+							if group.family == anyFamily {
+								// Reported for the other strand.
+								continue
+							}
+							log.Printf("skipping hsp on opposite strand: %s:%d-%d x %s:%d-%d",
+								queryAccVer, hsp.QueryFrom, hsp.QueryTo,
+								id, hsp.HitFrom, hsp.HitTo)
+							continue
+						}
+
+						// Convert to 0-based indexing.
+						hsp.QueryFrom--
+						hsp.HitFrom--
+
+						remapped = append(remapped, store.Annotated{
+							Record: blast.Record{
+								QueryAccVer: queryAccVer,
+								QueryStart:  hsp.QueryFrom,
+								QueryEnd:    hsp.QueryTo,
+
+								SubjectAccVer: id,
+								SubjectStart:  hsp.HitFrom,
+								SubjectEnd:    hsp.HitTo,
+
+								Strand: strand,
+
+								PctIdentity:     100 * float64(*hsp.HspIdentity) / float64(*hsp.AlignLen),
+								AlignmentLength: *hsp.AlignLen,
+								Mismatches:      *hsp.AlignLen - *hsp.HspIdentity,
+								GapOpens:        *hsp.HspGaps,
+								EValue:          hsp.EValue,
+								BitScore:        hsp.BitScore,
+
+								UID:      uid,
+								SumScore: score,
+							},
+							Truncated: truncated,
+						})
 					}
-
-					// Remap coordinates onto original subject.
-					hsp.HitFrom += left
-					hsp.HitTo += left
-
-					// TODO: Integrate this into highest scoring reciprocal logic.
-					if strand != queryStrand {
-						log.Printf("skipping hsp on opposite strand: %s:%d-%d x %s:%d-%d",
-							queryAccVer, hsp.QueryFrom, hsp.QueryTo,
-							id, hsp.HitFrom, hsp.HitTo)
-						continue
-					}
-
-					// Convert to 0-based indexing.
-					hsp.QueryFrom--
-					hsp.HitFrom--
-
-					remapped = append(remapped, blast.Record{
-						QueryAccVer: queryAccVer,
-						QueryStart:  hsp.QueryFrom,
-						QueryEnd:    hsp.QueryTo,
-
-						SubjectAccVer: id,
-						SubjectStart:  hsp.HitFrom,
-						SubjectEnd:    hsp.HitTo,
-
-						Strand: strand,
-
-						PctIdentity:     100 * float64(*hsp.HspIdentity) / float64(*hsp.AlignLen),
-						AlignmentLength: *hsp.AlignLen,
-						Mismatches:      *hsp.AlignLen - *hsp.HspIdentity,
-						GapOpens:        *hsp.HspGaps,
-						EValue:          hsp.EValue,
-						BitScore:        hsp.BitScore,
-
-						UID:      uid,
-						SumScore: score,
-					})
 				}
 			}
 		}
 	}
 
-	return remapped
+	return remapped, skipped
+}
+
+// regionDesc is the description of a merged region given to the
+// reciprocal search. Regions are searched with surrogate identifiers,
+// and their descriptions are held separately.
+type regionDesc struct {
+	left, right int
+	group       regionGroup
+	subject     string
+	truncated   int
 }
 
 func sumScore(h blast.Hit, it blast.Iteration, queryStrand int8) float64 {
@@ -367,52 +509,6 @@ func lnFact(f float64) float64 {
 	return p
 }
 
-// mask writes a masked copy of the genome in the src file based on the given
-// blast hits. Regions that are masked are replaced with the masked alphabet.Letter.
-func mask(path string, hits []blast.Record, masked alphabet.Letter) error {
-	log.Printf("masking %s", path)
-	src, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer src.Close()
-
-	dst, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-*")
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-
-	hitsOf := make(map[string][]blast.Record)
-	for _, h := range hits {
-		hitsOf[h.SubjectAccVer] = append(hitsOf[h.SubjectAccVer], h)
-	}
-
-	sc := seqio.NewScanner(fasta.NewReader(src, linear.NewSeq("", nil, alphabet.DNAredundant)))
-	for sc.Next() {
-		seq := sc.Seq().(*linear.Seq)
-		for _, h := range hitsOf[seq.ID] {
-			// Blast reports minus strand matches by inverting the coordinates.
-			if h.SubjectEnd < h.SubjectStart {
-				h.SubjectStart, h.SubjectEnd = h.SubjectEnd, h.SubjectStart
-			}
-			for i := h.SubjectStart; i < h.SubjectEnd; i++ {
-				seq.Seq[i-seq.Offset] = masked
-			}
-		}
-		fmt.Fprintf(dst, "%60a\n", seq)
-	}
-	err = sc.Error()
-	if err != nil {
-		return err
-	}
-	err = dst.Sync()
-	if err != nil {
-		return err
-	}
-	return os.Rename(dst.Name(), path)
-}
-
 // detail is the class and length of a repeat type.
 type detail struct {
 	class  string
@@ -441,7 +537,8 @@ func libDetails(lib []library) (map[string]detail, error) {
 		default:
 			panic("unknown library type")
 		}
-		sc := bufio.NewScanner(r)
+		src := newNormalizer(r, l.name(), false)
+		sc := bufio.NewScanner(src)
 		sc.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
 			if atEOF && len(data) == 0 {
 				return 0, nil, nil
@@ -493,6 +590,7 @@ func libDetails(lib []library) (map[string]detail, error) {
 		if err != nil {
 			return nil, err
 		}
+		src.warn()
 	}
 	return details, nil
 }
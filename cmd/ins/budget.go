@@ -0,0 +1,114 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// tmpFactor is the estimated ratio of temporary file space required
+// to the size of the query. It accounts for the fragmented copy, the
+// iteratively masked working copy and its BLAST database.
+const tmpFactor = 3
+
+// byteSize is a flag.Value holding a size in bytes. It accepts an integer
+// with an optional K, M, G or T binary multiplier suffix.
+type byteSize int64
+
+// Set sets the value of b from s.
+func (b *byteSize) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	size := s
+	mul := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		case 'T':
+			mul = 1 << 40
+		}
+		if mul != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size: %w", err)
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid negative size: %d", n)
+	}
+	if n > math.MaxInt64/mul {
+		return fmt.Errorf("size too large: %s", size)
+	}
+	*b = byteSize(n * mul)
+	return nil
+}
+
+// String satisfies the flag.Value interface.
+func (b *byteSize) String() string {
+	if b == nil || *b == 0 {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// checkDisk returns an error if the file system holding dir is estimated
+// not to have enough space for a run on a query of size n, or if the
+// estimated requirement exceeds max. If max is zero, only the available
+// space is considered.
+func checkDisk(dir string, n, max int64) error {
+	need := tmpFactor * n
+	if max != 0 && need > max {
+		return fmt.Errorf("estimated temporary space requirement of %d bytes exceeds budget of %d bytes", need, max)
+	}
+	avail, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if avail >= 0 && need > avail {
+		return fmt.Errorf("estimated temporary space requirement of %d bytes exceeds %d bytes available in %s", need, avail, dir)
+	}
+	return nil
+}
+
+// checkMem returns an error if the memory obtained from the OS exceeds
+// max. If max is zero, checkMem always returns nil.
+func checkMem(max int64) error {
+	if max == 0 {
+		return nil
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if int64(stats.HeapAlloc) > max {
+		return fmt.Errorf("memory use of %d bytes exceeds budget of %d bytes", stats.HeapAlloc, max)
+	}
+	return nil
+}
+
+// removeDB removes the files of the BLAST database at path.
+func removeDB(path string) error {
+	files, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err = os.Remove(f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to an unprivileged
+// user on the file system holding dir.
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(dir, &fs)
+	if err != nil {
+		return 0, err
+	}
+	return int64(fs.F_bavail) * int64(fs.F_bsize), nil
+}
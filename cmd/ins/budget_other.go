@@ -0,0 +1,13 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd
+// +build !linux,!darwin,!freebsd,!dragonfly,!openbsd
+
+package main
+
+// freeSpace returns -1 indicating that the available space is unknown.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,42 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+var byteSizeTests = []struct {
+	in      string
+	want    byteSize
+	wantErr bool
+}{
+	{in: "0", want: 0},
+	{in: "512", want: 512},
+	{in: " 4k ", want: 4 << 10},
+	{in: "2M", want: 2 << 20},
+	{in: "3G", want: 3 << 30},
+	{in: "8388607T", want: 8388607 << 40},
+	{in: "8388608T", wantErr: true},
+	{in: "9999999T", wantErr: true},
+	{in: "9223372036854775807", want: 1<<63 - 1},
+	{in: "9223372036854775808", wantErr: true},
+	{in: "-1G", wantErr: true},
+	{in: "G", wantErr: true},
+	{in: "", wantErr: true},
+	{in: "1P", wantErr: true},
+}
+
+func TestByteSizeSet(t *testing.T) {
+	for _, test := range byteSizeTests {
+		var got byteSize
+		err := got.Set(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %q: got:%v want error:%t", test.in, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("unexpected size for %q: got:%d want:%d", test.in, got, test.want)
+		}
+	}
+}
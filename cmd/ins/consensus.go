@@ -0,0 +1,50 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// consensusSpan is the position of an alignment in a repeat consensus.
+// Begin and end are one-based and closed, and left is the number of
+// consensus bases beyond end.
+type consensusSpan struct {
+	begin, end, left int
+}
+
+// consensusCoords returns the position of the alignment r in a consensus
+// of the given length. The span is normalized so that begin is not after
+// end regardless of the strand of the alignment or the order of its query
+// coordinates. If the length of the consensus is not known or is shorter
+// than the alignment end, left is zero.
+func consensusCoords(r blast.Record, length int) consensusSpan {
+	start, end := r.QueryStart, r.QueryEnd
+	if end < start {
+		start, end = end, start
+	}
+	left := length - end
+	if left < 0 {
+		left = 0
+	}
+	return consensusSpan{begin: start + 1, end: end, left: left}
+}
+
+// String returns the span formatted as begin, end and left.
+func (c consensusSpan) String() string {
+	return fmt.Sprintf("%d %d %d", c.begin, c.end, c.left)
+}
+
+// repeatMasker returns the span formatted as in RepeatMasker .out files
+// for an alignment on the given strand. Plus strand spans are formatted as
+// "begin end (left)" and minus strand spans as "(left) end begin".
+func (c consensusSpan) repeatMasker(strand int8) string {
+	if strand < 0 {
+		return fmt.Sprintf("(%d) %d %d", c.left, c.end, c.begin)
+	}
+	return fmt.Sprintf("%d %d (%d)", c.begin, c.end, c.left)
+}
@@ -0,0 +1,121 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+var consensusCoordsTests = []struct {
+	name   string
+	rec    blast.Record
+	length int
+
+	want   consensusSpan
+	wantRM string
+}{
+	{
+		name:   "forward",
+		rec:    blast.Record{QueryStart: 10, QueryEnd: 60, Strand: 1},
+		length: 100,
+		want:   consensusSpan{begin: 11, end: 60, left: 40},
+		wantRM: "11 60 (40)",
+	},
+	{
+		name:   "reverse",
+		rec:    blast.Record{QueryStart: 10, QueryEnd: 60, Strand: -1},
+		length: 100,
+		want:   consensusSpan{begin: 11, end: 60, left: 40},
+		wantRM: "(40) 60 11",
+	},
+	{
+		name:   "reverse inverted query",
+		rec:    blast.Record{QueryStart: 60, QueryEnd: 10, Strand: -1},
+		length: 100,
+		want:   consensusSpan{begin: 11, end: 60, left: 40},
+		wantRM: "(40) 60 11",
+	},
+	{
+		name:   "forward inverted query",
+		rec:    blast.Record{QueryStart: 60, QueryEnd: 10, Strand: 1},
+		length: 100,
+		want:   consensusSpan{begin: 11, end: 60, left: 40},
+		wantRM: "11 60 (40)",
+	},
+	{
+		name:   "full length",
+		rec:    blast.Record{QueryStart: 0, QueryEnd: 100, Strand: 1},
+		length: 100,
+		want:   consensusSpan{begin: 1, end: 100, left: 0},
+		wantRM: "1 100 (0)",
+	},
+	{
+		name:   "reverse full length",
+		rec:    blast.Record{QueryStart: 100, QueryEnd: 0, Strand: -1},
+		length: 100,
+		want:   consensusSpan{begin: 1, end: 100, left: 0},
+		wantRM: "(0) 100 1",
+	},
+	{
+		name:   "beyond consensus end",
+		rec:    blast.Record{QueryStart: 90, QueryEnd: 120, Strand: 1},
+		length: 100,
+		want:   consensusSpan{begin: 91, end: 120, left: 0},
+		wantRM: "91 120 (0)",
+	},
+	{
+		name:   "reverse beyond consensus end",
+		rec:    blast.Record{QueryStart: 120, QueryEnd: 90, Strand: -1},
+		length: 100,
+		want:   consensusSpan{begin: 91, end: 120, left: 0},
+		wantRM: "(0) 120 91",
+	},
+	{
+		name:   "unknown length",
+		rec:    blast.Record{QueryStart: 10, QueryEnd: 60, Strand: 1},
+		length: 0,
+		want:   consensusSpan{begin: 11, end: 60, left: 0},
+		wantRM: "11 60 (0)",
+	},
+	{
+		name:   "zero length",
+		rec:    blast.Record{QueryStart: 30, QueryEnd: 30, Strand: 1},
+		length: 100,
+		want:   consensusSpan{begin: 31, end: 30, left: 70},
+		wantRM: "31 30 (70)",
+	},
+	{
+		name:   "reverse zero length",
+		rec:    blast.Record{QueryStart: 30, QueryEnd: 30, Strand: -1},
+		length: 100,
+		want:   consensusSpan{begin: 31, end: 30, left: 70},
+		wantRM: "(70) 30 31",
+	},
+	{
+		name:   "zero length at consensus end",
+		rec:    blast.Record{QueryStart: 100, QueryEnd: 100, Strand: 1},
+		length: 100,
+		want:   consensusSpan{begin: 101, end: 100, left: 0},
+		wantRM: "101 100 (0)",
+	},
+}
+
+func TestConsensusCoords(t *testing.T) {
+	for _, test := range consensusCoordsTests {
+		got := consensusCoords(test.rec, test.length)
+		if got != test.want {
+			t.Errorf("unexpected span for %s test: got:%+v want:%+v", test.name, got, test.want)
+		}
+		if got.end-got.begin+1 != abs(test.rec.QueryEnd-test.rec.QueryStart) {
+			t.Errorf("unexpected span length for %s test: got:%d want:%d", test.name, got.end-got.begin+1, abs(test.rec.QueryEnd-test.rec.QueryStart))
+		}
+		gotRM := got.repeatMasker(test.rec.Strand)
+		if gotRM != test.wantRM {
+			t.Errorf("unexpected RepeatMasker span for %s test: got:%q want:%q", test.name, gotRM, test.wantRM)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// config is the ins configuration file.
+type config struct {
+	// Container specifies a container used
+	// to run BLAST executables.
+	Container *container `json:"container,omitempty"`
+
+	// Scratch is the directory working
+	// directories are created in when
+	// no directory is specified.
+	Scratch string `json:"scratch,omitempty"`
+}
+
+// container describes the container used to run external commands.
+type container struct {
+	// Runtime is the container runtime,
+	// either docker or singularity.
+	Runtime string `json:"runtime"`
+
+	// Image is the container image.
+	Image string `json:"image"`
+
+	// Tools are the commands run in the
+	// container. The default is the BLAST+
+	// executables used by ins.
+	Tools []string `json:"tools,omitempty"`
+
+	// Mounts are additional directories
+	// made available in the container.
+	Mounts []string `json:"mounts,omitempty"`
+
+	// Args are additional arguments for
+	// the runtime's run or exec command.
+	Args []string `json:"args,omitempty"`
+}
+
+// blastTools are the BLAST+ executables that may be run by ins.
+var blastTools = []string{"blastn", "makeblastdb", "dustmasker"}
+
+// readConfig returns the configuration in the JSON file at path.
+func readConfig(path string) (config, error) {
+	var c config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return c, fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+	if c.Container != nil {
+		switch c.Container.Runtime {
+		case "docker", "singularity":
+		default:
+			return c, fmt.Errorf("invalid container runtime: %q", c.Container.Runtime)
+		}
+		if c.Container.Image == "" {
+			return c, fmt.Errorf("missing container image in %s", path)
+		}
+		if len(c.Container.Tools) == 0 {
+			c.Container.Tools = blastTools
+		}
+	}
+	return c, nil
+}
+
+// runs returns whether the command named name is run in the container.
+func (c *container) runs(name string) bool {
+	if c == nil {
+		return false
+	}
+	for _, t := range c.Tools {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// commandLine returns the command line that runs the command name with
+// args in the container. Directories of paths in args, the current working
+// directory and the configured mounts are mounted at the same paths in the
+// container.
+func (c *container) commandLine(name string, args []string) ([]string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{cwd: true}
+	for _, m := range c.Mounts {
+		dirs[m] = true
+	}
+	for _, a := range args {
+		if a == "" || a[0] == '-' {
+			continue
+		}
+		if !filepath.IsAbs(a) {
+			a = filepath.Join(cwd, a)
+		}
+		// Arguments may be files or the prefixes
+		// of files to be created, so mount their
+		// directory if it exists.
+		dir := filepath.Dir(a)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() && dir != "/" {
+			dirs[dir] = true
+		}
+	}
+	mounts := make([]string, 0, len(dirs))
+	for d := range dirs {
+		mounts = append(mounts, d)
+	}
+	sort.Strings(mounts)
+
+	var cl []string
+	switch c.Runtime {
+	case "docker":
+		cl = []string{"docker", "run", "--rm", "-i", "-w", cwd}
+		if uid := os.Getuid(); uid >= 0 {
+			cl = append(cl, "--user", strconv.Itoa(uid)+":"+strconv.Itoa(os.Getgid()))
+		}
+		for _, m := range mounts {
+			cl = append(cl, "-v", m+":"+m)
+		}
+	case "singularity":
+		cl = []string{"singularity", "exec", "--pwd", cwd}
+		for _, m := range mounts {
+			cl = append(cl, "--bind", m)
+		}
+	default:
+		return nil, fmt.Errorf("invalid container runtime: %q", c.Runtime)
+	}
+	cl = append(cl, c.Args...)
+	cl = append(cl, c.Image, name)
+	return append(cl, args...), nil
+}
+
+// wrap returns cmd modified to run the command from the executor's BLAST
+// binary directory or container if either is configured for the command.
+// The standard streams and environment of cmd must not yet be set.
+func (e executor) wrap(cmd *exec.Cmd) (*exec.Cmd, error) {
+	name := filepath.Base(cmd.Args[0])
+	switch {
+	case e.container.runs(name):
+		cl, err := e.container.commandLine(name, cmd.Args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return exec.Command(cl[0], cl[1:]...), nil
+	case e.blastBin != "" && isBlastTool(name):
+		return exec.Command(filepath.Join(e.blastBin, name), cmd.Args[1:]...), nil
+	}
+	return cmd, nil
+}
+
+// isBlastTool returns whether name is a BLAST+ executable used by ins.
+func isBlastTool(name string) bool {
+	for _, t := range blastTools {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// output runs the command built by b and returns its standard output.
+func (e executor) output(b commandBuilder) ([]byte, error) {
+	cmd, err := b.BuildCommand()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err = e.wrap(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.env) != 0 {
+		cmd.Env = append(os.Environ(), e.env...)
+	}
+	return cmd.Output()
+}
@@ -0,0 +1,145 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/crossmatch"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// engineCrossMatch is the phrap cross_match forward search engine.
+const engineCrossMatch = "crossmatch"
+
+// crossMatchDefault holds the default cross_match parameters. These
+// match those commonly used for repeat annotation with cross_match.
+var crossMatchDefault = crossmatch.CrossMatch{
+	GapInit:   -25,
+	InsGapExt: -5,
+	DelGapExt: -5,
+	MinMatch:  14,
+	MinScore:  225,
+	Bandwidth: 14,
+	MaskLevel: 80,
+	Tags:      true,
+}
+
+// checkCrossMatch checks that cross_match is available, adding it to
+// versions. cross_match does not report a version, so its path is
+// recorded instead.
+func checkCrossMatch(versions map[string]string) error {
+	path, err := exec.LookPath("cross_match")
+	if err != nil {
+		return err
+	}
+	versions["cross_match"] = path
+	return nil
+}
+
+// runCrossMatch runs a cross_match search of the sequences in query against
+// the sequences in libs with the parameters in search. The search is done
+// in a single pass, relying on the cross_match masklevel to resolve
+// overlapping matches. The cross_match output for each library is retained
+// in the working directory. If logger is not nil, output from cross_match
+// to stderr is written to it.
+func runCrossMatch(search crossmatch.CrossMatch, query *os.File, libs []library, mx map[string]fragment, logger io.Writer) (*kv.DB, error) {
+	dir := filepath.Dir(query.Name())
+	hits, err := store.Create(filepath.Join(dir, "forward.db"), store.Forward, insVersion())
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	for i, lib := range libs {
+		in := lib.name()
+		if in == "-" {
+			in, err = libraryFile(filepath.Join(dir, fmt.Sprintf("library-%d.fa", i)), lib)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out := filepath.Join(dir, fmt.Sprintf("crossmatch-%d.out", i))
+		f, err := os.Create(out)
+		if err != nil {
+			return nil, err
+		}
+		search := search
+		search.Query = query.Name()
+		search.Subject = in
+		err = exe.run(search, nil, f, logger)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		err = f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		libHits, err := readCrossMatch(out)
+		if err != nil {
+			return nil, err
+		}
+		logFields(fields{"library": lib.name()}, "cross_match search found %d matches", len(libHits))
+
+		log.Print("remapping coordinates")
+		err = store.PutRecords(hits, remapCoords(libHits, mx))
+		if err != nil {
+			return nil, err
+		}
+
+		err = lib.reset()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+// importCrossMatch returns a forward hit database in dir holding the
+// alignments in the cross_match output files at paths. The cross_match
+// queries must be the unfragmented genome sequences and the subjects the
+// library sequences.
+func importCrossMatch(dir string, paths []string) (*kv.DB, error) {
+	hits, err := store.Create(filepath.Join(dir, "forward.db"), store.Forward, insVersion())
+	if err != nil {
+		return nil, storeError(err)
+	}
+	for _, p := range paths {
+		recs, err := readCrossMatch(p)
+		if err != nil {
+			return nil, inputError(err)
+		}
+		log.Printf("imported %d matches from %s", len(recs), p)
+		err = store.PutRecords(hits, recs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+// readCrossMatch returns the alignments in the cross_match output file at
+// path.
+func readCrossMatch(path string) ([]blast.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recs, err := crossmatch.ParseOutput(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return recs, nil
+}
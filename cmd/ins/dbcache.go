@@ -0,0 +1,189 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// dbCache is a directory holding makeblastdb products keyed by the
+// content of their inputs. An empty dbCache disables caching.
+type dbCache string
+
+// makeDB runs the makeblastdb command described by m, writing output from
+// the command to logger if it is not nil. If the cache holds a database
+// built from the same sequence, mask data and flags, the cached database
+// files are placed at m.Out instead of running makeblastdb. Otherwise a
+// newly built database is added to the cache.
+func (c dbCache) makeDB(m blast.MakeDB, logger io.Writer) error {
+	var dir string
+	if c != "" {
+		key, err := dbKey(m)
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(string(c), key)
+		ok, err := linkFiles(dir, m.Out)
+		if err != nil {
+			return err
+		}
+		if ok {
+			logFields(fields{"cache": dir}, "using cached database %s for %s", dir, m.In)
+			return nil
+		}
+	}
+
+	err := makeDB(m, logger)
+	if err != nil || dir == "" {
+		return err
+	}
+
+	// Failure to cache is not fatal since
+	// the database has been built.
+	err = c.store(dir, m.Out)
+	if err != nil {
+		warnf("failed to cache database for %s: %v", m.In, err)
+	}
+	return nil
+}
+
+// makeDB runs the makeblastdb command described by m, writing output from
+// the command to logger if it is not nil. Existing database files at m.Out
+// are removed first since they may be links to files in a dbCache entry,
+// which makeblastdb would otherwise overwrite in place.
+func makeDB(m blast.MakeDB, logger io.Writer) error {
+	err := removeDB(m.Out)
+	if err != nil {
+		return err
+	}
+	return exe.run(m, nil, nil, logger)
+}
+
+// store adds the database files with the prefix out to the cache entry dir.
+func (c dbCache) store(dir, out string) error {
+	files, err := dbFiles(out)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no database files for %s", out)
+	}
+	err = os.MkdirAll(string(c), 0o755)
+	if err != nil {
+		return err
+	}
+	// Build the entry in a temporary directory and
+	// rename it into place so that concurrent runs
+	// never see a partial entry.
+	tmp, err := ioutil.TempDir(string(c), ".tmp-")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err = linkOrCopy(f, filepath.Join(tmp, "db"+strings.TrimPrefix(f, out)))
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		os.RemoveAll(tmp)
+		if _, _err := os.Stat(dir); _err == nil {
+			// Another run cached the same database.
+			return nil
+		}
+		return err
+	}
+	log.Printf("cached database for %s in %s", out, dir)
+	return nil
+}
+
+// linkFiles places the database files in the cache entry dir at the path
+// prefix out. It returns false if there is no entry dir.
+func linkFiles(dir, out string) (ok bool, err error) {
+	files, err := dbFiles(filepath.Join(dir, "db"))
+	if err != nil {
+		return false, err
+	}
+	if len(files) == 0 {
+		return false, nil
+	}
+	err = removeDB(out)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range files {
+		err = linkOrCopy(f, out+strings.TrimPrefix(f, filepath.Join(dir, "db")))
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// dbFiles returns the database files with the path prefix out.
+func dbFiles(out string) ([]string, error) {
+	return filepath.Glob(out + ".*")
+}
+
+// dbKey returns the cache key for the database described by m. The key is
+// the digest of the database type, the extra arguments and the contents of
+// the input sequence and mask data files.
+func dbKey(m blast.MakeDB) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%q\x00", m.DBType, m.ExtraFlags, m.ExtraArgs)
+	for _, p := range []string{m.In, m.MaskData} {
+		if p == "" {
+			io.WriteString(h, "\x00")
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, "\x00")
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// linkOrCopy hard links src to dst, falling back to copying when
+// a link can not be made, for example across file systems.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, s)
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
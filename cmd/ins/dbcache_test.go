@@ -0,0 +1,114 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// fakeMakeDB is a makeblastdb stand-in that writes the contents of its
+// -in file to the .nsq and .nin files of its -out prefix, truncating the
+// existing files in place as makeblastdb does.
+const fakeMakeDB = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-in) in=$2; shift ;;
+	-out) out=$2; shift ;;
+	esac
+	shift
+done
+cat "$in" >"$out.nsq"
+cat "$in" >"$out.nin"
+`
+
+func TestDBCacheRebuild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake makeblastdb requires a POSIX shell")
+	}
+	dir, err := ioutil.TempDir("", "ins-dbcache-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tool := filepath.Join(dir, "makeblastdb")
+	err = ioutil.WriteFile(tool, []byte(fakeMakeDB), 0o755)
+	if err != nil {
+		t.Fatalf("failed to write fake makeblastdb: %v", err)
+	}
+	cache := dbCache(filepath.Join(dir, "cache"))
+	working := filepath.Join(dir, "working")
+	m := blast.MakeDB{Cmd: tool, DBType: "nucl", In: working, Out: working}
+
+	const unmasked = ">seq\nACGTACGT\n"
+	err = ioutil.WriteFile(working, []byte(unmasked), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write working sequence: %v", err)
+	}
+	key, err := dbKey(m)
+	if err != nil {
+		t.Fatalf("failed to get cache key: %v", err)
+	}
+	entry := filepath.Join(string(cache), key, "db")
+
+	// The first build is a miss and
+	// the second a hit on the entry.
+	for i := 0; i < 2; i++ {
+		err = cache.makeDB(m, nil)
+		if err != nil {
+			t.Fatalf("unexpected error making database %d: %v", i, err)
+		}
+		checkDBFiles(t, entry, unmasked)
+		checkDBFiles(t, working, unmasked)
+	}
+
+	// Rebuild into the same output with a
+	// different sequence, both through the
+	// cache and directly.
+	const masked = ">seq\nACGTNNNN\n"
+	err = ioutil.WriteFile(working, []byte(masked), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write working sequence: %v", err)
+	}
+	err = cache.makeDB(m, nil)
+	if err != nil {
+		t.Fatalf("unexpected error making masked database: %v", err)
+	}
+	checkDBFiles(t, entry, unmasked)
+	checkDBFiles(t, working, masked)
+
+	_, err = linkFiles(filepath.Dir(entry), working)
+	if err != nil {
+		t.Fatalf("failed to link cached database: %v", err)
+	}
+	err = makeDB(m, nil)
+	if err != nil {
+		t.Fatalf("unexpected error making uncached database: %v", err)
+	}
+	checkDBFiles(t, entry, unmasked)
+	checkDBFiles(t, working, masked)
+}
+
+// checkDBFiles checks that the fake database files with the path prefix
+// out hold want.
+func checkDBFiles(t *testing.T, out, want string) {
+	t.Helper()
+	for _, ext := range []string{".nsq", ".nin"} {
+		got, err := ioutil.ReadFile(out + ext)
+		if err != nil {
+			t.Errorf("failed to read database file: %v", err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("unexpected contents of %s: got:%q want:%q", out+ext, got, want)
+		}
+	}
+}
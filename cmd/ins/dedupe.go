@@ -0,0 +1,187 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+)
+
+// dedupeK is the k-mer length used to compare library sequences.
+const dedupeK = 16
+
+// libRecord is a library fasta record.
+type libRecord struct {
+	header []byte
+	lines  [][]byte
+	seq    []byte
+}
+
+// dedupeLibrary writes the sequences in libs to the fasta file at dst,
+// omitting sequences that are redundant with a longer retained sequence.
+// A sequence is redundant when at least the given fraction of its k-mers,
+// on either strand, are present in a single retained sequence. It returns
+// the path to the written library and the number of sequences omitted.
+func dedupeLibrary(dst string, libs []string, fraction float64) (string, int, error) {
+	var recs []*libRecord
+	for _, lib := range libs {
+		r, err := readLibRecords(lib)
+		if err != nil {
+			return "", 0, err
+		}
+		recs = append(recs, r...)
+	}
+	order := make([]int, len(recs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(recs[order[i]].seq) > len(recs[order[j]].seq)
+	})
+
+	keep := make([]bool, len(recs))
+	index := make(map[uint32][]int32)
+	var removed int
+	for _, i := range order {
+		kmers := canonicalKmers(recs[i].seq)
+		if len(kmers) != 0 {
+			shared := make(map[int32]int)
+			for _, k := range kmers {
+				for _, rep := range index[k] {
+					shared[rep]++
+				}
+			}
+			redundant := false
+			for rep, n := range shared {
+				if float64(n) >= fraction*float64(len(kmers)) {
+					logFields(fields{"family": libID(recs[i].header)}, "library sequence %s is redundant with %s", libID(recs[i].header), libID(recs[rep].header))
+					redundant = true
+					break
+				}
+			}
+			if redundant {
+				removed++
+				continue
+			}
+			for _, k := range kmers {
+				index[k] = append(index[k], int32(i))
+			}
+		}
+		keep[i] = true
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	w := bufio.NewWriter(f)
+	for i, r := range recs {
+		if !keep[i] {
+			continue
+		}
+		w.Write(r.header)
+		for _, l := range r.lines {
+			w.Write(l)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	return dst, removed, f.Close()
+}
+
+// readLibRecords returns the fasta records in the file at path. Header and
+// sequence lines are retained verbatim.
+func readLibRecords(path string) ([]*libRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		recs []*libRecord
+		cur  *libRecord
+	)
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) != 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if line[0] == '>' {
+				cur = &libRecord{header: line}
+				recs = append(recs, cur)
+			} else if cur != nil {
+				cur.lines = append(cur.lines, line)
+				cur.seq = append(cur.seq, bytes.TrimSpace(line)...)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// libID returns the sequence identifier of a fasta header line.
+func libID(header []byte) string {
+	name, _ := libHeader(bytes.TrimSpace(header))
+	return name
+}
+
+// canonicalKmers returns the distinct canonical k-mers of s. K-mers
+// containing bases other than A, C, G and T are ignored.
+func canonicalKmers(s []byte) []uint32 {
+	const mask = 1<<(2*dedupeK) - 1
+	var (
+		fwd, rev uint32
+		n        int
+		kmers    []uint32
+	)
+	for _, b := range s {
+		var c uint32
+		switch b {
+		case 'A', 'a':
+			c = 0
+		case 'C', 'c':
+			c = 1
+		case 'G', 'g':
+			c = 2
+		case 'T', 't':
+			c = 3
+		default:
+			n = 0
+			continue
+		}
+		fwd = (fwd<<2 | c) & mask
+		rev = rev>>2 | (3-c)<<(2*(dedupeK-1))
+		n++
+		if n < dedupeK {
+			continue
+		}
+		if rev < fwd {
+			kmers = append(kmers, rev)
+		} else {
+			kmers = append(kmers, fwd)
+		}
+	}
+	sort.Slice(kmers, func(i, j int) bool { return kmers[i] < kmers[j] })
+	u := kmers[:0]
+	for i, k := range kmers {
+		if i == 0 || k != kmers[i-1] {
+			u = append(u, k)
+		}
+	}
+	return u
+}
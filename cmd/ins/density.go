@@ -0,0 +1,198 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// writeDensity writes the repeat density tracks for the annotations in hits
+// on the query sequences with the given lengths, converting them to bigWig
+// if requested.
+func (r run) writeDensity(prefix string, hits []blast.Record, lengths map[string]int) error {
+	// bedGraphToBigWig does not read
+	// compressed bedGraph files.
+	ext := r.compressedExt()
+	if r.bigWig {
+		ext = ""
+	}
+	paths, err := writeDensityTracks(prefix, ext, hits, r.details, lengths, r.density)
+	if err != nil {
+		return err
+	}
+	log.Printf("repeat density tracks in %s", strings.Join(paths, ", "))
+	if !r.bigWig {
+		return nil
+	}
+	sizes := prefix + ".chrom.sizes"
+	err = writeChromSizes(sizes, lengths)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		bw, err := toBigWig(p, sizes)
+		if err != nil {
+			return err
+		}
+		log.Printf("bigWig track in %s", bw)
+	}
+	return nil
+}
+
+// writeDensityTracks writes a bedGraph track for each repeat class of the fraction
+// of each window of the given width covered by repeats of the class. The
+// class of each hit is obtained from details and sequence lengths are given
+// by lengths. Tracks are written to files named with prefix and the class,
+// followed by ext, and their paths are returned.
+func writeDensityTracks(prefix, ext string, hits []blast.Record, details map[string]detail, lengths map[string]int, window int) ([]string, error) {
+	byClass := make(map[string][]blast.Record)
+	for _, h := range hits {
+		class := details[h.QueryAccVer].class
+		if class == "" {
+			class = unknownClass
+		}
+		byClass[class] = append(byClass[class], h)
+	}
+	classes := make([]string, 0, len(byClass))
+	for c := range byClass {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+
+	names := make([]string, 0, len(lengths))
+	for n := range lengths {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var paths []string
+	for _, c := range classes {
+		path := fmt.Sprintf("%s-%s.bedgraph%s", prefix, fileSafe(c), ext)
+		err := writeClassDensity(path, c, byClass[c], names, lengths, window)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// writeClassDensity writes the bedGraph density track for the hits of a
+// single class to the file at path.
+func writeClassDensity(path, class string, hits []blast.Record, names []string, lengths map[string]int, window int) error {
+	covered := make(map[string][]gap)
+	for _, h := range hits {
+		left, right := subjectSpan(h)
+		covered[h.SubjectAccVer] = append(covered[h.SubjectAccVer], gap{start: left, end: right})
+	}
+
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "track type=bedGraph name=%q description=%q\n", class, "ins "+class+" density")
+	for _, name := range names {
+		ivs := union(covered[name])
+		length := lengths[name]
+		i := 0
+		for start := 0; start < length; start += window {
+			end := min(start+window, length)
+			var n int
+			for i < len(ivs) && ivs[i].end <= start {
+				i++
+			}
+			for j := i; j < len(ivs) && ivs[j].start < end; j++ {
+				n += min(ivs[j].end, end) - max(ivs[j].start, start)
+			}
+			if n == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.4f\n", name, start, end, float64(n)/float64(end-start))
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// union returns the sorted union of the intervals in ivs.
+func union(ivs []gap) []gap {
+	if len(ivs) == 0 {
+		return nil
+	}
+	sort.Slice(ivs, func(i, j int) bool { return ivs[i].start < ivs[j].start })
+	u := []gap{ivs[0]}
+	for _, iv := range ivs[1:] {
+		last := &u[len(u)-1]
+		if iv.start > last.end {
+			u = append(u, iv)
+			continue
+		}
+		if iv.end > last.end {
+			last.end = iv.end
+		}
+	}
+	return u
+}
+
+// fileSafe returns s with characters that are not safe for use in
+// file names replaced with underscores.
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// writeChromSizes writes the sequence lengths in lengths to the file at
+// path in UCSC chrom.sizes format.
+func writeChromSizes(path string, lengths map[string]int) error {
+	names := make([]string, 0, len(lengths))
+	for n := range lengths {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s\t%d\n", n, lengths[n])
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// toBigWig converts the bedGraph file at path to bigWig using the UCSC
+// bedGraphToBigWig tool and the chrom.sizes file at sizes, returning the
+// path of the bigWig file.
+func toBigWig(path, sizes string) (string, error) {
+	out := strings.TrimSuffix(path, ".bedgraph") + ".bw"
+	err := exe.run(command{"bedGraphToBigWig", path, sizes, out}, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
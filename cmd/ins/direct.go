@@ -0,0 +1,112 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// detailColumns are the tabular output columns requested from the forward
+// search when the reciprocal search is skipped. They provide the alignment
+// details otherwise obtained from the reciprocal search.
+var detailColumns = []string{"std", "qlen", "slen", "btop"}
+
+// direct returns whether the hits of the pass are taken directly from
+// the forward search instead of a reciprocal search of merged regions.
+// Only BLAST forward searches provide the alignment details needed.
+func (p pass) direct() bool {
+	return !p.searchRegions && p.engine == engineBlast
+}
+
+// assignRegions creates reverse.db in dir from the forward search hits in
+// forward, grouping the hits within each merged region in regions as the
+// HSPs of a single hit with a shared UID. The sum score of each group is
+// the sum of the bit scores of its HSPs. Surrogate library identifiers
+// are replaced with the originals in ids.
+func assignRegions(forward, regions *kv.DB, ids idMap, dir string, maxMem int64) (*kv.DB, error) {
+	reverse, err := store.Create(filepath.Join(dir, "reverse.db"), store.Reverse, insVersion())
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	merged := store.Iterate(regions)
+	var (
+		region store.BlastRecordKey
+		found  bool
+		group  []blast.Record
+		n      int
+	)
+	flush := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+		uid := nextID()
+		var sum float64
+		for _, h := range group {
+			sum += h.BitScore
+		}
+		for i := range group {
+			group[i].QueryAccVer = ids.original(group[i].QueryAccVer)
+			group[i].UID = uid
+			group[i].SumScore = sum
+		}
+		err := store.PutRecords(reverse, group)
+		if err != nil {
+			return err
+		}
+		n += len(group)
+		group = group[:0]
+		return checkMem(maxMem)
+	}
+	err = store.IterGroups(forward, func(hits []blast.Record) error {
+		for _, h := range hits {
+			// Regions are merged from the hits in the same order
+			// that they are read here, so the region holding each
+			// hit is the current region or a later one.
+			for !found || !inRegion(h, region) {
+				err := flush()
+				if err != nil {
+					return err
+				}
+				if !merged.Next() {
+					if merged.Err() != nil {
+						return merged.Err()
+					}
+					left, right := subjectSpan(h)
+					return fmt.Errorf("no merged region for %s hit at %s:%d-%d", h.QueryAccVer, h.SubjectAccVer, left, right)
+				}
+				region = merged.Key()
+				found = true
+			}
+			group = append(group, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = flush()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("assigned %d forward hits to merged regions", n)
+	return reverse, nil
+}
+
+// inRegion returns whether the hit h starts within the merged region.
+func inRegion(h blast.Record, region store.BlastRecordKey) bool {
+	left, _ := subjectSpan(h)
+	return h.Strand == region.Strand &&
+		h.QueryAccVer == region.QueryAccVer &&
+		h.SubjectAccVer == region.SubjectAccVer &&
+		region.SubjectLeft <= int64(left) && int64(left) <= region.SubjectRight
+}
@@ -0,0 +1,332 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kortschak/ins/internal/store"
+)
+
+// distribution is the record of a distributed forward search.
+type distribution struct {
+	// Query is the query sequence file.
+	Query string `json:"query"`
+	// Shards is the number of shards.
+	Shards int `json:"shards"`
+	// Args are the ins arguments used to
+	// run the shards and gather results.
+	Args []string `json:"args"`
+}
+
+// distributionFile is the name of the distribution record in
+// a distribution directory.
+const distributionFile = "distribution.json"
+
+// shardDir returns the path of the working directory of shard i of the
+// distribution in dir.
+func shardDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%d", i))
+}
+
+// distribute splits the query at path into fragments in dir and partitions
+// them into n shards, each in its own directory. It writes a command script
+// for each shard and an array job script that runs the shard selected by
+// the SLURM or SGE array task ID. Shards are run with the arguments in args
+// with the addition of the -shard flag.
+func (r run) distribute(path, dir string, n int, args []string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	query, err := os.Open(path)
+	if err != nil {
+		return inputError(err)
+	}
+	defer query.Close()
+	err = checkUniqueIDs(query)
+	if err != nil {
+		return inputError(err)
+	}
+	_, err = query.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	fragsPath := filepath.Join(dir, "query-fragments")
+	frags, err := os.Create(fragsPath)
+	if err != nil {
+		return err
+	}
+	log.Println("splitting query")
+	src := newNormalizer(query, query.Name(), r.primary.upperQuery && !r.primary.exclude.lower)
+	mx, gaps, err := split(frags, src, optFragmentLen, maxFragmentLen, r.primary.overlap, r.primary.exclude)
+	if err != nil {
+		frags.Close()
+		return inputError(err)
+	}
+	src.warn()
+	err = frags.Close()
+	if err != nil {
+		return err
+	}
+	err = writeFragments(filepath.Join(dir, "fragments.tsv"), mx)
+	if err != nil {
+		return err
+	}
+	err = writeGaps(filepath.Join(dir, "gaps.bed"), gaps)
+	if err != nil {
+		return err
+	}
+
+	parts, err := partitionFasta(fragsPath, n)
+	if err != nil {
+		return err
+	}
+	for i, p := range parts {
+		sd := shardDir(dir, i)
+		err = os.MkdirAll(sd, 0o755)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(sd, "query-fragments")
+		if p == fragsPath {
+			os.Remove(dst)
+			err = linkOrCopy(p, dst)
+		} else {
+			err = os.Rename(p, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ins, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for i := range parts {
+		err = writeScript(filepath.Join(dir, fmt.Sprintf("shard-%d.sh", i)), shellQuote(ins, append(args, "-shard", shardDir(dir, i))...))
+		if err != nil {
+			return err
+		}
+	}
+	// SLURM array task IDs are taken as given, while SGE
+	// task IDs start from one and are made zero-based.
+	// Without either, the task is the first argument.
+	array := fmt.Sprintf(`task=${SLURM_ARRAY_TASK_ID:-${SGE_TASK_ID:+$((SGE_TASK_ID-1))}}
+task=${task:-$1}
+if [ -z "$task" ]; then
+	echo "no array task ID" >&2
+	exit 2
+fi
+exec %s -shard %s/shard-"$task"`, shellQuote(ins, args...), shellQuote(dir))
+	err = writeScript(filepath.Join(dir, "array.sh"), array)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(distribution{Query: path, Shards: len(parts), Args: args}, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, distributionFile), append(b, '\n'), 0o664)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote %d shards to %s: run %s for each and then %s gather -dir %s", len(parts), dir, filepath.Join(dir, "shard-<n>.sh"), ins, dir)
+	return nil
+}
+
+// shard performs the forward search of the query fragments in the shard
+// working directory dir, leaving the hits in forward.db in dir.
+func (r run) shard(dir string) error {
+	mx, err := readFragments(filepath.Join(filepath.Dir(dir), "fragments.tsv"))
+	if err != nil {
+		return err
+	}
+	frags, err := os.Open(filepath.Join(dir, "query-fragments"))
+	if err != nil {
+		return err
+	}
+	defer frags.Close()
+	err = removeIfExists(filepath.Join(dir, "forward.db"))
+	if err != nil {
+		return err
+	}
+	p, libraries, err := r.primary.prepareLibraries(dir)
+	if err != nil {
+		return err
+	}
+	hits, err := p.forward(dir, frags, libraries, mx)
+	if err != nil {
+		return err
+	}
+	log.Printf("shard forward search complete in %s", dir)
+	return hits.Close()
+}
+
+// gather is the ins gather subcommand. It merges the forward search
+// results of the shards of a distribution and continues the pipeline
+// using the merged results.
+func gather(args []string) {
+	fs := flag.NewFlagSet("gather", flag.ExitOnError)
+	dir := fs.String("dir", "", "specify the distribution directory (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage of %[1]s gather:
+  $ %[1]s gather -dir <distribution> >out.gtf 2>out.log
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dir == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(*dir, distributionFile))
+	if err != nil {
+		fatal(inputError(err))
+	}
+	var d distribution
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		fatal(inputError(fmt.Errorf("invalid distribution record: %w", err)))
+	}
+
+	merged := filepath.Join(*dir, "forward.db")
+	err = mergeShards(merged, *dir, d.Shards)
+	if err != nil {
+		fatal(err)
+	}
+
+	ins, err := os.Executable()
+	if err != nil {
+		fatal(err)
+	}
+	cmd := exec.Command(ins, append(d.Args, "-recover", merged)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Print(cmd)
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// mergeShards merges the forward.db files of the n shards in the
+// distribution directory dir into a new database at dst.
+func mergeShards(dst, dir string, n int) error {
+	err := removeIfExists(dst)
+	if err != nil {
+		return err
+	}
+	merged, err := store.Create(dst, store.Forward, insVersion())
+	if err != nil {
+		return storeError(err)
+	}
+	for i := 0; i < n; i++ {
+		path := filepath.Join(shardDir(dir, i), "forward.db")
+		src, err := store.Open(path, store.Forward)
+		if err != nil {
+			merged.Close()
+			return storeError(fmt.Errorf("shard %d: %w", i, err))
+		}
+		count, err := store.Copy(merged, src)
+		src.Close()
+		if err != nil {
+			merged.Close()
+			return storeError(fmt.Errorf("shard %d: %w", i, err))
+		}
+		log.Printf("merged %d hits from %s", count, path)
+	}
+	return merged.Close()
+}
+
+// writeScript writes a shell script running cmd to path.
+func writeScript(path, cmd string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "#!/bin/sh\nset -e\n%s\n", cmd)
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// shellQuote returns the command line of cmd and args quoted for a POSIX
+// shell.
+func shellQuote(cmd string, args ...string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, a := range append([]string{cmd}, args...) {
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./,:+@%") == "" {
+			words = append(words, a)
+			continue
+		}
+		words = append(words, "'"+strings.Replace(a, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(words, " ")
+}
+
+// withoutFlags returns args with the flags named in names and their values
+// removed. Flags taking values are assumed to be given as -name=value or
+// -name value.
+func withoutFlags(args []string, names ...string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(a, "-")
+		if name == a {
+			out = append(out, a)
+			continue
+		}
+		name, _, hasValue := cut(name, "=")
+		matched := false
+		for _, n := range names {
+			if name == n {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			out = append(out, a)
+			continue
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	return out
+}
@@ -0,0 +1,227 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// saturated is the divergence reported for alignments too diverged for the
+// substitution model to give an estimate.
+const saturated = 100
+
+// hitDivergence returns the percent divergence of the alignment of r from
+// its consensus. If the alignment has BLAST traceback operations, the
+// Kimura two-parameter distance is returned, otherwise the Jukes-Cantor
+// distance is estimated from the percent identity. Gapped positions are
+// not counted.
+func hitDivergence(r blast.Record) float64 {
+	if r.BTOP == "" {
+		p := 1 - r.PctIdentity/100
+		a := 1 - 4*p/3
+		if a <= 0 {
+			return saturated
+		}
+		return 100 * -0.75 * math.Log(a)
+	}
+	var aligned, transitions, transversions int
+	b := r.BTOP
+	for i := 0; i < len(b); {
+		j := i
+		for j < len(b) && '0' <= b[j] && b[j] <= '9' {
+			j++
+		}
+		if j != i {
+			n, err := strconv.Atoi(b[i:j])
+			if err != nil {
+				break
+			}
+			aligned += n
+			i = j
+			continue
+		}
+		if i+2 > len(b) {
+			break
+		}
+		x, y := b[i]|0x20, b[i+1]|0x20
+		switch {
+		case x == '-' || y == '-':
+		case isTransition(x, y):
+			aligned++
+			transitions++
+		default:
+			aligned++
+			transversions++
+		}
+		i += 2
+	}
+	if aligned == 0 {
+		return 0
+	}
+	p := float64(transitions) / float64(aligned)
+	q := float64(transversions) / float64(aligned)
+	a1 := 1 - 2*p - q
+	a2 := 1 - 2*q
+	if a1 <= 0 || a2 <= 0 {
+		return saturated
+	}
+	return 100 * (-0.5*math.Log(a1) - 0.25*math.Log(a2))
+}
+
+// isTransition returns whether the lower case nucleotides x and y differ
+// by a purine-purine or pyrimidine-pyrimidine substitution.
+func isTransition(x, y byte) bool {
+	switch {
+	case x == 'a' && y == 'g', x == 'g' && y == 'a':
+		return true
+	case x == 'c' && y == 't', x == 't' && y == 'c':
+		return true
+	}
+	return false
+}
+
+// writeDivergence writes the divergence of the hits from their consensus
+// sequences, using the family classes in details. The genomic bases of each
+// family in one percent divergence bins are written in long format to
+// path.divergence.csv, and the per-family divergence and per-class bins
+// are written to path.divsum in the layout of the RepeatMasker
+// calcDivergenceFromAlign.pl summary. The file names are followed by ext.
+func writeDivergence(path, ext string, hits []blast.Record, details map[string]detail) error {
+	type bin struct {
+		name string
+		div  int
+	}
+	type family struct {
+		class    string
+		bases    int64
+		diverged float64
+	}
+	var (
+		maxBin     int
+		counts     = make(map[bin]int)
+		famBins    = make(map[bin]int64)
+		classBins  = make(map[bin]int64)
+		families   = make(map[string]*family)
+		classNames = make(map[string]bool)
+	)
+	for _, h := range hits {
+		class := details[h.QueryAccVer].class
+		if class == "" {
+			class = unknownClass
+		}
+		left, right := subjectSpan(h)
+		bases := int64(right - left)
+		d := hitDivergence(h)
+		b := int(d)
+		if b > maxBin {
+			maxBin = b
+		}
+		counts[bin{h.QueryAccVer, b}]++
+		famBins[bin{h.QueryAccVer, b}] += bases
+		classBins[bin{class, b}] += bases
+		classNames[class] = true
+
+		f, ok := families[h.QueryAccVer]
+		if !ok {
+			f = &family{class: class}
+			families[h.QueryAccVer] = f
+		}
+		f.bases += bases
+		f.diverged += float64(bases) * d
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ci, cj := families[names[i]].class, families[names[j]].class
+		if ci != cj {
+			return ci < cj
+		}
+		return names[i] < names[j]
+	})
+	classes := make([]string, 0, len(classNames))
+	for class := range classNames {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	err := writeFile(path+".divergence.csv"+ext, func(w *bufio.Writer) {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"family", "class", "divergence", "elements", "bases"})
+		for _, name := range names {
+			for d := 0; d <= maxBin; d++ {
+				b := bin{name, d}
+				if counts[b] == 0 {
+					continue
+				}
+				cw.Write([]string{
+					name,
+					families[name].class,
+					strconv.Itoa(d),
+					strconv.Itoa(counts[b]),
+					strconv.FormatInt(famBins[b], 10),
+				})
+			}
+		}
+		cw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	return writeFile(path+".divsum"+ext, func(w *bufio.Writer) {
+		fmt.Fprintln(w, "Jukes/Cantor and Kimura subsitution levels")
+		fmt.Fprintln(w, "==========================================")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Class\tRepeat\tabsLen\twellCharLen\tKimura%")
+		fmt.Fprintln(w, "-----\t------\t------\t-----------\t-------")
+		for _, name := range names {
+			f := families[name]
+			var div float64
+			if f.bases != 0 {
+				div = f.diverged / float64(f.bases)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f\n", f.class, name, f.bases, f.bases, div)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Coverage for each repeat class and divergence (Kimura)")
+		fmt.Fprint(w, "Div")
+		for _, class := range classes {
+			fmt.Fprintf(w, "\t%s", class)
+		}
+		fmt.Fprintln(w)
+		for d := 0; d <= maxBin; d++ {
+			fmt.Fprint(w, d)
+			for _, class := range classes {
+				fmt.Fprintf(w, "\t%d", classBins[bin{class, d}])
+			}
+			fmt.Fprintln(w)
+		}
+	})
+}
+
+// writeFile writes the output file at path using fn.
+func writeFile(path string, fn func(*bufio.Writer)) error {
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fn(w)
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,336 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// commandBuilder is a type that can build an external command.
+type commandBuilder interface {
+	BuildCommand() (*exec.Cmd, error)
+}
+
+// command is a commandBuilder for an explicit command line.
+type command []string
+
+func (c command) BuildCommand() (*exec.Cmd, error) {
+	if len(c) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return exec.Command(c[0], c[1:]...), nil
+}
+
+// executor runs external commands.
+type executor struct {
+	// timeout is the longest time an attempt
+	// to run a command may take. Zero is no
+	// limit.
+	timeout time.Duration
+
+	// retries is the number of times a command
+	// that fails transiently is retried.
+	retries int
+
+	// env holds additional KEY=VALUE environment
+	// variables for commands.
+	env []string
+
+	// blastBin is the directory holding the
+	// BLAST+ executables. If blastBin is empty
+	// they are found in the PATH.
+	blastBin string
+
+	// container is the container used to run
+	// its configured tools. If container is nil
+	// commands are run directly.
+	container *container
+}
+
+// exe is the executor used to run all external commands.
+var exe executor
+
+// stderrTail is the amount of a failed command's stderr output retained
+// for its error.
+const stderrTail = 4 << 10
+
+// commandError is the error returned when an external command fails.
+type commandError struct {
+	cmd      string
+	err      error
+	stderr   string
+	timedOut bool
+}
+
+func (e *commandError) Error() string {
+	msg := e.err.Error()
+	if e.timedOut {
+		msg = "timed out"
+	}
+	if e.stderr == "" {
+		return fmt.Sprintf("%s: %s", e.cmd, msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.cmd, msg, e.stderr)
+}
+
+func (e *commandError) Unwrap() error { return e.err }
+
+// transientMessages are fragments of error messages indicating a failure
+// that may succeed when retried. They are mostly due to cluster file
+// system and resource contention.
+var transientMessages = []string{
+	"stale file handle",
+	"input/output error",
+	"resource temporarily unavailable",
+	"text file busy",
+	"too many open files",
+	"connection timed out",
+	"memory map",
+}
+
+// transient returns whether the command failure may succeed if retried.
+func (e *commandError) transient() bool {
+	if e.timedOut {
+		return true
+	}
+	var exit *exec.ExitError
+	if errors.As(e.err, &exit) && exit.ExitCode() == -1 {
+		// Killed by a signal.
+		return true
+	}
+	msg := strings.ToLower(e.err.Error() + "\n" + e.stderr)
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// once returns a copy of e that does not retry failed commands.
+func (e executor) once() executor {
+	e.retries = 0
+	return e
+}
+
+// run runs the command built by b to completion. If stdin is not nil, it is
+// called before each attempt to obtain the command's standard input. The
+// command's standard output is written to stdout, or to logger if stdout
+// is nil, and its standard error is written to logger. Commands writing to
+// a stdout that can not be rewound are not retried.
+func (e executor) run(b commandBuilder, stdin func() (io.Reader, error), stdout, logger io.Writer) error {
+	if stdout == nil {
+		stdout = logger
+	}
+	if !rewindable(stdout) {
+		e.retries = 0
+	}
+	return e.retry(func(attempt int) error {
+		if attempt != 0 {
+			err := rewind(stdout)
+			if err != nil {
+				return err
+			}
+		}
+		p, err := e.start(b, stdin, stdout, logger)
+		if err != nil {
+			return err
+		}
+		return p.wait()
+	})
+}
+
+// stream runs the command built by b, passing its standard output to parse.
+// If stdin is not nil, it is called before each attempt to obtain the
+// command's standard input. Standard error is written to logger. If the
+// command fails transiently it is retried, so parse must discard the results
+// of earlier calls.
+func (e executor) stream(b commandBuilder, stdin func() (io.Reader, error), logger io.Writer, parse func(io.Reader) error) error {
+	return e.retry(func(int) error {
+		r, w := io.Pipe()
+		p, err := e.start(b, stdin, w, logger)
+		if err != nil {
+			return err
+		}
+		done := make(chan error, 1)
+		go func() {
+			err := p.wait()
+			w.CloseWithError(err)
+			done <- err
+		}()
+		perr := parse(r)
+		if perr != nil {
+			// Unblock the command if it is still writing.
+			r.CloseWithError(perr)
+		} else {
+			io.Copy(ioutil.Discard, r)
+		}
+		err = <-done
+		if err != nil {
+			return err
+		}
+		return perr
+	})
+}
+
+// retry calls fn with the attempt number until it succeeds, fails with
+// an error that is not transient or the number of retries is exhausted.
+func (e executor) retry(fn func(attempt int) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		var ce *commandError
+		if err == nil || attempt >= e.retries || !errors.As(err, &ce) || !ce.transient() {
+			return err
+		}
+		delay := time.Second << attempt
+		warnf("%v: retrying in %v", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// process is a running external command.
+type process struct {
+	cmd      *exec.Cmd
+	stderr   *tailBuffer
+	timer    *time.Timer
+	timedOut int32
+}
+
+// start starts the command built by b with the executor's environment
+// and timeout.
+func (e executor) start(b commandBuilder, stdin func() (io.Reader, error), stdout, logger io.Writer) (*process, error) {
+	cmd, err := b.BuildCommand()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err = e.wrap(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if stdin != nil {
+		cmd.Stdin, err = stdin()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(e.env) != 0 {
+		cmd.Env = append(os.Environ(), e.env...)
+	}
+	p := &process{cmd: cmd, stderr: &tailBuffer{max: stderrTail}}
+	cmd.Stdout = stdout
+	cmd.Stderr = p.stderr
+	if logger != nil {
+		cmd.Stderr = io.MultiWriter(logger, p.stderr)
+	}
+	log.Print(cmd)
+	err = cmd.Start()
+	if err != nil {
+		return nil, &commandError{cmd: cmd.Path, err: err}
+	}
+	if e.timeout > 0 {
+		p.timer = time.AfterFunc(e.timeout, func() {
+			atomic.StoreInt32(&p.timedOut, 1)
+			cmd.Process.Kill()
+		})
+	}
+	return p, nil
+}
+
+// wait waits for the process to exit, returning a *commandError if it
+// failed.
+func (p *process) wait() error {
+	err := p.cmd.Wait()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if err == nil {
+		return nil
+	}
+	return &commandError{
+		cmd:      p.cmd.Path,
+		err:      err,
+		stderr:   strings.TrimSpace(p.stderr.String()),
+		timedOut: atomic.LoadInt32(&p.timedOut) != 0,
+	}
+}
+
+// tailBuffer is an io.Writer that retains the last max bytes written.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	n := len(b)
+	if len(b) > t.max {
+		b = b[len(b)-t.max:]
+	}
+	if over := len(t.buf) + len(b) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	t.buf = append(t.buf, b...)
+	return n, nil
+}
+
+func (t *tailBuffer) String() string { return string(t.buf) }
+
+// rewindable returns whether w can be rewound by rewind.
+func rewindable(w io.Writer) bool {
+	switch w := w.(type) {
+	case nil, *bytes.Buffer:
+		return true
+	case *os.File:
+		fi, err := w.Stat()
+		return err == nil && fi.Mode().IsRegular()
+	}
+	return w == ioutil.Discard
+}
+
+// rewind discards data written to w.
+func rewind(w io.Writer) error {
+	switch w := w.(type) {
+	case *bytes.Buffer:
+		w.Reset()
+	case *os.File:
+		err := w.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = w.Seek(0, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+// stdinBytes returns a stdin function for run and stream that provides b.
+func stdinBytes(b []byte) func() (io.Reader, error) {
+	return func() (io.Reader, error) { return bytes.NewReader(b), nil }
+}
+
+// stdinLibrary returns a stdin function for run and stream that provides
+// the stream of lib, resetting it before each attempt after the first.
+func stdinLibrary(lib library) func() (io.Reader, error) {
+	var started bool
+	return func() (io.Reader, error) {
+		if started {
+			err := lib.reset()
+			if err != nil {
+				return nil, err
+			}
+		}
+		started = true
+		return lib.stream(), nil
+	}
+}
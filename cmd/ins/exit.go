@@ -0,0 +1,131 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Exit codes.
+const (
+	exitFailure      = 1 // Unclassified failure.
+	exitUsage        = 2 // Invalid command line.
+	exitBadInput     = 3 // Invalid or unreadable input.
+	exitNoBlast      = 4 // BLAST executable not found.
+	exitBlastFailure = 5 // BLAST executable failed.
+	exitStoreFailure = 6 // Data store failure.
+	exitNoRepeats    = 7 // No repeat found.
+)
+
+var exitKinds = map[int]string{
+	exitFailure:      "failure",
+	exitUsage:        "usage",
+	exitBadInput:     "bad-input",
+	exitNoBlast:      "blast-missing",
+	exitBlastFailure: "blast-failure",
+	exitStoreFailure: "store-failure",
+	exitNoRepeats:    "no-repeats",
+}
+
+// exitError is an error with an associated exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string { return e.err.Error() }
+func (e exitError) Unwrap() error { return e.err }
+
+// inputError returns err marked as an input error.
+func inputError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return exitError{code: exitBadInput, err: err}
+}
+
+// storeError returns err marked as a data store error.
+func storeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return exitError{code: exitStoreFailure, err: err}
+}
+
+// exitCode returns the exit code for err.
+func exitCode(err error) int {
+	var e exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return exitNoBlast
+	}
+	var x *exec.ExitError
+	if errors.As(err, &x) {
+		return exitBlastFailure
+	}
+	return exitFailure
+}
+
+// errorJSON is the path to write machine-readable error reports to.
+var errorJSON string
+
+// fatal logs err and exits with the exit code for err, writing a JSON
+// error report to errorJSON if it is not empty.
+func fatal(err error) {
+	code := exitCode(err)
+	log.Print(err)
+	if errorJSON != "" {
+		var stage string
+		if stdLog != nil {
+			stdLog.mu.Lock()
+			stage = stdLog.stage
+			stdLog.mu.Unlock()
+		}
+		b, _err := json.Marshal(struct {
+			Code    int    `json:"code"`
+			Kind    string `json:"kind"`
+			Stage   string `json:"stage,omitempty"`
+			Message string `json:"message"`
+		}{
+			Code:    code,
+			Kind:    exitKinds[code],
+			Stage:   stage,
+			Message: err.Error(),
+		})
+		if _err == nil {
+			_err = ioutil.WriteFile(errorJSON, append(b, '\n'), 0o664)
+		}
+		if _err != nil {
+			log.Printf("failed to write error report: %v", _err)
+		}
+	}
+	runAtExit()
+	os.Exit(code)
+}
+
+// exitFuncs are the functions to run before the program exits.
+var exitFuncs []func()
+
+// atExit registers fn to be run by runAtExit.
+func atExit(fn func()) {
+	exitFuncs = append(exitFuncs, fn)
+}
+
+// runAtExit runs the functions registered by atExit in reverse order
+// of registration. Each function is run at most once.
+func runAtExit() {
+	for len(exitFuncs) != 0 {
+		fn := exitFuncs[len(exitFuncs)-1]
+		exitFuncs = exitFuncs[:len(exitFuncs)-1]
+		fn()
+	}
+}
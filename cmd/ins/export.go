@@ -0,0 +1,184 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// exportTools is the external tool used to write each export format.
+var exportTools = map[string]string{
+	"sqlite":  "sqlite3",
+	"parquet": "duckdb",
+}
+
+// exportColumns are the columns of the exported annotations table.
+var exportColumns = []struct{ name, typ string }{
+	{"seq_name", "TEXT"},
+	{"start", "INTEGER"},
+	{"end", "INTEGER"},
+	{"strand", "TEXT"},
+	{"family", "TEXT"},
+	{"class", "TEXT"},
+	{"rep_start", "INTEGER"},
+	{"rep_end", "INTEGER"},
+	{"rep_left", "INTEGER"},
+	{"bit_score", "REAL"},
+	{"evalue", "REAL"},
+	{"pct_identity", "REAL"},
+	{"sum_score", "REAL"},
+	{"uid", "INTEGER"},
+	{"id", "TEXT"},
+}
+
+// checkExportTool checks that the external tool used to write the given
+// export format is available, and records its version in versions.
+func checkExportTool(format string, versions map[string]string) error {
+	tool, ok := exportTools[format]
+	if !ok {
+		return exitError{code: exitUsage, err: fmt.Errorf("unknown annotation table format: %q", format)}
+	}
+	if !exe.container.runs(tool) {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			return err
+		}
+	}
+	out, err := exe.output(command{tool, "-version"})
+	if err != nil {
+		return fmt.Errorf("%s: %w", tool, err)
+	}
+	v := strings.Fields(string(out))
+	if len(v) == 0 {
+		return fmt.Errorf("%s: no version reported", tool)
+	}
+	versions[tool] = strings.TrimPrefix(v[0], "v")
+	return nil
+}
+
+// checkExportPath returns an error if the annotations table for the given
+// format can not be written to path. The sqlite3 .import command does not
+// allow quotes in its file name to be escaped, so the path of the imported
+// table may not hold quotes or white space.
+func checkExportPath(format, path string) error {
+	if format != "sqlite" {
+		return nil
+	}
+	tsv := path + ".tsv"
+	if strings.ContainsAny(tsv, `'"`) || strings.IndexFunc(tsv, unicode.IsSpace) >= 0 {
+		return exitError{code: exitUsage, err: fmt.Errorf("sqlite table import path %q must not contain quotes or white space", tsv)}
+	}
+	return nil
+}
+
+// export writes the annotations in hits to the file at path as an indexed
+// table in the given format using the external tool for the format. Family
+// classes and lengths are obtained from details. If lift is not nil,
+// annotations are lifted to object coordinates. Start coordinates are
+// zero-based.
+func export(path, format string, hits []blast.Record, details map[string]detail, lift *liftover) error {
+	err := checkExportPath(format, path)
+	if err != nil {
+		return err
+	}
+	tsv := path + ".tsv"
+	err = writeExportTSV(tsv, hits, details, lift, format == "parquet")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tsv)
+
+	err = removeIfExists(path)
+	if err != nil {
+		return err
+	}
+	var (
+		cmd   command
+		stdin func() (io.Reader, error)
+	)
+	switch format {
+	case "sqlite":
+		cols := make([]string, len(exportColumns))
+		for i, c := range exportColumns {
+			cols[i] = fmt.Sprintf("%q %s", c.name, c.typ)
+		}
+		cmd = command{exportTools[format], path}
+		stdin = stdinBytes([]byte(fmt.Sprintf(`CREATE TABLE annotations (%s);
+.mode tabs
+.import '%s' annotations
+CREATE INDEX annotations_position ON annotations (seq_name, start, "end");
+CREATE INDEX annotations_family ON annotations (family);
+CREATE INDEX annotations_class ON annotations (class);
+`, strings.Join(cols, ", "), tsv)))
+	case "parquet":
+		cmd = command{exportTools[format], "-c", fmt.Sprintf(
+			`COPY (SELECT * FROM read_csv_auto('%s', delim='\t', header=true) ORDER BY seq_name, start, "end") TO '%s' (FORMAT parquet)`,
+			sqlQuote(tsv), sqlQuote(path)),
+		}
+	default:
+		return fmt.Errorf("unknown export format: %q", format)
+	}
+	// A failed export may leave a partial table,
+	// so it is not retried.
+	return exe.once().run(cmd, stdin, nil, nil)
+}
+
+// writeExportTSV writes the annotations in hits to the file at path as
+// tab-separated rows of the export columns, with a header line if header
+// is true.
+func writeExportTSV(path string, hits []blast.Record, details map[string]detail, lift *liftover, header bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if header {
+		for i, c := range exportColumns {
+			if i != 0 {
+				w.WriteByte('\t')
+			}
+			w.WriteString(c.name)
+		}
+		w.WriteByte('\n')
+	}
+	for _, h := range hits {
+		if lift != nil {
+			h = liftAnnotation(lift, h)
+		}
+		start, end := subjectSpan(h)
+		strand := "+"
+		if h.Strand < 0 {
+			strand = "-"
+		}
+		repeat := details[h.QueryAccVer]
+		span := consensusCoords(h, repeat.length)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%d\t%d\t%d\t%g\t%g\t%g\t%g\t%d\t%s\n",
+			h.SubjectAccVer, start, end, strand,
+			h.QueryAccVer, repeat.class,
+			span.begin, span.end, span.left,
+			h.BitScore, h.EValue, h.PctIdentity, h.SumScore, h.UID, stableID(h),
+		)
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sqlQuote returns s with single quotes escaped for use in an SQL string
+// literal.
+func sqlQuote(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
@@ -0,0 +1,172 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// fakeExportTools installs fake sqlite3 and duckdb executables in dir and
+// prepends dir to the PATH, returning a function that restores the PATH.
+// The fakes report a version when given -version, and otherwise write
+// their arguments to dir/<tool>.args and their standard input to
+// dir/<tool>.stdin. The fake sqlite3 also copies the file named by an
+// .import command to dir/imported.tsv.
+func fakeExportTools(t *testing.T, dir string) (restore func()) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake export tools require a POSIX shell")
+	}
+	for tool, version := range map[string]string{
+		"sqlite3": "3.45.1 2024-01-30 16:01:20",
+		"duckdb":  "v1.1.3 19864453f7",
+	} {
+		script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "-version" ]; then
+	echo %[3]s
+	exit 0
+fi
+printf '%%s\n' "$@" >%[1]s/%[2]s.args
+cat >%[1]s/%[2]s.stdin
+imported=$(sed -n "s/^\.import '\(.*\)' annotations$/\1/p" %[1]s/%[2]s.stdin)
+if [ -n "$imported" ]; then
+	cp "$imported" %[1]s/imported.tsv
+fi
+`, dir, tool, version)
+		err := ioutil.WriteFile(filepath.Join(dir, tool), []byte(script), 0o755)
+		if err != nil {
+			t.Fatalf("failed to write fake %s: %v", tool, err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestCheckExportTool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-export-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeExportTools(t, dir)()
+
+	versions := make(map[string]string)
+	for _, format := range []string{"sqlite", "parquet"} {
+		err = checkExportTool(format, versions)
+		if err != nil {
+			t.Errorf("unexpected error checking %s tool: %v", format, err)
+		}
+	}
+	want := map[string]string{"sqlite3": "3.45.1", "duckdb": "1.1.3"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("unexpected tool versions: got:%v want:%v", versions, want)
+	}
+	err = checkExportTool("csv", versions)
+	if err == nil {
+		t.Error("expected error for unknown export format")
+	}
+}
+
+var exportHits = []blast.Record{{
+	QueryAccVer:   "L1",
+	SubjectAccVer: "chr1",
+	QueryStart:    0,
+	QueryEnd:      10,
+	SubjectStart:  20,
+	SubjectEnd:    10,
+	BitScore:      100,
+	Strand:        -1,
+}}
+
+var exportDetails = map[string]detail{"L1": {class: "LINE/L1", length: 50}}
+
+func TestExportSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-export-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeExportTools(t, dir)()
+
+	path := filepath.Join(dir, "seq.fa.sqlite")
+	err = export(path, "sqlite", exportHits, exportDetails, nil)
+	if err != nil {
+		t.Fatalf("unexpected error exporting table: %v", err)
+	}
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "sqlite3.args"))
+	if err != nil {
+		t.Fatalf("failed to read sqlite3 arguments: %v", err)
+	}
+	if string(args) != path+"\n" {
+		t.Errorf("unexpected sqlite3 arguments: got:%q want:%q", args, path+"\n")
+	}
+	stdin, err := ioutil.ReadFile(filepath.Join(dir, "sqlite3.stdin"))
+	if err != nil {
+		t.Fatalf("failed to read sqlite3 input: %v", err)
+	}
+	wantImport := fmt.Sprintf(".import '%s.tsv' annotations\n", path)
+	if !strings.Contains(string(stdin), wantImport) {
+		t.Errorf("missing import command %q in sqlite3 input:\n%s", wantImport, stdin)
+	}
+	tsv, err := ioutil.ReadFile(filepath.Join(dir, "imported.tsv"))
+	if err != nil {
+		t.Fatalf("failed to read imported table: %v", err)
+	}
+	wantRow := "chr1\t10\t20\t-\tL1\tLINE/L1\t1\t10\t40\t100\t"
+	if !strings.HasPrefix(string(tsv), wantRow) || strings.Count(string(tsv), "\n") != 1 {
+		t.Errorf("unexpected imported table: got:%q want prefix:%q", tsv, wantRow)
+	}
+	_, err = os.Stat(path + ".tsv")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected imported table to be removed: %v", err)
+	}
+}
+
+func TestExportQuotedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-export-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeExportTools(t, dir)()
+
+	for _, name := range []string{"it's.fa.sqlite", "my seq.fa.sqlite", "tab\tseq.fa.sqlite"} {
+		path := filepath.Join(dir, name)
+		err = export(path, "sqlite", exportHits, exportDetails, nil)
+		if err == nil {
+			t.Errorf("expected error exporting sqlite table to %q", path)
+		}
+		_, err = os.Stat(filepath.Join(dir, "sqlite3.args"))
+		if !os.IsNotExist(err) {
+			t.Errorf("unexpected sqlite3 run for %q", path)
+		}
+	}
+
+	path := filepath.Join(dir, "it's.fa.parquet")
+	err = export(path, "parquet", exportHits, exportDetails, nil)
+	if err != nil {
+		t.Fatalf("unexpected error exporting parquet table: %v", err)
+	}
+	args, err := ioutil.ReadFile(filepath.Join(dir, "duckdb.args"))
+	if err != nil {
+		t.Fatalf("failed to read duckdb arguments: %v", err)
+	}
+	quoted := strings.Replace(path, "'", "''", -1)
+	wantSQL := fmt.Sprintf(`read_csv_auto('%s.tsv', delim='\t', header=true)`, quoted)
+	if !strings.HasPrefix(string(args), "-c\n") || !strings.Contains(string(args), wantSQL) || !strings.Contains(string(args), fmt.Sprintf("TO '%s' (FORMAT parquet)", quoted)) {
+		t.Errorf("unexpected duckdb arguments for quoted path:\n%s", args)
+	}
+}
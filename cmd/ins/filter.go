@@ -0,0 +1,66 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// filter is a set of output thresholds applied to final annotations.
+// Zero values disable the corresponding threshold.
+type filter struct {
+	minLen      int
+	minScore    float64
+	maxEValue   float64
+	minIdentity float64
+
+	// exclude holds the sorted disjoint
+	// intervals of each sequence in which
+	// annotations are not reported.
+	exclude map[string][]gap
+}
+
+// keep returns whether r passes the filter.
+func (f filter) keep(r blast.Record) bool {
+	left, right := subjectSpan(r)
+	switch {
+	case f.minLen > 0 && right-left < f.minLen:
+		return false
+	case f.minScore > 0 && r.BitScore < f.minScore:
+		return false
+	case f.maxEValue > 0 && r.EValue > f.maxEValue:
+		return false
+	case f.minIdentity > 0 && r.PctIdentity < f.minIdentity:
+		return false
+	case excluded(f.exclude[r.SubjectAccVer], left, right):
+		return false
+	}
+	return true
+}
+
+// excluded returns whether [left, right) overlaps any of the sorted disjoint
+// intervals in ivs.
+func excluded(ivs []gap, left, right int) bool {
+	i := sort.Search(len(ivs), func(i int) bool { return ivs[i].end > left })
+	return i < len(ivs) && ivs[i].start < right
+}
+
+// maskable returns whether the family or class of h matches one of the
+// patterns. A pattern matching a class also matches its subclasses. If
+// patterns is empty, all hits are maskable.
+func maskable(h blast.Record, details map[string]detail, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	class := details[h.QueryAccVer].class
+	for _, p := range patterns {
+		if (familyParams{pattern: p}).matches(h.QueryAccVer, class) {
+			return true
+		}
+	}
+	return false
+}
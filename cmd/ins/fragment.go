@@ -5,10 +5,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"modernc.org/kv"
 
@@ -21,60 +27,434 @@ import (
 	"github.com/kortschak/ins/internal/store"
 )
 
+// minGapLen is the shortest run of N that is treated as an assembly gap.
+const minGapLen = 10
+
+// gap is an assembly gap in a query sequence.
+type gap struct {
+	start, end int
+}
+
+// exclusion describes regions of the query that are not searched.
+type exclusion struct {
+	// lower specifies that lower case
+	// soft-masked letters are excluded.
+	lower bool
+
+	// regions holds the sorted disjoint
+	// excluded intervals of each sequence.
+	regions map[string][]gap
+}
+
+// apply replaces the letters of the sequence s with the given id that are
+// excluded by e with N.
+func (e exclusion) apply(id string, s []alphabet.Letter) {
+	if e.lower {
+		for i, l := range s {
+			if 'a' <= l && l <= 'z' {
+				s[i] = 'N'
+			}
+		}
+	}
+	for _, iv := range e.regions[id] {
+		start, end := iv.start, iv.end
+		if end > len(s) {
+			end = len(s)
+		}
+		for i := start; i < end; i++ {
+			s[i] = 'N'
+		}
+	}
+}
+
 // split splits the fasta sequence read from src into fragments that are no longer
-// than max but segmenting into fragments that are goal long. It writes the coordinates
-// of the sequence relative to the original in the first three space separated fields
-// of the fasta description and returns a map containing a look-up table from the
-// generated sequences to the parent and coordinates.
-func split(dst io.Writer, src io.Reader, goal, max int) (map[string]fragment, error) {
+// than max but segmenting into fragments that are goal long, with adjacent fragments
+// overlapping by overlap bases. Assembly gaps are
+// excluded from fragments, longer sequence segments are preferentially cut at
+// shorter runs of N, and fragments that are entirely N are dropped. Fragments are
+// given surrogate identifiers so that they cannot collide with query sequence
+// identifiers or be altered by BLAST identifier parsing. It writes the parent
+// identifier and coordinates of the sequence relative to the original in the first
+// three space separated fields of the fasta description and returns a map containing
+// a look-up table from the generated sequences to the parent and coordinates, and a
+// map of the assembly gaps in each sequence. Regions excluded by excl are replaced
+// with N after assembly gaps are found so that they are not searched.
+func split(dst io.Writer, src io.Reader, goal, max, overlap int, excl exclusion) (map[string]fragment, map[string][]gap, error) {
 	frags := make(map[string]fragment)
+	gaps := make(map[string][]gap)
 	sc := seqio.NewScanner(fasta.NewReader(src, linear.NewSeq("", nil, alphabet.DNA)))
 	i := 1
 	for sc.Next() {
-		pos := 0
 		seq := sc.Seq().(*linear.Seq)
 		id := seq.ID
 		desc := seq.Desc
-		for seq.Len() > max {
-			tmp := *seq
-			n := min(len(tmp.Seq), goal)
-			tmp.Seq = tmp.Seq[:n]
-			tmp.ID = fmt.Sprintf("%s_%d", id, i)
-			tmp.Desc = fmt.Sprintf("%s %d %d %s", id, pos, pos+n, desc)
-			if _, ok := frags[tmp.ID]; ok {
-				return nil, fmt.Errorf("non-unique sequence id in input: %q", id)
-			}
-			frags[tmp.ID] = fragment{parent: id, start: pos, end: pos + n}
-			fmt.Fprintf(dst, "%60a\n", &tmp)
-			seq.Seq = seq.Seq[n:]
-			pos += n
-			i++
+		if _, ok := gaps[id]; ok {
+			return nil, nil, fmt.Errorf("non-unique sequence id in input: %q", id)
 		}
-		seq.ID = fmt.Sprintf("%s_%d", id, i)
-		seq.Desc = fmt.Sprintf("%s %d %d %s", id, pos, pos+seq.Len(), desc)
-		if _, ok := frags[seq.ID]; ok {
-			return nil, fmt.Errorf("non-unique sequence id in input: %q", id)
+		g := nRuns(seq.Seq, minGapLen)
+		gaps[id] = g
+		excl.apply(id, seq.Seq)
+		for _, seg := range segments(len(seq.Seq), g) {
+			for pos := seg.start; pos < seg.end; {
+				n := seg.end - pos
+				if n > max {
+					n = cutPoint(seq.Seq[pos:seg.end], goal, max)
+				}
+				if allN(seq.Seq[pos : pos+n]) {
+					pos += n
+					continue
+				}
+				next := pos + n
+				if next < seg.end && n > overlap {
+					next -= overlap
+				}
+				tmp := *seq
+				tmp.Seq = seq.Seq[pos : pos+n]
+				tmp.ID = fmt.Sprintf("frag_%d", i)
+				tmp.Desc = fmt.Sprintf("%s %d %d %s", id, pos, pos+n, desc)
+				frags[tmp.ID] = fragment{parent: id, start: pos, end: pos + n}
+				fmt.Fprintf(dst, "%60a\n", &tmp)
+				pos = next
+				i++
+			}
 		}
-		frags[seq.ID] = fragment{parent: id, start: pos, end: pos + seq.Len()}
-		fmt.Fprintf(dst, "%60a\n", seq)
 	}
 	if err := sc.Error(); err != nil {
-		return nil, fmt.Errorf("error during sequence read: %w", err)
+		return nil, nil, fmt.Errorf("error during sequence read: %w", err)
+	}
+	return frags, gaps, nil
+}
+
+// checkUniqueIDs returns an error listing the records of the fasta data
+// read from r that have the identifier of an earlier record.
+func checkUniqueIDs(r io.Reader) error {
+	type record struct {
+		n, line int
+	}
+	var (
+		seen  = make(map[string]record)
+		dups  []string
+		n     int
+		lines = bufio.NewReader(r)
+	)
+	for line := 1; ; line++ {
+		b, err := lines.ReadBytes('\n')
+		if len(b) != 0 && b[0] == '>' {
+			n++
+			id := libID(b)
+			if first, ok := seen[id]; ok {
+				dups = append(dups, fmt.Sprintf("%q at record %d (line %d) first seen at record %d (line %d)", id, n, line, first.n, first.line))
+			} else {
+				seen[id] = record{n: n, line: line}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+	}
+	if len(dups) != 0 {
+		return fmt.Errorf("non-unique sequence ids in input:\n\t%s", strings.Join(dups, "\n\t"))
+	}
+	return nil
+}
+
+// writeFragments writes the fragment look-up table mx to the file at path
+// as tab-separated fragment ID, parent ID, start and end.
+func writeFragments(path string, mx map[string]fragment) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	ids := make([]string, 0, len(mx))
+	for id := range mx {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		frag := mx[id]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", id, frag.parent, frag.start, frag.end)
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readFragments reads a fragment look-up table written by writeFragments
+// from the file at path.
+func readFragments(path string) (map[string]fragment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mx := make(map[string]fragment)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var (
+			id   string
+			frag fragment
+		)
+		_, err = fmt.Sscanf(sc.Text(), "%s\t%s\t%d\t%d", &id, &frag.parent, &frag.start, &frag.end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fragment line %q: %w", sc.Text(), err)
+		}
+		mx[id] = frag
+	}
+	return mx, sc.Err()
+}
+
+// writeGaps writes the assembly gaps in gaps to the file at path in
+// BED format.
+func writeGaps(path string, gaps map[string][]gap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	ids := make([]string, 0, len(gaps))
+	for id := range gaps {
+		ids = append(ids, id)
 	}
-	return frags, nil
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, g := range gaps[id] {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", id, g.start, g.end)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readGaps reads assembly gaps written by writeGaps from the file at path.
+func readGaps(path string) (map[string][]gap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gaps := make(map[string][]gap)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var (
+			id string
+			g  gap
+		)
+		_, err = fmt.Sscanf(sc.Text(), "%s\t%d\t%d", &id, &g.start, &g.end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gap line %q: %w", sc.Text(), err)
+		}
+		gaps[id] = append(gaps[id], g)
+	}
+	return gaps, sc.Err()
+}
+
+// isN returns whether l is an N.
+func isN(l alphabet.Letter) bool {
+	return l == 'N' || l == 'n'
+}
+
+// allN returns whether all the letters in s are N.
+func allN(s []alphabet.Letter) bool {
+	for _, l := range s {
+		if !isN(l) {
+			return false
+		}
+	}
+	return true
+}
+
+// nRuns returns the runs of N in s that are at least min long.
+func nRuns(s []alphabet.Letter, min int) []gap {
+	var runs []gap
+	start := -1
+	for i, l := range s {
+		switch {
+		case isN(l) && start < 0:
+			start = i
+		case !isN(l) && start >= 0:
+			if i-start >= min {
+				runs = append(runs, gap{start: start, end: i})
+			}
+			start = -1
+		}
+	}
+	if start >= 0 && len(s)-start >= min {
+		runs = append(runs, gap{start: start, end: len(s)})
+	}
+	return runs
+}
+
+// segments returns the intervals of a sequence of length n that
+// are not within gaps.
+func segments(n int, gaps []gap) []gap {
+	var segs []gap
+	pos := 0
+	for _, g := range gaps {
+		if g.start > pos {
+			segs = append(segs, gap{start: pos, end: g.start})
+		}
+		pos = g.end
+	}
+	if pos < n {
+		segs = append(segs, gap{start: pos, end: n})
+	}
+	return segs
+}
+
+// cutPoint returns the length of the first fragment to cut from s. The cut
+// is made in the run of N nearest to goal within the range goal/2 to max if
+// there is one, and at goal otherwise.
+func cutPoint(s []alphabet.Letter, goal, max int) int {
+	best := -1
+	for _, r := range nRuns(s[:max], 1) {
+		mid := (r.start + r.end) / 2
+		if mid < goal/2 || mid == 0 {
+			continue
+		}
+		if best < 0 || abs(mid-goal) < abs(best-goal) {
+			best = mid
+		}
+	}
+	if best < 0 {
+		return goal
+	}
+	return best
+}
+
+// abs returns the absolute value of a.
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
 }
 
 // remapCoords adjusts hits so that subjects (genome sequence) are mapped against
-// the original un-fragmented genome sequence consumed by split. It then sorts
-// hits by strand, repeat type, position and BLAST bitscore.
-func remapCoords(hits []blast.Record, frags map[string]fragment) {
+// the original un-fragmented genome sequence consumed by split. Hits that are
+// duplicated in the overlap between adjacent fragments are removed and hits that
+// are truncated at a fragment boundary are joined with their continuation in the
+// adjacent fragment. The returned hits are sorted by repeat type, subject, strand
+// and position, and use the backing array of hits.
+func remapCoords(hits []blast.Record, frags map[string]fragment) []blast.Record {
+	type remapped struct {
+		blast.Record
+		frag fragment
+	}
+	rs := make([]remapped, len(hits))
 	for i, r := range hits {
 		iv := frags[r.SubjectAccVer]
 		r.SubjectAccVer = iv.parent
 		r.SubjectStart += iv.start
 		r.SubjectEnd += iv.start
-		hits[i] = r
+		rs[i] = remapped{Record: r, frag: iv}
 	}
+	sort.Slice(rs, func(i, j int) bool {
+		a, b := rs[i], rs[j]
+		if a.QueryAccVer != b.QueryAccVer {
+			return a.QueryAccVer < b.QueryAccVer
+		}
+		if a.SubjectAccVer != b.SubjectAccVer {
+			return a.SubjectAccVer < b.SubjectAccVer
+		}
+		if a.Strand != b.Strand {
+			return a.Strand < b.Strand
+		}
+		al, ar := subjectSpan(a.Record)
+		bl, br := subjectSpan(b.Record)
+		if al != bl {
+			return al < bl
+		}
+		return ar < br
+	})
+
+	hits = hits[:0]
+	for i := 0; i < len(rs); {
+		cur := rs[i]
+		j := i + 1
+		for ; j < len(rs); j++ {
+			next := rs[j]
+			if next.QueryAccVer != cur.QueryAccVer || next.SubjectAccVer != cur.SubjectAccVer || next.Strand != cur.Strand {
+				break
+			}
+			_, cr := subjectSpan(cur.Record)
+			nl, _ := subjectSpan(next.Record)
+			if nl >= cr {
+				break
+			}
+			if next.frag == cur.frag {
+				break
+			}
+			duplicate := next.SubjectStart == cur.SubjectStart && next.SubjectEnd == cur.SubjectEnd &&
+				next.QueryStart == cur.QueryStart && next.QueryEnd == cur.QueryEnd
+			if !duplicate && !atBoundary(cur.Record, cur.frag, next.Record, next.frag) {
+				break
+			}
+			if next.QueryStart > cur.QueryEnd+near || cur.QueryStart > next.QueryEnd+near {
+				break
+			}
+			cur.Record = join(cur.Record, next.Record)
+			cur.frag = next.frag
+		}
+		hits = append(hits, cur.Record)
+		i = j
+	}
+	return hits
+}
+
+// atBoundary returns whether the genomic overlap of a from fragment fa and b
+// from the following fragment fb is due to the fragment overlap, with a reaching
+// the right end of fa or b reaching the left end of fb.
+func atBoundary(a blast.Record, fa fragment, b blast.Record, fb fragment) bool {
+	if fb.start >= fa.end || fb.parent != fa.parent {
+		return false
+	}
+	_, ar := subjectSpan(a)
+	bl, _ := subjectSpan(b)
+	return ar >= fa.end-near || bl <= fb.start+near
+}
+
+// join returns the union of the hits a and b, which must be on the same
+// strand of the same subject and query. The alignment statistics are taken
+// from the higher scoring hit.
+func join(a, b blast.Record) blast.Record {
+	if b.BitScore > a.BitScore {
+		a, b = b, a
+	}
+	j := a
+	al, ar := subjectSpan(a)
+	bl, br := subjectSpan(b)
+	left, right := min(al, bl), max(ar, br)
+	if a.SubjectEnd < a.SubjectStart {
+		j.SubjectStart, j.SubjectEnd = right, left
+	} else {
+		j.SubjectStart, j.SubjectEnd = left, right
+	}
+	j.QueryStart = min(a.QueryStart, b.QueryStart)
+	j.QueryEnd = max(a.QueryEnd, b.QueryEnd)
+	j.AlignmentLength = max(a.AlignmentLength, right-left)
+	if b.EValue < j.EValue {
+		j.EValue = b.EValue
+	}
+	return j
+}
+
+// subjectSpan returns the left and right subject coordinates of r.
+func subjectSpan(r blast.Record) (left, right int) {
+	if r.SubjectEnd < r.SubjectStart {
+		return r.SubjectEnd, r.SubjectStart
+	}
+	return r.SubjectStart, r.SubjectEnd
 }
 
 type fragment struct {
@@ -83,52 +463,51 @@ type fragment struct {
 }
 
 // merge takes a sorted set of hits and groups them into individual regions based
-// on proximity. If adjacent hits are within near, they are grouped.
-func merge(hits *kv.DB, near int, dir string) (regions *kv.DB, err error) {
+// on proximity. If adjacent hits are within near, they are grouped. If tol is not
+// negative, hits that do not overlap in the genome are only grouped if they are
+// also adjacent within tol bases in the coordinates of the library consensus.
+// If limit is positive, regions grouping more than limit hits are reduced to
+// the span of their limit highest scoring hits. The value of each region holds
+// the number of hits grouped followed by the number omitted by the limit.
+func merge(hits *kv.DB, near, tol, limit int, dir string) (regions *kv.DB, err error) {
 	log.Println("merging regions")
 
-	opts := &kv.Options{Compare: store.GroupByQueryOrderSubjectLeft}
-	regions, err = kv.Create(filepath.Join(dir, "regions.db"), opts)
+	regions, err = store.Create(filepath.Join(dir, "regions.db"), store.Regions, insVersion())
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 
-	it, err := hits.SeekFirst()
-	if err != nil {
-		return nil, err
+	c := store.Iterate(hits)
+	if !c.Next() {
+		if c.Err() != nil {
+			return nil, c.Err()
+		}
+		return nil, io.EOF
 	}
-	k, _, err := it.Next()
-	if err != nil {
-		return nil, err
+	last := c.Key()
+	// members holds the hits of the region being
+	// grouped when the number of hits is limited.
+	var members []store.BlastRecordKey
+	if limit > 0 {
+		members = append(members, last)
 	}
-	last := store.UnmarshalBlastRecordKey(k)
+	// edge is the consensus position at the right
+	// end of the region being grouped. Keys hold
+	// query coordinates in subject order.
+	edge := last.QueryEnd
 	last.QueryStart, last.QueryEnd = 0, 0
 	n := 1
 	const batch = 100
 	i, inTx := 0, false
-	for {
-		k, _, err := it.Next()
-		if err != nil {
-			if err == io.EOF {
-				if inTx {
-					err = regions.Commit()
-					if err != nil {
-						return nil, err
-					}
-				}
-				break
-			}
-			_err := regions.Commit()
-			if _err != nil {
-				log.Printf("failed to commit regions during failure: %v", err)
-			}
-			return nil, err
-		}
-
-		r := store.UnmarshalBlastRecordKey(k)
-		if r.SubjectLeft-last.SubjectRight <= int64(near) && r.Strand == last.Strand && r.SubjectAccVer == last.SubjectAccVer && r.QueryAccVer == last.QueryAccVer {
+	for c.Next() {
+		r := c.Key()
+		if r.SubjectLeft-last.SubjectRight <= int64(near) && r.Strand == last.Strand && r.SubjectAccVer == last.SubjectAccVer && r.QueryAccVer == last.QueryAccVer && collinear(r, last, edge, tol) {
 			if r.SubjectRight > last.SubjectRight {
 				last.SubjectRight = r.SubjectRight
+				edge = r.QueryEnd
+			}
+			if limit > 0 {
+				members = append(members, r)
 			}
 			n++
 			continue
@@ -142,17 +521,17 @@ func merge(hits *kv.DB, near int, dir string) (regions *kv.DB, err error) {
 			}
 		}
 
-		err = regions.Set(store.MarshalBlastRecordKey(blast.Record{
-			SubjectAccVer: last.SubjectAccVer,
-			SubjectStart:  int(last.SubjectLeft),
-			SubjectEnd:    int(last.SubjectRight),
-			QueryAccVer:   last.QueryAccVer,
-			Strand:        last.Strand,
-		}), store.MarshalInt(n))
+		region, omitted := capRegion(last, members, limit)
+		err = regions.Set(regionKey(region), regionValue(n, omitted))
 		if err != nil {
 			return nil, err
 		}
 		last = r
+		if limit > 0 {
+			members = append(members[:0], r)
+		}
+		edge = last.QueryEnd
+		last.QueryStart, last.QueryEnd = 0, 0
 		n = 1
 
 		if i%batch == batch-1 {
@@ -164,22 +543,32 @@ func merge(hits *kv.DB, near int, dir string) (regions *kv.DB, err error) {
 		}
 		i++
 	}
+	if c.Err() != nil {
+		if inTx {
+			err := regions.Commit()
+			if err != nil {
+				log.Printf("failed to commit regions during failure: %v", c.Err())
+			}
+		}
+		return nil, c.Err()
+	}
+	if inTx {
+		err = regions.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
 	final, _, err := regions.Last()
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
-	if err == io.EOF || final == nil || last != store.UnmarshalBlastRecordKey(final) {
+	region, omitted := capRegion(last, members, limit)
+	if err == io.EOF || final == nil || store.IsHeader(final) || !bytes.Equal(regionKey(region), final) {
 		err = regions.BeginTransaction()
 		if err != nil {
 			return nil, err
 		}
-		err = regions.Set(store.MarshalBlastRecordKey(blast.Record{
-			SubjectAccVer: last.SubjectAccVer,
-			SubjectStart:  int(last.SubjectLeft),
-			SubjectEnd:    int(last.SubjectRight),
-			QueryAccVer:   last.QueryAccVer,
-			Strand:        last.Strand,
-		}), store.MarshalInt(n))
+		err = regions.Set(regionKey(region), regionValue(n, omitted))
 		if err != nil {
 			return nil, err
 		}
@@ -192,9 +581,84 @@ func merge(hits *kv.DB, near int, dir string) (regions *kv.DB, err error) {
 	return regions, nil
 }
 
+// regionKey returns the regions store key for the merged region r.
+func regionKey(r store.BlastRecordKey) []byte {
+	return store.MarshalBlastRecordKey(blast.Record{
+		SubjectAccVer: r.SubjectAccVer,
+		SubjectStart:  int(r.SubjectLeft),
+		SubjectEnd:    int(r.SubjectRight),
+		QueryAccVer:   r.QueryAccVer,
+		Strand:        r.Strand,
+	})
+}
+
+// regionValue returns the regions store value for a merged region grouping
+// n hits with omitted hits dropped by the region hit limit.
+func regionValue(n, omitted int) []byte {
+	return append(store.MarshalInt(n), store.MarshalInt(omitted)...)
+}
+
+// regionOmitted returns the number of hits omitted from a merged region
+// by the region hit limit held in the regions store value v. Values
+// written before hits were limited hold only the number of hits.
+func regionOmitted(v []byte) int {
+	if len(v) < 16 {
+		return 0
+	}
+	return store.UnmarshalInt(v[8:])
+}
+
+// capRegion returns the merged region last reduced to the span of the
+// limit highest scoring of its member hits, and the number of members
+// omitted. If limit is not positive or is not exceeded, last is returned
+// unaltered. The order of members is not retained.
+func capRegion(last store.BlastRecordKey, members []store.BlastRecordKey, limit int) (store.BlastRecordKey, int) {
+	if limit <= 0 || len(members) <= limit {
+		return last, 0
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].BitScore > members[j].BitScore
+	})
+	last.SubjectLeft, last.SubjectRight = math.MaxInt64, math.MinInt64
+	for _, m := range members[:limit] {
+		if m.SubjectLeft < last.SubjectLeft {
+			last.SubjectLeft = m.SubjectLeft
+		}
+		if m.SubjectRight > last.SubjectRight {
+			last.SubjectRight = m.SubjectRight
+		}
+	}
+	return last, len(members) - limit
+}
+
+// flankRegion returns the region [left, right) extended by flank bases on
+// each side, clamped to the bounds of a sequence of the given length.
+func flankRegion(left, right, flank, length int) (int, int) {
+	return max(0, left-flank), min(length, right+flank)
+}
+
+// collinear returns whether the hit r can extend the region last, with
+// consensus position edge at its right end, given the consensus distance
+// tolerance tol. Hits that overlap the region in the genome are always
+// collinear, as are all hits when tol is negative.
+func collinear(r, last store.BlastRecordKey, edge int64, tol int) bool {
+	if tol < 0 || r.SubjectLeft < last.SubjectRight {
+		return true
+	}
+	d := int64(r.Strand) * (r.QueryStart - edge)
+	return -int64(tol) <= d && d <= int64(tol)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
 	}
 	return b
 }
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
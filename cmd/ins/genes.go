@@ -0,0 +1,283 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// geneIndex is an index of the genes and gene parts of a GFF3 gene
+// annotation by sequence.
+type geneIndex struct {
+	// genes holds the gene spans on each
+	// sequence sorted by start, and byEnd
+	// holds the same spans sorted by end.
+	genes map[string]*intervals
+	byEnd map[string][]geneSpan
+
+	// exons and utrs hold the exon and CDS,
+	// and UTR spans on each sequence.
+	exons map[string]*intervals
+	utrs  map[string]*intervals
+}
+
+// geneSpan is a half-open interval of a sequence with an identifier.
+type geneSpan struct {
+	start, end int
+	id         string
+}
+
+// intervals is a set of spans sorted by start with the length of the
+// longest span.
+type intervals struct {
+	spans  []geneSpan
+	maxLen int
+}
+
+// overlapping returns the spans of the set that overlap [start, end).
+func (iv *intervals) overlapping(start, end int) []geneSpan {
+	if iv == nil {
+		return nil
+	}
+	var o []geneSpan
+	i := sort.Search(len(iv.spans), func(i int) bool { return iv.spans[i].start >= end })
+	for i--; i >= 0 && iv.spans[i].start > start-iv.maxLen; i-- {
+		if iv.spans[i].end > start {
+			o = append(o, iv.spans[i])
+		}
+	}
+	return o
+}
+
+// geneTypes are the GFF3 feature types treated as genes.
+var geneTypes = map[string]bool{
+	"gene":                      true,
+	"pseudogene":                true,
+	"ncRNA_gene":                true,
+	"transposable_element_gene": true,
+}
+
+// readGenes returns an index of the genes, exons and UTRs in the GFF3
+// file at path. Features are identified by their ID attribute, or their
+// Name attribute if they have no ID.
+func readGenes(path string) (*geneIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	add := func(m map[string]*intervals, seq string, s geneSpan) {
+		iv, ok := m[seq]
+		if !ok {
+			iv = &intervals{}
+			m[seq] = iv
+		}
+		iv.spans = append(iv.spans, s)
+		if l := s.end - s.start; l > iv.maxLen {
+			iv.maxLen = l
+		}
+	}
+	g := geneIndex{
+		genes: make(map[string]*intervals),
+		byEnd: make(map[string][]geneSpan),
+		exons: make(map[string]*intervals),
+		utrs:  make(map[string]*intervals),
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, bufio.MaxScanTokenSize<<4)
+	var line int
+	for sc.Scan() {
+		line++
+		b := bytes.TrimSpace(sc.Bytes())
+		if bytes.Equal(b, []byte("##FASTA")) {
+			break
+		}
+		if len(b) == 0 || b[0] == '#' {
+			continue
+		}
+		fields := strings.Split(string(b), "\t")
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("genes: too few fields at line %d: %q", line, b)
+		}
+		start, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("genes: invalid start at line %d: %w", line, err)
+		}
+		end, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("genes: invalid end at line %d: %w", line, err)
+		}
+		if end < start {
+			return nil, fmt.Errorf("genes: inverted feature at line %d: %d-%d", line, start, end)
+		}
+		// Convert to zero-based half-open.
+		s := geneSpan{start: start - 1, end: end}
+		seq, typ := fields[0], fields[2]
+		switch {
+		case geneTypes[typ]:
+			s.id = gffID(fields[8])
+			if s.id == "" {
+				s.id = fmt.Sprintf("%s:%d-%d", seq, start, end)
+			}
+			add(g.genes, seq, s)
+		case typ == "exon" || typ == "CDS":
+			add(g.exons, seq, s)
+		case strings.Contains(strings.ToLower(typ), "utr"):
+			add(g.utrs, seq, s)
+		}
+	}
+	err = sc.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range []map[string]*intervals{g.genes, g.exons, g.utrs} {
+		for _, iv := range m {
+			sort.Slice(iv.spans, func(i, j int) bool { return iv.spans[i].start < iv.spans[j].start })
+		}
+	}
+	for seq, iv := range g.genes {
+		byEnd := append([]geneSpan(nil), iv.spans...)
+		sort.Slice(byEnd, func(i, j int) bool { return byEnd[i].end < byEnd[j].end })
+		g.byEnd[seq] = byEnd
+	}
+	return &g, nil
+}
+
+// gffID returns the ID attribute, or the Name attribute if there is no
+// ID, of the GFF3 attributes column attr.
+func gffID(attr string) string {
+	var name string
+	for _, a := range strings.Split(attr, ";") {
+		i := strings.Index(a, "=")
+		if i < 0 {
+			continue
+		}
+		val, err := url.PathUnescape(a[i+1:])
+		if err != nil {
+			val = a[i+1:]
+		}
+		switch strings.TrimSpace(a[:i]) {
+		case "ID":
+			return val
+		case "Name":
+			name = val
+		}
+	}
+	return name
+}
+
+// geneContext is the relationship of an annotation to the genes of a
+// gene annotation.
+type geneContext struct {
+	// Overlap is a comma-separated list of the
+	// gene parts overlapped, exon, intron and
+	// UTR, or intergenic.
+	Overlap string
+
+	// Nearest is the identifier of the gene
+	// with the largest overlap with the
+	// annotation, or of the nearest gene if
+	// there is no overlap, and Distance is
+	// the distance to it. Nearest is empty
+	// if the sequence has no genes.
+	Nearest  string
+	Distance int
+}
+
+// context returns the gene context of rec.
+func (g *geneIndex) context(rec blast.Record) geneContext {
+	seq := rec.SubjectAccVer
+	start, end := subjectSpan(rec)
+
+	var c geneContext
+	genes := g.genes[seq].overlapping(start, end)
+	if len(genes) == 0 {
+		c.Overlap = "intergenic"
+		c.Nearest, c.Distance = g.nearest(seq, start, end)
+		return c
+	}
+
+	var (
+		best    int
+		overlap []string
+	)
+	for _, s := range genes {
+		if o := min(s.end, end) - max(s.start, start); o > best {
+			best = o
+			c.Nearest = s.id
+		}
+	}
+	exons := g.exons[seq].overlapping(start, end)
+	utrs := g.utrs[seq].overlapping(start, end)
+	if len(exons) != 0 {
+		overlap = append(overlap, "exon")
+	}
+	if coverage(genes, start, end) > coverage(append(exons, utrs...), start, end) {
+		overlap = append(overlap, "intron")
+	}
+	if len(utrs) != 0 {
+		overlap = append(overlap, "UTR")
+	}
+	c.Overlap = strings.Join(overlap, ",")
+	return c
+}
+
+// nearest returns the identifier of the gene on seq nearest to the span
+// [start, end), which overlaps no gene, and its distance.
+func (g *geneIndex) nearest(seq string, start, end int) (id string, dist int) {
+	dist = -1
+	if iv := g.genes[seq]; iv != nil {
+		i := sort.Search(len(iv.spans), func(i int) bool { return iv.spans[i].start >= end })
+		if i < len(iv.spans) {
+			id, dist = iv.spans[i].id, iv.spans[i].start-end
+		}
+	}
+	byEnd := g.byEnd[seq]
+	i := sort.Search(len(byEnd), func(i int) bool { return byEnd[i].end > start })
+	if i > 0 {
+		if d := start - byEnd[i-1].end; dist < 0 || d < dist {
+			id, dist = byEnd[i-1].id, d
+		}
+	}
+	if dist < 0 {
+		dist = 0
+	}
+	return id, dist
+}
+
+// coverage returns the number of bases of [start, end) covered by spans.
+func coverage(spans []geneSpan, start, end int) int {
+	clipped := make([]geneSpan, 0, len(spans))
+	for _, s := range spans {
+		s.start, s.end = max(s.start, start), min(s.end, end)
+		if s.start < s.end {
+			clipped = append(clipped, s)
+		}
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i].start < clipped[j].start })
+	var (
+		n    int
+		last = start
+	)
+	for _, s := range clipped {
+		if s.end <= last {
+			continue
+		}
+		n += s.end - max(s.start, last)
+		last = s.end
+	}
+	return n
+}
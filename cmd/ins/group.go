@@ -0,0 +1,123 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// hspGroup is the set of HSPs of a single BLAST hit, identified by their
+// shared UID.
+type hspGroup struct {
+	// span is the union of the HSPs in output
+	// coordinates.
+	span blast.Record
+
+	// local is the union of the HSPs in query
+	// coordinates on the sequence named seq.
+	seq   string
+	local gap
+
+	// id is the stable ID of the group. It is
+	// distinct from the ID of an HSP with the
+	// same span.
+	id string
+
+	// written is whether the parent feature
+	// for the group has been written.
+	written bool
+}
+
+// hspGroups returns the HSP groups of the records in hits that pass the
+// output filter, keyed by UID. Records without a UID are not grouped.
+func (r run) hspGroups(hits *kv.DB) (map[int64]*hspGroup, error) {
+	groups := make(map[int64]*hspGroup)
+	c := store.Iterate(hits)
+	for c.Next() {
+		rec, err := c.Record()
+		if err != nil {
+			return nil, err
+		}
+		if rec.UID == 0 || !r.filter.keep(rec) {
+			continue
+		}
+		seq := rec.SubjectAccVer
+		localLeft, localRight := subjectSpan(rec)
+		if r.lift != nil {
+			rec, _ = r.lift.liftRecord(rec)
+		}
+		left, right := subjectSpan(rec)
+		g, ok := groups[rec.UID]
+		if !ok {
+			rec.SubjectStart, rec.SubjectEnd = left, right
+			groups[rec.UID] = &hspGroup{span: rec, seq: seq, local: gap{start: localLeft, end: localRight}}
+			continue
+		}
+		g.local.start = min(g.local.start, localLeft)
+		g.local.end = max(g.local.end, localRight)
+		g.span.SubjectStart = min(g.span.SubjectStart, left)
+		g.span.SubjectEnd = max(g.span.SubjectEnd, right)
+		g.span.QueryStart = min(g.span.QueryStart, min(rec.QueryStart, rec.QueryEnd))
+		g.span.QueryEnd = max(g.span.QueryEnd, max(rec.QueryStart, rec.QueryEnd))
+	}
+	if c.Err() != nil {
+		return nil, c.Err()
+	}
+	for _, g := range groups {
+		g.id = stableID(g.span) + "-hit"
+	}
+	return groups, nil
+}
+
+// writeParent writes the parent feature of the HSP group g to enc.
+func (r run) writeParent(enc *gff.Writer, g *hspGroup) error {
+	rec := g.span
+	repeat := r.details[rec.QueryAccVer]
+	span := consensusCoords(rec, repeat.length)
+	pos := span.String()
+	if r.rmCoords {
+		pos = span.repeatMasker(rec.Strand)
+	}
+	feat := &gff.Feature{
+		SeqName:    rec.SubjectAccVer,
+		Source:     "ins",
+		Feature:    "repeat",
+		FeatStart:  rec.SubjectStart,
+		FeatEnd:    rec.SubjectEnd,
+		FeatScore:  &rec.SumScore,
+		FeatStrand: seq.Strand(rec.Strand),
+		FeatFrame:  gff.NoFrame,
+		FeatAttributes: gff.Attributes{
+			{
+				Tag:   "Repeat",
+				Value: fmt.Sprintf("%s %s %s", rec.QueryAccVer, repeat.class, pos),
+			},
+			{
+				Tag:   "ID",
+				Value: g.id,
+			},
+			{
+				Tag:   "UID",
+				Value: fmt.Sprint(rec.UID),
+			},
+		},
+	}
+	if r.tsdLen.max != 0 {
+		feat.FeatAttributes = appendTSD(feat.FeatAttributes, r.genome.tsd(g.seq, g.local.start, g.local.end, r.tsdLen))
+	}
+	_, err := enc.Write(feat)
+	if err != nil {
+		return fmt.Errorf("failed to write feature: %w", err)
+	}
+	g.written = true
+	return nil
+}
@@ -0,0 +1,23 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// stableID returns an identifier for the annotation r that depends only
+// on its subject, subject coordinates, family and strand, so that the
+// same annotation is given the same identifier in different runs.
+func stableID(r blast.Record) string {
+	left, right := subjectSpan(r)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\t%d\t%d\t%s\t%d", r.SubjectAccVer, left, right, r.QueryAccVer, r.Strand)
+	return "ins-" + hex.EncodeToString(h.Sum(nil)[:8])
+}
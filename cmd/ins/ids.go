@@ -0,0 +1,174 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// maxSafeIDLen is the longest sequence identifier that is passed to
+// BLAST unaltered. Longer identifiers are rejected by makeblastdb when
+// sequence identifiers are parsed.
+const maxSafeIDLen = 50
+
+// idMap is a mapping from surrogate sequence identifiers used in
+// searches to the original identifiers.
+type idMap map[string]string
+
+// original returns the original identifier for id.
+func (m idMap) original(id string) string {
+	if orig, ok := m[id]; ok {
+		return orig
+	}
+	return id
+}
+
+// safeID returns whether id is passed through BLAST without being
+// parsed as a structured identifier or truncated.
+func safeID(id string) bool {
+	if len(id) == 0 || len(id) > maxSafeIDLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c >= 0x7f || c == '|' || c == ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeLibraries writes a copy of the library sequences in libs to
+// the file at path with identifiers that are not safe replaced with
+// surrogates. The remainder of each header is retained so that repeat
+// classes are unaltered. The returned idMap maps the surrogates to the
+// original identifiers and is written to path with a .tsv extension.
+// If all identifiers are safe, no file is written and sanitizeLibraries
+// returns a nil idMap.
+func sanitizeLibraries(path string, libs []string) (idMap, error) {
+	var unsafe bool
+	for _, lib := range libs {
+		err := eachHeader(lib, func(header []byte) error {
+			unsafe = unsafe || !safeID(libID(header))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if unsafe {
+			break
+		}
+	}
+	if !unsafe {
+		return nil, nil
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(dst)
+	ids := make(idMap)
+	for _, lib := range libs {
+		f, err := os.Open(lib)
+		if err != nil {
+			dst.Close()
+			return nil, err
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) != 0 {
+				if line[0] == '>' {
+					if id := libID(line); !safeID(id) {
+						surrogate := fmt.Sprintf("ins_lib_%d", len(ids)+1)
+						ids[surrogate] = id
+						rest := bytes.TrimPrefix(bytes.TrimLeft(line[1:], " \t"), []byte(id))
+						line = append([]byte(">"+surrogate), rest...)
+					}
+				}
+				_, werr := w.Write(line)
+				if werr != nil {
+					f.Close()
+					dst.Close()
+					return nil, werr
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				f.Close()
+				dst.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+	}
+	err = w.Flush()
+	if err != nil {
+		dst.Close()
+		return nil, err
+	}
+	err = dst.Close()
+	if err != nil {
+		return nil, err
+	}
+	return ids, writeIDMap(path[:len(path)-len(filepath.Ext(path))]+".tsv", ids)
+}
+
+// eachHeader calls fn for each fasta header line in the file at path.
+func eachHeader(path string, fn func(header []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) != 0 && line[0] == '>' {
+			ferr := fn(line)
+			if ferr != nil {
+				return ferr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// writeIDMap writes the surrogate identifier mapping ids to the file at
+// path as tab-separated surrogate and original identifiers.
+func writeIDMap(path string, ids idMap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	surrogates := make([]string, 0, len(ids))
+	for id := range ids {
+		surrogates = append(surrogates, id)
+	}
+	sort.Strings(surrogates)
+	for _, id := range surrogates {
+		fmt.Fprintf(w, "%s\t%s\n", id, ids[id])
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
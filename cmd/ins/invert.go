@@ -0,0 +1,255 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// runBlastInverted runs a BLAST search of the sequences in query against
+// databases constructed from the sequences in libs. This is the inverse of
+// the search direction of runBlastTabular and is performed as a single pass
+// without iterative masking. The query fragments are partitioned into one
+// group for each search thread and the groups are searched concurrently.
+// Hits are returned in the orientation of runBlastTabular, with library
+// sequences as queries and the genome as subjects. The arguments in mflags
+// and bflags are passed to makeblastdb and blastn without interpretation or
+// checking. Databases are taken from and added to cache, and the raw output
+// of each search is saved by save. If logger is not nil, output from the
+// blast executables is written to it.
+func runBlastInverted(search blast.Nucleic, query *os.File, libs []library, mx map[string]fragment, cache dbCache, save blastSaver, mflags, bflags []string, logger io.Writer) (*kv.DB, error) {
+	search.OutFormat = tabFmt
+	dir := filepath.Dir(query.Name())
+
+	hits, err := store.Create(filepath.Join(dir, "forward.db"), store.Forward, insVersion())
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	workers := search.Threads
+	if workers < 1 {
+		workers = 1
+	}
+	parts, err := partitionFasta(query.Name(), workers)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, lib := range libs {
+		search := search
+		if g, ok := lib.(grouped); ok {
+			search = g.search
+			search.OutFormat = tabFmt
+		}
+		// Each partition is searched by a single thread.
+		search.Threads = 0
+
+		in := lib.name()
+		if in == "-" {
+			in, err = libraryFile(filepath.Join(dir, fmt.Sprintf("library-%d.fa", i)), lib)
+			if err != nil {
+				return nil, err
+			}
+		}
+		db := filepath.Join(dir, fmt.Sprintf("library-%d", i))
+		err = cache.makeDB(blast.MakeDB{DBType: "nucl", In: in, Out: db, ExtraArgs: mflags}, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		found := make([][]blast.Record, len(parts))
+		errs := make([]error, len(parts))
+		var wg sync.WaitGroup
+		for j, part := range parts {
+			wg.Add(1)
+			go func(j int, part string) {
+				defer wg.Done()
+				search := search
+				search.Database = db
+				search.Query = part
+				search.ExtraArgs = bflags
+				errs[j] = exe.stream(search, nil, logger, save.tee(fmt.Sprintf("forward-%d-part-%d.tsv", i, j), func(r io.Reader) error {
+					var err error
+					found[j], err = blast.ParseTabularColumns(r, 0, search.OutColumns)
+					return warnSkipped(fmt.Sprintf("blast search of %s", part), err)
+				}))
+				for k, r := range found[j] {
+					found[j][k] = invertRecord(r)
+				}
+			}(j, part)
+		}
+		wg.Wait()
+		var libHits []blast.Record
+		for j, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+			libHits = append(libHits, found[j]...)
+		}
+		logFields(fields{"library": lib.name()}, "inverted blast search found %d matches", len(libHits))
+
+		log.Print("remapping coordinates")
+		err = store.PutRecords(hits, remapCoords(libHits, mx))
+		if err != nil {
+			return nil, err
+		}
+
+		err = lib.reset()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+// invertRecord returns r with query and subject exchanged. Coordinates
+// are adjusted so that the returned record has the form of a hit found
+// with the query and subject in the exchanged roles.
+func invertRecord(r blast.Record) blast.Record {
+	r.QueryAccVer, r.SubjectAccVer = r.SubjectAccVer, r.QueryAccVer
+	r.QueryLength, r.SubjectLength = r.SubjectLength, r.QueryLength
+	r.BTOP = invertBTOP(r.BTOP, r.Strand < 0)
+	if r.Strand < 0 {
+		// Reversed subjects are held as the one-based start
+		// made zero-based and the one-based end, so both the
+		// library and genome intervals are re-expressed.
+		r.QueryStart, r.QueryEnd, r.SubjectStart, r.SubjectEnd = r.SubjectEnd-1, r.SubjectStart+1, r.QueryEnd-1, r.QueryStart+1
+		return r
+	}
+	r.QueryStart, r.QueryEnd, r.SubjectStart, r.SubjectEnd = r.SubjectStart, r.SubjectEnd, r.QueryStart, r.QueryEnd
+	return r
+}
+
+// invertBTOP returns the BLAST traceback operations string b with the
+// roles of query and subject exchanged. If reverse is true, the alignment
+// is reverse complemented so that the new query is in the forward
+// orientation.
+func invertBTOP(b string, reverse bool) string {
+	if b == "" {
+		return ""
+	}
+	var ops []string
+	for i := 0; i < len(b); {
+		j := i
+		for j < len(b) && '0' <= b[j] && b[j] <= '9' {
+			j++
+		}
+		if j == i {
+			// A mismatch or gap pair.
+			j = i + 2
+			if j > len(b) {
+				j = len(b)
+			}
+			op := []byte(b[i:j])
+			if len(op) == 2 {
+				op[0], op[1] = op[1], op[0]
+				if reverse {
+					op[0], op[1] = complement(op[0]), complement(op[1])
+				}
+			}
+			ops = append(ops, string(op))
+		} else {
+			ops = append(ops, b[i:j])
+		}
+		i = j
+	}
+	if reverse {
+		for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+			ops[i], ops[j] = ops[j], ops[i]
+		}
+	}
+	return strings.Join(ops, "")
+}
+
+// partitionFasta writes the records of the fasta file at path into at most
+// n files with approximately equal total sequence length, returning the
+// paths of the written files. If n is one, the path is returned unaltered.
+func partitionFasta(path string, n int) ([]string, error) {
+	if n == 1 {
+		return []string{path}, nil
+	}
+	recs, err := readLibRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) < n {
+		n = len(recs)
+	}
+	if n <= 1 {
+		return []string{path}, nil
+	}
+	sort.SliceStable(recs, func(i, j int) bool {
+		return len(recs[i].seq) > len(recs[j].seq)
+	})
+	type part struct {
+		f    *os.File
+		w    *bufio.Writer
+		size int
+	}
+	parts := make([]part, n)
+	paths := make([]string, n)
+	for i := range parts {
+		paths[i] = fmt.Sprintf("%s-part-%d", path, i)
+		f, err := os.Create(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = part{f: f, w: bufio.NewWriter(f)}
+	}
+	for _, r := range recs {
+		// Place each record in the smallest partition.
+		min := 0
+		for i, p := range parts {
+			if p.size < parts[min].size {
+				min = i
+			}
+		}
+		p := &parts[min]
+		p.w.Write(r.header)
+		for _, l := range r.lines {
+			p.w.Write(l)
+		}
+		p.size += len(r.seq)
+	}
+	for _, p := range parts {
+		err = p.w.Flush()
+		if err != nil {
+			p.f.Close()
+			return nil, err
+		}
+		err = p.f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// libraryFile writes the stream of lib to the file at path, returning path.
+func libraryFile(path string, lib library) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, lib.stream())
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
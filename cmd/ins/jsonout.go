@@ -0,0 +1,170 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// jsonStream is an io.Writer that writes the JSON values of the feature
+// output as newline-delimited JSON, or as the elements of a single JSON
+// array. Each call to Write must be given exactly one complete JSON value.
+type jsonStream struct {
+	w     io.Writer
+	array bool
+	n     int
+}
+
+// Write writes the JSON value in b to the stream.
+func (s *jsonStream) Write(b []byte) (int, error) {
+	v := bytes.TrimRight(b, "\n")
+	var err error
+	switch {
+	case !s.array:
+		_, err = s.w.Write(append(v[:len(v):len(v)], '\n'))
+	case s.n == 0:
+		_, err = s.w.Write(append([]byte("[\n"), v...))
+	default:
+		_, err = s.w.Write(append([]byte(",\n"), v...))
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.n++
+	return len(b), nil
+}
+
+// Close terminates the array of an array stream. It does not close the
+// underlying writer.
+func (s *jsonStream) Close() error {
+	if !s.array {
+		return nil
+	}
+	var err error
+	if s.n == 0 {
+		_, err = io.WriteString(s.w, "[]\n")
+	} else {
+		_, err = io.WriteString(s.w, "\n]\n")
+	}
+	return err
+}
+
+// writeSchema writes a JSON Schema describing the values of the JSON
+// feature output to w. The schema is generated from the output types so
+// that it follows changes to blast.Record and the annotation fields.
+func writeSchema(w io.Writer) error {
+	repeat := objectSchema(reflect.TypeOf(annotatedRecord{}))
+	repeat["description"] = "A repeat annotation."
+	secondary := objectSchema(reflect.TypeOf(struct {
+		secondaryRecord
+		libraryAnnotation
+	}{}))
+	secondary["description"] = "A secondary family assignment, written with -secondary."
+	tandem := objectSchema(reflect.TypeOf(tandemArray{}))
+	tandem["description"] = "A telomeric or satellite tandem array, written with -tandem."
+	head := objectSchema(reflect.TypeOf(header{}))
+	head["description"] = "The provenance of the annotation set."
+	schema := map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"$id":         "https://github.com/kortschak/ins/feature.schema.json",
+		"title":       "ins feature output",
+		"description": "A value of the ins JSON feature output. The first value is the header.",
+		"definitions": map[string]interface{}{
+			"header": map[string]interface{}{
+				"type":                 "object",
+				"properties":           map[string]interface{}{"ins": head},
+				"required":             []string{"ins"},
+				"additionalProperties": false,
+			},
+			"repeat":    repeat,
+			"secondary": secondary,
+			"tandem":    tandem,
+		},
+		"oneOf": []interface{}{
+			map[string]string{"$ref": "#/definitions/header"},
+			map[string]string{"$ref": "#/definitions/tandem"},
+			map[string]string{"$ref": "#/definitions/secondary"},
+			map[string]string{"$ref": "#/definitions/repeat"},
+		},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(schema)
+}
+
+// objectSchema returns the JSON Schema of the JSON encoding of the struct
+// type t. Fields without omitempty are required.
+func objectSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	var walk func(reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts := tag, ""
+			if i := strings.Index(tag, ","); i >= 0 {
+				name, opts = tag[:i], tag[i+1:]
+			}
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = typeSchema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	s := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if len(required) != 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// typeSchema returns the JSON Schema of the JSON encoding of values of
+// type t.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return objectSchema(t)
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,172 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+	"github.com/kortschak/ins/last"
+)
+
+// Forward search engines.
+const (
+	engineBlast = "blast" // NCBI+ BLAST blastn.
+	engineLast  = "last"  // LAST lastal.
+)
+
+// lastSearch holds the parameters for a LAST forward search.
+type lastSearch struct {
+	// train specifies that substitution and
+	// gap parameters are learned for each
+	// library with last-train before the
+	// first search iteration.
+	train bool
+
+	// eValue is the maximum E-value of
+	// reported alignments.
+	eValue float64
+
+	// threads is the number of threads
+	// used by LAST.
+	threads int
+
+	// flags are passed to lastal as
+	// arguments without interpretation.
+	flags []string
+}
+
+// lastTools are the LAST executables used by a LAST forward search.
+var lastTools = []string{"lastdb", "lastal", "last-train"}
+
+// checkLastTools checks that the LAST executables are available, adding
+// their versions to versions.
+func checkLastTools(versions map[string]string) error {
+	for _, cmd := range lastTools {
+		path, err := exec.LookPath(cmd)
+		if err != nil {
+			return err
+		}
+		v, err := last.Version(path)
+		if err != nil {
+			return err
+		}
+		versions[cmd] = v
+	}
+	return nil
+}
+
+// runLastTabular runs a LAST search of the sequences in libs against a
+// database constructed from the sequences in query. It performs the same
+// iterative masking search as runBlastTabular, ending the search of each
+// library when conv is satisfied. If search.train is true, scoring
+// parameters are trained for each library against the unmasked query.
+// If logger is not nil, output from the LAST executables is written to it.
+func runLastTabular(search lastSearch, query *os.File, libs []library, mx map[string]fragment, conv convergence, logger io.Writer) (*kv.DB, error) {
+	dir := filepath.Dir(query.Name())
+	hits, err := store.Create(filepath.Join(dir, "forward.db"), store.Forward, insVersion())
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	for i, lib := range libs {
+		// LAST reads its queries more than once when
+		// training, so streamed libraries are written
+		// to a file.
+		in := lib.name()
+		if in == "-" {
+			in, err = libraryFile(filepath.Join(dir, fmt.Sprintf("library-%d.fa", i)), lib)
+			if err != nil {
+				return nil, err
+			}
+		}
+		working, err := workingFile(query, query.Name()+"-working")
+		if err != nil {
+			return nil, err
+		}
+		g, err := readGenome(working)
+		if err != nil {
+			return nil, err
+		}
+		db := working + "-lastdb"
+		var params string
+		for n := 0; n < conv.maxIters; n++ {
+			err = exe.run(last.DB{Out: db, In: working, Threads: search.threads}, nil, nil, logger)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 && search.train {
+				params = filepath.Join(dir, fmt.Sprintf("library-%d.train", i))
+				f, err := os.Create(params)
+				if err != nil {
+					return nil, err
+				}
+				err = exe.run(last.Train{RevSym: true, Threads: search.threads, DB: db, Query: in}, nil, f, logger)
+				if err != nil {
+					f.Close()
+					return nil, err
+				}
+				err = f.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			var lastHits []blast.Record
+			err = exe.stream(last.Align{
+				Params:    params,
+				Format:    "BlastTab",
+				EValue:    search.eValue,
+				Threads:   search.threads,
+				DB:        db,
+				Query:     in,
+				ExtraArgs: search.flags,
+			}, nil, logger, func(r io.Reader) error {
+				var err error
+				lastHits, err = last.ParseTabular(r, n)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			logFields(fields{"library": lib.name(), "iteration": n}, "last iteration %d found %d new matches", n, len(lastHits))
+
+			if len(lastHits) == 0 {
+				break
+			}
+
+			log.Printf("masking %s", working)
+			newBases := g.mask(lastHits, 'N')
+			err = g.write(working)
+			if err != nil {
+				return nil, err
+			}
+
+			log.Print("remapping coordinates")
+			newHits, err := conv.putHits(hits, remapCoords(lastHits, mx))
+			if err != nil {
+				return nil, err
+			}
+
+			if conv.done(newHits, newBases) {
+				logFields(fields{"library": lib.name(), "iteration": n}, "last iteration %d masked %d new bases: search converged", n, newBases)
+				break
+			}
+		}
+		err = lib.reset()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
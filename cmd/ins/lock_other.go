@@ -0,0 +1,36 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile takes an exclusive lock on path by creating it and returns
+// a function that releases the lock by removing the file. If the file
+// already exists errLocked is returned. A lock file left by a process
+// that did not exit cleanly must be removed by the user.
+func lockFile(path string) (unlock func() error, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	fmt.Fprintln(f, os.Getpid())
+	err = f.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return func() error {
+		return os.Remove(path)
+	}, nil
+}
@@ -0,0 +1,36 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-lock-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "work.lock")
+
+	for i := 0; i < 2; i++ {
+		unlock, err := lockFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error taking lock %d: %v", i, err)
+		}
+		_, err = lockFile(path)
+		if err != errLocked {
+			t.Errorf("unexpected error taking held lock %d: got:%v want:%v", i, err, errLocked)
+		}
+		err = unlock()
+		if err != nil {
+			t.Errorf("unexpected error releasing lock %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+)
+
+var levelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// fields holds structured logging fields.
+type fields map[string]interface{}
+
+// logWriter is an io.Writer that formats the output of the log package
+// as leveled text or JSON lines. Messages prefixed with "warning: " are
+// logged at warn level and all others at info level.
+type logWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	min   logLevel
+	stage string
+}
+
+// stdLog is the logWriter used by the log package.
+var stdLog *logWriter
+
+// setupLog directs log package output to a new logWriter writing to w
+// in the given format, text or json, filtering messages below min.
+func setupLog(w io.Writer, format string, min logLevel) error {
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log format: %q", format)
+	}
+	stdLog = &logWriter{w: w, json: format == "json", min: min}
+	log.SetFlags(0)
+	log.SetOutput(stdLog)
+	return nil
+}
+
+// Write satisfies the io.Writer interface.
+func (l *logWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	level := levelInfo
+	if strings.HasPrefix(msg, "warning: ") {
+		level = levelWarn
+		if l.json {
+			msg = strings.TrimPrefix(msg, "warning: ")
+		}
+	}
+	err := l.emit(level, msg, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (l *logWriter) emit(level logLevel, msg string, f fields) error {
+	if level < l.min {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.json {
+		var buf strings.Builder
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(msg)
+		keys := make([]string, 0, len(f))
+		for k := range f {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, " %s=%v", k, f[k])
+		}
+		buf.WriteByte('\n')
+		_, err := io.WriteString(l.w, buf.String())
+		return err
+	}
+	rec := fields{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   strings.TrimPrefix(msg, "\t"),
+	}
+	if l.stage != "" {
+		rec["stage"] = l.stage
+	}
+	for k, v := range f {
+		rec[k] = v
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// logFields logs a formatted message at info level with the provided
+// structured fields.
+func logFields(f fields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if stdLog == nil {
+		log.Print(msg)
+		return
+	}
+	err := stdLog.emit(levelInfo, msg, f)
+	if err != nil {
+		log.Printf("failed to log: %v", err)
+	}
+}
+
+// logDebug logs msg at debug level.
+func logDebug(msg string) {
+	if stdLog == nil {
+		log.Printf("\t%s", msg)
+		return
+	}
+	err := stdLog.emit(levelDebug, "\t"+msg, nil)
+	if err != nil {
+		log.Printf("failed to log: %v", err)
+	}
+}
+
+// stageTime is the accumulated duration of a named pipeline stage.
+type stageTime struct {
+	name     string
+	duration time.Duration
+}
+
+// stageTimes holds the durations of completed stages in order of
+// first completion.
+var stageTimes []stageTime
+
+// addStageTime adds d to the accumulated duration of the named stage.
+func addStageTime(name string, d time.Duration) {
+	for i, st := range stageTimes {
+		if st.name == name {
+			stageTimes[i].duration += d
+			return
+		}
+	}
+	stageTimes = append(stageTimes, stageTime{name: name, duration: d})
+}
+
+// stage logs the start of the named pipeline stage and returns a function
+// that logs the stage's completion and duration.
+func stage(name string) (done func()) {
+	var last string
+	if stdLog != nil {
+		stdLog.mu.Lock()
+		last = stdLog.stage
+		stdLog.stage = name
+		stdLog.mu.Unlock()
+	}
+	start := time.Now()
+	logFields(fields{"stage": name}, "starting %s", name)
+	return func() {
+		d := time.Since(start)
+		addStageTime(name, d)
+		logFields(fields{"stage": name, "duration": d.Seconds()}, "finished %s", name)
+		if stdLog != nil {
+			stdLog.mu.Lock()
+			stdLog.stage = last
+			stdLog.mu.Unlock()
+		}
+	}
+}
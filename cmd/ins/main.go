@@ -10,25 +10,27 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	"modernc.org/kv"
 
 	"github.com/biogo/biogo/alphabet"
 	"github.com/biogo/biogo/io/featio/gff"
-	"github.com/biogo/biogo/seq"
-	"github.com/biogo/biogo/seq/linear"
-	"github.com/biogo/hts/fai"
 
 	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/crossmatch"
+	"github.com/kortschak/ins/internal/classify"
 	"github.com/kortschak/ins/internal/store"
 )
 
@@ -46,7 +48,8 @@ var (
 )
 
 const (
-	// Maximum number of first pass BLAST searches.
+	// Default maximum number of first pass BLAST
+	// searches for each library.
 	maxIters = 100
 	// Optimal fragment length to split genome into.
 	optFragmentLen = 100000
@@ -59,19 +62,133 @@ const (
 const near = 30
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gather" {
+		gather(os.Args[2:])
+		return
+	}
+	var stageCmd string
+	if len(os.Args) > 1 && isStageCommand(os.Args[1]) {
+		stageCmd = os.Args[1]
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+	}
+
+	start := time.Now()
+
 	var libs sliceValue
-	in := flag.String("query", "", "specify query sequence file (required)")
+	var in sliceValue
+	flag.Var(&in, "query", "specify query sequence files, directories of fasta files or glob patterns (required - may be present more than once)")
 	flag.Var(&libs, "lib", "specify the search libraries (required - may be present more than once)")
 	mode := flag.String("mode", "normal", "specify search mode")
-	jsonOut := flag.Bool("json", false, "specify json format for feature output")
+	species := flag.String("species", "", "specify a comma-separated lineage of taxa, from the species to the root, whose library families are searched (default all families)")
+	libCheck := flag.String("lib-check", checkWarn, "specify library validation policy (none, warn or fail)")
+	libMinLen := flag.Int("lib-min-len", 30, "specify the length below which library sequences are reported as suspiciously short")
+	libReport := flag.String("lib-report", "", "specify a file to write the library validation report to as JSON")
+	classScheme := flag.String("class-scheme", "", "specify the classification scheme that library classes are normalized to in outputs (dfam, repbase or wicker, default is no normalization)")
+	classMap := flag.String("class-map", "", "specify a tab-separated file of library class to output class mappings that override the built-in classification scheme table")
+	dedupe := flag.Float64("dedupe-lib", 0, "specify the k-mer containment fraction above which library sequences redundant with a longer sequence are removed before searching (0 is no removal)")
+	var conv convergence
+	flag.IntVar(&conv.maxIters, "max-iters", maxIters, "specify the maximum number of forward search iterations for each library")
+	flag.IntVar(&conv.minHits, "min-new-hits", 0, "specify the minimum number of hits in a forward search iteration for the search to continue")
+	flag.IntVar(&conv.minBases, "min-new-bases", 0, "specify the minimum number of newly masked bases in a forward search iteration for the search to continue")
+	flag.Float64Var(&conv.dedup, "dedup-overlap", 0, "specify the fraction of a forward hit overlapped by an earlier hit of the same family and strand for it to be discarded as a duplicate (0 is no check, 1 is contained hits only)")
+	saveBlast := flag.Bool("save-blast", false, "specify to save gzipped raw BLAST outputs in the working directory")
+	storeValues := flag.String("store-values", "json", "specify the encoding of hit records in working databases: json, binary or snappy (compressed binary)")
+	dbCacheDir := flag.String("db-cache", "", "specify a directory to cache BLAST databases in between runs (default is no caching)")
+	engine := flag.String("engine", engineBlast, "specify the forward search engine (blast, last or crossmatch)")
+	lastTrain := flag.Bool("last-train", true, "specify to train LAST scoring parameters for each library with last-train")
+	lflags := flag.String("lflags", "", "specify additional lastal flags for the last engine (shell quoting rules apply)")
+	cmflags := flag.String("cmflags", "", "specify additional or alternative cross_match flags for the crossmatch engine (shell quoting rules apply)")
+	var crossMatchOut sliceValue
+	flag.Var(&crossMatchOut, "crossmatch-out", "specify existing cross_match output of the query against the library to use instead of a forward search (may be present more than once)")
+	reciprocalSearch := flag.Bool("reciprocal", false, "specify to obtain final alignments by searching merged regions with the libraries instead of using the forward BLAST search alignments")
+	invert := flag.Bool("invert", false, "specify that the forward search uses the genome as the BLAST query and the library as the database, without iterative masking")
+	overlap := flag.Int("fragment-overlap", 0, "specify the overlap between adjacent query fragments so that elements crossing fragment boundaries are found full length")
+	softMasked := flag.Bool("soft-masked", false, "specify that lower case soft-masked regions of the query are prior annotations that are excluded from the search")
+	excludePath := flag.String("exclude", "", "specify a BED file of query regions that are not searched and in which no annotations are reported")
+	priorMask := flag.String("prior-mask", "", "specify a BED file of pre-existing mask intervals to merge with annotated repeats in the masked query sequence")
+	upperQuery := flag.Bool("upper-query", true, "specify to upper-case query sequence letters before searching, discarding soft masking")
+	secondaryRatio := flag.Float64("secondary", 0, "specify the minimum score ratio to the containing hit for culled hits of other families to be reported as secondary assignments (0 is none)")
+	maskChar := flag.String("mask-char", "N", "specify the character used to mask repeats in the masked query sequence")
+	maskLines := flag.Bool("mask-lines", false, "specify to preserve the line lengths of the query in the masked query sequence and write a fasta index for it")
+	maskedOut := flag.String("masked-out", "", "specify the path of the masked query sequence, gzip compressed if the path ends in .gz (default is <query>-masked.fasta)")
+	force := flag.Bool("force", false, "specify to overwrite an existing masked query sequence")
+	tabix := flag.Bool("tabix", false, "specify to write GTF features sorted by position, BGZF compressed to <prefix>.gtf.gz with a tabix index (requires -out or -per-query)")
+	gz := flag.Bool("gz", false, "specify to compress output files, adding .gz to their names: fasta and GTF outputs are BGZF compressed for indexing")
+	maskClasses := flag.String("mask-classes", "", "specify a comma-separated list of family or class patterns to mask in the masked query sequence (default all)")
+	tsdFlag := flag.String("tsd", "", "specify the target site duplication length range to search for flanking each GTF feature as min-max (default none)")
+	groupHSPs := flag.Bool("group-hsps", false, "specify to write the HSPs of each hit as repeat_fragment features of a parent repeat feature in GTF output")
+	tandem := flag.Bool("tandem", false, "specify to detect telomeric and large satellite tandem arrays by k-mer periodicity and report them as telomere and satellite features")
+	telomereMotif := flag.String("telomere-motif", defaultTelomereMotif, "specify the telomeric repeat unit used to classify tandem arrays as telomeres")
+	referenceCopies := flag.Bool("reference-copies", false, "specify to flag identical full-length matches to library sequences as reference copies rather than repeats")
+	rmCoords := flag.Bool("rm-coords", false, "specify that GTF Repeat attribute consensus coordinates are ordered as in RepeatMasker .out files")
+	exportFormat := flag.String("format", "", "specify an indexed table format for final annotations written to <query>.<format> (sqlite or parquet)")
+	familyMatrix := flag.Bool("family-matrix", false, "specify to write per-sequence by family element count and annotated base matrices to <query>.family.counts.tsv and <query>.family.bases.tsv")
+	bamOut := flag.Bool("bam", false, "specify to write alignments of annotated copies to their library sequences to <query>.bam with a BAM index (requires forward search alignments)")
+	divergence := flag.Bool("divergence", false, "specify to write per-family divergence bins to <query>.divergence.csv and a RepeatMasker divergence summary to <query>.divsum")
+	rmskOut := flag.Bool("rmsk", false, "specify to write annotations as a UCSC rmsk table to <query>.rmsk")
+	densityWindow := flag.Int("density-window", 0, "specify the window width for per-class repeat density bedGraph tracks (0 is no tracks)")
+	bigWig := flag.Bool("bigwig", false, "specify to convert repeat density tracks to bigWig with bedGraphToBigWig")
+	var outFilter filter
+	flag.IntVar(&outFilter.minLen, "min-len", 0, "specify the minimum genomic length of reported annotations")
+	flag.Float64Var(&outFilter.minScore, "min-score", 0, "specify the minimum bit score of reported annotations")
+	flag.Float64Var(&outFilter.maxEValue, "max-evalue", 0, "specify the maximum E-value of reported annotations (0 is no limit)")
+	flag.Float64Var(&outFilter.minIdentity, "min-identity", 0, "specify the minimum percent identity of reported annotations")
+	dustOpts := flag.String("dust", "", "specify forward search query dust filtering (yes, no or 'level window linker', default is the blastn default)")
+	softMaskQuery := flag.Bool("softmask-query", false, "specify that forward search query filtering is applied as soft masking")
+	dustGenome := flag.Bool("dust-genome", false, "specify to soft-mask low-complexity regions of the query genome with dustmasker before the forward search")
+	quickMode := flag.String("quick", "", "specify a search mode used to mask easily found repeats before searching the remaining sequence with -mode (e.g. rough)")
+	jsonOut := flag.Bool("json", false, "specify json format for feature output, written as newline-delimited JSON")
+	jsonArray := flag.Bool("json-array", false, "specify to write json feature output as a single JSON array (implies -json)")
+	jsonSchema := flag.Bool("json-schema", false, "specify to print the JSON Schema of json feature output and exit")
+	perQuery := flag.Bool("per-query", false, "specify to write features for each query to <query>.gtf or <query>.json instead of standard output")
+	outPrefix := flag.String("out", "", "specify a prefix for output file names: features are written to <prefix>.gtf or <prefix>.json, the masked sequence to <prefix>.masked.fa, the summary to <prefix>.summary.tbl and the log to <prefix>.log (default is features to standard output and other files beside the query)")
 	cull := flag.Bool("cull", true, "specify to discard lower scoring nested features")
-	verbose := flag.Bool("verbose", false, "specify verbose logging")
+	verbose := flag.Bool("verbose", false, "specify verbose logging (implies -log-level=debug)")
+	logFormat := flag.String("log-format", "text", "specify log format (text or json)")
+	logLevelName := flag.String("log-level", "info", "specify minimum log level (debug, info or warn)")
 	pool := flag.Bool("pool", true, "specify to pool all libraries into a single search")
+	deterministic := flag.Bool("deterministic", false, "specify reproducible mode: single-threaded blast searches and per-query UIDs")
 	threads := flag.Int("cores", 0, "specify the maximum number of cores for blast searches (<=0 is use all cores)")
-	work := flag.Bool("work", false, "specify to keep temporary files")
-	bflags := flag.String("bflags", "", "specify additional or alternative blastn flags")
-	mflags := flag.String("mflags", "", "specify additional or alternative makeblastdb flags")
-	recover := flag.String("recover", "", "specify path to kv db file for continuation (debug only)")
+	work := flag.Bool("work", false, "specify to keep temporary files (equivalent to -keep=all)")
+	keep := flag.String("keep", keepNone, "specify which working files to keep after a successful run (none, dbs or all)")
+	workdir := flag.String("workdir", "", "specify the directory to create the working directory in (default is the configured scratch directory, $TMPDIR or the system temporary directory)")
+	bflags := flag.String("bflags", "", "specify additional or alternative blastn flags (shell quoting rules apply)")
+	mflags := flag.String("mflags", "", "specify additional or alternative makeblastdb flags (shell quoting rules apply)")
+	var bflag, mflag sliceValue
+	flag.Var(&bflag, "bflag", "specify an additional blastn flag as key=value or key (may be present more than once)")
+	flag.Var(&mflag, "mflag", "specify an additional makeblastdb flag as key=value or key (may be present more than once)")
+	anyFamily := flag.Bool("merge-families", false, "specify to join overlapping merged regions of all families and search each region once with all the libraries in the reciprocal search")
+	flank := flag.Int("flank", 0, "specify the number of bases to extend each merged region by on both sides for the reciprocal search")
+	regionHitCap := flag.Int("region-hit-cap", 0, "specify the maximum number of forward hits in a merged region searched by the reciprocal search, retaining the highest scoring hits (0 is no limit)")
+	consensusTol := flag.Int("merge-consensus", -1, "specify the consensus distance tolerance for merging adjacent hits into regions (<0 is no check)")
+	flag.StringVar(&errorJSON, "error-json", "", "specify a file to write a JSON error report to on failure")
+	recover := flag.String("recover", "", "specify path to kv db file for continuation, or its name in the working directory")
+	genesPath := flag.String("genes", "", "specify a GFF3 gene annotation of the query used to describe the gene context of annotations")
+	agp := flag.String("agp", "", "specify an AGP file used to lift annotations and masked sequence into object coordinates")
+	familyParamsPath := flag.String("family-params", "", "specify a table of per-family or per-class blastn parameter overrides")
+	var thenLibs sliceValue
+	var screenLibs sliceValue
+	flag.Var(&screenLibs, "screen", "specify rDNA or organelle reference sequences searched with the primary libraries as type=path, where type is rDNA, NUMT or NUPT (may be present more than once)")
+	flag.Var(&thenLibs, "then-lib", "specify libraries to search against the masked query after the primary search (may be present more than once)")
+	var maxTmp, maxMem byteSize
+	maxReport := byteSize(512 << 20)
+	flag.Var(&maxReport, "max-xml", "specify the size of the streamed reciprocal blast output for a library sequence above which a warning is reported with optional K, M, G or T suffix (0 is no limit)")
+	batchSize := byteSize(16 << 20)
+	seqCacheSize := byteSize(1 << 30)
+	flag.Var(&seqCacheSize, "seq-cache", "specify the total length of query sequences cached in memory when extracting merged regions with optional K, M, G or T suffix")
+	flag.Var(&batchSize, "reciprocal-batch", "specify the total length of merged regions searched together in the reciprocal search with optional K, M, G or T suffix (0 searches each family and strand separately)")
+	flag.Var(&maxTmp, "max-tmp", "specify the maximum temporary file space to use with optional K, M, G or T suffix (0 is no limit)")
+	flag.Var(&maxMem, "max-mem", "specify the maximum heap memory to use with optional K, M, G or T suffix (0 is no limit)")
+	flag.DurationVar(&exe.timeout, "exec-timeout", 0, "specify the maximum duration of each external command attempt (0 is no limit)")
+	flag.IntVar(&exe.retries, "exec-retries", 2, "specify the number of times an external command failing transiently is retried")
+	distributeShards := flag.Int("distribute", 0, "specify the number of shards to partition the forward search into for distributed execution (0 is no distribution)")
+	distributeDir := flag.String("distribute-dir", "ins-distribute", "specify the directory to write distributed shards and job scripts to")
+	stageDir := flag.String("stage-dir", "", "specify the directory holding the artifacts of pipeline stage subcommands (required for stage subcommands)")
+	shard := flag.String("shard", "", "specify a shard directory to run the forward search of (used by distributed job scripts)")
+	flag.StringVar(&exe.blastBin, "blast-bin", "", "specify the directory holding the BLAST+ executables (default is to find them in the PATH)")
+	configPath := flag.String("config", "", "specify a JSON configuration file, for example describing a container to run BLAST+ in")
+	var execEnv sliceValue
+	flag.Var(&execEnv, "exec-env", "specify an environment variable as KEY=VALUE to set for external commands (may be present more than once)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), `Usage of %[1]s:
@@ -84,459 +201,699 @@ Options:
 
 	flag.Parse()
 
-	if *in == "" || len(libs) == 0 {
+	if *jsonSchema {
+		err := writeSchema(os.Stdout)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *jsonArray {
+		*jsonOut = true
+	}
+
+	if len(in) == 0 || len(libs) == 0 {
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
-	search, ok := blastnModes[*mode]
+	minLevel, ok := levelNames[*logLevelName]
 	if !ok {
-		log.Fatalf("unknown search mode: %q", *mode)
-	}
-	if *threads > 0 {
-		search.Threads = min(*threads, search.Threads)
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("unknown log level: %q", *logLevelName)})
 	}
-
-	log.Println(os.Args)
-	var logger io.WriteCloser
 	if *verbose {
-		logger = logCapture()
-		defer logger.Close()
+		minLevel = levelDebug
 	}
-
-	tmpDir, err := ioutil.TempDir("", "ins-tmp-*")
+	var logOut io.Writer = os.Stderr
+	if *outPrefix != "" {
+		err := os.MkdirAll(filepath.Dir(*outPrefix), 0o755)
+		if err != nil {
+			fatal(err)
+		}
+		f, err := os.Create(*outPrefix + ".log")
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		logOut = io.MultiWriter(os.Stderr, f)
+	}
+	err := setupLog(logOut, *logFormat, minLevel)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitError{code: exitUsage, err: err})
+	}
+
+	switch *keep {
+	case keepNone, keepDBs, keepAll:
+	default:
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("unknown keep policy: %q", *keep)})
 	}
-	log.Printf("working in %s", tmpDir)
 	if *work {
-		log.Println("keeping work")
-	} else {
-		defer func() {
-			os.RemoveAll(tmpDir)
-		}()
+		*keep = keepAll
 	}
 
-	query, err := os.Open(*in)
+	search, ok := blastnModes[*mode]
+	if !ok {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("unknown search mode: %q", *mode)})
+	}
+	if *threads > 0 {
+		search.Threads = min(*threads, search.Threads)
+	}
+	if *deterministic {
+		search.Threads = 1
+	}
+	switch *libCheck {
+	case checkNone, checkWarn, checkFail:
+	default:
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("unknown library validation policy: %q", *libCheck)})
+	}
+	if *dedupe < 0 || *dedupe > 1 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid library redundancy fraction: %v", *dedupe)})
+	}
+	if exe.timeout < 0 || exe.retries < 0 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid external command timeout or retries: %v %d", exe.timeout, exe.retries)})
+	}
+	for _, e := range execEnv {
+		if k, _, ok := cut(e, "="); !ok || k == "" {
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid environment variable: %q", e)})
+		}
+	}
+	exe.env = execEnv
+	if *configPath != "" {
+		cfg, err := readConfig(*configPath)
+		if err != nil {
+			fatal(exitError{code: exitUsage, err: err})
+		}
+		exe.container = cfg.Container
+		if *workdir == "" {
+			*workdir = cfg.Scratch
+		}
+	}
+	if *anyFamily && !*reciprocalSearch && *engine == engineBlast {
+		fatal(exitError{code: exitUsage, err: errors.New("family-agnostic regions are only searched by the reciprocal search: use -reciprocal")})
+	}
+	if *bamOut && (*reciprocalSearch || *engine != engineBlast) {
+		fatal(exitError{code: exitUsage, err: errors.New("BAM output uses the forward BLAST search alignments: cannot use -reciprocal or other engines")})
+	}
+	if *tandem && (len(*telomereMotif) < minTandemPeriod || strings.Trim(strings.ToUpper(*telomereMotif), "ACGT") != "") {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid telomere motif: %q", *telomereMotif)})
+	}
+	if *flank < 0 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid region flank: %d", *flank)})
+	}
+	if *regionHitCap < 0 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid region hit cap: %d", *regionHitCap)})
+	}
+	if conv.dedup < 0 || conv.dedup > 1 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid duplicate hit overlap: %v", conv.dedup)})
+	}
+	if conv.maxIters < 1 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid maximum forward search iterations: %d", conv.maxIters)})
+	}
+	switch *engine {
+	case engineBlast:
+	case engineLast:
+		switch {
+		case *invert:
+			fatal(exitError{code: exitUsage, err: errors.New("inverted searches are not available with the last engine")})
+		case *dustGenome:
+			fatal(exitError{code: exitUsage, err: errors.New("genome dust masking is not available with the last engine")})
+		case *familyParamsPath != "":
+			fatal(exitError{code: exitUsage, err: errors.New("family parameters are not available with the last engine")})
+		}
+	case engineCrossMatch:
+		switch {
+		case *invert:
+			fatal(exitError{code: exitUsage, err: errors.New("inverted searches are not available with the crossmatch engine")})
+		case *dustGenome:
+			fatal(exitError{code: exitUsage, err: errors.New("genome dust masking is not available with the crossmatch engine")})
+		case *familyParamsPath != "":
+			fatal(exitError{code: exitUsage, err: errors.New("family parameters are not available with the crossmatch engine")})
+		}
+	default:
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("unknown search engine: %q", *engine)})
+	}
+	if len(crossMatchOut) != 0 && *engine != engineCrossMatch {
+		fatal(exitError{code: exitUsage, err: errors.New("cross_match output may only be used with the crossmatch engine")})
+	}
+	if *invert && *dustGenome {
+		fatal(exitError{code: exitUsage, err: errors.New("genome dust masking is not available with inverted searches")})
+	}
+	if *overlap < 0 || *overlap >= optFragmentLen/2 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid fragment overlap: %d", *overlap)})
+	}
+	if *secondaryRatio < 0 || *secondaryRatio > 1 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid secondary score ratio: %v", *secondaryRatio)})
+	}
+	valueEnc, err := store.ParseEncoding(*storeValues)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitError{code: exitUsage, err: err})
 	}
-	defer query.Close()
-
-	frags, err := os.Create(filepath.Join(tmpDir, "query-fragments"))
+	store.ValueEncoding = valueEnc
+	if len(*maskChar) != 1 || *maskChar == ">" || *maskChar == "\n" {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid mask character: %q", *maskChar)})
+	}
+	var maskPatterns []string
+	if *maskClasses != "" {
+		for _, p := range strings.Split(*maskClasses, ",") {
+			_, err = path.Match(p, "")
+			if err != nil {
+				fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid mask class pattern %q: %w", p, err)})
+			}
+			maskPatterns = append(maskPatterns, p)
+		}
+	}
+	tsdLen, err := parseTSDRange(*tsdFlag)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitError{code: exitUsage, err: err})
 	}
-
-	log.Println("indexing query")
-	qidx, err := fai.NewIndex(query)
+	if _, ok := exportTools[*exportFormat]; *exportFormat != "" && !ok {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("unknown annotation table format: %q", *exportFormat)})
+	}
+	if *densityWindow < 0 {
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid density window: %d", *densityWindow)})
+	}
+	if *bigWig {
+		if *densityWindow == 0 {
+			fatal(exitError{code: exitUsage, err: errors.New("-bigwig requires -density-window")})
+		}
+		_, err = exec.LookPath("bedGraphToBigWig")
+		if err != nil {
+			fatal(err)
+		}
+	}
+	search.Dust, err = parseDust(*dustOpts)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitError{code: exitUsage, err: err})
+	}
+	if *softMaskQuery {
+		search.SoftMask = true
+	}
+	var quick *blast.Nucleic
+	if *quickMode != "" {
+		q, ok := blastnModes[*quickMode]
+		if !ok || *quickMode == "user" || *mode == "user" {
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid quick search mode: %q", *quickMode)})
+		}
+		q.Threads = search.Threads
+		q.Dust = search.Dust
+		q.SoftMask = search.SoftMask
+		quick = &q
 	}
-	_, err = query.Seek(0, io.SeekStart)
+	margs, err := extraArgs(*mflags, mflag)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid makeblastdb flags: %w", err)})
 	}
-
-	log.Println("splitting query")
-	mx, err := split(frags, query, optFragmentLen, maxFragmentLen)
+	bargs, err := extraArgs(*bflags, bflag)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid blastn flags: %w", err)})
+	}
+	var also []string
+	if *dustGenome {
+		also = append(also, "dustmasker")
 	}
-	err = frags.Sync()
+	tools, err := checkTools(search, margs, bargs, *mode == "user", also...)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-
-	var libraries []library
-	libs = uniq(libs)
-	if len(libs) > 1 && *pool {
-		libraries, err = newStream(libs)
+	if *exportFormat != "" {
+		err = checkExportTool(*exportFormat, tools)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-	} else {
-		libraries = filenames(libs)
 	}
-
-	var hits *kv.DB
-	switch filepath.Base(*recover) {
-	case "forward.db":
-		log.Printf("recovering blast results from %s", *recover)
-		opts := &kv.Options{Compare: store.GroupByQueryOrderSubjectLeft}
-		hits, err = kv.Open(*recover, opts)
+	var xsearch crossmatch.CrossMatch
+	if *engine == engineCrossMatch {
+		if len(crossMatchOut) == 0 {
+			err = checkCrossMatch(tools)
+			if err != nil {
+				fatal(err)
+			}
+		}
+		xsearch = crossMatchDefault
+		xsearch.ExtraArgs, err = blast.SplitFlags(*cmflags)
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid cross_match flags: %w", err)})
 		}
-	case "regions.db", "reverse.db":
-		// Do nothing.
-	default:
-		hits, err = runBlastTabular(search, frags, libraries, mx, *mflags, *bflags, logger)
+	}
+	var lsearch lastSearch
+	if *engine == engineLast {
+		err = checkLastTools(tools)
+		if err != nil {
+			fatal(err)
+		}
+		largs, err := blast.SplitFlags(*lflags)
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid lastal flags: %w", err)})
+		}
+		lsearch = lastSearch{
+			train:   *lastTrain,
+			eValue:  search.EValue,
+			threads: search.Threads,
+			flags:   largs,
 		}
-		log.Println("forward.db valid for recover")
 	}
 
-	var regions *kv.DB
-	switch filepath.Base(*recover) {
-	case "regions.db":
-		log.Printf("recovering merged results from %s", *recover)
-		opts := &kv.Options{Compare: store.GroupByQueryOrderSubjectLeft}
-		regions, err = kv.Open(*recover, opts)
+	log.Println(os.Args)
+	var table []familyParams
+	if *familyParamsPath != "" {
+		table, err = readFamilyParams(*familyParamsPath, search)
 		if err != nil {
-			log.Fatal(err)
+			fatal(inputError(err))
 		}
-	case "reverse.db":
-		// Do nothing.
-	default:
-		regions, err = merge(hits, near, tmpDir)
-		if err != nil {
-			if err == io.EOF {
-				log.Println("no repeat region found")
-				return
-			}
-			log.Fatal(err)
+	}
+	queries, err := expandQueries(in)
+	if err != nil {
+		fatal(inputError(err))
+	}
+	if len(queries) > 1 && *recover != "" {
+		fatal(exitError{code: exitUsage, err: errors.New("cannot recover with multiple queries")})
+	}
+	if *maskedOut != "" {
+		switch {
+		case len(queries) > 1:
+			fatal(exitError{code: exitUsage, err: errors.New("cannot name the masked sequence of multiple queries")})
+		case *maskLines && strings.HasSuffix(*maskedOut, ".gz"):
+			fatal(exitError{code: exitUsage, err: errors.New("cannot index a compressed masked sequence")})
+		}
+	}
+	if *tabix {
+		switch {
+		case *jsonOut:
+			fatal(exitError{code: exitUsage, err: errors.New("cannot index json features")})
+		case *outPrefix == "" && !*perQuery:
+			fatal(exitError{code: exitUsage, err: errors.New("cannot index features written to standard output")})
+		}
+	}
+	if *maskLines && *gz && *maskedOut == "" {
+		fatal(exitError{code: exitUsage, err: errors.New("cannot index a compressed masked sequence")})
+	}
+	if stageCmd != "" {
+		switch {
+		case *stageDir == "":
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("missing stage directory for %s", stageCmd)})
+		case len(queries) > 1:
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("cannot run %s with multiple queries", stageCmd)})
+		case *recover != "":
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("cannot recover with %s", stageCmd)})
+		case *distributeShards != 0 || *shard != "":
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("cannot distribute with %s", stageCmd)})
+		}
+		*recover = stageInput(*stageDir, stageCmd)
+		*keep = keepAll
+	}
+	if *distributeShards != 0 || *shard != "" {
+		switch {
+		case *distributeShards < 0:
+			fatal(exitError{code: exitUsage, err: fmt.Errorf("invalid number of shards: %d", *distributeShards)})
+		case len(queries) > 1:
+			fatal(exitError{code: exitUsage, err: errors.New("cannot distribute multiple queries")})
+		case *recover != "":
+			fatal(exitError{code: exitUsage, err: errors.New("cannot recover a distributed search")})
+		case len(crossMatchOut) != 0:
+			fatal(exitError{code: exitUsage, err: errors.New("cannot distribute imported cross_match output")})
 		}
-		log.Println("regions.db valid for recover")
-		err = hits.Close()
+	}
+	var lift *liftover
+	if *agp != "" {
+		lift, err = readAGP(*agp)
 		if err != nil {
-			log.Fatal(err)
+			fatal(inputError(err))
 		}
 	}
 
-	var (
-		remappedHits *kv.DB
-		buf          bytes.Buffer
-	)
-	switch filepath.Base(*recover) {
-	case "reverse.db":
-		log.Printf("recovering reciprocal blast results from %s", *recover)
-		opts := &kv.Options{Compare: store.BySubjectPosition}
-		remappedHits, err = kv.Open(*recover, opts)
+	var genes *geneIndex
+	if *genesPath != "" {
+		genes, err = readGenes(*genesPath)
 		if err != nil {
-			log.Fatal(err)
+			fatal(inputError(err))
 		}
-	default:
-		opts := &kv.Options{Compare: store.BySubjectPosition}
-		remappedHits, err = kv.Create(filepath.Join(tmpDir, "reverse.db"), opts)
+	}
+	var exclude map[string][]gap
+	if *excludePath != "" {
+		exclude, err = readBED(*excludePath)
 		if err != nil {
-			log.Fatal(err)
+			fatal(inputError(err))
 		}
-		qfa := fai.NewFile(query, qidx)
-		var (
-			g store.BlastRecordKey
-			n int
-		)
-		final := false
-		it, err := regions.SeekFirst()
+		outFilter.exclude = exclude
+	}
+	var prior map[string][]gap
+	if *priorMask != "" {
+		prior, err = readBED(*priorMask)
 		if err != nil {
-			if err != io.EOF {
-				log.Fatal(err)
-			}
-			final = true
-		} else {
-			k, _, err := it.Next()
-			if err != nil {
-				if err != io.EOF {
-					log.Fatal(err)
-				}
-				final = true
-			} else {
-				g = store.UnmarshalBlastRecordKey(k)
-			}
+			fatal(inputError(err))
 		}
-		for !final {
-			var next store.BlastRecordKey
-			k, _, err := it.Next()
-			if err != nil {
-				if err != io.EOF {
-					log.Fatal(err)
-				}
-				final = true
-			} else {
-				next = store.UnmarshalBlastRecordKey(k)
-			}
+	}
 
-			seq, err := qfa.SeqRange(g.SubjectAccVer, int(g.SubjectLeft), int(g.SubjectRight))
-			if err != nil {
-				log.Fatal(err)
-			}
-			b, err := ioutil.ReadAll(seq)
-			if err != nil {
-				log.Fatal(err)
-			}
-			s := linear.NewSeq(fmt.Sprintf("%s_%d_%d", g.SubjectAccVer, g.SubjectLeft, g.SubjectRight), alphabet.BytesToLetters(b), alphabet.DNAredundant)
-			s.Desc = fmt.Sprintf("%d %d %s %+d", g.SubjectLeft, g.SubjectRight, g.QueryAccVer, g.Strand)
-			fmt.Fprintf(&buf, "%60a\n", s)
-
-			if final || g.QueryAccVer != next.QueryAccVer || g.Strand != next.Strand {
-				var libraries []library
-				if len(libs) > 1 && *pool {
-					libraries, err = newStream(libs)
-					if err != nil {
-						log.Fatal(err)
-					}
-				} else {
-					libraries = filenames(libs)
-				}
+	defer reportWarnings()
 
-				search := realign
-				if *mode == "user" {
-					search = blastnModes[*mode]
-				}
-				hits, err := runBlastXML(search, g, &buf, libraries, tmpDir, *mflags, *bflags, logger)
-				if err != nil {
-					log.Fatal(err)
-				}
+	var logger io.WriteCloser
+	if *verbose {
+		logger = logCapture()
+		defer logger.Close()
+	}
 
-				reported := reportBlast(hits, g.QueryAccVer, g.Strand, *verbose)
-				log.Printf("got %d reciprocal hits", len(reported))
-				err = remappedHits.BeginTransaction()
-				if err != nil {
-					log.Fatal(err)
-				}
-				for _, h := range reported {
-					key := store.MarshalBlastRecordKey(h)
-					value, err := json.Marshal(h)
-					if err != nil {
-						log.Fatal(err)
-					}
-					err = remappedHits.Set(key, value)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-				err = remappedHits.Commit()
-				if err != nil {
-					log.Fatal(err)
-				}
-				n += len(reported)
-				log.Printf("holding %d total remapped hits", n)
-				buf.Reset()
-			}
-			g = next
+	screens := make([]screen, len(screenLibs))
+	screenPaths := make([]string, len(screenLibs))
+	for i, spec := range screenLibs {
+		screens[i], err = parseScreen(spec)
+		if err != nil {
+			fatal(exitError{code: exitUsage, err: err})
+		}
+		screenPaths[i] = screens[i].path
+	}
+	copies, err := bufferLibraries(*workdir, libs, thenLibs, screenPaths)
+	atExit(func() {
+		for _, p := range copies {
+			os.Remove(p)
 		}
-		err = regions.Close()
+	})
+	defer runAtExit()
+	if err != nil {
+		fatal(inputError(err))
+	}
+	for i, p := range screenPaths {
+		screens[i].path = p
+	}
+	libs = uniq(append(libs, screenPaths...))
+	allLibs := libs
+	if len(thenLibs) != 0 {
+		thenLibs = uniq(thenLibs)
+		allLibs = uniq(append(libs[:len(libs):len(libs)], thenLibs...))
+	}
+	err = checkLibraries(allLibs, *libCheck, *libMinLen, *libReport)
+	if err != nil {
+		fatal(err)
+	}
+	var libraries []library
+	if len(allLibs) > 1 && *pool {
+		libraries, err = newStream(allLibs)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
+	} else {
+		libraries = filenames(allLibs)
 	}
-
-	if *cull {
-		log.Println("discarding low scoring nested features")
-		if *work {
-			// Close and copy reverse.db into reverse-unculled.db.
-			log.Println("keeping copy of unculled reverse.db in reverse-unculled.db")
-			err = remappedHits.Close()
-			if err != nil {
-				log.Fatal(err)
-			}
-			path := filepath.Join(tmpDir, "reverse.db")
-			src, err := os.Open(path)
-			if err != nil {
-				log.Fatal(err)
-			}
-			dst, err := os.Create(filepath.Join(tmpDir, "reverse-unculled.db"))
-			if err != nil {
-				log.Fatal(err)
-			}
-			_, err = io.Copy(dst, src)
+	details, err := libDetails(libraries)
+	if err != nil {
+		fatal(inputError(fmt.Errorf("failed to get feature lengths: %w", err)))
+	}
+	if *classScheme != "" || *classMap != "" {
+		norm, err := classify.New(*classScheme)
+		if err != nil {
+			fatal(exitError{code: exitUsage, err: err})
+		}
+		if *classMap != "" {
+			err = norm.ReadFile(*classMap)
 			if err != nil {
-				log.Fatalf("failed to copy reverse.db before culling: %v", err)
+				fatal(inputError(err))
 			}
-			log.Println("reverse-unculled.db valid for recover: must be copied to reverse.db for recovery")
+		}
+		for name, d := range details {
+			d.class = norm.Class(d.class)
+			details[name] = d
+		}
+	}
+	screened, err := screenFamilies(screens, details)
+	if err != nil {
+		fatal(inputError(fmt.Errorf("failed to read screening references: %w", err)))
+	}
 
-			// Reopen reverse.db.
-			opts := &kv.Options{Compare: store.BySubjectPosition}
-			remappedHits, err = kv.Open(path, opts)
-			if err != nil {
-				log.Fatal(err)
-			}
+	reciprocal := realign
+	if *mode == "user" {
+		reciprocal = blastnModes[*mode]
+	}
+	if *deterministic {
+		reciprocal.Threads = 1
+	}
+	reciprocal.OutFormat = reportFormat(reciprocal.Cmd, tools)
+	r := run{
+		primary: pass{
+			search:        search,
+			reciprocal:    reciprocal,
+			libs:          libs,
+			pool:          *pool,
+			mflags:        margs,
+			bflags:        bargs,
+			recover:       *recover,
+			consensusTol:  *consensusTol,
+			regionHitCap:  *regionHitCap,
+			flank:         *flank,
+			anyFamily:     *anyFamily,
+			maxTmp:        int64(maxTmp),
+			maxMem:        int64(maxMem),
+			maxReport:     int64(maxReport),
+			verbose:       *verbose,
+			logger:        logger,
+			familyParams:  table,
+			species:       parseLineage(*species),
+			dustGenome:    *dustGenome,
+			searchRegions: *reciprocalSearch,
+			batchSize:     int64(batchSize),
+			seqCache:      int64(seqCacheSize),
+			overlap:       *overlap,
+			upperQuery:    *upperQuery,
+			exclude:       exclusion{lower: *softMasked, regions: exclude},
+			convergence:   conv,
+			dedupe:        *dedupe,
+			dbCache:       dbCache(*dbCacheDir),
+			saveBlast:     *saveBlast,
+			invert:        *invert,
+			engine:        *engine,
+			last:          lsearch,
+			crossMatch:    xsearch,
+			crossMatchOut: crossMatchOut,
+		},
+		thenLibs:      thenLibs,
+		quick:         quick,
+		libs:          allLibs,
+		mode:          *mode,
+		keep:          *keep,
+		workdir:       *workdir,
+		cull:          *cull,
+		secondary:     *secondaryRatio,
+		filter:        outFilter,
+		maskChar:      alphabet.Letter((*maskChar)[0]),
+		maskClasses:   maskPatterns,
+		maskLines:     *maskLines,
+		maskedOut:     *maskedOut,
+		force:         *force,
+		deterministic: *deterministic,
+		gz:            *gz,
+		prior:         prior,
+		groupHSPs:     *groupHSPs,
+		rmCoords:      *rmCoords,
+		refCopies:     *referenceCopies,
+		screened:      screened,
+		tandem:        *tandem,
+		telomere:      *telomereMotif,
+		tsdLen:        tsdLen,
+		format:        *exportFormat,
+		rmsk:          *rmskOut,
+		bam:           *bamOut,
+		matrix:        *familyMatrix,
+		divsum:        *divergence,
+		density:       *densityWindow,
+		bigWig:        *bigWig,
+		lift:          lift,
+		genes:         genes,
+		details:       details,
+		tools:         tools,
+		stage:         stageCmd,
+		stageDir:      *stageDir,
+		out:           *outPrefix,
+	}
+	switch stageCmd {
+	case stageSplit, stageForward, stageMerge:
+		r.primary.stop = stageCmd
+	}
+	switch {
+	case stageCmd != "" && stageCmd != stageReport:
+		err = r.annotateQuery(queries[0], nil, nil)
+		if err != nil {
+			fatal(err)
 		}
-		err = cullContained(remappedHits)
+		log.Printf("%s stage complete in %s", stageCmd, *stageDir)
+		return
+	case *distributeShards > 0:
+		args := withoutFlags(os.Args[1:], "distribute", "distribute-dir")
+		err = r.distribute(queries[0], *distributeDir, *distributeShards, args)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
+		return
+	case *shard != "":
+		err = r.shard(*shard)
+		if err != nil {
+			fatal(err)
+		}
+		return
 	}
-	log.Println("reverse.db valid for recover")
 
-	var masking []blast.Record
-	buf.Reset()
-	dec := json.NewDecoder(&buf)
+	provenance := header{
+		Version:     insVersion(),
+		Mode:        *mode,
+		Libraries:   allLibs,
+		Date:        start,
+		CommandLine: os.Args,
+	}
+	ext := ".gtf"
 	if *jsonOut {
-		it, err := remappedHits.SeekFirst()
-		if err != nil && err != io.EOF {
-			log.Fatal(err)
+		ext = ".json"
+	}
+	if *gz || *tabix {
+		ext += ".gz"
+	}
+	var (
+		enc     *gff.Writer
+		stdout  io.Writer = os.Stdout
+		outFile io.WriteCloser
+		stream  *jsonStream
+	)
+	if *outPrefix != "" && !*perQuery {
+		outFile, err = createFeatures(*outPrefix+ext, *tabix)
+		if err != nil {
+			fatal(err)
+		}
+		stdout = outFile
+	}
+	if *jsonOut && !*perQuery {
+		stream = &jsonStream{w: stdout, array: *jsonArray}
+		stdout = stream
+	}
+	if !*perQuery {
+		enc, err = writeHeader(stdout, provenance, *jsonOut)
+		if err != nil {
+			fatal(err)
 		}
-		for {
-			_, m, err := it.Next()
+	}
+	var found int
+	for _, q := range queries {
+		var (
+			out   io.Writer = stdout
+			f     io.WriteCloser
+			fname string
+			fs    *jsonStream
+		)
+		r.out = queryPrefix(*outPrefix, q, len(queries) > 1)
+		if *perQuery {
+			fname = r.outputName(q, ext, "")
+			f, err = createFeatures(fname, *tabix)
 			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Fatal(err)
+				fatal(err)
+			}
+			out = f
+			if *jsonOut {
+				fs = &jsonStream{w: f, array: *jsonArray}
+				out = fs
 			}
-			buf.Write(m)
-			var r blast.Record
-			err = dec.Decode(&r)
+			enc, err = writeHeader(out, provenance, *jsonOut)
 			if err != nil {
-				log.Fatal(err)
+				fatal(err)
 			}
-			masking = append(masking, r)
-			os.Stdout.Write(m)
-		}
-	} else {
-		details, err := libDetails(libraries)
-		if err != nil {
-			log.Fatalf("failed to get feature lengths: %v", err)
-		}
-		enc := gff.NewWriter(os.Stdout, 60, true)
-		it, err := remappedHits.SeekFirst()
-		if err != nil && err != io.EOF {
-			log.Fatal(err)
 		}
-		for {
-			_, m, err := it.Next()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Fatal(err)
+		err = r.annotateQuery(q, out, enc)
+		switch {
+		case err == io.EOF:
+			if len(queries) == 1 {
+				fatal(exitError{code: exitNoRepeats, err: errors.New("no repeat region found")})
 			}
-			buf.Write(m)
-			var r blast.Record
-			err = dec.Decode(&r)
+			warnf("no repeat region found in %s", q)
+		case err != nil:
+			fatal(err)
+		default:
+			found++
+		}
+		if fs != nil {
+			err = fs.Close()
 			if err != nil {
-				log.Fatal(err)
-			}
-			masking = append(masking, r)
-
-			if r.Strand < 0 {
-				r.SubjectStart, r.SubjectEnd = r.SubjectEnd, r.SubjectStart
+				fatal(err)
 			}
-			repeat := details[r.QueryAccVer]
-			_, err = enc.Write(&gff.Feature{
-				SeqName:    r.SubjectAccVer,
-				Source:     "ins",
-				Feature:    "repeat",
-				FeatStart:  r.SubjectStart,
-				FeatEnd:    r.SubjectEnd,
-				FeatScore:  &r.BitScore,
-				FeatStrand: seq.Strand(r.Strand),
-				FeatFrame:  gff.NoFrame,
-				FeatAttributes: gff.Attributes{
-					{
-						Tag:   "Repeat",
-						Value: fmt.Sprintf("%s %s %d %d %d", r.QueryAccVer, repeat.class, r.QueryStart+1, r.QueryEnd, repeat.length-r.QueryEnd),
-					},
-					{
-						Tag:   "UID",
-						Value: fmt.Sprint(r.UID),
-					},
-					{
-						Tag:   "SumScore",
-						Value: fmt.Sprintf("%.4f", r.SumScore),
-					},
-				},
-			})
+		}
+		if f != nil {
+			err = f.Close()
 			if err != nil {
-				log.Fatalf("failed to write feature: %v", err)
+				fatal(err)
 			}
+			log.Printf("features for %s in %s", q, fname)
 		}
 	}
-
-	target, err := workingFile(query, "-masked.fasta")
-	if err != nil {
-		log.Fatal(err)
+	if stream != nil {
+		err = stream.Close()
+		if err != nil {
+			fatal(err)
+		}
 	}
-	err = mask(target, masking, 'N')
-	if err != nil {
-		log.Fatal(err)
+	if outFile != nil {
+		err = outFile.Close()
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("features in %s", *outPrefix+ext)
 	}
-	log.Printf("masked sequence in %s", target)
-
-	err = remappedHits.Close()
-	if err != nil {
-		log.Fatal(err)
+	if found == 0 {
+		fatal(exitError{code: exitNoRepeats, err: errors.New("no repeat region found")})
 	}
 }
 
 // cullContained blanks all hits that are completely contained by a higher scoring hit.
-// hits must be sorted bySubjectPosition.
-func cullContained(hits *kv.DB) error {
-	outerIt, err := hits.SeekFirst()
-	if err != nil {
-		return err
-	}
-
+// hits must be sorted bySubjectPosition. If secondary is not nil, contained hits of
+// other families scoring at least ratio times the containing hit's score are stored
+// in secondary as ranked alternative assignments.
+func cullContained(hits, secondary *kv.DB, ratio float64) error {
 	i, last := 0, 0
-	for {
-		k, _, err := outerIt.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
+	outers := store.Iterate(hits)
+	for outers.Next() {
 		i++
 
-		outer := store.UnmarshalBlastRecordKey(k)
-		candidates, ok, err := hits.Seek(k)
-		if !ok {
-			panic(fmt.Sprintf("expected match for existing key: %+v", outer))
-		}
-		if err != nil {
-			if err == io.EOF {
-				continue
-			}
-			return err
-		}
-		_, _, err = candidates.Next()
-		if err != nil {
-			if err == io.EOF {
-				continue
-			}
-			return err
-		}
-
-		for {
-			j, _, err := candidates.Next()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-
-			inner := store.UnmarshalBlastRecordKey(j)
-			if inner.Strand != outer.Strand || inner.SubjectAccVer != outer.SubjectAccVer {
-				break
-			}
-
-			// All innerLeft must be >= an outerLeft due to sort order.
-
-			if inner.SubjectLeft >= outer.SubjectRight {
-				// No more possible contained hits from here.
-				break
-			}
+		outer := outers.Key()
+		var alts []secondaryRecord
+		// All candidate lefts are >= the outer left due to sort order.
+		candidates := store.Contained(hits, outers.RawKey())
+		for candidates.Next() {
+			inner := candidates.Key()
 			if inner.SubjectRight > outer.SubjectRight {
 				continue
 			}
 			if inner.BitScore < outer.BitScore || (inner.BitScore == outer.BitScore && inner.SumScore < outer.SumScore) {
 				i++
-				err = hits.Delete(j)
+				if secondary != nil && inner.QueryAccVer != outer.QueryAccVer && inner.BitScore >= ratio*outer.BitScore {
+					r, err := candidates.Annotated()
+					if err != nil {
+						return err
+					}
+					alts = append(alts, secondaryRecord{Annotated: r, Primary: outer.QueryAccVer, ScoreRatio: inner.BitScore / outer.BitScore})
+				}
+				err := hits.Delete(candidates.RawKey())
 				if err != nil {
 					return err
 				}
 			}
 		}
+		if candidates.Err() != nil {
+			return candidates.Err()
+		}
+		if secondary != nil {
+			err := storeSecondary(secondary, alts)
+			if err != nil {
+				return err
+			}
+		}
 		if i-last > 1e5 {
 			log.Printf("\tprocessed %d features", i)
 			last = i
 		}
 	}
-	return nil
+	return outers.Err()
+}
+
+// liftAnnotation returns r lifted into object coordinates by l, logging
+// records that cannot be lifted and returning them unaltered.
+func liftAnnotation(l *liftover, r blast.Record) blast.Record {
+	lifted, ok := l.liftRecord(r)
+	if !ok {
+		log.Printf("could not lift %s:%d-%d: retaining component coordinates", r.SubjectAccVer, r.SubjectStart, r.SubjectEnd)
+	}
+	return lifted
 }
 
 // sliceValue is a multi-value flag value.
@@ -562,7 +919,7 @@ func logCapture() io.WriteCloser {
 			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
 				continue
 			}
-			log.Printf("\t%s", sc.Bytes())
+			logDebug(sc.Text())
 		}
 		err := sc.Err()
 		if err != nil && err != io.EOF {
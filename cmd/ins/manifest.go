@@ -0,0 +1,150 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/biogo/biogo/io/featio/gff"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// manifest is the provenance record of a run.
+type manifest struct {
+	Version       string            `json:"version"`
+	CommandLine   []string          `json:"command_line"`
+	Start         time.Time         `json:"start"`
+	End           time.Time         `json:"end"`
+	Tools         map[string]string `json:"tools"`
+	Container     *container        `json:"container,omitempty"`
+	Query         fileSum           `json:"query"`
+	Libraries     []fileSum         `json:"libraries"`
+	Mode          string            `json:"mode"`
+	Engine        string            `json:"engine"`
+	Search        blast.Nucleic     `json:"search"`
+	Reciprocal    blast.Nucleic     `json:"reciprocal"`
+	Quick         *blast.Nucleic    `json:"quick,omitempty"`
+	Deterministic bool              `json:"deterministic,omitempty"`
+	Stages        []stageSeconds    `json:"stages"`
+	Work          workRecord        `json:"work"`
+}
+
+// fileSum is a file path and its SHA-256 digest.
+type fileSum struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+type stageSeconds struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// insVersion returns the module version of the ins binary.
+func insVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" {
+		return "(devel)"
+	}
+	return info.Main.Version
+}
+
+// sumFile returns the SHA-256 digest of the file at path.
+func sumFile(path string) (fileSum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileSum{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return fileSum{}, err
+	}
+	return fileSum{Path: path, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// writeManifest writes the manifest for a run to the file at path.
+func writeManifest(path string, m manifest, query string, libs []string) error {
+	var err error
+	m.Query, err = sumFile(query)
+	if err != nil {
+		return err
+	}
+	for _, l := range libs {
+		s, err := sumFile(l)
+		if err != nil {
+			return err
+		}
+		m.Libraries = append(m.Libraries, s)
+	}
+	for _, st := range stageTimes {
+		m.Stages = append(m.Stages, stageSeconds{Name: st.name, Seconds: st.duration.Seconds()})
+	}
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeOutput(path, append(b, '\n'))
+}
+
+// header is the provenance of an annotation set written at the start of
+// the feature output.
+type header struct {
+	Version     string    `json:"version"`
+	Mode        string    `json:"mode"`
+	Libraries   []string  `json:"libraries"`
+	Date        time.Time `json:"date"`
+	CommandLine []string  `json:"command_line"`
+}
+
+// writeGFFHeader writes h as pragma and comment lines to enc.
+func writeGFFHeader(enc *gff.Writer, h header) error {
+	_, err := enc.WriteMetaData("source-version ins " + h.Version)
+	if err != nil {
+		return err
+	}
+	_, err = enc.WriteMetaData(h.Date)
+	if err != nil {
+		return err
+	}
+	_, err = enc.WriteComment("mode: " + h.Mode)
+	if err != nil {
+		return err
+	}
+	for _, l := range h.Libraries {
+		_, err = enc.WriteComment("library: " + l)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = enc.WriteComment("command: " + strings.Join(h.CommandLine, " "))
+	return err
+}
+
+// writeHeader writes h to w as JSON if json is true, or otherwise as GTF
+// pragmas and comments, returning a GTF writer for w.
+func writeHeader(w io.Writer, h header, json bool) (*gff.Writer, error) {
+	if json {
+		return nil, writeJSONHeader(w, h)
+	}
+	enc := gff.NewWriter(w, 60, true)
+	return enc, writeGFFHeader(enc, h)
+}
+
+// writeJSONHeader writes h as a top-level JSON object to w.
+func writeJSONHeader(w io.Writer, h header) error {
+	return json.NewEncoder(w).Encode(struct {
+		Header header `json:"ins"`
+	}{h})
+}
@@ -0,0 +1,491 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/seqio"
+	"github.com/biogo/biogo/io/seqio/fasta"
+	"github.com/biogo/biogo/seq/linear"
+	"github.com/biogo/hts/fai"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// maskInFlight is the maximum number of bytes of sequence and formatted
+// output held by mask when no memory budget is given.
+const maskInFlight = 1 << 30
+
+// mask writes a masked copy of the genome in the src file based on the given
+// sorted disjoint spans for each sequence, as returned by maskSpans. Regions
+// that are masked are replaced with the masked alphabet.Letter. Assembly gaps
+// in gaps are left unaltered. Sequences are masked concurrently while the
+// sequences and formatted output held do not exceed maxMem bytes, or
+// maskInFlight bytes if maxMem is zero.
+func mask(path string, spans map[string][]gap, masked alphabet.Letter, gaps map[string][]gap, maxMem int64) error {
+	log.Printf("masking %s", path)
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	w := bufio.NewWriter(dst)
+
+	// Sequences are masked and formatted concurrently
+	// and written in their original order.
+	workers := runtime.GOMAXPROCS(0)
+	if maxMem == 0 {
+		maxMem = maskInFlight
+	}
+	var (
+		jobs  = make(chan *maskJob, workers)
+		order = make(chan *maskJob, 2*workers)
+		inUse = newByteLimit(maxMem)
+		scErr error
+	)
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		sc := seqio.NewScanner(fasta.NewReader(src, linear.NewSeq("", nil, alphabet.DNAredundant)))
+		for sc.Next() {
+			seq := sc.Seq().(*linear.Seq)
+			// Account for the sequence and its
+			// formatted output.
+			size := 2 * int64(len(seq.Seq))
+			inUse.acquire(size)
+			job := &maskJob{seq: seq, size: size, done: make(chan struct{})}
+			order <- job
+			jobs <- job
+		}
+		scErr = sc.Error()
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				job.mask(spans[job.seq.ID], masked, gaps[job.seq.ID])
+			}
+		}()
+	}
+	for job := range order {
+		<-job.done
+		if err == nil {
+			_, err = w.Write(job.out.Bytes())
+		}
+		job.out = bytes.Buffer{}
+		inUse.release(job.size)
+	}
+	if err != nil {
+		return err
+	}
+	if scErr != nil {
+		return scErr
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = dst.Sync()
+	if err != nil {
+		return err
+	}
+	// Files must be closed before they can be
+	// replaced on some platforms.
+	src.Close()
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), path)
+}
+
+// maskLines writes a masked copy of the genome in the src file in the same
+// way as mask, but retains the line structure of the original file so that
+// the byte offsets of all sequence letters are unchanged. A fasta index for
+// the masked file is written to path.fai.
+func maskLines(path string, spans map[string][]gap, masked alphabet.Letter, gaps map[string][]gap) error {
+	log.Printf("masking %s preserving line lengths", path)
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	w := bufio.NewWriter(dst)
+
+	var (
+		seqSpans, seqGaps []gap
+		pos               int
+	)
+	r := bufio.NewReader(src)
+	for {
+		b, err := r.ReadBytes('\n')
+		if len(b) != 0 {
+			if b[0] == '>' {
+				id := libID(b)
+				seqSpans, seqGaps, pos = spans[id], gaps[id], 0
+			} else {
+				n := len(bytes.TrimRight(b, "\r\n"))
+				seqSpans, seqGaps = maskLine(b[:n], pos, seqSpans, seqGaps, byte(masked))
+				pos += n
+			}
+			_, err := w.Write(b)
+			if err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = dst.Sync()
+	if err != nil {
+		return err
+	}
+	err = src.Close()
+	if err != nil {
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(dst.Name(), path)
+	if err != nil {
+		return err
+	}
+	return writeIndex(path)
+}
+
+// maskLine masks the letters of line, which starts at offset within its
+// sequence, that are within spans but not within gaps. Both spans and gaps
+// must be sorted. The spans and gaps that may overlap later lines of the
+// sequence are returned.
+func maskLine(line []byte, offset int, spans, gaps []gap, masked byte) (remainingSpans, remainingGaps []gap) {
+	end := offset + len(line)
+	for len(spans) != 0 && spans[0].start < end {
+		s := spans[0]
+		for i := max(s.start, offset); i < min(s.end, end); i++ {
+			for len(gaps) != 0 && gaps[0].end <= i {
+				gaps = gaps[1:]
+			}
+			if len(gaps) != 0 && gaps[0].start <= i {
+				continue
+			}
+			line[i-offset] = masked
+		}
+		if s.end > end {
+			break
+		}
+		spans = spans[1:]
+	}
+	return spans, gaps
+}
+
+// writeIndex writes a fasta index for the file at path to path.fai.
+func writeIndex(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	idx, err := fai.NewIndex(f)
+	if err != nil {
+		return err
+	}
+	dst, err := os.Create(path + ".fai")
+	if err != nil {
+		return err
+	}
+	err = fai.WriteTo(dst, idx)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// maskJob is a sequence being masked by mask.
+type maskJob struct {
+	seq  *linear.Seq
+	size int64
+	out  bytes.Buffer
+	done chan struct{}
+}
+
+// byteLimit limits the number of bytes held by concurrent work.
+type byteLimit struct {
+	mu    sync.Mutex
+	cond  sync.Cond
+	limit int64
+	used  int64
+}
+
+// newByteLimit returns a byteLimit allowing limit bytes to be held.
+func newByteLimit(limit int64) *byteLimit {
+	l := &byteLimit{limit: limit}
+	l.cond.L = &l.mu
+	return l
+}
+
+// acquire blocks until n bytes may be held within the limit. A request
+// is always granted when no bytes are held, so work larger than the
+// limit is done alone.
+func (l *byteLimit) acquire(n int64) {
+	l.mu.Lock()
+	for l.used != 0 && l.used+n > l.limit {
+		l.cond.Wait()
+	}
+	l.used += n
+	l.mu.Unlock()
+}
+
+// release returns n bytes acquired by acquire.
+func (l *byteLimit) release(n int64) {
+	l.mu.Lock()
+	l.used -= n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// mask masks the sequence of the job within spans with the masked letter,
+// leaving assembly gaps unaltered, and formats the result into out.
+func (j *maskJob) mask(spans []gap, masked alphabet.Letter, gaps []gap) {
+	defer close(j.done)
+	seq := j.seq
+	var saved [][]alphabet.Letter
+	for _, g := range gaps {
+		saved = append(saved, append([]alphabet.Letter(nil), seq.Seq[g.start-seq.Offset:g.end-seq.Offset]...))
+	}
+	fill(seq.Seq, seq.Offset, spans, masked)
+	for i, g := range gaps {
+		copy(seq.Seq[g.start-seq.Offset:], saved[i])
+	}
+	fmt.Fprintf(&j.out, "%60a\n", seq)
+	// Release the sequence as soon as it is formatted.
+	j.seq = nil
+}
+
+// maskSpans returns the sorted union of the subject intervals of hits
+// for each subject.
+func maskSpans(hits []blast.Record) map[string][]gap {
+	spans := make(spanSet)
+	for _, h := range hits {
+		spans.add(h)
+	}
+	return spans.union()
+}
+
+// spanSet accumulates the subject intervals of hits for masking without
+// retaining the hits. Overlapping intervals of hits added in subject
+// position order are merged as they are added, so the size of the set
+// is bounded by the number of disjoint masked regions.
+type spanSet map[string][]gap
+
+// add adds the subject interval of h to the set.
+func (s spanSet) add(h blast.Record) {
+	// Blast reports minus strand matches by inverting the coordinates.
+	left, right := subjectSpan(h)
+	ivs := s[h.SubjectAccVer]
+	if n := len(ivs); n != 0 {
+		last := &ivs[n-1]
+		if left <= last.end && last.start <= right {
+			if left < last.start {
+				last.start = left
+			}
+			if right > last.end {
+				last.end = right
+			}
+			return
+		}
+	}
+	s[h.SubjectAccVer] = append(ivs, gap{start: left, end: right})
+}
+
+// union returns the sorted union of the intervals in the set for each
+// subject. The set must not be used after union has been called.
+func (s spanSet) union() map[string][]gap {
+	for id, ivs := range s {
+		s[id] = union(ivs)
+	}
+	return s
+}
+
+// readBED returns the intervals in the BED file at path for each sequence.
+// Only the first three columns are used, and track, browser and comment
+// lines are ignored.
+func readBED(path string) (map[string][]gap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ivs := make(map[string][]gap)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 || b[0] == '#' || bytes.HasPrefix(b, []byte("track")) || bytes.HasPrefix(b, []byte("browser")) {
+			continue
+		}
+		var (
+			id string
+			iv gap
+		)
+		_, err = fmt.Sscan(string(b), &id, &iv.start, &iv.end)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid BED line %d: %q: %w", path, line, b, err)
+		}
+		if iv.start < 0 || iv.end < iv.start {
+			return nil, fmt.Errorf("%s: invalid BED interval at line %d: %d-%d", path, line, iv.start, iv.end)
+		}
+		ivs[id] = append(ivs[id], iv)
+	}
+	err = sc.Err()
+	if err != nil {
+		return nil, err
+	}
+	for id, iv := range ivs {
+		ivs[id] = union(iv)
+	}
+	return ivs, nil
+}
+
+// mergeSpans adds the intervals in prior to the sorted disjoint spans for
+// each sequence, clipped to the sequence lengths, keeping the spans sorted
+// and disjoint. Intervals on sequences not in lengths are ignored.
+func mergeSpans(spans, prior map[string][]gap, lengths map[string]int) {
+	for id, ivs := range prior {
+		length, ok := lengths[id]
+		if !ok {
+			continue
+		}
+		merged := spans[id]
+		for _, iv := range ivs {
+			if iv.end > length {
+				iv.end = length
+			}
+			if iv.start < iv.end {
+				merged = append(merged, iv)
+			}
+		}
+		spans[id] = union(merged)
+	}
+}
+
+// fill sets the letters of s, which starts at offset, within the
+// intervals in ivs to letter.
+func fill(s []alphabet.Letter, offset int, ivs []gap, letter alphabet.Letter) {
+	for _, iv := range ivs {
+		b := s[iv.start-offset : iv.end-offset]
+		if len(b) == 0 {
+			continue
+		}
+		b[0] = letter
+		for n := 1; n < len(b); n *= 2 {
+			copy(b[n:], b[:n])
+		}
+	}
+}
+
+// genome is an in-memory set of sequences that may be repeatedly masked
+// and written.
+type genome struct {
+	seqs  []*linear.Seq
+	index map[string]int
+}
+
+// readGenome returns the sequences in the fasta file at path.
+func readGenome(path string) (*genome, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g := genome{index: make(map[string]int)}
+	sc := seqio.NewScanner(fasta.NewReader(bufio.NewReader(f), linear.NewSeq("", nil, alphabet.DNAredundant)))
+	for sc.Next() {
+		seq := sc.Seq().(*linear.Seq)
+		g.index[seq.ID] = len(g.seqs)
+		g.seqs = append(g.seqs, seq)
+	}
+	return &g, sc.Error()
+}
+
+// mask masks the regions of the genome covered by hits with the masked
+// alphabet.Letter, returning the number of bases that were not already
+// masked.
+func (g *genome) mask(hits []blast.Record, masked alphabet.Letter) int {
+	var n int
+	for id, ivs := range maskSpans(hits) {
+		i, ok := g.index[id]
+		if !ok {
+			continue
+		}
+		seq := g.seqs[i]
+		for _, iv := range ivs {
+			for _, l := range seq.Seq[iv.start-seq.Offset : iv.end-seq.Offset] {
+				if l != masked {
+					n++
+				}
+			}
+		}
+		fill(seq.Seq, seq.Offset, ivs, masked)
+	}
+	return n
+}
+
+// write writes the genome to the fasta file at path.
+func (g *genome) write(path string) error {
+	dst, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	w := bufio.NewWriter(dst)
+	for _, seq := range g.seqs {
+		fmt.Fprintf(w, "%60a\n", seq)
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = dst.Sync()
+	if err != nil {
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), path)
+}
@@ -0,0 +1,193 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// hit returns a blast.Record on the subject id from start to end. A
+// reverse strand hit has start greater than end, as reported by BLAST.
+func hit(id string, start, end int) blast.Record {
+	strand := int8(1)
+	if end < start {
+		strand = -1
+	}
+	return blast.Record{SubjectAccVer: id, SubjectStart: start, SubjectEnd: end, Strand: strand}
+}
+
+var maskSpansTests = []struct {
+	name string
+	hits []blast.Record
+	want map[string][]gap
+}{
+	{
+		name: "empty",
+		hits: nil,
+		want: map[string][]gap{},
+	},
+	{
+		name: "forward",
+		hits: []blast.Record{hit("chr1", 10, 20)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 20}}},
+	},
+	{
+		name: "reverse",
+		hits: []blast.Record{hit("chr1", 20, 10)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 20}}},
+	},
+	{
+		name: "reverse overlapping forward",
+		hits: []blast.Record{hit("chr1", 10, 20), hit("chr1", 25, 15)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 25}}},
+	},
+	{
+		name: "reverse contained in forward",
+		hits: []blast.Record{hit("chr1", 10, 40), hit("chr1", 30, 15)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 40}}},
+	},
+	{
+		name: "adjacent",
+		hits: []blast.Record{hit("chr1", 10, 20), hit("chr1", 30, 20)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 30}}},
+	},
+	{
+		name: "separate",
+		hits: []blast.Record{hit("chr1", 10, 20), hit("chr1", 30, 21)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 20}, {start: 21, end: 30}}},
+	},
+	{
+		name: "unsorted",
+		hits: []blast.Record{hit("chr1", 50, 40), hit("chr1", 10, 20), hit("chr1", 15, 45)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 50}}},
+	},
+	{
+		name: "unsorted separate",
+		hits: []blast.Record{hit("chr1", 60, 50), hit("chr1", 10, 20), hit("chr1", 35, 30)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 20}, {start: 30, end: 35}, {start: 50, end: 60}}},
+	},
+	{
+		name: "subjects",
+		hits: []blast.Record{hit("chr1", 10, 20), hit("chr2", 20, 10), hit("chr1", 15, 25)},
+		want: map[string][]gap{"chr1": {{start: 10, end: 25}}, "chr2": {{start: 10, end: 20}}},
+	},
+}
+
+func TestMaskSpans(t *testing.T) {
+	for _, test := range maskSpansTests {
+		got := maskSpans(test.hits)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected spans for %s test: got:%v want:%v", test.name, got, test.want)
+		}
+	}
+}
+
+// spanSetAddTests are hits added in subject position order, which are
+// merged as they are added.
+var spanSetAddTests = []struct {
+	name string
+	hits []blast.Record
+	want spanSet
+}{
+	{
+		name: "empty",
+		hits: nil,
+		want: spanSet{},
+	},
+	{
+		name: "reverse overlapping forward",
+		hits: []blast.Record{hit("chr1", 10, 20), hit("chr1", 25, 15)},
+		want: spanSet{"chr1": {{start: 10, end: 25}}},
+	},
+	{
+		name: "forward overlapping reverse",
+		hits: []blast.Record{hit("chr1", 20, 10), hit("chr1", 15, 25)},
+		want: spanSet{"chr1": {{start: 10, end: 25}}},
+	},
+	{
+		name: "adjacent reverse",
+		hits: []blast.Record{hit("chr1", 20, 10), hit("chr1", 30, 20)},
+		want: spanSet{"chr1": {{start: 10, end: 30}}},
+	},
+	{
+		name: "separate",
+		hits: []blast.Record{hit("chr1", 20, 10), hit("chr1", 21, 30), hit("chr2", 5, 1)},
+		want: spanSet{"chr1": {{start: 10, end: 20}, {start: 21, end: 30}}, "chr2": {{start: 1, end: 5}}},
+	},
+}
+
+func TestSpanSetAdd(t *testing.T) {
+	for _, test := range spanSetAddTests {
+		got := make(spanSet)
+		for _, h := range test.hits {
+			got.add(h)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected spans for %s test: got:%v want:%v", test.name, got, test.want)
+		}
+	}
+}
+
+var unionTests = []struct {
+	name string
+	ivs  []gap
+	want []gap
+}{
+	{name: "nil", ivs: nil, want: nil},
+	{name: "empty", ivs: []gap{}, want: nil},
+	{name: "single", ivs: []gap{{start: 1, end: 5}}, want: []gap{{start: 1, end: 5}}},
+	{name: "adjacent", ivs: []gap{{start: 5, end: 10}, {start: 1, end: 5}}, want: []gap{{start: 1, end: 10}}},
+	{name: "overlapping", ivs: []gap{{start: 1, end: 6}, {start: 4, end: 10}}, want: []gap{{start: 1, end: 10}}},
+	{name: "contained", ivs: []gap{{start: 1, end: 10}, {start: 2, end: 3}}, want: []gap{{start: 1, end: 10}}},
+	{name: "disjoint", ivs: []gap{{start: 20, end: 30}, {start: 1, end: 10}}, want: []gap{{start: 1, end: 10}, {start: 20, end: 30}}},
+	{name: "empty interval", ivs: []gap{{start: 5, end: 5}, {start: 1, end: 3}}, want: []gap{{start: 1, end: 3}, {start: 5, end: 5}}},
+}
+
+func TestUnion(t *testing.T) {
+	for _, test := range unionTests {
+		got := union(test.ivs)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected union for %s test: got:%v want:%v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestByteLimit(t *testing.T) {
+	l := newByteLimit(10)
+
+	// Work larger than the limit is done alone.
+	l.acquire(20)
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire(5)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("unexpected acquisition beyond limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.release(20)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("failed to acquire after release")
+	}
+
+	// Work within the limit is done together.
+	l.acquire(5)
+	if l.used != 10 {
+		t.Errorf("unexpected bytes held: got:%d want:10", l.used)
+	}
+	l.release(5)
+	l.release(5)
+	if l.used != 0 {
+		t.Errorf("unexpected bytes held after release: got:%d want:0", l.used)
+	}
+}
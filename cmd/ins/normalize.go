@@ -0,0 +1,99 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"sort"
+)
+
+// normalizer is an io.Reader that normalizes the fasta data read from
+// an underlying reader. Carriage returns are removed from line endings,
+// '*' padding letters are replaced with N and, optionally, sequence
+// letters are upper-cased. Sequence letters that are not IUPAC
+// nucleotide codes are passed through and counted.
+type normalizer struct {
+	r     *bufio.Reader
+	name  string
+	upper bool
+
+	line []byte
+	err  error
+
+	pads int
+	bad  map[byte]int
+}
+
+// newNormalizer returns a normalizer reading from r. The name is used to
+// identify the source in warnings. If upper is true, sequence letters
+// are upper-cased.
+func newNormalizer(r io.Reader, name string, upper bool) *normalizer {
+	return &normalizer{r: bufio.NewReader(r), name: name, upper: upper}
+}
+
+// Read implements the io.Reader interface.
+func (n *normalizer) Read(b []byte) (int, error) {
+	for len(n.line) == 0 {
+		if n.err != nil {
+			return 0, n.err
+		}
+		n.line, n.err = n.r.ReadBytes('\n')
+		n.normalize()
+	}
+	c := copy(b, n.line)
+	n.line = n.line[c:]
+	return c, nil
+}
+
+// normalize normalizes the current line.
+func (n *normalizer) normalize() {
+	line := n.line
+	eol := len(line)
+	if eol != 0 && line[eol-1] == '\n' {
+		eol--
+	}
+	if eol != 0 && line[eol-1] == '\r' {
+		copy(line[eol-1:], line[eol:])
+		line = line[:len(line)-1]
+		eol--
+	}
+	n.line = line
+	if len(line) == 0 || line[0] == '>' {
+		return
+	}
+	for i, c := range line[:eol] {
+		switch {
+		case c == '*':
+			line[i] = 'N'
+			n.pads++
+		case n.upper && 'a' <= c && c <= 'z':
+			line[i] = c &^ 0x20
+		}
+		if !iupac[line[i]] && line[i] != ' ' && line[i] != '\t' {
+			if n.bad == nil {
+				n.bad = make(map[byte]int)
+			}
+			n.bad[line[i]]++
+		}
+	}
+}
+
+// warn reports padding and invalid letters found during reading.
+func (n *normalizer) warn() {
+	if n.pads != 0 {
+		warnf("%s: replaced %d '*' padding letters with N", n.name, n.pads)
+	}
+	if len(n.bad) != 0 {
+		letters := make([]byte, 0, len(n.bad))
+		var count int
+		for b, c := range n.bad {
+			letters = append(letters, b)
+			count += c
+		}
+		sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+		warnf("%s: %d sequence letters are not IUPAC nucleotide codes: %q", n.name, count, letters)
+	}
+}
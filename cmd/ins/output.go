@@ -0,0 +1,122 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/biogo/hts/bgzf"
+)
+
+// bgzfExts are the extensions of output files that are written with BGZF
+// compression when compressed so that they can be indexed by samtools faidx
+// and tabix.
+var bgzfExts = map[string]bool{
+	".fa":    true,
+	".fas":   true,
+	".fasta": true,
+	".fna":   true,
+	".gtf":   true,
+	".gff":   true,
+	".gff3":  true,
+	".bed":   true,
+}
+
+// createOutput creates the output file at path. If path ends in .gz the
+// file is compressed, with BGZF if the extension preceding .gz is in
+// bgzfExts, and with gzip otherwise.
+func createOutput(path string) (io.WriteCloser, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	if bgzfExts[filepath.Ext(strings.TrimSuffix(path, ".gz"))] {
+		return compressedFile{z: bgzf.NewWriter(f, runtime.GOMAXPROCS(0)), f: f}, nil
+	}
+	return compressedFile{z: gzip.NewWriter(f), f: f}, nil
+}
+
+// writeOutput writes b to the output file at path, compressing it if path
+// ends in .gz.
+func writeOutput(path string, b []byte) error {
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compressedFile is a compressed output file.
+type compressedFile struct {
+	z io.WriteCloser
+	f *os.File
+}
+
+func (c compressedFile) Write(b []byte) (int, error) { return c.z.Write(b) }
+
+// Close closes the compressor and the file.
+func (c compressedFile) Close() error {
+	err := c.z.Close()
+	if err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+// compressFile writes a compressed copy of the file at src to the output
+// file at dst, which must end in .gz, and removes src.
+func compressFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := createOutput(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// compressed returns name with a .gz suffix if output compression is
+// requested and name does not already have one.
+func (r run) compressed(name string) string {
+	if !r.gz || strings.HasSuffix(name, ".gz") {
+		return name
+	}
+	return name + ".gz"
+}
+
+// compressedExt returns the extension added to the names of compressed
+// outputs, or the empty string if output compression is not requested.
+func (r run) compressedExt() string {
+	if r.gz {
+		return ".gz"
+	}
+	return ""
+}
@@ -0,0 +1,243 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// familyParams is a set of blastn parameter overrides applied to library
+// families matching pattern.
+type familyParams struct {
+	pattern string
+	params  []param
+}
+
+// param is a blastn parameter setting.
+type param struct {
+	key, value string
+}
+
+// readFamilyParams reads a table of per-family blastn parameter overrides
+// from the file at file. Each non-blank line that does not start with '#'
+// holds a family or class pattern followed by white space separated
+// key=value parameter settings. The parameters are checked against search.
+func readFamilyParams(file string, search blast.Nucleic) ([]familyParams, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var table []familyParams
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		words := strings.Fields(text)
+		if len(words) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing parameters", file, line)
+		}
+		_, err = path.Match(words[0], "")
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q: %w", file, line, words[0], err)
+		}
+		fp := familyParams{pattern: words[0]}
+		for _, w := range words[1:] {
+			k, v, ok := cut(w, "=")
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: parameter %q is not key=value", file, line, w)
+			}
+			fp.params = append(fp.params, param{key: strings.TrimLeft(k, "-"), value: v})
+		}
+		_, err = applyParams(search, fp.params)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		table = append(table, fp)
+	}
+	return table, sc.Err()
+}
+
+// matches returns whether the family name or its class matches the pattern.
+// A pattern matching a class also matches its subclasses.
+func (f familyParams) matches(name, class string) bool {
+	if ok, _ := path.Match(f.pattern, name); ok {
+		return true
+	}
+	for class != "" {
+		if ok, _ := path.Match(f.pattern, class); ok {
+			return true
+		}
+		i := strings.LastIndexByte(class, '/')
+		if i < 0 {
+			break
+		}
+		class = class[:i]
+	}
+	return false
+}
+
+// paramsFor returns the index of the first entry in table matching the
+// family name and class, or -1 if no entry matches.
+func paramsFor(table []familyParams, name, class string) int {
+	for i, f := range table {
+		if f.matches(name, class) {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyParams returns n with the parameters in params applied.
+func applyParams(n blast.Nucleic, params []param) (blast.Nucleic, error) {
+	for _, p := range params {
+		var err error
+		switch p.key {
+		case "evalue":
+			n.EValue, err = strconv.ParseFloat(p.value, 64)
+		case "word_size":
+			n.WordSize, err = strconv.Atoi(p.value)
+		case "reward":
+			n.Reward, err = strconv.Atoi(p.value)
+		case "penalty":
+			n.Penalty, err = strconv.Atoi(p.value)
+		case "xdrop_ungap":
+			n.XdropUngap, err = strconv.Atoi(p.value)
+		case "xdrop_gap":
+			n.XdropGap, err = strconv.Atoi(p.value)
+		case "xdrop_gap_final":
+			n.XdropGapFinal, err = strconv.Atoi(p.value)
+		case "gapopen":
+			n.GapOpen, err = strconv.Atoi(p.value)
+		case "gapextend":
+			n.GapExtend, err = strconv.Atoi(p.value)
+		default:
+			return n, fmt.Errorf("unsupported family parameter: %s", p.key)
+		}
+		if err != nil {
+			return n, fmt.Errorf("invalid value for %s: %w", p.key, err)
+		}
+	}
+	return n, nil
+}
+
+// grouped is a library searched with its own blastn parameters.
+type grouped struct {
+	library
+	search blast.Nucleic
+}
+
+// splitLibrary splits the sequences in libs into libraries written to dir
+// according to the first matching entry of table. It returns a library for
+// each non-empty group, searched with the parameters of search modified by
+// the group's overrides. Sequences not matching any entry are searched with
+// search. Families with surrogate identifiers are matched by their original
+// identifiers in ids.
+func splitLibrary(dir string, libs []string, ids idMap, table []familyParams, search blast.Nucleic) ([]library, error) {
+	files := make([]*os.File, len(table)+1)
+	counts := make([]int, len(files))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	for _, lib := range libs {
+		f, err := os.Open(lib)
+		if err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(f)
+		var dst *os.File
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) != 0 {
+				if line[0] == '>' {
+					name, class := libHeader(bytes.TrimSpace(line))
+					i := paramsFor(table, ids.original(name), class)
+					if i < 0 {
+						i = len(table)
+					}
+					if files[i] == nil {
+						var cerr error
+						files[i], cerr = os.Create(filepath.Join(dir, fmt.Sprintf("library-group-%d.fa", i)))
+						if cerr != nil {
+							f.Close()
+							return nil, cerr
+						}
+					}
+					dst = files[i]
+					counts[i]++
+				}
+				if dst != nil {
+					_, err := dst.Write(line)
+					if err != nil {
+						f.Close()
+						return nil, err
+					}
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				f.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+	}
+
+	var groups []library
+	for i, f := range files {
+		if f == nil {
+			continue
+		}
+		s := search
+		pattern := "(default)"
+		if i < len(table) {
+			var err error
+			s, err = applyParams(search, table[i].params)
+			if err != nil {
+				return nil, err
+			}
+			pattern = table[i].pattern
+		}
+		err := f.Close()
+		files[i] = nil
+		if err != nil {
+			return nil, err
+		}
+		logFields(fields{"library": f.Name(), "pattern": pattern}, "grouped %d library families matching %s", counts[i], pattern)
+		groups = append(groups, grouped{library: filename(f.Name()), search: s})
+	}
+	return groups, nil
+}
+
+// libHeader returns the family name and class from a library fasta
+// header line.
+func libHeader(b []byte) (name, class string) {
+	b = bytes.TrimPrefix(b, []byte{'>'})
+	lenID := bytes.IndexAny(b, " \t")
+	if lenID < 0 {
+		return string(b), ""
+	}
+	return string(b[:lenID]), string(bytes.Fields(b[lenID+1:])[0])
+}
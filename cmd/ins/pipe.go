@@ -0,0 +1,87 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// bufferLibraries replaces each path in libs that is not a regular file,
+// such as a named pipe or a process substitution, with a path to a copy of
+// its contents in dir, or the system temporary directory if dir is empty.
+// Libraries are read more than once during a search, so streams must be
+// buffered. Copies are named by the digest of their contents so that
+// working directory names and recovery are stable between runs with the
+// same library content. The paths of the copies are returned so they can
+// be removed when no longer needed.
+func bufferLibraries(dir string, libs ...[]string) ([]string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	var copies []string
+	buffered := make(map[string]string)
+	for _, set := range libs {
+		for i, p := range set {
+			if b, ok := buffered[p]; ok {
+				set[i] = b
+				continue
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				return copies, err
+			}
+			if fi.Mode().IsRegular() {
+				continue
+			}
+			b, err := bufferLibrary(dir, p)
+			if err != nil {
+				return copies, err
+			}
+			logFields(fields{"library": p}, "buffered library %s to %s", p, b)
+			buffered[p] = b
+			copies = append(copies, b)
+			set[i] = b
+		}
+	}
+	return copies, nil
+}
+
+// bufferLibrary copies the stream at path to a file in dir named by the
+// digest of its contents, returning the path of the copy.
+func bufferLibrary(dir, path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, "ins-lib-*.fa")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, h), src)
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	err = dst.Close()
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	name := filepath.Join(dir, "ins-lib-"+hex.EncodeToString(h.Sum(nil)[:8])+".fa")
+	err = os.Rename(dst.Name(), name)
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return name, nil
+}
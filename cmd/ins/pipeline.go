@@ -0,0 +1,684 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"modernc.org/kv"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/seq/linear"
+	"github.com/biogo/hts/fai"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/crossmatch"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// pass holds the parameters for an annotation pass.
+type pass struct {
+	// search and reciprocal are the forward and
+	// reciprocal BLAST parameters.
+	search, reciprocal blast.Nucleic
+
+	// libs is the set of library file names.
+	libs []string
+	// pool specifies that libraries are pooled
+	// into a single search.
+	pool bool
+
+	// mflags and bflags are passed to makeblastdb
+	// and blastn as arguments without interpretation.
+	mflags, bflags []string
+
+	// consensusTol is the consensus coordinate
+	// tolerance used when merging hits into
+	// regions. Negative values disable the check.
+	consensusTol int
+
+	// regionHitCap is the maximum number of
+	// forward hits in a merged region searched
+	// by the reciprocal search. Zero is no limit.
+	regionHitCap int
+
+	// flank is the number of bases each merged
+	// region is extended by on both sides for
+	// the reciprocal search.
+	flank int
+
+	// anyFamily specifies that merged regions
+	// are joined across families and searched
+	// once with all the libraries.
+	anyFamily bool
+
+	// recover is the path to a kv db file for
+	// continuation.
+	recover string
+
+	// maxTmp and maxMem are the temporary file
+	// space and memory budgets for the pass.
+	maxTmp, maxMem int64
+
+	// maxReport is the size of the reciprocal
+	// search output for a library sequence
+	// above which a warning is reported. Zero
+	// is no limit.
+	maxReport int64
+
+	verbose bool
+	logger  io.Writer
+
+	// familyParams holds per-family blastn
+	// parameter overrides.
+	familyParams []familyParams
+
+	// species is the lineage of taxa whose
+	// library sequences are searched. If
+	// species is empty, all sequences are
+	// searched.
+	species []string
+
+	// ids maps surrogate library sequence
+	// identifiers to the original identifiers.
+	ids idMap
+
+	// overlap is the length of the overlap
+	// between adjacent query fragments.
+	overlap int
+
+	// upperQuery specifies that query
+	// sequence letters are upper-cased
+	// when the query is split.
+	upperQuery bool
+
+	// exclude describes the regions of the
+	// query that are not searched, soft-masked
+	// prior annotations and excluded intervals.
+	exclude exclusion
+
+	// stop is the pipeline stage after which
+	// annotate returns errStageDone. If stop
+	// is empty, all stages are performed.
+	stop string
+
+	// dedupe is the k-mer containment fraction
+	// above which library sequences are removed
+	// as redundant before searching. If dedupe
+	// is zero, the libraries are searched as
+	// given.
+	dedupe float64
+
+	// convergence is the criteria for ending
+	// the iterative forward search.
+	convergence convergence
+
+	// dbCache holds makeblastdb products from
+	// earlier runs.
+	dbCache dbCache
+
+	// saveBlast specifies that raw BLAST
+	// outputs are saved in the working
+	// directory.
+	saveBlast bool
+
+	// invert specifies that the forward search
+	// uses the query as the BLAST query and the
+	// libraries as the database.
+	invert bool
+
+	// engine is the forward search engine and
+	// last holds the parameters used when it
+	// is engineLast.
+	engine string
+	last   lastSearch
+
+	// crossMatch holds the parameters used
+	// when engine is engineCrossMatch. If
+	// crossMatchOut is not empty, its files
+	// are used as the cross_match output
+	// instead of searching.
+	crossMatch    crossmatch.CrossMatch
+	crossMatchOut []string
+
+	// dustGenome specifies that low-complexity
+	// regions of the query are soft-masked in
+	// the forward search.
+	dustGenome bool
+
+	// batchSize is the total length of merged
+	// regions at which a batch of region groups
+	// is searched in the reciprocal search. If
+	// batchSize is zero, each group is searched
+	// separately.
+	batchSize int64
+
+	// seqCache is the maximum total length of
+	// query sequences held in memory to extract
+	// merged regions for the reciprocal search.
+	seqCache int64
+
+	// searchRegions specifies that merged
+	// regions are searched with the libraries
+	// even when the forward search provides
+	// alignment details.
+	searchRegions bool
+}
+
+// libraries returns the libraries to search for the pass.
+func (p pass) libraries() ([]library, error) {
+	if len(p.libs) > 1 && p.pool {
+		return newStream(p.libs)
+	}
+	return filenames(p.libs), nil
+}
+
+// prepareLibraries returns the pass with library sequences not relevant
+// to p.species and redundant library sequences removed into dir, and the
+// libraries to search.
+func (p pass) prepareLibraries(dir string) (pass, []library, error) {
+	if len(p.species) != 0 {
+		done := stage("species")
+		lib, removed, err := speciesLibrary(filepath.Join(dir, "library-species.fa"), p.libs, p.species)
+		if err != nil {
+			return p, nil, inputError(err)
+		}
+		log.Printf("removed %d library sequences not annotated with %q", removed, p.species)
+		p.libs = []string{lib}
+		done()
+	}
+	if p.dedupe > 0 {
+		done := stage("dedupe")
+		lib, removed, err := dedupeLibrary(filepath.Join(dir, "library-deduped.fa"), p.libs, p.dedupe)
+		if err != nil {
+			return p, nil, inputError(err)
+		}
+		log.Printf("removed %d redundant library sequences", removed)
+		p.libs = []string{lib}
+		done()
+	}
+	ids, err := sanitizeLibraries(filepath.Join(dir, "library-ids.fa"), p.libs)
+	if err != nil {
+		return p, nil, inputError(err)
+	}
+	if ids != nil {
+		log.Printf("replaced %d unsafe library sequence identifiers", len(ids))
+		p.libs = []string{filepath.Join(dir, "library-ids.fa")}
+		p.ids = ids
+	}
+	libraries, err := p.libraries()
+	return p, libraries, err
+}
+
+// forward performs the forward search of libraries against the query
+// fragments in frags, working in dir, and returns the database of hits
+// remapped to query coordinates using mx.
+func (p pass) forward(dir string, frags *os.File, libraries []library, mx map[string]fragment) (*kv.DB, error) {
+	var (
+		maskData string
+		err      error
+	)
+	if p.dustGenome {
+		done := stage("dust")
+		maskData, err = dustMask(frags, p.logger)
+		if err != nil {
+			return nil, err
+		}
+		done()
+	}
+	done := stage("forward")
+	if p.direct() {
+		p.search.OutColumns = detailColumns
+	}
+	if len(p.familyParams) != 0 {
+		libraries, err = splitLibrary(dir, p.libs, p.ids, p.familyParams, p.search)
+		if err != nil {
+			return nil, inputError(err)
+		}
+	}
+	var hits *kv.DB
+	switch {
+	case p.engine == engineCrossMatch && len(p.crossMatchOut) != 0:
+		hits, err = importCrossMatch(dir, p.crossMatchOut)
+	case p.engine == engineCrossMatch:
+		hits, err = runCrossMatch(p.crossMatch, frags, libraries, mx, p.logger)
+	case p.engine == engineLast:
+		hits, err = runLastTabular(p.last, frags, libraries, mx, p.convergence, p.logger)
+	case p.invert:
+		hits, err = runBlastInverted(p.search, frags, libraries, mx, p.dbCache, p.saver(dir), p.mflags, p.bflags, p.logger)
+	default:
+		hits, err = runBlastTabular(p.search, frags, libraries, mx, maskData, p.convergence, p.dbCache, p.saver(dir), p.mflags, p.bflags, p.logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	done()
+	return hits, nil
+}
+
+// annotate performs the forward, merge and reciprocal passes of a search
+// for the libraries in p against the sequences in the fasta file at path,
+// working in dir. It returns the database of reciprocal hits. If no repeat
+// region is found, annotate returns io.EOF.
+func annotate(path, dir string, p pass) (*kv.DB, error) {
+	query, err := os.Open(path)
+	if err != nil {
+		return nil, inputError(err)
+	}
+	defer query.Close()
+	fi, err := query.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = checkDisk(dir, fi.Size(), p.maxTmp)
+	if err != nil {
+		if p.maxTmp != 0 {
+			return nil, err
+		}
+		warnf("%v", err)
+	}
+
+	var frags *os.File
+	if filepath.Base(p.recover) == "fragments.tsv" {
+		// Continue from the fragments of an earlier split.
+		frags, err = os.Open(filepath.Join(filepath.Dir(p.recover), "query-fragments"))
+	} else {
+		frags, err = os.Create(filepath.Join(dir, "query-fragments"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer frags.Close()
+
+	done := stage("split")
+	log.Println("indexing query")
+	err = checkUniqueIDs(query)
+	if err != nil {
+		return nil, inputError(err)
+	}
+	_, err = query.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	qidx, err := fai.NewIndex(query)
+	if err != nil {
+		return nil, inputError(err)
+	}
+	_, err = query.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mx   map[string]fragment
+		gaps map[string][]gap
+	)
+	if p.recover != "" {
+		from := filepath.Dir(p.recover)
+		mx, err = readFragments(filepath.Join(from, "fragments.tsv"))
+		if err == nil {
+			gaps, err = readGaps(filepath.Join(from, "gaps.bed"))
+		}
+		switch {
+		case err == nil:
+			log.Printf("recovered fragment index from %s", from)
+		case os.IsNotExist(err):
+			mx = nil
+		default:
+			return nil, err
+		}
+	}
+	if mx == nil {
+		log.Println("splitting query")
+		src := newNormalizer(query, query.Name(), p.upperQuery && !p.exclude.lower)
+		mx, gaps, err = split(frags, src, optFragmentLen, maxFragmentLen, p.overlap, p.exclude)
+		if err != nil {
+			return nil, inputError(err)
+		}
+		src.warn()
+		err = frags.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = writeFragments(filepath.Join(dir, "fragments.tsv"), mx)
+	if err != nil {
+		return nil, err
+	}
+	err = writeGaps(filepath.Join(dir, "gaps.bed"), gaps)
+	if err != nil {
+		return nil, err
+	}
+	done()
+	if p.stop == stageSplit {
+		return nil, errStageDone
+	}
+
+	p, libraries, err := p.prepareLibraries(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits *kv.DB
+	switch filepath.Base(p.recover) {
+	case "forward.db":
+		log.Printf("recovering blast results from %s", p.recover)
+		hits, err = store.Open(p.recover, store.Forward)
+		if err != nil {
+			return nil, storeError(err)
+		}
+	case "regions.db", "reverse.db", "culled.db":
+		// Do nothing.
+	default:
+		hits, err = p.forward(dir, frags, libraries, mx)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("forward.db valid for recover")
+		if p.stop == stageForward {
+			err = hits.Close()
+			if err != nil {
+				return nil, err
+			}
+			return nil, errStageDone
+		}
+	}
+	err = checkMem(p.maxMem)
+	if err != nil {
+		return nil, err
+	}
+
+	var regions *kv.DB
+	switch filepath.Base(p.recover) {
+	case "regions.db":
+		log.Printf("recovering merged results from %s", p.recover)
+		regions, err = store.Open(p.recover, store.Regions)
+		if err != nil {
+			return nil, storeError(err)
+		}
+	case "reverse.db", "culled.db":
+		log.Printf("recovering reciprocal blast results from %s", p.recover)
+		db, err := store.Open(p.recover, store.Reverse)
+		return db, storeError(err)
+	default:
+		done := stage("merge")
+		limit := p.regionHitCap
+		if p.direct() {
+			// All forward hits are assigned to
+			// their merged region.
+			limit = 0
+		}
+		regions, err = merge(hits, near, p.consensusTol, limit, dir)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("regions.db valid for recover")
+		err = hits.Close()
+		if err != nil {
+			return nil, err
+		}
+		done()
+		if p.stop == stageMerge {
+			err = regions.Close()
+			if err != nil {
+				return nil, err
+			}
+			return nil, errStageDone
+		}
+	}
+
+	if p.direct() {
+		done = stage("assign")
+		defer done()
+		forwardPath := filepath.Join(dir, "forward.db")
+		switch filepath.Base(p.recover) {
+		case "forward.db":
+			forwardPath = p.recover
+		case "regions.db":
+			forwardPath = filepath.Join(filepath.Dir(p.recover), "forward.db")
+		}
+		hits, err = store.Open(forwardPath, store.Forward)
+		if err != nil {
+			return nil, storeError(err)
+		}
+		reverse, err := assignRegions(hits, regions, p.ids, dir, p.maxMem)
+		if err != nil {
+			hits.Close()
+			return nil, err
+		}
+		err = hits.Close()
+		if err != nil {
+			return nil, err
+		}
+		err = regions.Close()
+		if err != nil {
+			return nil, err
+		}
+		return reverse, nil
+	}
+
+	done = stage("reciprocal")
+	defer done()
+	remappedHits, err := store.Create(filepath.Join(dir, "reverse.db"), store.Reverse, insVersion())
+	if err != nil {
+		return nil, storeError(err)
+	}
+	qfa := newSeqCache(fai.NewFile(query, qidx), qidx, p.seqCache)
+	if p.anyFamily {
+		_, err = p.searchAnyFamily(remappedHits, regions, qfa, qidx, dir)
+		if err != nil {
+			return nil, err
+		}
+		err = regions.Close()
+		if err != nil {
+			return nil, err
+		}
+		return remappedHits, nil
+	}
+	var details map[string]detail
+	if len(p.familyParams) != 0 {
+		details, err = libDetails(filenames(p.libs))
+		if err != nil {
+			return nil, inputError(err)
+		}
+	}
+	var (
+		g     store.BlastRecordKey
+		gOmit int
+		n     int
+		buf   bytes.Buffer
+		final bool
+
+		// Region groups are searched in batches
+		// sharing reciprocal search parameters.
+		batch    int
+		batchLen int64
+		sizes    = make(map[regionGroup]groupSize)
+
+		// Regions are given surrogate identifiers
+		// with the region coordinates and subject
+		// identifier held in descs for each batch.
+		regionID int
+		descs    = make(map[string]regionDesc)
+	)
+	c := store.Iterate(regions)
+	if c.Next() {
+		g = c.Key()
+		gOmit = regionOmitted(c.Value())
+	} else {
+		if c.Err() != nil {
+			return nil, c.Err()
+		}
+		final = true
+	}
+	for !final {
+		var (
+			next     store.BlastRecordKey
+			nextOmit int
+		)
+		if c.Next() {
+			next = c.Key()
+			nextOmit = regionOmitted(c.Value())
+		} else {
+			if c.Err() != nil {
+				return nil, c.Err()
+			}
+			final = true
+		}
+
+		left, right := flankRegion(int(g.SubjectLeft), int(g.SubjectRight), p.flank, qidx[g.SubjectAccVer].Length)
+		b, err := qfa.seqRange(g.SubjectAccVer, left, right)
+		if err != nil {
+			return nil, err
+		}
+		regionID++
+		s := linear.NewSeq(fmt.Sprintf("region_%d", regionID), alphabet.BytesToLetters(b), alphabet.DNAredundant)
+		fmt.Fprintf(&buf, "%60a\n", s)
+		group := regionGroup{family: g.QueryAccVer, strand: g.Strand}
+		descs[s.ID] = regionDesc{left: left, right: right, group: group, subject: g.SubjectAccVer, truncated: gOmit}
+		size := sizes[group]
+		size.len += int64(len(b))
+		size.n++
+		sizes[group] = size
+		batchLen += int64(len(b))
+
+		if final || g.QueryAccVer != next.QueryAccVer || g.Strand != next.Strand {
+			params := paramsFor(p.familyParams, p.ids.original(g.QueryAccVer), details[g.QueryAccVer].class)
+			if !final && batchLen < p.batchSize && paramsFor(p.familyParams, p.ids.original(next.QueryAccVer), details[next.QueryAccVer].class) == params {
+				// Add the next group to the batch.
+				g, gOmit = next, nextOmit
+				continue
+			}
+
+			libraries, err := p.libraries()
+			if err != nil {
+				return nil, err
+			}
+
+			reciprocal := p.reciprocal
+			if params >= 0 {
+				reciprocal, err = applyParams(reciprocal, p.familyParams[params].params)
+				if err != nil {
+					return nil, err
+				}
+			}
+			name := fmt.Sprintf("reciprocal-%d", batch)
+			var reported int
+			err = p.saver(dir).saveRegions(name, descs)
+			if err != nil {
+				return nil, err
+			}
+			err = runBlastReport(reciprocal, name, &buf, libraries, dir, p.saver(dir), p.mflags, p.bflags, p.maxReport, p.ids, p.logger, func(o *blast.Output) error {
+				recs, skipped := reportBlast([]*blast.Output{o}, descs, sizes, p.verbose)
+				if skipped != 0 {
+					warnf("%s: skipped %d hits to unknown regions", name, skipped)
+				}
+				reported += len(recs)
+				for i := range recs {
+					recs[i].QueryAccVer = p.ids.original(recs[i].QueryAccVer)
+				}
+				err := store.PutAnnotated(remappedHits, recs)
+				if err != nil {
+					return err
+				}
+				return checkMem(p.maxMem)
+			})
+			if err != nil {
+				return nil, err
+			}
+			logFields(fields{"batch": batch, "groups": len(sizes)}, "got %d reciprocal hits for %d region groups", reported, len(sizes))
+			if p.maxTmp != 0 {
+				// Reciprocal databases are not reused, so
+				// release their space when working to a budget.
+				err = removeDB(filepath.Join(dir, name+"-working"))
+				if err != nil {
+					return nil, err
+				}
+			}
+			n += reported
+			log.Printf("holding %d total remapped hits", n)
+			buf.Reset()
+			sizes = make(map[regionGroup]groupSize)
+			descs = make(map[string]regionDesc)
+			batchLen = 0
+			batch++
+		}
+		g, gOmit = next, nextOmit
+	}
+	err = regions.Close()
+	if err != nil {
+		return nil, err
+	}
+	return remappedHits, nil
+}
+
+// thenPass masks a copy of the sequences in query using the hits in db
+// and annotates the masked copy with the libraries in p, working in the
+// named sub-directory of dir. The hits found are added to db so that they
+// are resolved together with the existing hits.
+func thenPass(db *kv.DB, query *os.File, dir, name string, p pass) error {
+	// Hits are read in subject position order, so
+	// only the disjoint masked regions are held.
+	masking := make(spanSet)
+	c := store.Iterate(db)
+	for c.Next() {
+		r, err := c.Record()
+		if err != nil {
+			return err
+		}
+		masking.add(r)
+	}
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	sub := filepath.Join(dir, name)
+	err := os.Mkdir(sub, 0o755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sub, "query-masked")
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = query.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, query)
+	if err != nil {
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	err = mask(path, masking.union(), 'N', nil, p.maxMem)
+	if err != nil {
+		return err
+	}
+
+	extra, err := annotate(path, sub, p)
+	if err != nil {
+		if err == io.EOF {
+			log.Println("no additional repeat region found")
+			return nil
+		}
+		return err
+	}
+	defer extra.Close()
+	n, err := store.Copy(db, extra)
+	if err != nil {
+		return err
+	}
+	log.Printf("added %d hits from %s pass", n, name)
+	return nil
+}
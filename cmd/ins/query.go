@@ -0,0 +1,1057 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"modernc.org/kv"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
+	"github.com/biogo/hts/fai"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+// fastaExts are the file extensions of query sequence files found
+// in query directories.
+var fastaExts = map[string]bool{
+	".fa":    true,
+	".fas":   true,
+	".fasta": true,
+	".fna":   true,
+}
+
+// expandQueries returns the query sequence files specified by args. Each
+// arg may be a file, a directory holding fasta files or a glob pattern.
+// Masked sequence files written by ins are not included from directories.
+func expandQueries(args []string) ([]string, error) {
+	var queries []string
+	for _, a := range args {
+		if strings.ContainsAny(a, "*?[") {
+			matches, err := filepath.Glob(a)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no query matches %q", a)
+			}
+			queries = append(queries, matches...)
+			continue
+		}
+		fi, err := os.Stat(a)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			queries = append(queries, a)
+			continue
+		}
+		entries, err := ioutil.ReadDir(a)
+		if err != nil {
+			return nil, err
+		}
+		var n int
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || !fastaExts[filepath.Ext(name)] || strings.Contains(name, "-masked") || strings.Contains(name, ".masked") {
+				continue
+			}
+			queries = append(queries, filepath.Join(a, name))
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("no query sequence files in %s", a)
+		}
+	}
+	return uniq(queries), nil
+}
+
+// run holds the parameters shared by the annotation of each query.
+type run struct {
+	primary  pass
+	thenLibs []string
+
+	// quick is the search used to mask easily
+	// found repeats before the primary search
+	// of the remaining sequence. If quick is
+	// nil, only the primary search is used.
+	quick *blast.Nucleic
+
+	// libs is the complete set of libraries searched.
+	libs []string
+
+	mode    string
+	keep    string
+	workdir string
+	cull    bool
+
+	// stage is the pipeline stage subcommand
+	// being run in the working directory
+	// stageDir. If stage is empty, the
+	// complete pipeline is run.
+	stage    string
+	stageDir string
+
+	// secondary is the minimum score ratio of
+	// contained hits of other families that are
+	// retained as alternative assignments. If
+	// secondary is zero, none are retained.
+	secondary float64
+
+	// filter is applied to the final
+	// annotations before output.
+	filter filter
+
+	// maskChar is the letter used to mask
+	// annotated repeats in the masked query,
+	// and maskClasses are the patterns of
+	// families and classes to mask. If
+	// maskClasses is empty, all annotated
+	// repeats are masked. If maskLines is
+	// true the masked query retains the line
+	// structure of the query and is indexed.
+	maskChar    alphabet.Letter
+	maskClasses []string
+	maskLines   bool
+
+	// maskedOut is the path of the masked
+	// query. If maskedOut is empty, the path
+	// is named for the query or the output
+	// prefix. A masked query path ending in
+	// .gz is BGZF compressed. An existing
+	// masked query is only overwritten if
+	// force is true.
+	maskedOut string
+	force     bool
+
+	// gz specifies that output files are
+	// compressed, with .gz added to their
+	// names.
+	gz bool
+
+	// prior holds pre-existing mask intervals
+	// for each query sequence that are merged
+	// with the annotated repeats in the masked
+	// query. If prior is nil, only annotated
+	// repeats are masked.
+	prior map[string][]gap
+
+	// deterministic specifies that the run is
+	// reproducible. BLAST searches are single
+	// threaded and UIDs are numbered from one
+	// for each query.
+	deterministic bool
+
+	// tsdLen is the range of target site
+	// duplication lengths reported in GTF
+	// output, and genome holds the query
+	// sequence when tsdLen is not zero.
+	tsdLen tsdRange
+	genome *genome
+
+	// groupHSPs specifies that the HSPs of
+	// each hit are written as fragments of
+	// a parent element feature in GTF output.
+	groupHSPs bool
+
+	// rmCoords specifies that consensus
+	// coordinates in the Repeat attribute
+	// are ordered and formatted as in
+	// RepeatMasker .out files.
+	rmCoords bool
+
+	// genes is the gene annotation used to
+	// describe the gene context of hits. If
+	// genes is nil, no context is given.
+	genes *geneIndex
+
+	// tandem specifies that telomeric and
+	// satellite tandem arrays are detected
+	// and reported, with arrays of the
+	// telomere motif reported as telomeres.
+	tandem   bool
+	telomere string
+
+	// screened holds the screen type of the
+	// families of screening references.
+	// Their matches are reported with the
+	// type as the feature type.
+	screened map[string]string
+
+	// refCopies specifies that identical
+	// full-length matches to a library sequence
+	// are flagged as reference copies.
+	refCopies bool
+
+	// format is the format of the indexed
+	// annotation table to write, if any.
+	format string
+
+	// rmsk specifies that annotations are
+	// also written as a UCSC rmsk table.
+	rmsk bool
+
+	// bam specifies that annotations are
+	// also written as BAM alignments to
+	// their library sequences.
+	bam bool
+
+	// matrix specifies that per-sequence
+	// by family element count and annotated
+	// base matrices are written.
+	matrix bool
+
+	// divsum specifies that per-family
+	// divergence bins and a RepeatMasker
+	// divergence summary are written.
+	divsum bool
+
+	// density is the window width of per-class
+	// repeat density tracks. If density is zero,
+	// no tracks are written. If bigWig is true
+	// the tracks are converted to bigWig.
+	density int
+	bigWig  bool
+
+	// out is the prefix of the names of the
+	// output files for the query. If out is
+	// empty, outputs are written beside the
+	// query.
+	out string
+
+	lift    *liftover
+	details map[string]detail
+	tools   map[string]string
+}
+
+// outputName returns the name of the output file for the query at path
+// with the given suffix. If the run has an output prefix, the name is the
+// prefix followed by alt, or by suffix if alt is empty.
+func (r run) outputName(path, suffix, alt string) string {
+	if r.out == "" {
+		return path + suffix
+	}
+	if alt == "" {
+		alt = suffix
+	}
+	return r.out + alt
+}
+
+// maskedName returns the name of the masked sequence file for the query at
+// path.
+func (r run) maskedName(path string) string {
+	if r.maskedOut != "" {
+		return r.maskedOut
+	}
+	return r.compressed(r.outputName(path, "-masked.fasta", ".masked.fa"))
+}
+
+// checkMasked returns an error if writing the masked sequence for the query
+// at path would overwrite an existing file without the run being forced,
+// or would overwrite the query.
+func (r run) checkMasked(path string) error {
+	masked := r.maskedName(path)
+	if filepath.Clean(masked) == filepath.Clean(path) {
+		return exitError{code: exitUsage, err: fmt.Errorf("masked sequence would overwrite query %s", path)}
+	}
+	if r.force {
+		return nil
+	}
+	_, err := os.Stat(masked)
+	if err == nil {
+		return exitError{code: exitUsage, err: fmt.Errorf("masked sequence %s exists: use -force to overwrite", masked)}
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// beginQuery resets the per-query state of the run. In deterministic
+// runs, UIDs are numbered from one for each query.
+func (r run) beginQuery() {
+	stageTimes = nil
+	if r.deterministic {
+		hitID = 0
+	}
+}
+
+// queryPrefix returns the output prefix for the query at path given the
+// output prefix of the run. If the run has more than one query, the base
+// name of the query without its extension is added to the prefix.
+func queryPrefix(prefix, path string, many bool) string {
+	if prefix == "" || !many {
+		return prefix
+	}
+	base := filepath.Base(path)
+	return prefix + "." + strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// annotateQuery runs the complete pipeline for the query sequence file at
+// path, writing features to out, or enc when it is not nil, and the masked
+// sequence and run manifest beside the query or named with the output prefix. If no repeat region is found,
+// annotateQuery returns io.EOF.
+func (r run) annotateQuery(path string, out io.Writer, enc *gff.Writer) error {
+	start := time.Now()
+	r.beginQuery()
+	logFields(fields{"query": path}, "annotating %s", path)
+	if r.stage == "" || r.stage == stageReport {
+		err := r.checkMasked(path)
+		if err != nil {
+			return err
+		}
+		if r.format != "" {
+			err = checkExportPath(r.format, r.outputName(path, "."+r.format, ""))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tmpDir := r.stageDir
+	if tmpDir == "" {
+		var err error
+		tmpDir, err = workDir(r.workdir, path, r.mode, r.primary.libs)
+		if err != nil {
+			return err
+		}
+	}
+	unlock, err := lockWorkDir(tmpDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	primary := r.primary
+	if r.quick != nil {
+		primary.search = *r.quick
+	}
+	primary.recover = recoverPath(primary.recover, tmpDir)
+	err = prepareWorkDir(tmpDir, primary.recover)
+	if err != nil {
+		return err
+	}
+	log.Printf("working in %s", tmpDir)
+	if r.keep != keepNone {
+		log.Printf("keeping %s work", r.keep)
+	}
+
+	query, err := os.Open(path)
+	if err != nil {
+		return inputError(err)
+	}
+	defer query.Close()
+
+	remappedHits, err := annotate(path, tmpDir, primary)
+	if err == errStageDone {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Additional passes are part of the reciprocal
+	// stage and are not repeated by later stages.
+	passes := r.stage == "" || r.stage == stageReverse
+	if r.quick != nil && passes {
+		log.Printf("searching sequence remaining after quick search in %s mode", r.mode)
+		slow := primary
+		slow.search = r.primary.search
+		slow.recover = ""
+		err = thenPass(remappedHits, query, tmpDir, "slow", slow)
+		if err != nil {
+			return err
+		}
+	}
+	if len(r.thenLibs) != 0 && passes {
+		log.Printf("searching masked sequence with %q", r.thenLibs)
+		then := r.primary
+		then.libs = r.thenLibs
+		then.recover = ""
+		err = thenPass(remappedHits, query, tmpDir, "then", then)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.stage == stageReverse {
+		return remappedHits.Close()
+	}
+
+	var secondary *kv.DB
+	culled := filepath.Base(primary.recover) == "culled.db"
+	if culled && r.secondary > 0 {
+		secondary, err = openIfExists(filepath.Join(tmpDir, "secondary.db"))
+		if err != nil {
+			return storeError(err)
+		}
+	}
+	if r.stage == stageCull || (r.cull && !culled) {
+		done := stage("cull")
+		log.Println("discarding low scoring nested features")
+		if r.keep != keepNone {
+			// Close and copy reverse.db into reverse-unculled.db.
+			log.Println("keeping copy of unculled reverse.db in reverse-unculled.db")
+			err = remappedHits.Close()
+			if err != nil {
+				return err
+			}
+			db := filepath.Join(tmpDir, "reverse.db")
+			err = copyFile(filepath.Join(tmpDir, "reverse-unculled.db"), db)
+			if err != nil {
+				return storeError(fmt.Errorf("failed to copy reverse.db before culling: %w", err))
+			}
+			log.Println("reverse-unculled.db will be used when recovering from reverse.db")
+
+			// Reopen reverse.db.
+			remappedHits, err = store.Open(db, store.Reverse)
+			if err != nil {
+				return storeError(err)
+			}
+		}
+		if r.secondary > 0 {
+			path := filepath.Join(tmpDir, "secondary.db")
+			err = removeIfExists(path)
+			if err != nil {
+				return err
+			}
+			secondary, err = store.Create(path, store.Secondary, insVersion())
+			if err != nil {
+				return storeError(err)
+			}
+		}
+		err = cullContained(remappedHits, secondary, r.secondary)
+		if err != nil {
+			return storeError(err)
+		}
+		done()
+	}
+	if r.stage == stageCull {
+		if secondary != nil {
+			err = secondary.Close()
+			if err != nil {
+				return err
+			}
+		}
+		err = remappedHits.Close()
+		if err != nil {
+			return err
+		}
+		err = copyFile(filepath.Join(tmpDir, "culled.db"), filepath.Join(tmpDir, "reverse.db"))
+		if err != nil {
+			return storeError(err)
+		}
+		log.Println("culled.db valid for report")
+		return nil
+	}
+	log.Println("reverse.db valid for recover")
+
+	done := stage("output")
+	if r.tsdLen.max != 0 && enc != nil {
+		r.genome, err = readGenome(path)
+		if err != nil {
+			return err
+		}
+	}
+	sorted, err := outputOrder(filepath.Join(tmpDir, "output.db"), remappedHits, secondary)
+	if err != nil {
+		return storeError(err)
+	}
+	masked, err := r.writeFeatures(out, enc, sorted, remappedHits)
+	if err != nil {
+		return err
+	}
+	if r.tandem {
+		g := r.genome
+		if g == nil {
+			g, err = readGenome(path)
+			if err != nil {
+				return err
+			}
+		}
+		err = r.writeTandem(out, enc, g)
+		if err != nil {
+			return err
+		}
+	}
+	if secondary != nil {
+		err = secondary.Close()
+		if err != nil {
+			return err
+		}
+	}
+	done()
+
+	done = stage("mask")
+	_, err = query.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	qidx, err := fai.NewIndex(query)
+	if err != nil {
+		return err
+	}
+	var genome int64
+	for _, rec := range qidx {
+		genome += int64(rec.Length)
+	}
+	maskedPath := r.maskedName(path)
+	compressed := strings.HasSuffix(maskedPath, ".gz")
+	target := maskedPath
+	if compressed {
+		target = filepath.Join(tmpDir, "query-masked.fasta")
+	}
+	target, err = workingFile(query, target)
+	if err != nil {
+		return err
+	}
+	gaps, err := readGaps(filepath.Join(tmpDir, "gaps.bed"))
+	if err != nil {
+		return err
+	}
+	spans := masked.union()
+	if r.prior != nil {
+		lengths := make(map[string]int, len(qidx))
+		for name, rec := range qidx {
+			lengths[name] = rec.Length
+		}
+		mergeSpans(spans, r.prior, lengths)
+	}
+	if r.maskLines {
+		err = maskLines(target, spans, r.maskChar, gaps)
+	} else {
+		err = mask(target, spans, r.maskChar, gaps, r.primary.maxMem)
+	}
+	if err != nil {
+		return err
+	}
+	if r.lift != nil {
+		lifted := r.outputName(path, "-masked-lifted.fasta", ".masked-lifted.fa")
+		dst := lifted
+		if compressed {
+			lifted += ".gz"
+			dst = filepath.Join(tmpDir, "query-masked-lifted.fasta")
+		}
+		err = r.lift.liftFasta(dst, target)
+		if err == nil && compressed {
+			err = compressFile(lifted, dst)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("lifted masked sequence in %s", lifted)
+	}
+	if compressed {
+		err = compressFile(maskedPath, target)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("masked sequence in %s", maskedPath)
+	done()
+
+	// The hits are only retained when a
+	// report needs them in addition to
+	// the repeat summary.
+	summary := newRepeatCounts(r.details)
+	var masking []blast.Record
+	err = r.reportRecords(sorted, func(rec blast.Record) error {
+		summary.add(rec)
+		if !r.reportsHits() {
+			return nil
+		}
+		masking = append(masking, rec)
+		if len(masking)%1e5 == 0 {
+			return checkMem(r.primary.maxMem)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = sorted.Close()
+	if err != nil {
+		return err
+	}
+	err = remappedHits.Close()
+	if err != nil {
+		return err
+	}
+	retained, err := cleanWorkDir(tmpDir, r.keep)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := r.compressed(r.outputName(path, "-run-manifest.json", ".run-manifest.json"))
+	err = writeManifest(manifestPath, manifest{
+		Version:       insVersion(),
+		CommandLine:   os.Args,
+		Start:         start,
+		End:           time.Now(),
+		Tools:         r.tools,
+		Container:     exe.container,
+		Mode:          r.mode,
+		Engine:        r.primary.engine,
+		Search:        r.primary.search,
+		Reciprocal:    r.primary.reciprocal,
+		Quick:         r.quick,
+		Deterministic: r.deterministic,
+		Work:          workRecord{Dir: tmpDir, Keep: r.keep, Retained: retained},
+	}, path, r.libs)
+	if err != nil {
+		return err
+	}
+	log.Printf("run manifest in %s", manifestPath)
+	tablePath := r.outputName(path, ".tbl", ".summary.tbl")
+	err = writeRepeatTable(tablePath, r.compressedExt(), summary.table(path, genome))
+	if err != nil {
+		return err
+	}
+	log.Printf("repeat summary in %s%s and %[1]s.json%[2]s", tablePath, r.compressedExt())
+	lengths := make(map[string]int, len(qidx))
+	for name, rec := range qidx {
+		lengths[name] = rec.Length
+	}
+	if r.rmsk {
+		rmskPath := r.compressed(r.outputName(path, ".rmsk", ""))
+		rmskLengths := lengths
+		if r.lift != nil {
+			rmskLengths = r.lift.objectLengths()
+		}
+		err = writeRmsk(rmskPath, masking, rmskLengths, r.details, r.lift)
+		if err != nil {
+			return err
+		}
+		log.Printf("rmsk table in %s", rmskPath)
+	}
+	if r.matrix {
+		matrixPath := r.outputName(path, ".family", "")
+		err = writeFamilyMatrix(matrixPath, r.compressedExt(), masking, lengths)
+		if err != nil {
+			return err
+		}
+		log.Printf("family matrices in %[1]s.counts.tsv%[2]s and %[1]s.bases.tsv%[2]s", matrixPath, r.compressedExt())
+	}
+	if r.divsum {
+		divPath := r.outputName(path, "", "")
+		err = writeDivergence(divPath, r.compressedExt(), masking, r.details)
+		if err != nil {
+			return err
+		}
+		log.Printf("divergence bins in %[1]s.divergence.csv%[2]s and %[1]s.divsum%[2]s", divPath, r.compressedExt())
+	}
+	if r.bam {
+		bamPath := r.outputName(path, ".bam", "")
+		qfa := newSeqCache(fai.NewFile(query, qidx), qidx, r.primary.seqCache)
+		err = writeBAM(bamPath, masking, qfa, r.details)
+		if err != nil {
+			return err
+		}
+		log.Printf("consensus alignments in %[1]s and %[1]s.bai", bamPath)
+	}
+	if r.format != "" {
+		exportPath := r.outputName(path, "."+r.format, "")
+		err = export(exportPath, r.format, masking, r.details, r.lift)
+		if err != nil {
+			return err
+		}
+		log.Printf("annotation table in %s", exportPath)
+	}
+	if r.density != 0 {
+		err = r.writeDensity(r.outputName(path, "", ""), masking, lengths)
+		if err != nil {
+			return err
+		}
+	}
+	logSummary(summary, genome, start)
+	return nil
+}
+
+// writeFeatures writes the features in sorted, a database returned by
+// outputOrder, to out as JSON, or to enc as GTF if it is not nil. Features
+// are written in order of subject, position, family and strand. HSP groups
+// are obtained from hits. It returns the subject intervals of the written
+// features that are to be masked.
+func (r run) writeFeatures(out io.Writer, enc *gff.Writer, sorted, hits *kv.DB) (spanSet, error) {
+	var (
+		masked   = make(spanSet)
+		filtered int
+	)
+	defer func() {
+		if filtered != 0 {
+			log.Printf("filtered %d annotations", filtered)
+		}
+	}()
+	var groups map[int64]*hspGroup
+	if r.groupHSPs && enc != nil {
+		var err error
+		groups, err = r.hspGroups(hits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := store.Iterate(sorted)
+	for c.Next() {
+		k, v := c.RawKey(), c.Value()
+		switch k[len(k)-1] {
+		case primaryTag:
+			rec, err := store.DecodeAnnotated(v)
+			if err != nil {
+				return nil, err
+			}
+			if !r.filter.keep(rec.Record) {
+				filtered++
+				break
+			}
+			if maskable(rec.Record, r.details, r.maskClasses) {
+				masked.add(rec.Record)
+			}
+			parent := groups[rec.UID]
+			if parent != nil && !parent.written {
+				err = r.writeParent(enc, parent)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = r.writeFeature(out, enc, rec, store.RawJSON(v), nil, parent)
+			if err != nil {
+				return nil, err
+			}
+		case secondaryTag:
+			var alt secondaryRecord
+			err := json.Unmarshal(v, &alt)
+			if err != nil {
+				return nil, err
+			}
+			if !r.filter.keep(alt.Record) {
+				filtered++
+				break
+			}
+			err = r.writeFeature(out, enc, alt.Annotated, nil, &alt, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.Err() != nil {
+		return nil, c.Err()
+	}
+	return masked, nil
+}
+
+// reportRecords calls fn on each primary record in sorted, a database
+// returned by outputOrder, that is retained by the run's filter, in output
+// order.
+func (r run) reportRecords(sorted *kv.DB, fn func(blast.Record) error) error {
+	c := store.Iterate(sorted)
+	for c.Next() {
+		k := c.RawKey()
+		if k[len(k)-1] != primaryTag {
+			continue
+		}
+		rec, err := c.Record()
+		if err != nil {
+			return err
+		}
+		if !r.filter.keep(rec) {
+			continue
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// reportsHits returns whether any of the run's reports other than the
+// repeat summary is written from the retained hits.
+func (r run) reportsHits() bool {
+	return r.rmsk || r.matrix || r.divsum || r.bam || r.format != "" || r.density != 0
+}
+
+// Output database key suffixes identifying the source of records.
+const (
+	primaryTag   = 'p'
+	secondaryTag = 's'
+)
+
+// outputOrder returns a database at path holding the records of hits and
+// secondary, which may be nil, ordered by store.ByOutputOrder. Keys are
+// suffixed with primaryTag or secondaryTag according to their source.
+func outputOrder(path string, hits, secondary *kv.DB) (*kv.DB, error) {
+	err := removeIfExists(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := store.Create(path, store.Output, insVersion())
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range []struct {
+		db  *kv.DB
+		tag byte
+	}{
+		{db: hits, tag: primaryTag},
+		{db: secondary, tag: secondaryTag},
+	} {
+		const batch = 1000
+		c := store.Iterate(src.db)
+		i := 0
+		for ; c.Next(); i++ {
+			if i%batch == 0 {
+				err = db.BeginTransaction()
+				if err != nil {
+					db.Close()
+					return nil, err
+				}
+			}
+			k := c.RawKey()
+			err = db.Set(append(k[:len(k):len(k)], src.tag), c.Value())
+			if err == nil && i%batch == batch-1 {
+				err = db.Commit()
+			}
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		if c.Err() != nil {
+			db.Close()
+			return nil, c.Err()
+		}
+		if i%batch != 0 {
+			err = db.Commit()
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	}
+	return db, nil
+}
+
+// annotatedRecord is a hit with output annotations.
+type annotatedRecord struct {
+	store.Annotated
+	libraryAnnotation
+
+	// ReferenceCopy indicates the hit is
+	// a reference copy of its library
+	// sequence.
+	ReferenceCopy bool `json:",omitempty"`
+
+	// Screen is the screen type of the
+	// hit if it matches a screening
+	// reference.
+	Screen string `json:",omitempty"`
+
+	// GeneOverlap, NearestGene and
+	// GeneDistance are the gene context
+	// of the hit.
+	GeneOverlap  string `json:",omitempty"`
+	NearestGene  string `json:",omitempty"`
+	GeneDistance *int   `json:",omitempty"`
+}
+
+// libraryAnnotation is the library metadata of a hit's family.
+type libraryAnnotation struct {
+	// Class is the repeat class of the
+	// family from the library.
+	Class string `json:",omitempty"`
+
+	// ConsensusLength is the length of the
+	// family's library sequence and
+	// ConsensusLeft is the number of its
+	// bases after the end of the alignment.
+	// They are omitted if the length is not
+	// known.
+	ConsensusLength int  `json:",omitempty"`
+	ConsensusLeft   *int `json:",omitempty"`
+}
+
+// libraryAnnotation returns the library metadata of the family of rec.
+func (r run) libraryAnnotation(rec blast.Record) libraryAnnotation {
+	repeat := r.details[rec.QueryAccVer]
+	a := libraryAnnotation{Class: repeat.class}
+	if repeat.length != 0 {
+		left := consensusCoords(rec, repeat.length).left
+		a.ConsensusLength = repeat.length
+		a.ConsensusLeft = &left
+	}
+	return a
+}
+
+// isReferenceCopy returns whether rec is an identical match to the full
+// length of its library sequence. Such matches are usually the genomic
+// copy that the library sequence was taken from rather than interspersed
+// repeats. The library sequence length must be known.
+func (r run) isReferenceCopy(rec blast.Record) bool {
+	length := r.details[rec.QueryAccVer].length
+	return length != 0 &&
+		rec.QueryStart == 0 && rec.QueryEnd == length &&
+		rec.Mismatches == 0 && rec.GapOpens == 0 && rec.PctIdentity == 100
+}
+
+// writeFeature writes hit to out as JSON, or to enc as GTF if it is not nil.
+// If alt is not nil, hit is written as an alternative assignment. If parent
+// is not nil, hit is written as a fragment of the parent's element. The raw
+// JSON encoding of hit is written if it is not nil and no transformation is
+// needed. JSON features include the class and consensus length of their
+// family when they are known. If reference copies are being flagged,
+// primary hits that are reference copies are written as such, and if a
+// gene annotation is held, the gene context of primary hits is included.
+func (r run) writeFeature(out io.Writer, enc *gff.Writer, hit store.Annotated, raw []byte, alt *secondaryRecord, parent *hspGroup) error {
+	rec := hit.Record
+	refCopy := r.refCopies && alt == nil && r.isReferenceCopy(rec)
+	var screen string
+	if alt == nil {
+		screen = r.screened[rec.QueryAccVer]
+	}
+	var genes *geneContext
+	if r.genes != nil && alt == nil {
+		c := r.genes.context(rec)
+		genes = &c
+	}
+	if enc == nil {
+		lib := r.libraryAnnotation(rec)
+		var err error
+		switch {
+		case alt != nil:
+			if r.lift != nil {
+				alt.Record = liftAnnotation(r.lift, rec)
+			}
+			raw, err = json.Marshal(struct {
+				*secondaryRecord
+				libraryAnnotation
+			}{alt, lib})
+		case refCopy || genes != nil || screen != "" || lib != (libraryAnnotation{}):
+			if r.lift != nil {
+				hit.Record = liftAnnotation(r.lift, rec)
+			}
+			a := annotatedRecord{
+				Annotated:         hit,
+				libraryAnnotation: lib,
+				ReferenceCopy:     refCopy,
+				Screen:            screen,
+			}
+			if genes != nil {
+				a.GeneOverlap = genes.Overlap
+				a.NearestGene = genes.Nearest
+				a.GeneDistance = &genes.Distance
+			}
+			raw, err = json.Marshal(a)
+		case r.lift != nil || raw == nil:
+			if r.lift != nil {
+				hit.Record = liftAnnotation(r.lift, rec)
+			}
+			raw, err = json.Marshal(hit)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(raw)
+		return err
+	}
+
+	var dup string
+	if r.tsdLen.max != 0 && parent == nil {
+		left, right := subjectSpan(rec)
+		dup = r.genome.tsd(rec.SubjectAccVer, left, right, r.tsdLen)
+	}
+	var contig string
+	if r.lift != nil {
+		left, right := subjectSpan(rec)
+		contig = fmt.Sprintf("%s:%d-%d", rec.SubjectAccVer, left+1, right)
+		rec = liftAnnotation(r.lift, rec)
+	}
+	if rec.Strand < 0 {
+		rec.SubjectStart, rec.SubjectEnd = rec.SubjectEnd, rec.SubjectStart
+	}
+	repeat := r.details[rec.QueryAccVer]
+	span := consensusCoords(rec, repeat.length)
+	pos := span.String()
+	if r.rmCoords {
+		pos = span.repeatMasker(rec.Strand)
+	}
+	feat := &gff.Feature{
+		SeqName:    rec.SubjectAccVer,
+		Source:     "ins",
+		Feature:    "repeat",
+		FeatStart:  rec.SubjectStart,
+		FeatEnd:    rec.SubjectEnd,
+		FeatScore:  &rec.BitScore,
+		FeatStrand: seq.Strand(rec.Strand),
+		FeatFrame:  gff.NoFrame,
+		FeatAttributes: gff.Attributes{
+			{
+				Tag:   "Repeat",
+				Value: fmt.Sprintf("%s %s %s", rec.QueryAccVer, repeat.class, pos),
+			},
+			{
+				Tag:   "ID",
+				Value: stableID(rec),
+			},
+			{
+				Tag:   "UID",
+				Value: fmt.Sprint(rec.UID),
+			},
+			{
+				Tag:   "SumScore",
+				Value: fmt.Sprintf("%.4f", rec.SumScore),
+			},
+		},
+	}
+	if contig != "" {
+		feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "Contig", Value: contig})
+	}
+	if hit.Truncated != 0 {
+		feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "Truncated", Value: fmt.Sprint(hit.Truncated)})
+	}
+	feat.FeatAttributes = appendTSD(feat.FeatAttributes, dup)
+	if genes != nil {
+		feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "GeneOverlap", Value: genes.Overlap})
+		if genes.Nearest != "" {
+			feat.FeatAttributes = append(feat.FeatAttributes,
+				gff.Attribute{Tag: "NearestGene", Value: genes.Nearest},
+				gff.Attribute{Tag: "GeneDistance", Value: fmt.Sprint(genes.Distance)},
+			)
+		}
+	}
+	if refCopy {
+		feat.Feature = "reference_copy"
+	}
+	if screen != "" {
+		feat.Feature = screen
+	}
+	if parent != nil {
+		feat.Feature = "repeat_fragment"
+		feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "Parent", Value: parent.id})
+	}
+	if alt != nil {
+		feat.Feature = "secondary_repeat"
+		feat.FeatAttributes = append(feat.FeatAttributes,
+			gff.Attribute{Tag: "Rank", Value: fmt.Sprint(alt.Rank)},
+			gff.Attribute{Tag: "ScoreRatio", Value: fmt.Sprintf("%.4f", alt.ScoreRatio)},
+			gff.Attribute{Tag: "Primary", Value: alt.Primary},
+		)
+	}
+	_, err := enc.Write(feat)
+	if err != nil {
+		return fmt.Errorf("failed to write feature: %w", err)
+	}
+	return nil
+}
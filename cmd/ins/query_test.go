@@ -0,0 +1,112 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+var deterministicRecords = []blast.Record{
+	{QueryAccVer: "L1HS", QueryStart: 0, QueryEnd: 100, SubjectAccVer: "chr2", SubjectStart: 500, SubjectEnd: 600, Strand: 1, BitScore: 150},
+	{QueryAccVer: "AluY", QueryStart: 10, QueryEnd: 300, SubjectAccVer: "chr1", SubjectStart: 2000, SubjectEnd: 1710, Strand: -1, BitScore: 400},
+	{QueryAccVer: "L1HS", QueryStart: 50, QueryEnd: 250, SubjectAccVer: "chr1", SubjectStart: 100, SubjectEnd: 300, Strand: 1, BitScore: 300},
+	{QueryAccVer: "AluY", QueryStart: 0, QueryEnd: 300, SubjectAccVer: "chr1", SubjectStart: 100, SubjectEnd: 400, Strand: 1, BitScore: 450},
+}
+
+func TestDeterministicFeatures(t *testing.T) {
+	defer func(id int64) { hitID = id }(hitID)
+
+	dir, err := ioutil.TempDir("", "ins-deterministic-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, deterministic := range []bool{false, true} {
+		r := run{deterministic: deterministic}
+		var got [][]byte
+		for i := 0; i < 2; i++ {
+			out, err := annotateRecords(r, filepath.Join(dir, fmt.Sprintf("%t-%d", deterministic, i)))
+			if err != nil {
+				t.Fatalf("unexpected error writing features: %v", err)
+			}
+			got = append(got, out)
+		}
+		if !deterministic {
+			if bytes.Equal(got[0], got[1]) {
+				t.Error("unexpected identical features from non-deterministic runs")
+			}
+			continue
+		}
+		if !bytes.Equal(got[0], got[1]) {
+			t.Errorf("features differ between deterministic runs:\n%s\n%s", got[0], got[1])
+		}
+
+		var features []blast.Record
+		dec := json.NewDecoder(bytes.NewReader(got[0]))
+		for dec.More() {
+			var f blast.Record
+			err = dec.Decode(&f)
+			if err != nil {
+				t.Fatalf("failed to decode feature: %v", err)
+			}
+			features = append(features, f)
+		}
+		var uids []int64
+		for _, f := range features {
+			uids = append(uids, f.UID)
+		}
+		// Features are in output order and UIDs
+		// follow the order they were assigned.
+		wantUIDs := []int64{3, 4, 2, 1}
+		if !reflect.DeepEqual(uids, wantUIDs) {
+			t.Errorf("unexpected feature UIDs: got:%v want:%v", uids, wantUIDs)
+		}
+	}
+}
+
+// annotateRecords begins a query for r and stores deterministicRecords,
+// each numbered with a new UID, in a hits database with the path prefix
+// name. It returns the features written from the output order of the hits.
+func annotateRecords(r run, name string) ([]byte, error) {
+	r.beginQuery()
+
+	hits, err := store.Create(name+"-reverse.db", store.Reverse, insVersion())
+	if err != nil {
+		return nil, err
+	}
+	defer hits.Close()
+	recs := make([]blast.Record, len(deterministicRecords))
+	copy(recs, deterministicRecords)
+	for i := range recs {
+		recs[i].UID = nextID()
+	}
+	err = store.PutRecords(hits, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted, err := outputOrder(name+"-output.db", hits, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer sorted.Close()
+	var buf bytes.Buffer
+	_, err = r.writeFeatures(&buf, nil, sorted, hits)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// writeRmsk writes the annotations in hits to the file at path as rows of
+// the UCSC rmsk table. Sequence lengths are given by lengths and family
+// classes and lengths by details. If lift is not nil, annotations are lifted
+// to object coordinates and lengths must hold the object lengths.
+func writeRmsk(path string, hits []blast.Record, lengths map[string]int, details map[string]detail, lift *liftover) error {
+	f, err := createOutput(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, h := range hits {
+		if lift != nil {
+			h = liftAnnotation(lift, h)
+		}
+		fmt.Fprintln(w, rmskRow(h, lengths[h.SubjectAccVer], details[h.QueryAccVer]))
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rmskRow returns the tab-separated rmsk table row for the hit r on a
+// sequence of the given length. The fields are bin, swScore, milliDiv,
+// milliDel, milliIns, genoName, genoStart, genoEnd, genoLeft, strand,
+// repName, repClass, repFamily, repStart, repEnd, repLeft and id.
+// Insertions and deletions are not distinguished by BLAST, so milliDel
+// and milliIns are reported as zero.
+func rmskRow(r blast.Record, length int, repeat detail) string {
+	start, end := subjectSpan(r)
+	class, family := rmskClass(repeat.class)
+
+	// Consensus coordinates follow the RepeatMasker
+	// convention of reporting the unaligned remainder
+	// as a negative value at the distal end.
+	span := consensusCoords(r, repeat.length)
+	strand := "+"
+	repStart := span.begin
+	repEnd := span.end
+	repLeft := -span.left
+	if r.Strand < 0 {
+		strand = "-"
+		repStart, repLeft = repLeft, repStart
+	}
+
+	return fmt.Sprintf("%d\t%d\t%d\t0\t0\t%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d",
+		ucscBin(start, end),
+		int(math.Round(r.BitScore)),
+		int(math.Round(10*(100-r.PctIdentity))),
+		r.SubjectAccVer, start, end, -(length - end),
+		strand,
+		r.QueryAccVer, class, family,
+		repStart, repEnd, repLeft,
+		r.UID,
+	)
+}
+
+// rmskClass returns the rmsk repClass and repFamily for a RepeatMasker
+// library class. Classes without a family use the class as the family.
+func rmskClass(c string) (class, family string) {
+	if c == "" {
+		c = unknownClass
+	}
+	class, family, ok := cut(c, "/")
+	if !ok {
+		family = class
+	}
+	return class, strings.ReplaceAll(family, "/", "_")
+}
+
+// ucscBin returns the UCSC bin for the zero-based half-open interval
+// [start, end), using the extended binning scheme for intervals ending
+// beyond 512Mb.
+func ucscBin(start, end int) int {
+	const (
+		firstShift = 17
+		nextShift  = 3
+
+		// extendedBase is the offset of the first
+		// bin of the extended binning scheme.
+		extendedBase = 4681
+	)
+	base := 0
+	offsets := []int{512 + 64 + 8 + 1, 64 + 8 + 1, 8 + 1, 1, 0}
+	if end > 1<<29 {
+		base = extendedBase
+		offsets = []int{4096 + 512 + 64 + 8 + 1, 512 + 64 + 8 + 1, 64 + 8 + 1, 8 + 1, 1, 0}
+	}
+	start >>= firstShift
+	end = (end - 1) >> firstShift
+	for _, off := range offsets {
+		if start == end {
+			return base + off + start
+		}
+		start >>= nextShift
+		end >>= nextShift
+	}
+	return base
+}
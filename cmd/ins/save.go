@@ -0,0 +1,106 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// savedDir is the working sub-directory that raw BLAST outputs are
+// saved in.
+const savedDir = "blast"
+
+// blastSaver is a directory that raw BLAST outputs are saved to.
+// The zero value does not save outputs.
+type blastSaver string
+
+// saver returns the blastSaver for the working directory dir, or the
+// zero blastSaver if BLAST outputs are not being saved.
+func (p pass) saver(dir string) blastSaver {
+	if !p.saveBlast {
+		return ""
+	}
+	return blastSaver(filepath.Join(dir, savedDir))
+}
+
+// tee returns a parse function that saves the output read by parse to
+// the gzip file name.gz in the save directory. The complete output is
+// saved even if parse does not consume it all. If s is empty, parse is
+// returned unaltered.
+func (s blastSaver) tee(name string, parse func(io.Reader) error) func(io.Reader) error {
+	if s == "" {
+		return parse
+	}
+	return func(r io.Reader) error {
+		err := os.MkdirAll(string(s), 0o755)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(string(s), name+".gz"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		z := gzip.NewWriter(f)
+		tr := io.TeeReader(r, z)
+		err = parse(tr)
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, tr)
+		}
+		// Partial output is retained on failure
+		// to help diagnose the problem.
+		zerr := z.Close()
+		if err == nil {
+			err = zerr
+		}
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	}
+}
+
+// saveRegions writes the merged region descriptions searched in the named
+// reciprocal search to name-regions.tsv in the save directory so that the
+// surrogate region identifiers in the saved output can be interpreted.
+// If s is empty, saveRegions does nothing.
+func (s blastSaver) saveRegions(name string, descs map[string]regionDesc) error {
+	if s == "" {
+		return nil
+	}
+	err := os.MkdirAll(string(s), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(string(s), name+"-regions.tsv"))
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(descs))
+	for id := range descs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "#id\tsubject\tleft\tright\tfamily\tstrand\ttruncated")
+	for _, id := range ids {
+		d := descs[id]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%+d\t%d\n", id, d.subject, d.left, d.right, d.group.family, d.group.strand, d.truncated)
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,60 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// screenTypes are the types of screening reference sequences. Matches to
+// screening references are reported with the type as the feature type
+// and class so that they are not mistaken for interspersed repeats.
+var screenTypes = map[string]bool{
+	"rDNA": true, // Ribosomal DNA units.
+	"NUMT": true, // Nuclear insertions of mitochondrial DNA.
+	"NUPT": true, // Nuclear insertions of plastid DNA.
+}
+
+// screen is a file of screening reference sequences of a screen type.
+type screen struct {
+	typ  string
+	path string
+}
+
+// parseScreen returns the screen described by s in the form type=path.
+func parseScreen(s string) (screen, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return screen{}, fmt.Errorf("invalid screen %q: want type=path", s)
+	}
+	typ, path := s[:i], s[i+1:]
+	if !screenTypes[typ] {
+		return screen{}, fmt.Errorf("invalid screen type %q: want rDNA, NUMT or NUPT", typ)
+	}
+	if path == "" {
+		return screen{}, fmt.Errorf("invalid screen %q: missing path", s)
+	}
+	return screen{typ: typ, path: path}, nil
+}
+
+// screenFamilies returns the screen type of each sequence in the screening
+// references, setting the class of the sequences in details to their
+// screen type. The paths of screens must have been buffered.
+func screenFamilies(screens []screen, details map[string]detail) (map[string]string, error) {
+	types := make(map[string]string)
+	for _, s := range screens {
+		seqs, err := libDetails(filenames([]string{s.path}))
+		if err != nil {
+			return nil, err
+		}
+		for name, d := range seqs {
+			types[name] = s.typ
+			d.class = s.typ
+			details[name] = d
+		}
+	}
+	return types, nil
+}
@@ -0,0 +1,59 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/internal/store"
+)
+
+// secondaryRecord is a hit of a different family contained by a higher
+// scoring hit that was retained as an alternative assignment.
+type secondaryRecord struct {
+	store.Annotated
+
+	// Primary is the family of the containing hit.
+	Primary string
+
+	// Rank is the rank of the hit among the
+	// assignments of the containing hit, which
+	// has rank 1.
+	Rank int
+
+	// ScoreRatio is the ratio of the hit's bit
+	// score to that of the containing hit.
+	ScoreRatio float64
+}
+
+// storeSecondary ranks the alternative assignments in alts and stores them
+// in db.
+func storeSecondary(db *kv.DB, alts []secondaryRecord) error {
+	if len(alts) == 0 {
+		return nil
+	}
+	sort.SliceStable(alts, func(i, j int) bool {
+		return alts[i].BitScore > alts[j].BitScore
+	})
+	err := db.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	for i := range alts {
+		alts[i].Rank = i + 2
+		value, err := json.Marshal(alts[i])
+		if err != nil {
+			return err
+		}
+		err = db.Set(store.MarshalBlastRecordKey(alts[i].Record), value)
+		if err != nil {
+			return err
+		}
+	}
+	return db.Commit()
+}
@@ -0,0 +1,93 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/biogo/hts/fai"
+)
+
+// seqCache is a least recently used cache of whole sequences read from an
+// indexed fasta file, so that regions clustered on the same sequence are
+// read and decoded once.
+type seqCache struct {
+	fa  *fai.File
+	idx fai.Index
+
+	// max is the maximum total length of
+	// cached sequences, and size is the
+	// current total length.
+	max, size int64
+
+	seqs map[string]*list.Element
+	lru  *list.List
+}
+
+// cachedSeq is a seqCache entry.
+type cachedSeq struct {
+	name string
+	seq  []byte
+}
+
+// newSeqCache returns a seqCache for the sequences in fa with the index
+// idx holding at most max bases.
+func newSeqCache(fa *fai.File, idx fai.Index, max int64) *seqCache {
+	return &seqCache{
+		fa:   fa,
+		idx:  idx,
+		max:  max,
+		seqs: make(map[string]*list.Element),
+		lru:  list.New(),
+	}
+}
+
+// seqRange returns the bases of the named sequence in the half-open
+// interval [start, end). The returned slice must not be modified.
+// Sequences longer than the cache capacity are read directly.
+func (c *seqCache) seqRange(name string, start, end int) ([]byte, error) {
+	rec, ok := c.idx[name]
+	if !ok {
+		return nil, fmt.Errorf("no sequence %q in index", name)
+	}
+	if start < 0 || end < start || rec.Length < end {
+		return nil, fmt.Errorf("invalid range %d-%d for sequence %q of length %d", start, end, name, rec.Length)
+	}
+	if e, ok := c.seqs[name]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedSeq).seq[start:end], nil
+	}
+	if int64(rec.Length) > c.max {
+		r, err := c.fa.SeqRange(name, start, end)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	r, err := c.fa.SeqRange(name, 0, rec.Length)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(rec.Length + bytes.MinRead)
+	_, err = buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	seq := buf.Bytes()
+	for c.size+int64(len(seq)) > c.max {
+		e := c.lru.Back()
+		old := c.lru.Remove(e).(*cachedSeq)
+		delete(c.seqs, old.name)
+		c.size -= int64(len(old.seq))
+	}
+	c.seqs[name] = c.lru.PushFront(&cachedSeq{name: name, seq: seq})
+	c.size += int64(len(seq))
+	return seq[start:end], nil
+}
@@ -0,0 +1,73 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/internal/store"
+)
+
+// Pipeline stage subcommands in order of execution. Each stage reads the
+// artifacts written to the stage directory by the previous stage.
+const (
+	stageSplit   = "split"   // Writes query-fragments, fragments.tsv and gaps.bed.
+	stageForward = "forward" // Writes forward.db.
+	stageMerge   = "merge"   // Writes regions.db.
+	stageReverse = "reverse" // Writes reverse.db.
+	stageCull    = "cull"    // Writes culled.db, secondary.db and reverse-unculled.db.
+	stageReport  = "report"  // Writes the annotation, masked sequence and reports.
+)
+
+// stageInputs are the artifacts in the stage directory that each stage
+// subcommand continues from.
+var stageInputs = map[string]string{
+	stageSplit:   "",
+	stageForward: "fragments.tsv",
+	stageMerge:   "forward.db",
+	stageReverse: "regions.db",
+	stageCull:    "reverse.db",
+	stageReport:  "culled.db",
+}
+
+// errStageDone is returned when a stage subcommand has completed its stage.
+var errStageDone = errors.New("stage complete")
+
+// isStageCommand returns whether cmd is a pipeline stage subcommand.
+func isStageCommand(cmd string) bool {
+	_, ok := stageInputs[cmd]
+	return ok
+}
+
+// stageInput returns the path of the artifact in dir that the stage
+// subcommand continues from. A report stage run without a cull stage
+// continues from the unculled reciprocal hits.
+func stageInput(dir, stage string) string {
+	in := stageInputs[stage]
+	if in == "" {
+		return ""
+	}
+	path := filepath.Join(dir, in)
+	if stage == stageReport {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return filepath.Join(dir, "reverse.db")
+		}
+	}
+	return path
+}
+
+// openIfExists opens the secondary assignment database at path if it
+// exists. If it does not exist, openIfExists returns nil and a nil error.
+func openIfExists(path string) (*kv.DB, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return store.Open(path, store.Secondary)
+}
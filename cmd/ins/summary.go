@@ -0,0 +1,102 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// logSummary logs a single line summary of a run with the hits counted
+// in c on a genome of the given length started at start.
+func logSummary(c *repeatCounts, genome int64, start time.Time) {
+	masked := c.masked.bases()
+	var fraction float64
+	if genome != 0 {
+		fraction = float64(masked) / float64(genome)
+	}
+	stages := make([]string, len(stageTimes))
+	for i, st := range stageTimes {
+		stages[i] = fmt.Sprintf("%s:%.1fs", st.name, st.duration.Seconds())
+	}
+	logFields(fields{
+		"records":       c.records,
+		"elements":      len(c.elements),
+		"masked_bases":  masked,
+		"genome_bases":  genome,
+		"fraction":      fmt.Sprintf("%.4f", fraction),
+		"elapsed":       fmt.Sprintf("%.1fs", time.Since(start).Seconds()),
+		"stage_elapsed": strings.Join(stages, ","),
+	}, "ins summary:")
+}
+
+// maskedCount accumulates the number of bases covered by the subject
+// intervals of hits added in order of subject and left position.
+type maskedCount struct {
+	subject     string
+	left, right int
+	n           int64
+}
+
+// add adds the subject interval of h to the count.
+func (c *maskedCount) add(h blast.Record) {
+	left, right := subjectSpan(h)
+	if h.SubjectAccVer != c.subject || left > c.right {
+		c.n += int64(c.right - c.left)
+		c.subject, c.left, c.right = h.SubjectAccVer, left, right
+		return
+	}
+	if right > c.right {
+		c.right = right
+	}
+}
+
+// bases returns the number of bases covered.
+func (c *maskedCount) bases() int64 {
+	return c.n + int64(c.right-c.left)
+}
+
+// maskedBases returns the number of bases covered by the subject intervals
+// of hits.
+func maskedBases(hits []blast.Record) int64 {
+	type interval struct {
+		subject     string
+		left, right int
+	}
+	ivs := make([]interval, len(hits))
+	for i, h := range hits {
+		left, right := h.SubjectStart, h.SubjectEnd
+		if right < left {
+			left, right = right, left
+		}
+		ivs[i] = interval{subject: h.SubjectAccVer, left: left, right: right}
+	}
+	sort.Slice(ivs, func(i, j int) bool {
+		if ivs[i].subject != ivs[j].subject {
+			return ivs[i].subject < ivs[j].subject
+		}
+		return ivs[i].left < ivs[j].left
+	})
+	var (
+		n    int64
+		last interval
+	)
+	for i, iv := range ivs {
+		if i == 0 || iv.subject != last.subject || iv.left > last.right {
+			n += int64(last.right - last.left)
+			last = iv
+			continue
+		}
+		if iv.right > last.right {
+			last.right = iv.right
+		}
+	}
+	n += int64(last.right - last.left)
+	return n
+}
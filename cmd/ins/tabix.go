@@ -0,0 +1,354 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/biogo/hts/bgzf"
+)
+
+// Tabix index parameters.
+const (
+	// tabixBlockSize is the maximum number
+	// of uncompressed bytes held in each
+	// BGZF block of an indexed file.
+	tabixBlockSize = 0xff00
+
+	// tabixMinShift and tabixDepth are the
+	// binning scheme parameters of the
+	// tabix index, and tabixWindow is the
+	// width of linear index windows.
+	tabixMinShift = 14
+	tabixDepth    = 5
+	tabixWindow   = 1 << tabixMinShift
+)
+
+// gtfLine is a line of a GTF file and its location.
+type gtfLine struct {
+	line       []byte
+	seq        string
+	start, end int
+}
+
+// writeTabix writes the GTF features in the file at src to dst sorted by
+// sequence name and start position and BGZF compressed, and writes a tabix
+// index of dst to dst with a ".tbi" suffix. Comment lines are written
+// first in their original order. The file at src is removed on success.
+func writeTabix(dst, src string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	var header [][]byte
+	var lines []gtfLine
+	for n, l := range bytes.SplitAfter(b, []byte{'\n'}) {
+		if len(bytes.TrimSpace(l)) == 0 {
+			continue
+		}
+		if l[len(l)-1] != '\n' {
+			l = append(l, '\n')
+		}
+		if l[0] == '#' {
+			header = append(header, l)
+			continue
+		}
+		f := bytes.SplitN(l, []byte{'\t'}, 6)
+		if len(f) < 6 {
+			return fmt.Errorf("invalid GTF line %d: too few fields", n+1)
+		}
+		start, err := strconv.Atoi(string(f[3]))
+		if err != nil {
+			return fmt.Errorf("invalid GTF line %d: %w", n+1, err)
+		}
+		end, err := strconv.Atoi(string(f[4]))
+		if err != nil {
+			return fmt.Errorf("invalid GTF line %d: %w", n+1, err)
+		}
+		lines = append(lines, gtfLine{line: l, seq: string(f[0]), start: start - 1, end: end})
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].seq != lines[j].seq {
+			return lines[i].seq < lines[j].seq
+		}
+		return lines[i].start < lines[j].start
+	})
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := newTabixWriter(f)
+	for _, l := range header {
+		_, err = w.write(l)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	var idx tabixIndex
+	for _, l := range lines {
+		c, err := w.write(l.line)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		idx.add(l.seq, l.start, l.end, c)
+	}
+	err = w.close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Create(dst + ".tbi")
+	if err != nil {
+		return err
+	}
+	z := bgzf.NewWriter(f, 1)
+	_, err = idx.WriteTo(z)
+	if err != nil {
+		z.Close()
+		f.Close()
+		return err
+	}
+	err = z.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// createFeatures creates the feature output file at path. If index is
+// true, features are written to a temporary file that is sorted, compressed
+// and indexed into path by writeTabix when the returned file is closed.
+func createFeatures(path string, index bool) (io.WriteCloser, error) {
+	if !index {
+		return createOutput(path)
+	}
+	f, err := os.Create(path + ".unsorted")
+	if err != nil {
+		return nil, err
+	}
+	return tabixFile{File: f, dst: path}, nil
+}
+
+// tabixFile is an unsorted feature file that is indexed when closed.
+type tabixFile struct {
+	*os.File
+	dst string
+}
+
+// Close closes the file and writes the sorted and indexed features.
+func (f tabixFile) Close() error {
+	err := f.File.Close()
+	if err != nil {
+		return err
+	}
+	return writeTabix(f.dst, f.Name())
+}
+
+// tabixWriter is a BGZF writer that tracks the virtual offsets of lines.
+// Lines are never split across BGZF blocks.
+type tabixWriter struct {
+	cw *countWriter
+	z  *bgzf.Writer
+
+	// block is the file offset of the
+	// current block and n is the number
+	// of bytes written to it.
+	block int64
+	n     int
+}
+
+func newTabixWriter(w io.Writer) *tabixWriter {
+	cw := &countWriter{w: w}
+	return &tabixWriter{cw: cw, z: bgzf.NewWriter(cw, 1)}
+}
+
+// write writes the line l and returns its virtual offset chunk.
+func (w *tabixWriter) write(l []byte) (bgzf.Chunk, error) {
+	if len(l) > tabixBlockSize {
+		return bgzf.Chunk{}, errors.New("tabix: line too long to index")
+	}
+	if w.n+len(l) > tabixBlockSize {
+		err := w.z.Flush()
+		if err != nil {
+			return bgzf.Chunk{}, err
+		}
+		// Wait for the block to be written
+		// so that the next block's offset is
+		// known.
+		err = w.z.Wait()
+		if err != nil {
+			return bgzf.Chunk{}, err
+		}
+		w.block, w.n = w.cw.n, 0
+	}
+	var c bgzf.Chunk
+	c.Begin = bgzf.Offset{File: w.block, Block: uint16(w.n)}
+	_, err := w.z.Write(l)
+	if err != nil {
+		return bgzf.Chunk{}, err
+	}
+	w.n += len(l)
+	c.End = bgzf.Offset{File: w.block, Block: uint16(w.n)}
+	return c, nil
+}
+
+// close closes the BGZF stream, writing the end of file marker.
+func (w *tabixWriter) close() error {
+	return w.z.Close()
+}
+
+// countWriter is an io.Writer that counts the bytes written to it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// tabixIndex is a tabix index of a GTF file.
+type tabixIndex struct {
+	names []string
+	refs  map[string]*tabixRef
+}
+
+// tabixRef is the index of the lines of a reference sequence.
+type tabixRef struct {
+	bins   map[uint32][]bgzf.Chunk
+	linear []bgzf.Offset
+}
+
+// add adds the line spanning the zero-based half-open interval [start, end)
+// of the named reference sequence, stored at chunk c, to the index.
+func (idx *tabixIndex) add(name string, start, end int, c bgzf.Chunk) {
+	if idx.refs == nil {
+		idx.refs = make(map[string]*tabixRef)
+	}
+	ref, ok := idx.refs[name]
+	if !ok {
+		ref = &tabixRef{bins: make(map[uint32][]bgzf.Chunk)}
+		idx.refs[name] = ref
+		idx.names = append(idx.names, name)
+	}
+	if end <= start {
+		end = start + 1
+	}
+
+	bin := reg2bin(start, end)
+	chunks := ref.bins[bin]
+	if n := len(chunks); n != 0 && chunks[n-1].End == c.Begin {
+		chunks[n-1].End = c.End
+	} else {
+		ref.bins[bin] = append(chunks, c)
+	}
+
+	last := (end - 1) / tabixWindow
+	for len(ref.linear) <= last {
+		ref.linear = append(ref.linear, bgzf.Offset{File: -1})
+	}
+	for i := start / tabixWindow; i <= last; i++ {
+		if ref.linear[i].File < 0 {
+			ref.linear[i] = c.Begin
+		}
+	}
+}
+
+// reg2bin returns the smallest bin of the binning scheme that contains
+// the zero-based half-open interval [beg, end).
+func reg2bin(beg, end int) uint32 {
+	end--
+	for l, s := 0, tabixMinShift; l < tabixDepth; l, s = l+1, s+3 {
+		if beg>>s == end>>s {
+			return uint32(((1<<(3*(tabixDepth-l)))-1)/7 + beg>>s)
+		}
+	}
+	return 0
+}
+
+// WriteTo writes the index to w in tabix format with the GFF preset.
+func (idx *tabixIndex) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	le := binary.LittleEndian
+	put := func(v interface{}) {
+		binary.Write(cw, le, v)
+	}
+
+	var names []byte
+	for _, n := range idx.names {
+		names = append(names, n...)
+		names = append(names, 0)
+	}
+	cw.Write([]byte("TBI\x01"))
+	put(int32(len(idx.names)))
+	put(int32(0))   // Generic format.
+	put(int32(1))   // Sequence name column.
+	put(int32(4))   // Start column.
+	put(int32(5))   // End column.
+	put(int32('#')) // Comment character.
+	put(int32(0))   // Skipped lines.
+	put(int32(len(names)))
+	cw.Write(names)
+
+	for _, n := range idx.names {
+		ref := idx.refs[n]
+		bins := make([]uint32, 0, len(ref.bins))
+		for b := range ref.bins {
+			bins = append(bins, b)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		put(int32(len(bins)))
+		for _, b := range bins {
+			put(b)
+			put(int32(len(ref.bins[b])))
+			for _, c := range ref.bins[b] {
+				put(virtualOffset(c.Begin))
+				put(virtualOffset(c.End))
+			}
+		}
+		put(int32(len(ref.linear)))
+		var prev uint64
+		for _, o := range ref.linear {
+			// Empty windows take the offset
+			// of the preceding window.
+			if o.File >= 0 {
+				prev = virtualOffset(o)
+			}
+			put(prev)
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// virtualOffset returns the BGZF virtual file offset of o.
+func virtualOffset(o bgzf.Offset) uint64 {
+	return uint64(o.File)<<16 | uint64(o.Block)
+}
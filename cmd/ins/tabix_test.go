@@ -0,0 +1,378 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/biogo/hts/bgzf"
+)
+
+var reg2binTests = []struct {
+	beg, end int
+	want     uint32
+}{
+	{beg: 0, end: 1, want: 4681},
+	{beg: 0, end: 1 << 14, want: 4681},
+	{beg: 1 << 14, end: 1<<14 + 1, want: 4682},
+	{beg: 0, end: 1<<14 + 1, want: 585},
+	{beg: 0, end: 1 << 17, want: 585},
+	{beg: 1 << 17, end: 1<<17 + 10, want: 4681 + 8},
+	{beg: 0, end: 1<<17 + 1, want: 73},
+	{beg: 0, end: 1<<20 + 1, want: 9},
+	{beg: 0, end: 1<<23 + 1, want: 1},
+	{beg: 1 << 23, end: 1<<23 + 1<<20, want: 73 + 8},
+	{beg: 0, end: 1<<26 + 1, want: 0},
+}
+
+func TestReg2bin(t *testing.T) {
+	for _, test := range reg2binTests {
+		got := reg2bin(test.beg, test.end)
+		if got != test.want {
+			t.Errorf("unexpected bin for [%d,%d): got:%d want:%d", test.beg, test.end, got, test.want)
+		}
+	}
+}
+
+// tabixFeature is a GTF feature line read back from an indexed file.
+type tabixFeature struct {
+	seq        string
+	start, end int // Zero-based half-open.
+	line       string
+	offset     bgzf.Offset
+}
+
+func TestWriteTabix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-tabix-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Features overlap their neighbours, and
+	// there are enough to need several BGZF
+	// blocks. A few long features span many
+	// linear index windows. Features are
+	// written out of order to be sorted.
+	const header = "##gff-version 2\n##source-version ins\n"
+	var want []tabixFeature
+	for _, seq := range []string{"chr2", "chr1"} {
+		for i := 1199; i >= 0; i-- {
+			start := i * 150
+			want = append(want, tabixFeature{seq: seq, start: start, end: start + 300})
+		}
+	}
+	want = append(want,
+		tabixFeature{seq: "chr1", start: 0, end: 200000},
+		tabixFeature{seq: "chr2", start: 40000, end: 90000},
+	)
+	var src bytes.Buffer
+	src.WriteString(header)
+	for i, f := range want {
+		want[i].line = fmt.Sprintf("%s\tins\trepeat\t%d\t%d\t100\t+\t.\tRepeat L1 %d;\n", f.seq, f.start+1, f.end, i)
+		src.WriteString(want[i].line)
+	}
+	srcPath := filepath.Join(dir, "features.gtf.unsorted")
+	err = ioutil.WriteFile(srcPath, src.Bytes(), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write features: %v", err)
+	}
+	dst := filepath.Join(dir, "features.gtf.gz")
+	err = writeTabix(dst, srcPath)
+	if err != nil {
+		t.Fatalf("unexpected error writing tabix file: %v", err)
+	}
+	if _, err := os.Stat(srcPath); !os.IsNotExist(err) {
+		t.Errorf("unsorted features not removed: %v", err)
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatalf("failed to open indexed features: %v", err)
+	}
+	defer f.Close()
+	bg, err := bgzf.NewReader(f, 1)
+	if err != nil {
+		t.Fatalf("failed to open BGZF reader: %v", err)
+	}
+	defer bg.Close()
+	all, err := ioutil.ReadAll(bg)
+	if err != nil {
+		t.Fatalf("failed to read indexed features: %v", err)
+	}
+	if !bytes.HasPrefix(all, []byte(header)) {
+		t.Errorf("header not written first: got:%q", all[:len(header)])
+	}
+	sort.SliceStable(want, func(i, j int) bool {
+		if want[i].seq != want[j].seq {
+			return want[i].seq < want[j].seq
+		}
+		return want[i].start < want[j].start
+	})
+	var sorted strings.Builder
+	sorted.WriteString(header)
+	for _, f := range want {
+		sorted.WriteString(f.line)
+	}
+	if string(all) != sorted.String() {
+		t.Error("features not written in sorted order")
+	}
+
+	idx, err := readTestIndex(dst + ".tbi")
+	if err != nil {
+		t.Fatalf("failed to read index: %v", err)
+	}
+	if !reflect.DeepEqual(idx.names, []string{"chr1", "chr2"}) {
+		t.Errorf("unexpected reference names: got:%q want:%q", idx.names, []string{"chr1", "chr2"})
+	}
+
+	var lastBlock int64
+	for ref, name := range idx.names {
+		// Read back every feature of the reference
+		// through the index and check its bin and
+		// linear index entries.
+		got, err := readChunks(bg, idx.bins[ref])
+		if err != nil {
+			t.Fatalf("failed to read chunks: %v", err)
+		}
+		for bin, features := range got {
+			for _, f := range features {
+				if f.seq != name {
+					t.Errorf("feature on %s indexed under %s", f.seq, name)
+				}
+				if b := reg2bin(f.start, f.end); b != bin {
+					t.Errorf("feature [%d,%d) in bin %d, want bin %d", f.start, f.end, bin, b)
+				}
+				for w := f.start / tabixWindow; w <= (f.end-1)/tabixWindow; w++ {
+					if w >= len(idx.linear[ref]) {
+						t.Errorf("no linear index window %d for feature [%d,%d)", w, f.start, f.end)
+						break
+					}
+					if idx.linear[ref][w] > virtualOffset(f.offset) {
+						t.Errorf("linear index window %d offset %#x after feature [%d,%d) at %#x",
+							w, idx.linear[ref][w], f.start, f.end, virtualOffset(f.offset))
+					}
+				}
+				if f.offset.File > lastBlock {
+					lastBlock = f.offset.File
+				}
+			}
+		}
+
+		// Query intervals through the bins that
+		// overlap them and compare the features
+		// found with a scan of all the features.
+		for _, q := range [][2]int{{0, 1}, {100, 400}, {16000, 17000}, {45000, 45001}, {150000, 190000}, {300000, 400000}} {
+			var chunks []bgzf.Chunk
+			for _, b := range reg2bins(q[0], q[1]) {
+				chunks = append(chunks, idx.bins[ref][b]...)
+			}
+			found, err := readChunks(bg, map[uint32][]bgzf.Chunk{0: chunks})
+			if err != nil {
+				t.Fatalf("failed to read chunks: %v", err)
+			}
+			var gotLines, wantLines []string
+			for _, f := range found[0] {
+				if f.start < q[1] && q[0] < f.end {
+					gotLines = append(gotLines, f.line)
+				}
+			}
+			for _, f := range want {
+				if f.seq == name && f.start < q[1] && q[0] < f.end {
+					wantLines = append(wantLines, f.line)
+				}
+			}
+			sort.Strings(gotLines)
+			sort.Strings(wantLines)
+			if !reflect.DeepEqual(gotLines, wantLines) {
+				t.Errorf("unexpected features for %s:[%d,%d): got %d want %d", name, q[0], q[1], len(gotLines), len(wantLines))
+			}
+		}
+	}
+	if lastBlock == 0 {
+		t.Error("expected features in more than one BGZF block")
+	}
+}
+
+// testIndex is a decoded tabix index.
+type testIndex struct {
+	names  []string
+	bins   []map[uint32][]bgzf.Chunk
+	linear [][]uint64
+}
+
+// readTestIndex reads the tabix index at path.
+func readTestIndex(path string) (*testIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := bgzf.NewReader(f, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	r := bufio.NewReader(z)
+
+	le := binary.LittleEndian
+	var magic [4]byte
+	_, err = io.ReadFull(r, magic[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != "TBI\x01" {
+		return nil, fmt.Errorf("invalid magic: %q", magic)
+	}
+	var head struct {
+		NRef, Format, ColSeq, ColBeg, ColEnd, Meta, Skip, LNames int32
+	}
+	err = binary.Read(r, le, &head)
+	if err != nil {
+		return nil, err
+	}
+	got := [...]int32{head.Format, head.ColSeq, head.ColBeg, head.ColEnd, head.Meta, head.Skip}
+	if got != [...]int32{0, 1, 4, 5, '#', 0} {
+		return nil, fmt.Errorf("unexpected index header: %+v", head)
+	}
+	names := make([]byte, head.LNames)
+	_, err = io.ReadFull(r, names)
+	if err != nil {
+		return nil, err
+	}
+	idx := &testIndex{names: strings.Split(strings.TrimSuffix(string(names), "\x00"), "\x00")}
+	if len(idx.names) != int(head.NRef) {
+		return nil, fmt.Errorf("name count mismatch: %d != %d", len(idx.names), head.NRef)
+	}
+
+	offset := func(v uint64) bgzf.Offset {
+		return bgzf.Offset{File: int64(v >> 16), Block: uint16(v)}
+	}
+	for i := 0; i < int(head.NRef); i++ {
+		var nBins int32
+		err = binary.Read(r, le, &nBins)
+		if err != nil {
+			return nil, err
+		}
+		bins := make(map[uint32][]bgzf.Chunk)
+		for j := 0; j < int(nBins); j++ {
+			var bin struct {
+				Bin    uint32
+				NChunk int32
+			}
+			err = binary.Read(r, le, &bin)
+			if err != nil {
+				return nil, err
+			}
+			v := make([]uint64, 2*bin.NChunk)
+			err = binary.Read(r, le, v)
+			if err != nil {
+				return nil, err
+			}
+			for k := 0; k < len(v); k += 2 {
+				bins[bin.Bin] = append(bins[bin.Bin], bgzf.Chunk{Begin: offset(v[k]), End: offset(v[k+1])})
+			}
+		}
+		var nIntv int32
+		err = binary.Read(r, le, &nIntv)
+		if err != nil {
+			return nil, err
+		}
+		linear := make([]uint64, nIntv)
+		err = binary.Read(r, le, linear)
+		if err != nil {
+			return nil, err
+		}
+		idx.bins = append(idx.bins, bins)
+		idx.linear = append(idx.linear, linear)
+	}
+	_, err = r.ReadByte()
+	if err != io.EOF {
+		return nil, fmt.Errorf("unexpected trailing index data: %v", err)
+	}
+	return idx, nil
+}
+
+// readChunks returns the features held in the chunks of each bin, read
+// from bg.
+func readChunks(bg *bgzf.Reader, bins map[uint32][]bgzf.Chunk) (map[uint32][]tabixFeature, error) {
+	features := make(map[uint32][]tabixFeature)
+	for bin, chunks := range bins {
+		for _, c := range chunks {
+			// Lines are never split across blocks,
+			// so a chunk is within a single block.
+			if c.Begin.File != c.End.File || c.End.Block < c.Begin.Block {
+				return nil, fmt.Errorf("invalid chunk: %+v", c)
+			}
+			err := bg.Seek(c.Begin)
+			if err != nil {
+				return nil, err
+			}
+			b := make([]byte, c.End.Block-c.Begin.Block)
+			_, err = io.ReadFull(bg, b)
+			if err != nil {
+				return nil, err
+			}
+			pos := c.Begin.Block
+			for _, l := range bytes.SplitAfter(b, []byte{'\n'}) {
+				if len(l) == 0 {
+					continue
+				}
+				f := strings.Split(string(l), "\t")
+				var start, end int
+				_, err = fmt.Sscan(f[3], &start)
+				if err != nil {
+					return nil, err
+				}
+				_, err = fmt.Sscan(f[4], &end)
+				if err != nil {
+					return nil, err
+				}
+				features[bin] = append(features[bin], tabixFeature{
+					seq:    f[0],
+					start:  start - 1,
+					end:    end,
+					line:   string(l),
+					offset: bgzf.Offset{File: c.Begin.File, Block: pos},
+				})
+				pos += uint16(len(l))
+			}
+		}
+	}
+	return features, nil
+}
+
+// reg2bins returns the bins that may hold features overlapping the
+// zero-based half-open interval [beg, end).
+func reg2bins(beg, end int) []uint32 {
+	end--
+	bins := []uint32{0}
+	for _, level := range []struct {
+		offset uint32
+		shift  uint
+	}{
+		{offset: 1, shift: 26},
+		{offset: 9, shift: 23},
+		{offset: 73, shift: 20},
+		{offset: 585, shift: 17},
+		{offset: 4681, shift: 14},
+	} {
+		for k := level.offset + uint32(beg>>level.shift); k <= level.offset+uint32(end>>level.shift); k++ {
+			bins = append(bins, k)
+		}
+	}
+	return bins
+}
@@ -0,0 +1,275 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// unknownClass is the class of families without a class in the library.
+const unknownClass = "Unknown"
+
+// repeatTable is a summary of the repeat content of a query.
+type repeatTable struct {
+	Query         string     `json:"query"`
+	GenomeBases   int64      `json:"genome_bases"`
+	MaskedBases   int64      `json:"masked_bases"`
+	MaskedPercent float64    `json:"masked_percent"`
+	Classes       []tableRow `json:"classes"`
+	Families      []tableRow `json:"families"`
+}
+
+// tableRow is the repeat content of a class or family.
+type tableRow struct {
+	Name           string  `json:"name"`
+	Class          string  `json:"class,omitempty"`
+	Elements       int     `json:"elements"`
+	Bases          int64   `json:"bases"`
+	Percent        float64 `json:"percent"`
+	MeanDivergence float64 `json:"mean_divergence"`
+}
+
+// repeatCounts accumulates the repeat content of hits for a repeatTable
+// without retaining the hits. Hits must be added in output order.
+type repeatCounts struct {
+	details  map[string]detail
+	classes  map[string]*repeatGroup
+	families map[string]*repeatGroup
+
+	records  int
+	elements map[int64]bool
+	masked   maskedCount
+}
+
+// repeatGroup is the accumulated repeat content of a class or family.
+type repeatGroup struct {
+	class    string
+	elements map[int64]bool
+	masked   maskedCount
+	aligned  float64
+	diverged float64
+}
+
+// newRepeatCounts returns a new repeatCounts using the family classes
+// in details.
+func newRepeatCounts(details map[string]detail) *repeatCounts {
+	return &repeatCounts{
+		details:  details,
+		classes:  make(map[string]*repeatGroup),
+		families: make(map[string]*repeatGroup),
+		elements: make(map[int64]bool),
+	}
+}
+
+// add adds h to the counts. Hits must be added in order of subject and
+// subject position.
+func (c *repeatCounts) add(h blast.Record) {
+	class := c.details[h.QueryAccVer].class
+	if class == "" {
+		class = unknownClass
+	}
+	addTo := func(m map[string]*repeatGroup, name, class string) {
+		g, ok := m[name]
+		if !ok {
+			g = &repeatGroup{class: class, elements: make(map[int64]bool)}
+			m[name] = g
+		}
+		g.elements[h.UID] = true
+		g.masked.add(h)
+		g.aligned += float64(h.AlignmentLength)
+		g.diverged += float64(h.AlignmentLength) * (100 - h.PctIdentity)
+	}
+	addTo(c.classes, class, "")
+	addTo(c.families, h.QueryAccVer, class)
+	c.records++
+	c.elements[h.UID] = true
+	c.masked.add(h)
+}
+
+// table returns the repeat table of the counted hits annotated on query,
+// a genome of the given length. Divergence is the alignment length
+// weighted mean of 100 minus the percent identity of hits.
+func (c *repeatCounts) table(query string, genome int64) repeatTable {
+	percent := func(n int64) float64 {
+		if genome == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(genome)
+	}
+	rows := func(m map[string]*repeatGroup) []tableRow {
+		r := make([]tableRow, 0, len(m))
+		for name, g := range m {
+			bases := g.masked.bases()
+			var div float64
+			if g.aligned != 0 {
+				div = g.diverged / g.aligned
+			}
+			r = append(r, tableRow{
+				Name:           name,
+				Class:          g.class,
+				Elements:       len(g.elements),
+				Bases:          bases,
+				Percent:        percent(bases),
+				MeanDivergence: div,
+			})
+		}
+		sort.Slice(r, func(i, j int) bool {
+			if r[i].Bases != r[j].Bases {
+				return r[i].Bases > r[j].Bases
+			}
+			return r[i].Name < r[j].Name
+		})
+		return r
+	}
+
+	masked := c.masked.bases()
+	return repeatTable{
+		Query:         query,
+		GenomeBases:   genome,
+		MaskedBases:   masked,
+		MaskedPercent: percent(masked),
+		Classes:       rows(c.classes),
+		Families:      rows(c.families),
+	}
+}
+
+// writeText writes a human readable rendering of t to w.
+func (t repeatTable) writeText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	const rule = "=================================================================================="
+	fmt.Fprintln(bw, rule)
+	fmt.Fprintf(bw, "file name:     %s\n", t.Query)
+	fmt.Fprintf(bw, "total length:  %12d bp\n", t.GenomeBases)
+	fmt.Fprintf(bw, "bases masked:  %12d bp (%6.2f %%)\n", t.MaskedBases, t.MaskedPercent)
+	fmt.Fprintln(bw, rule)
+	fmt.Fprintf(bw, "%-32s %10s %14s %11s %11s\n", "class", "elements", "length (bp)", "percent", "divergence")
+	for _, r := range t.Classes {
+		fmt.Fprintf(bw, "%-32s %10d %14d %9.2f %% %9.2f %%\n", r.Name, r.Elements, r.Bases, r.Percent, r.MeanDivergence)
+	}
+	fmt.Fprintln(bw, rule)
+	fmt.Fprintf(bw, "%-32s %-20s %10s %14s %11s %11s\n", "family", "class", "elements", "length (bp)", "percent", "divergence")
+	for _, r := range t.Families {
+		fmt.Fprintf(bw, "%-32s %-20s %10d %14d %9.2f %% %9.2f %%\n", r.Name, r.Class, r.Elements, r.Bases, r.Percent, r.MeanDivergence)
+	}
+	fmt.Fprintln(bw, rule)
+	return bw.Flush()
+}
+
+// writeRepeatTable writes t as text to the file at path and as JSON to
+// path with a ".json" suffix followed by ext.
+func writeRepeatTable(path, ext string, t repeatTable) error {
+	f, err := createOutput(path + ext)
+	if err != nil {
+		return err
+	}
+	err = t.writeText(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeOutput(path+".json"+ext, append(b, '\n'))
+}
+
+// writeFamilyMatrix writes the number of elements and the number of bases
+// annotated for each family on each query sequence in hits to the files at
+// path with ".counts.tsv" and ".bases.tsv" suffixes followed by ext. The matrices hold a
+// row for each sequence in lengths, in name order, and a column for each
+// family, in descending order of bases annotated in the complete query.
+func writeFamilyMatrix(path, ext string, hits []blast.Record, lengths map[string]int) error {
+	type cell struct {
+		hits     []blast.Record
+		elements map[int64]bool
+	}
+	cells := make(map[string]map[string]*cell)
+	familyHits := make(map[string][]blast.Record)
+	for _, h := range hits {
+		row, ok := cells[h.SubjectAccVer]
+		if !ok {
+			row = make(map[string]*cell)
+			cells[h.SubjectAccVer] = row
+		}
+		c, ok := row[h.QueryAccVer]
+		if !ok {
+			c = &cell{elements: make(map[int64]bool)}
+			row[h.QueryAccVer] = c
+		}
+		c.hits = append(c.hits, h)
+		c.elements[h.UID] = true
+		familyHits[h.QueryAccVer] = append(familyHits[h.QueryAccVer], h)
+	}
+
+	families := make([]string, 0, len(familyHits))
+	total := make(map[string]int64, len(familyHits))
+	for f, h := range familyHits {
+		families = append(families, f)
+		total[f] = maskedBases(h)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		if total[families[i]] != total[families[j]] {
+			return total[families[i]] > total[families[j]]
+		}
+		return families[i] < families[j]
+	})
+	seqs := make([]string, 0, len(lengths))
+	for s := range lengths {
+		seqs = append(seqs, s)
+	}
+	sort.Strings(seqs)
+
+	for _, m := range []struct {
+		suffix string
+		value  func(*cell) int64
+	}{
+		{suffix: ".counts.tsv", value: func(c *cell) int64 { return int64(len(c.elements)) }},
+		{suffix: ".bases.tsv", value: func(c *cell) int64 { return maskedBases(c.hits) }},
+	} {
+		f, err := createOutput(path + m.suffix + ext)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		fmt.Fprint(w, "sequence\tlength")
+		for _, fam := range families {
+			fmt.Fprintf(w, "\t%s", fam)
+		}
+		fmt.Fprintln(w)
+		for _, s := range seqs {
+			fmt.Fprintf(w, "%s\t%d", s, lengths[s])
+			row := cells[s]
+			for _, fam := range families {
+				var v int64
+				if c, ok := row[fam]; ok {
+					v = m.value(c)
+				}
+				fmt.Fprintf(w, "\t%d", v)
+			}
+			fmt.Fprintln(w)
+		}
+		err = w.Flush()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// Tandem array detection parameters.
+const (
+	// tandemK is the length of k-mers used
+	// to measure the distance between
+	// repeated words.
+	tandemK = 10
+
+	// minTandemPeriod and maxTandemPeriod
+	// are the range of repeat unit lengths
+	// detected. Shorter periods are simple
+	// repeats that are annotated by the
+	// library search.
+	minTandemPeriod = 5
+	maxTandemPeriod = 2000
+
+	// tandemWindow is the width of windows
+	// in which the dominant period is found
+	// and tandemSupport is the fraction of
+	// k-mers in a window that must recur at
+	// the dominant period for the window to
+	// be part of an array.
+	tandemWindow  = 200
+	tandemSupport = 0.2
+
+	// minTelomereLen and minSatelliteLen
+	// are the minimum lengths of reported
+	// telomeric and satellite arrays.
+	minTelomereLen  = 200
+	minSatelliteLen = 3000
+)
+
+// defaultTelomereMotif is the vertebrate telomeric repeat unit.
+const defaultTelomereMotif = "TTAGGG"
+
+// tandemArray is a telomeric or satellite tandem repeat array.
+type tandemArray struct {
+	// Feature is the GTF feature type of
+	// the array, telomere or satellite.
+	Feature string
+
+	// SubjectAccVer, SubjectStart and
+	// SubjectEnd are the zero-based
+	// half-open location of the array.
+	SubjectAccVer string
+	SubjectStart  int
+	SubjectEnd    int
+
+	// Strand is the strand of a telomeric
+	// motif, or zero for satellites.
+	Strand int8
+
+	// Period is the length of the repeat
+	// unit, Unit is the first unit of the
+	// array and Copies is the number of
+	// units in the array.
+	Period int
+	Unit   string
+	Copies float64
+
+	// PctIdentity is the percentage of
+	// positions in the array matching the
+	// position one period downstream.
+	PctIdentity float64
+}
+
+// tandemFinder finds tandem repeat arrays in a set of sequences.
+type tandemFinder struct {
+	// motif is the upper case telomeric
+	// repeat unit and revMotif is its
+	// reverse complement.
+	motif, revMotif string
+
+	// last holds the most recent position
+	// of each k-mer, offset by base so that
+	// positions from earlier sequences are
+	// too distant to be counted.
+	last []int64
+	base int64
+}
+
+// newTandemFinder returns a tandemFinder that classifies arrays with the
+// given telomeric repeat unit as telomeres.
+func newTandemFinder(motif string) *tandemFinder {
+	motif = strings.ToUpper(motif)
+	rev := []byte(motif)
+	revComp(rev)
+	f := tandemFinder{
+		motif:    motif,
+		revMotif: string(rev),
+		last:     make([]int64, 1<<(2*tandemK)),
+	}
+	for i := range f.last {
+		f.last[i] = -maxTandemPeriod - 1
+	}
+	return &f
+}
+
+// find returns the tandem arrays in the sequence s with the given id.
+func (f *tandemFinder) find(id string, s []alphabet.Letter) []tandemArray {
+	type window struct {
+		period, support int
+	}
+	windows := make([]window, (len(s)+tandemWindow-1)/tandemWindow)
+	counts := make(map[int]int)
+	const mask = 1<<(2*tandemK) - 1
+	var (
+		h     int
+		valid int
+	)
+	for i, l := range s {
+		code, ok := baseCode(l)
+		if !ok {
+			valid = 0
+		} else {
+			h = (h<<2 | code) & mask
+			valid++
+		}
+		if valid >= tandemK {
+			pos := f.base + int64(i-tandemK+1)
+			d := int(pos - f.last[h])
+			f.last[h] = pos
+			if minTandemPeriod <= d && d <= maxTandemPeriod {
+				counts[d]++
+			}
+		}
+		if i%tandemWindow == tandemWindow-1 || i == len(s)-1 {
+			w := &windows[i/tandemWindow]
+			for d, n := range counts {
+				if n > w.support || (n == w.support && d < w.period) {
+					w.period, w.support = d, n
+				}
+				delete(counts, d)
+			}
+		}
+	}
+	f.base += int64(len(s)) + maxTandemPeriod + 1
+
+	var arrays []tandemArray
+	periodic := func(w window) bool {
+		return w.support >= tandemSupport*tandemWindow
+	}
+	for i := 0; i < len(windows); {
+		if !periodic(windows[i]) {
+			i++
+			continue
+		}
+		period := windows[i].period
+		j := i + 1
+		for j < len(windows) && periodic(windows[j]) && abs(windows[j].period-period) <= period/10 {
+			j++
+		}
+		start, end := i*tandemWindow, j*tandemWindow
+		if end > len(s) {
+			end = len(s)
+		}
+		if a, ok := f.array(id, s, start, end, period); ok {
+			arrays = append(arrays, a)
+		}
+		i = j
+	}
+	return arrays
+}
+
+// array returns the tandem array with the given period approximately
+// spanning [start, end) of s with its ends refined, and whether it is
+// long enough to be reported as a telomere or satellite.
+func (f *tandemFinder) array(id string, s []alphabet.Letter, start, end, period int) (tandemArray, bool) {
+	match := func(i int) bool {
+		return upper(byte(s[i])) == upper(byte(s[i+period]))
+	}
+	for start > 0 && start-1+period < len(s) && match(start-1) {
+		start--
+	}
+	for start < end-period && !match(start) {
+		start++
+	}
+	for end < len(s) && end-period >= 0 && match(end-period) {
+		end++
+	}
+	for end-period > start && !match(end-1-period) {
+		end--
+	}
+	if end-start <= period {
+		return tandemArray{}, false
+	}
+	var n int
+	for i := start; i < end-period; i++ {
+		if match(i) {
+			n++
+		}
+	}
+	unit := make([]byte, period)
+	for i := range unit {
+		unit[i] = upper(byte(s[start+i]))
+	}
+	a := tandemArray{
+		Feature:       "satellite",
+		SubjectAccVer: id,
+		SubjectStart:  start,
+		SubjectEnd:    end,
+		Period:        period,
+		Unit:          string(unit),
+		Copies:        float64(end-start) / float64(period),
+		PctIdentity:   100 * float64(n) / float64(end-start-period),
+	}
+	if period == len(f.motif) {
+		switch {
+		case strings.Contains(f.motif+f.motif, a.Unit):
+			a.Feature, a.Strand = "telomere", 1
+		case strings.Contains(f.revMotif+f.revMotif, a.Unit):
+			a.Feature, a.Strand = "telomere", -1
+		}
+	}
+	if a.Feature == "telomere" {
+		return a, end-start >= minTelomereLen
+	}
+	return a, end-start >= minSatelliteLen
+}
+
+// baseCode returns the two-bit code of the nucleotide l and whether l is
+// an unambiguous nucleotide.
+func baseCode(l alphabet.Letter) (int, bool) {
+	switch l {
+	case 'A', 'a':
+		return 0, true
+	case 'C', 'c':
+		return 1, true
+	case 'G', 'g':
+		return 2, true
+	case 'T', 't':
+		return 3, true
+	}
+	return 0, false
+}
+
+// writeTandem writes the telomeric and satellite arrays in g to out as
+// JSON, or to enc as GTF if it is not nil. Arrays overlapping regions
+// excluded by the output filter are not written.
+func (r run) writeTandem(out io.Writer, enc *gff.Writer, g *genome) error {
+	f := newTandemFinder(r.telomere)
+	var n int
+	for _, s := range g.seqs {
+		for _, a := range f.find(s.ID, s.Seq) {
+			if excluded(r.filter.exclude[a.SubjectAccVer], a.SubjectStart, a.SubjectEnd) {
+				continue
+			}
+			n++
+			var contig string
+			if r.lift != nil {
+				contig = fmt.Sprintf("%s:%d-%d", a.SubjectAccVer, a.SubjectStart+1, a.SubjectEnd)
+				rec := liftAnnotation(r.lift, blast.Record{
+					SubjectAccVer: a.SubjectAccVer,
+					SubjectStart:  a.SubjectStart,
+					SubjectEnd:    a.SubjectEnd,
+					Strand:        1,
+				})
+				a.SubjectAccVer = rec.SubjectAccVer
+				a.SubjectStart, a.SubjectEnd = subjectSpan(rec)
+				if rec.Strand < 0 {
+					// The array is on the reverse
+					// strand of the object.
+					a.Strand = -a.Strand
+					unit := []byte(a.Unit)
+					revComp(unit)
+					a.Unit = string(unit)
+				}
+			}
+			if enc == nil {
+				b, err := json.Marshal(a)
+				if err != nil {
+					return err
+				}
+				_, err = out.Write(b)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			feat := &gff.Feature{
+				SeqName:    a.SubjectAccVer,
+				Source:     "ins",
+				Feature:    a.Feature,
+				FeatStart:  a.SubjectStart,
+				FeatEnd:    a.SubjectEnd,
+				FeatScore:  &a.PctIdentity,
+				FeatStrand: seq.Strand(a.Strand),
+				FeatFrame:  gff.NoFrame,
+				FeatAttributes: gff.Attributes{
+					{Tag: "Period", Value: fmt.Sprint(a.Period)},
+					{Tag: "Unit", Value: a.Unit},
+					{Tag: "Copies", Value: fmt.Sprintf("%.1f", a.Copies)},
+				},
+			}
+			if contig != "" {
+				feat.FeatAttributes = append(feat.FeatAttributes, gff.Attribute{Tag: "Contig", Value: contig})
+			}
+			_, err := enc.Write(feat)
+			if err != nil {
+				return fmt.Errorf("failed to write feature: %w", err)
+			}
+		}
+	}
+	log.Printf("found %d telomeric and satellite arrays", n)
+	return nil
+}
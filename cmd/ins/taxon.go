@@ -0,0 +1,148 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// parseLineage returns the taxa of a comma-separated lineage.
+func parseLineage(s string) []string {
+	var lineage []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			lineage = append(lineage, t)
+		}
+	}
+	return lineage
+}
+
+// libTaxa returns the taxa annotated in a library fasta header line. Dfam
+// and RepeatMasker headers give taxa as words prefixed with @, for example
+// ">L1MA1 LINE/L1 @Mammalia", and RepBase headers give the species as the
+// tab-separated fields following the class, for example
+// ">L1HS<TAB>L1<TAB>Homo sapiens".
+func libTaxa(header []byte) []string {
+	b := bytes.TrimPrefix(bytes.TrimSpace(header), []byte{'>'})
+	var taxa []string
+	if f := bytes.Split(b, []byte{'\t'}); len(f) > 2 {
+		for _, t := range f[2:] {
+			t = bytes.TrimSpace(t)
+			if len(t) != 0 {
+				taxa = append(taxa, string(t))
+			}
+		}
+		return taxa
+	}
+	for _, f := range bytes.Fields(b) {
+		if len(f) > 1 && f[0] == '@' {
+			taxa = append(taxa, string(f[1:]))
+		}
+	}
+	return taxa
+}
+
+// taxonKey returns the comparison key for the taxon name t. Names are
+// compared without regard to case and with underscores matching spaces.
+func taxonKey(t string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(t), "_", " ", -1))
+}
+
+// speciesLibrary writes the sequences in libs that are relevant to the
+// taxa in lineage to the fasta file at dst, returning the path to the
+// written library and the number of sequences omitted. A sequence is
+// relevant if any of its header taxa is in lineage or if its header has
+// no taxon annotation.
+func speciesLibrary(dst string, libs, lineage []string) (string, int, error) {
+	want := make(map[string]bool)
+	for _, t := range lineage {
+		want[taxonKey(t)] = true
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	w := bufio.NewWriter(f)
+	var kept, removed int
+	for _, lib := range libs {
+		k, r, err := writeRelevant(w, lib, want)
+		if err != nil {
+			f.Close()
+			return "", 0, err
+		}
+		kept += k
+		removed += r
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	if kept == 0 {
+		return "", removed, errors.New("no library sequences are annotated with the species lineage")
+	}
+	return dst, removed, nil
+}
+
+// writeRelevant writes the records of the library fasta file at path whose
+// headers have no taxa or a taxon key in want to w, returning the number
+// of records kept and omitted. Header and sequence lines are written
+// verbatim.
+func writeRelevant(w io.Writer, path string, want map[string]bool) (kept, removed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var relevant bool
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) != 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if line[0] == '>' {
+				taxa := libTaxa(line)
+				relevant = len(taxa) == 0
+				for _, t := range taxa {
+					if want[taxonKey(t)] {
+						relevant = true
+						break
+					}
+				}
+				if relevant {
+					kept++
+				} else {
+					removed++
+				}
+			}
+			if relevant {
+				_, err := w.Write(line)
+				if err != nil {
+					return kept, removed, err
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return kept, removed, nil
+			}
+			return kept, removed, err
+		}
+	}
+}
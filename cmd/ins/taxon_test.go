@@ -0,0 +1,140 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var libTaxaTests = []struct {
+	header string
+	want   []string
+}{
+	{header: ">L1MA1 LINE/L1 @Mammalia\n", want: []string{"Mammalia"}},
+	{header: ">DF0000001.4 MIR @Mammalia @Aves", want: []string{"Mammalia", "Aves"}},
+	{header: ">L1HS\tL1\tHomo sapiens\n", want: []string{"Homo sapiens"}},
+	{header: ">L1HS\tL1\tHomo sapiens\tPan troglodytes\n", want: []string{"Homo sapiens", "Pan troglodytes"}},
+	{header: ">L1HS LINE/L1\n", want: nil},
+	{header: ">L1HS\tL1\n", want: nil},
+	{header: ">L1HS @ @\n", want: nil},
+}
+
+func TestLibTaxa(t *testing.T) {
+	for _, test := range libTaxaTests {
+		got := libTaxa([]byte(test.header))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected taxa for %q: got:%q want:%q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestParseLineage(t *testing.T) {
+	got := parseLineage(" Homo sapiens, Primates,,Mammalia ")
+	want := []string{"Homo sapiens", "Primates", "Mammalia"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected lineage: got:%q want:%q", got, want)
+	}
+}
+
+const speciesLib = `>L1HS LINE/L1 @Homo_sapiens
+ACGTACGT
+ACGT
+>L1MA1 LINE/L1 @Mammalia
+ACGTACGT
+>BovB LINE/RTE-BovB @Bovidae
+ACGTACGT
+>Alu SINE/Alu @Primates @Rodentia
+ACGTACGT
+>unannotated Unknown
+ACGTACGT
+`
+
+const speciesRepBase = ">Mariner\tMariner/Tc1\tDrosophila mauritiana\nACGTACGT\n>Gypsy\tGypsy\tMammalia\nACGTACGT\n"
+
+var speciesLibraryTests = []struct {
+	lineage     []string
+	want        string
+	wantRemoved int
+}{
+	{
+		lineage: []string{"Homo sapiens", "Primates", "mammalia"},
+		want: `>L1HS LINE/L1 @Homo_sapiens
+ACGTACGT
+ACGT
+>L1MA1 LINE/L1 @Mammalia
+ACGTACGT
+>Alu SINE/Alu @Primates @Rodentia
+ACGTACGT
+>unannotated Unknown
+ACGTACGT
+>Gypsy	Gypsy	Mammalia
+ACGTACGT
+`,
+		wantRemoved: 2,
+	},
+	{
+		lineage: []string{"Drosophila mauritiana"},
+		want: `>unannotated Unknown
+ACGTACGT
+>Mariner	Mariner/Tc1	Drosophila mauritiana
+ACGTACGT
+`,
+		wantRemoved: 5,
+	},
+}
+
+func TestSpeciesLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-species-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	libs := []string{filepath.Join(dir, "dfam.fa"), filepath.Join(dir, "repbase.fa")}
+	for i, lib := range []string{speciesLib, speciesRepBase} {
+		err = ioutil.WriteFile(libs[i], []byte(lib), 0o664)
+		if err != nil {
+			t.Fatalf("failed to write library: %v", err)
+		}
+	}
+
+	for _, test := range speciesLibraryTests {
+		dst := filepath.Join(dir, "species.fa")
+		path, removed, err := speciesLibrary(dst, libs, test.lineage)
+		if err != nil {
+			t.Errorf("unexpected error for lineage %q: %v", test.lineage, err)
+			continue
+		}
+		if path != dst {
+			t.Errorf("unexpected path for lineage %q: got:%q want:%q", test.lineage, path, dst)
+		}
+		if removed != test.wantRemoved {
+			t.Errorf("unexpected number of removed sequences for lineage %q: got:%d want:%d", test.lineage, removed, test.wantRemoved)
+		}
+		got, err := ioutil.ReadFile(dst)
+		if err != nil {
+			t.Fatalf("failed to read species library: %v", err)
+		}
+		if string(got) != test.want {
+			t.Errorf("unexpected species library for lineage %q:\ngot:\n%s\nwant:\n%s", test.lineage, got, test.want)
+		}
+	}
+
+	_, _, err = speciesLibrary(filepath.Join(dir, "none.fa"), libs[:1], []string{"Aves"})
+	if err != nil {
+		t.Errorf("unexpected error for lineage with only unannotated families: %v", err)
+	}
+	err = ioutil.WriteFile(libs[0], []byte(">L1HS LINE/L1 @Homo_sapiens\nACGT\n"), 0o664)
+	if err != nil {
+		t.Fatalf("failed to write library: %v", err)
+	}
+	_, _, err = speciesLibrary(filepath.Join(dir, "none.fa"), libs[:1], []string{"Aves"})
+	if err == nil {
+		t.Error("expected error for lineage matching no families")
+	}
+}
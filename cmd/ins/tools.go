@@ -0,0 +1,176 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// minBlastVersion is the oldest BLAST+ version known to support
+// all the flags used by ins.
+var minBlastVersion = [3]int{2, 2, 31}
+
+// minJSONVersion is the oldest BLAST+ version used with single-file
+// JSON output for reciprocal searches. Older versions use XML.
+var minJSONVersion = [3]int{2, 7, 1}
+
+var (
+	// blastnManaged are the blastn flags that are always
+	// set by ins.
+	blastnManaged = []string{"-db", "-query", "-outfmt"}
+
+	// blastnModeManaged are the blastn flags set by ins
+	// in all modes except user mode.
+	blastnModeManaged = []string{
+		"-evalue", "-word_size", "-dust", "-soft_masking",
+		"-reward", "-penalty", "-xdrop_ungap", "-xdrop_gap",
+		"-xdrop_gap_final", "-gapopen", "-gapextend",
+		"-num_alignments", "-searchsp", "-parse_deflines",
+		"-num_threads", "-db_soft_mask",
+	}
+
+	// makeblastdbManaged are the makeblastdb flags that
+	// are always set by ins.
+	makeblastdbManaged = []string{"-in", "-out", "-dbtype", "-title"}
+)
+
+// checkTools checks that the BLAST executables used by search, and any other
+// BLAST+ executables in also, are available and recent enough, and that the
+// extra arguments in mflags and bflags do not set flags managed by ins. It
+// returns the versions of the executables.
+func checkTools(search blast.Nucleic, mflags, bflags []string, userMode bool, also ...string) (map[string]string, error) {
+	versions := make(map[string]string)
+	for _, cmd := range append([]string{search.Cmd, "makeblastdb"}, also...) {
+		if cmd == "" {
+			cmd = "blastn"
+		}
+		v, err := blastVersion(cmd)
+		if err != nil {
+			return nil, err
+		}
+		if !atLeast(v, minBlastVersion) {
+			return nil, exitError{code: exitNoBlast, err: fmt.Errorf("%s version %s is older than minimum required version %d.%d.%d", cmd, v, minBlastVersion[0], minBlastVersion[1], minBlastVersion[2])}
+		}
+		versions[cmd] = v
+	}
+
+	managed := blastnManaged
+	if !userMode {
+		managed = append(managed[:len(managed):len(managed)], blastnModeManaged...)
+	}
+	err := checkFlags("blastn", bflags, managed)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFlags("makeblastdb", mflags, makeblastdbManaged)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// reportFormat returns the output format used for reciprocal searches
+// by the blastn executable cmd with the given versions.
+func reportFormat(cmd string, versions map[string]string) int {
+	if cmd == "" {
+		cmd = "blastn"
+	}
+	if atLeast(versions[cmd], minJSONVersion) {
+		return jsonFmt
+	}
+	return xmlFmt
+}
+
+// blastVersion returns the version of the BLAST+ executable cmd run by
+// the executor.
+func blastVersion(cmd string) (string, error) {
+	if !exe.container.runs(cmd) {
+		path := cmd
+		if exe.blastBin != "" && isBlastTool(cmd) {
+			path = filepath.Join(exe.blastBin, cmd)
+		}
+		_, err := exec.LookPath(path)
+		if err != nil {
+			return "", err
+		}
+	}
+	out, err := exe.output(command{cmd, "-version"})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", cmd, err)
+	}
+	return blast.ParseVersion(out), nil
+}
+
+// checkFlags returns an error if any of the flags in extra is in managed.
+func checkFlags(cmd string, extra, managed []string) error {
+	for _, f := range extra {
+		for _, m := range managed {
+			if f == m {
+				return exitError{code: exitUsage, err: fmt.Errorf("%s flag %s is managed by ins and may not be set", cmd, f)}
+			}
+		}
+	}
+	return nil
+}
+
+// extraArgs returns the arguments in the shell-quoted flags string followed
+// by the key=value or key flags in kv. Keys may be given with or without the
+// leading hyphen.
+func extraArgs(flags string, kv []string) ([]string, error) {
+	args, err := blast.SplitFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range kv {
+		k, v, ok := cut(f, "=")
+		k = strings.TrimLeft(k, "-")
+		if k == "" {
+			return nil, fmt.Errorf("missing flag name in %q", f)
+		}
+		args = append(args, "-"+k)
+		if ok {
+			args = append(args, v)
+		}
+	}
+	return args, nil
+}
+
+// cut slices s around the first instance of sep, returning the text before
+// and after sep and whether sep was found.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// atLeast returns whether the version string v, of the form "2.10.1+",
+// is at least min. Unparseable versions are assumed to be recent enough.
+func atLeast(v string, min [3]int) bool {
+	words := strings.Fields(v)
+	if len(words) == 0 {
+		return true
+	}
+	fields := strings.SplitN(strings.TrimSuffix(words[0], "+"), ".", 3)
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return true
+		}
+		switch {
+		case n > min[i]:
+			return true
+		case n < min[i]:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/biogo/biogo/io/featio/gff"
+)
+
+// tsdSlack is the number of bases each end of an element may be moved
+// when searching for a target site duplication, allowing for imprecise
+// alignment ends.
+const tsdSlack = 3
+
+// tsdRange is the range of target site duplication lengths searched for.
+// A zero max disables the search.
+type tsdRange struct {
+	min, max int
+}
+
+// parseTSDRange parses a target site duplication length range given as
+// "min-max" or as a single length.
+func parseTSDRange(s string) (tsdRange, error) {
+	if s == "" {
+		return tsdRange{}, nil
+	}
+	lo, hi, ok := cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	var (
+		r   tsdRange
+		err error
+	)
+	r.min, err = strconv.Atoi(lo)
+	if err != nil {
+		return tsdRange{}, fmt.Errorf("invalid TSD length range %q: %w", s, err)
+	}
+	r.max, err = strconv.Atoi(hi)
+	if err != nil {
+		return tsdRange{}, fmt.Errorf("invalid TSD length range %q: %w", s, err)
+	}
+	if r.min < 1 || r.max < r.min {
+		return tsdRange{}, fmt.Errorf("invalid TSD length range %q", s)
+	}
+	return r, nil
+}
+
+// tsd returns the longest target site duplication with a length in r
+// flanking the element at [start, end) on the sequence with the given id.
+// Each end of the element may be moved by up to tsdSlack bases. Matches
+// are case-insensitive and may not contain N. If no duplication is found
+// tsd returns the empty string.
+func (g *genome) tsd(id string, start, end int, r tsdRange) string {
+	i, ok := g.index[id]
+	if !ok {
+		return ""
+	}
+	seq := g.seqs[i]
+	s := seq.Seq
+	start -= seq.Offset
+	end -= seq.Offset
+
+	var best string
+	for dl := -tsdSlack; dl <= tsdSlack; dl++ {
+		left := start + dl
+		for dr := -tsdSlack; dr <= tsdSlack; dr++ {
+			right := end + dr
+			if right-left < 1 {
+				continue
+			}
+		lengths:
+			for n := r.max; n >= r.min && n > len(best); n-- {
+				if left-n < 0 || right+n > len(s) {
+					continue
+				}
+				for k := 0; k < n; k++ {
+					a, b := upper(byte(s[left-n+k])), upper(byte(s[right+k]))
+					if a != b || a == 'N' {
+						continue lengths
+					}
+				}
+				dup := make([]byte, n)
+				for k := range dup {
+					dup[k] = upper(byte(s[right+k]))
+				}
+				best = string(dup)
+				break
+			}
+		}
+	}
+	return best
+}
+
+// upper returns the upper case of the ASCII letter b.
+func upper(b byte) byte {
+	if 'a' <= b && b <= 'z' {
+		return b - ('a' - 'A')
+	}
+	return b
+}
+
+// appendTSD appends target site duplication attributes for dup to attr
+// if dup is not empty.
+func appendTSD(attr gff.Attributes, dup string) gff.Attributes {
+	if dup == "" {
+		return attr
+	}
+	return append(attr,
+		gff.Attribute{Tag: "TSD", Value: dup},
+		gff.Attribute{Tag: "TSDLength", Value: strconv.Itoa(len(dup))},
+	)
+}
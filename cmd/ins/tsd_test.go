@@ -0,0 +1,109 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq/linear"
+
+	"github.com/kortschak/ins/blast"
+	"github.com/kortschak/ins/internal/store"
+)
+
+var parseTSDRangeTests = []struct {
+	in      string
+	want    tsdRange
+	wantErr bool
+}{
+	{in: "", want: tsdRange{}},
+	{in: "5", want: tsdRange{min: 5, max: 5}},
+	{in: "4-8", want: tsdRange{min: 4, max: 8}},
+	{in: "0-8", wantErr: true},
+	{in: "8-4", wantErr: true},
+	{in: "four", wantErr: true},
+}
+
+func TestParseTSDRange(t *testing.T) {
+	for _, test := range parseTSDRangeTests {
+		got, err := parseTSDRange(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %q: got:%v want error:%t", test.in, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("unexpected range for %q: got:%+v want:%+v", test.in, got, test.want)
+		}
+	}
+}
+
+// tsdGenome is a sequence holding a 20 bp element at [14, 34) flanked by
+// the target site duplication ATTGCA.
+const tsdGenome = "GGGGGGGG" + "ATTGCA" + "CCCCCCCCCCCCCCCCCCCC" + "ATTGCA" + "TTTTTTTT"
+
+var tsdTests = []struct {
+	name       string
+	seq        string
+	start, end int
+	r          tsdRange
+	want       string
+}{
+	{name: "exact", seq: tsdGenome, start: 14, end: 34, r: tsdRange{min: 4, max: 8}, want: "ATTGCA"},
+	{name: "slack", seq: tsdGenome, start: 16, end: 32, r: tsdRange{min: 4, max: 8}, want: "ATTGCA"},
+	{name: "lower", seq: strings.ToLower(tsdGenome), start: 14, end: 34, r: tsdRange{min: 4, max: 8}, want: "ATTGCA"},
+	{name: "too short", seq: tsdGenome, start: 14, end: 34, r: tsdRange{min: 7, max: 8}, want: ""},
+	{name: "masked", seq: strings.Replace(tsdGenome, "ATTGCA", "NNNNNN", -1), start: 14, end: 34, r: tsdRange{min: 4, max: 8}, want: ""},
+	{name: "unknown", seq: tsdGenome, start: 14, end: 34, r: tsdRange{min: 4, max: 8}, want: ""},
+}
+
+func TestTSD(t *testing.T) {
+	for _, test := range tsdTests {
+		id := "chr1"
+		if test.name == "unknown" {
+			id = "chr2"
+		}
+		g := &genome{
+			seqs:  []*linear.Seq{linear.NewSeq("chr1", alphabet.BytesToLetters([]byte(test.seq)), alphabet.DNAredundant)},
+			index: map[string]int{"chr1": 0},
+		}
+		got := g.tsd(id, test.start, test.end, test.r)
+		if got != test.want {
+			t.Errorf("unexpected TSD for %s test: got:%q want:%q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteFeatureTSD(t *testing.T) {
+	g := &genome{
+		seqs:  []*linear.Seq{linear.NewSeq("chr1", alphabet.BytesToLetters([]byte(tsdGenome)), alphabet.DNAredundant)},
+		index: map[string]int{"chr1": 0},
+	}
+	rec := blast.Record{
+		QueryAccVer:   "L1",
+		QueryStart:    1,
+		QueryEnd:      20,
+		SubjectAccVer: "chr1",
+		SubjectStart:  14,
+		SubjectEnd:    34,
+		BitScore:      40,
+		Strand:        1,
+	}
+	for _, tsdLen := range []tsdRange{{}, {min: 4, max: 8}} {
+		r := run{tsdLen: tsdLen, genome: g}
+		var buf bytes.Buffer
+		err := r.writeFeature(nil, gff.NewWriter(&buf, 60, false), store.Annotated{Record: rec}, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error writing feature: %v", err)
+		}
+		got := buf.String()
+		wantTSD := tsdLen.max != 0
+		if strings.Contains(got, "TSD ATTGCA;") != wantTSD || strings.Contains(got, "TSDLength 6") != wantTSD {
+			t.Errorf("unexpected TSD reporting with range %+v: got:%q want TSD:%t", tsdLen, got, wantTSD)
+		}
+	}
+}
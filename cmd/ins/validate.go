@@ -0,0 +1,174 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Library validation policies.
+const (
+	checkNone = "none" // Do not validate libraries.
+	checkWarn = "warn" // Report library problems as warnings.
+	checkFail = "fail" // Fail if a library has problems.
+)
+
+// libIssue is a problem found in a library.
+type libIssue struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	ID      string `json:"id,omitempty"`
+	Problem string `json:"problem"`
+}
+
+func (i libIssue) String() string {
+	if i.ID == "" {
+		return fmt.Sprintf("%s:%d: %s", i.File, i.Line, i.Problem)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", i.File, i.Line, i.ID, i.Problem)
+}
+
+// iupac is the set of valid nucleotide sequence letters.
+var iupac = func() [256]bool {
+	var t [256]bool
+	for _, b := range []byte("ACGTURYSWKMBDHVN-") {
+		t[b] = true
+		t[b|0x20] = true
+	}
+	return t
+}()
+
+// validateLibraries returns the problems found in the library fasta files
+// at paths. Problems are duplicate sequence identifiers within or across
+// libraries, letters that are not IUPAC nucleotide codes, records without
+// sequence and sequences shorter than minLen.
+func validateLibraries(paths []string, minLen int) ([]libIssue, error) {
+	var issues []libIssue
+	type site struct {
+		file string
+		line int
+	}
+	seen := make(map[string]site)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var (
+			id     string
+			start  int
+			length int
+			bad    map[byte]bool
+		)
+		flush := func() {
+			if id == "" {
+				return
+			}
+			switch {
+			case length == 0:
+				issues = append(issues, libIssue{File: path, Line: start, ID: id, Problem: "record has no sequence"})
+			case length < minLen:
+				issues = append(issues, libIssue{File: path, Line: start, ID: id, Problem: fmt.Sprintf("sequence length %d is shorter than %d", length, minLen)})
+			}
+			if len(bad) != 0 {
+				letters := make([]byte, 0, len(bad))
+				for b := range bad {
+					letters = append(letters, b)
+				}
+				sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+				issues = append(issues, libIssue{File: path, Line: start, ID: id, Problem: fmt.Sprintf("sequence has non-IUPAC letters %q", letters)})
+			}
+		}
+		r := bufio.NewReader(f)
+		for line := 1; ; line++ {
+			b, err := r.ReadBytes('\n')
+			if len(b) != 0 {
+				b = bytes.TrimSpace(b)
+				switch {
+				case len(b) == 0:
+				case b[0] == '>':
+					flush()
+					id = libID(b)
+					start, length, bad = line, 0, nil
+					if id == "" {
+						issues = append(issues, libIssue{File: path, Line: line, Problem: "record has no identifier"})
+						break
+					}
+					if s, ok := seen[id]; ok {
+						issues = append(issues, libIssue{File: path, Line: line, ID: id, Problem: fmt.Sprintf("duplicate identifier first seen at %s:%d", s.file, s.line)})
+						break
+					}
+					seen[id] = site{file: path, line: line}
+				case id == "":
+					issues = append(issues, libIssue{File: path, Line: line, Problem: "sequence before first header"})
+				default:
+					length += len(b)
+					for _, c := range b {
+						if !iupac[c] {
+							if bad == nil {
+								bad = make(map[byte]bool)
+							}
+							bad[c] = true
+						}
+					}
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				f.Close()
+				return nil, err
+			}
+		}
+		flush()
+		f.Close()
+	}
+	return issues, nil
+}
+
+// checkLibraries validates the libraries at paths according to policy,
+// writing the issues found as JSON to the file at report if it is not
+// empty. If policy is checkFail and an issue is found, checkLibraries
+// returns an input error.
+func checkLibraries(paths []string, policy string, minLen int, report string) error {
+	if policy == checkNone {
+		return nil
+	}
+	issues, err := validateLibraries(paths, minLen)
+	if err != nil {
+		return inputError(err)
+	}
+	if report != "" {
+		b, err := json.MarshalIndent(issues, "", "\t")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(report, append(b, '\n'), 0o664)
+		if err != nil {
+			return err
+		}
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	if policy == checkFail {
+		for _, i := range issues {
+			logFields(fields{"library": i.File}, "%v", i)
+		}
+		return inputError(fmt.Errorf("found %d library problems", len(issues)))
+	}
+	for _, i := range issues {
+		warnf("%v", i)
+	}
+	return nil
+}
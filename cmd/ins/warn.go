@@ -0,0 +1,56 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// warnings holds the warnings raised during a run.
+var (
+	warnMu   sync.Mutex
+	warnings []string
+)
+
+// warnf logs a warning and records it for the warnings report. It is
+// safe for concurrent use.
+func warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("warning: %s", msg)
+	warnMu.Lock()
+	warnings = append(warnings, msg)
+	warnMu.Unlock()
+}
+
+// warnSkipped raises a warning for the malformed lines skipped while
+// parsing the named output if err is a *blast.SkippedError, and returns
+// nil. Other errors are returned unaltered.
+func warnSkipped(name string, err error) error {
+	var skipped *blast.SkippedError
+	if !errors.As(err, &skipped) {
+		return err
+	}
+	warnf("%s: %v", name, skipped)
+	for _, e := range skipped.Errors[1:] {
+		log.Printf("skipped malformed %v", e)
+	}
+	return nil
+}
+
+// reportWarnings logs all the warnings raised during the run.
+func reportWarnings() {
+	if len(warnings) == 0 {
+		return
+	}
+	log.Printf("%d warnings raised during run:", len(warnings))
+	for _, w := range warnings {
+		log.Printf("\t%s", w)
+	}
+}
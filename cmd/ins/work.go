@@ -0,0 +1,211 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Working file retention policies.
+const (
+	keepNone = "none" // Remove the working directory.
+	keepDBs  = "dbs"  // Keep only the kv databases and fragment index.
+	keepAll  = "all"  // Keep all working files.
+)
+
+// workRecord is the record of the working directory of a run.
+type workRecord struct {
+	Dir      string   `json:"dir"`
+	Keep     string   `json:"keep"`
+	Retained []string `json:"retained,omitempty"`
+}
+
+// laterDBs are the databases that are made stale when a run is recovered
+// from a database in the working directory.
+var laterDBs = map[string][]string{
+	"fragments.tsv": {"forward.db", "regions.db", "reverse.db", "culled.db"},
+	"forward.db":    {"regions.db", "reverse.db", "culled.db"},
+	"regions.db":    {"reverse.db", "culled.db"},
+	"reverse.db":    {"culled.db"},
+}
+
+// indexFiles are the fragment index files needed for recovery.
+var indexFiles = map[string]bool{
+	"fragments.tsv": true,
+	"gaps.bed":      true,
+}
+
+// passDirs are the working sub-directories of additional search passes.
+var passDirs = []string{"slow", "then"}
+
+// workDir returns the working directory for annotating the query at path
+// in the given mode with libs. The directory is created in parent, or the
+// system temporary directory if parent is empty, and is named for the query
+// and a digest of the parameters so that a failed run may be continued.
+func workDir(parent, path, mode string, libs []string) (string, error) {
+	if parent == "" {
+		parent = os.TempDir()
+	}
+	h := sha256.New()
+	for _, p := range append([]string{path}, libs...) {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", abs)
+	}
+	io.WriteString(h, mode)
+	return filepath.Join(parent, workPrefix(path)+hex.EncodeToString(h.Sum(nil)[:8])), nil
+}
+
+// workPrefix returns a working directory name prefix identifying
+// the query at path.
+func workPrefix(path string) string {
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	base = strings.Map(func(r rune) rune {
+		if r == os.PathSeparator || strings.ContainsRune(reservedPathChars, r) {
+			return '_'
+		}
+		return r
+	}, base)
+	return "ins-" + base + "-"
+}
+
+// reservedPathChars are the characters that are not valid
+// in file names on at least one supported platform.
+const reservedPathChars = `<>:"/\|?*`
+
+// errLocked is returned by lockFile when the lock is held by another run.
+var errLocked = errors.New("locked by another run")
+
+// lockWorkDir prevents concurrent runs from using the working directory
+// dir and returns a function that releases the lock. The lock file is
+// held beside dir so that it is unaffected by preparation and removal
+// of the working directory.
+func lockWorkDir(dir string) (unlock func() error, err error) {
+	err = os.MkdirAll(filepath.Dir(dir), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err = lockFile(dir + ".lock")
+	if err == errLocked {
+		return nil, fmt.Errorf("working directory %s is in use: %w (remove %s.lock if no other run is active)", dir, err, dir)
+	}
+	return unlock, err
+}
+
+// recoverPath returns the path of the recovery database named by recover.
+// Bare database names are resolved in the working directory, dir.
+func recoverPath(recover, dir string) string {
+	if recover == "" || filepath.Base(recover) != recover {
+		return recover
+	}
+	return filepath.Join(dir, recover)
+}
+
+// prepareWorkDir creates the working directory dir. If recover is a database
+// in dir, the existing working files are retained except for the databases
+// made stale by the recovery, and a culled reverse.db is replaced by the
+// unculled copy if it exists. Otherwise any existing contents of dir are
+// removed.
+func prepareWorkDir(dir, recover string) error {
+	if recover == "" || filepath.Clean(filepath.Dir(recover)) != filepath.Clean(dir) {
+		_, err := os.Stat(dir)
+		if err == nil {
+			log.Printf("removing stale working directory %s", dir)
+			err = os.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+		}
+		return os.MkdirAll(dir, 0o755)
+	}
+
+	log.Printf("reusing working directory %s", dir)
+	for _, name := range laterDBs[filepath.Base(recover)] {
+		err := removeIfExists(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	for _, sub := range passDirs {
+		err := os.RemoveAll(filepath.Join(dir, sub))
+		if err != nil {
+			return err
+		}
+	}
+	if filepath.Base(recover) != "reverse.db" {
+		return nil
+	}
+	unculled := filepath.Join(dir, "reverse-unculled.db")
+	_, err := os.Stat(unculled)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	log.Printf("restoring %s from %s", recover, unculled)
+	return copyFile(recover, unculled)
+}
+
+// removeIfExists removes the file at path if it exists.
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(dst, src string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, s)
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// cleanWorkDir removes working files from dir according to the keep policy
+// and returns the paths of retained files relative to dir.
+func cleanWorkDir(dir, keep string) ([]string, error) {
+	if keep == keepNone {
+		return nil, os.RemoveAll(dir)
+	}
+	var retained []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		saved := filepath.Base(filepath.Dir(path)) == savedDir
+		if keep == keepDBs && filepath.Ext(path) != ".db" && !indexFiles[filepath.Base(path)] && !saved {
+			return os.Remove(path)
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		retained = append(retained, rel)
+		return nil
+	})
+	return retained, err
+}
@@ -0,0 +1,516 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The libstat program reports summary statistics of repeat libraries to
+// help curate them before an ins run. For each library given with -lib it
+// reports the number of families and bases in each class, the distribution
+// of family lengths, GC content, duplicated sequence identifiers and
+// families with identical sequences.
+//
+// If another library is given with -other, the overlap of each library
+// with it is reported as the number of shared identifiers, the number of
+// families with a sequence identical to an other library family on either
+// strand, and the number of families whose k-mers are contained in the
+// other library at or above the -containment fraction.
+//
+// The class of a family is the first word after the sequence identifier in
+// the library fasta header, or Unknown if there is none.
+//
+// usage: libstat -lib library.fa [-lib library.fa ...] [-other other.fa]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// unknownClass is the class of families without a class in the library.
+const unknownClass = "Unknown"
+
+// sliceValue is a multi-value flag value.
+type sliceValue []string
+
+// Set adds the string to the sliceValue.
+func (s *sliceValue) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// String satisfies the flag.Value interface.
+func (s *sliceValue) String() string {
+	return fmt.Sprintf("%q", []string(*s))
+}
+
+func main() {
+	var libs sliceValue
+	flag.Var(&libs, "lib", "specify the libraries to report (required - may be present more than once)")
+	other := flag.String("other", "", "specify a library to report the overlap of each library with")
+	k := flag.Int("k", 15, "specify the k-mer length used to measure containment in the other library")
+	containment := flag.Float64("containment", 0.8, "specify the fraction of a family's k-mers found in the other library for it to be reported as contained")
+	jsonOut := flag.Bool("json", false, "specify json format for the report")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage of %[1]s:
+  $ %[1]s [options] -lib <library.fa> [-lib <library.fa> ...]
+
+Options:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(libs) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *k < 1 || *k > 32 {
+		log.Fatalf("invalid k-mer length: %d", *k)
+	}
+	if *containment <= 0 || *containment > 1 {
+		log.Fatalf("invalid containment fraction: %v", *containment)
+	}
+
+	var ref *index
+	if *other != "" {
+		seqs, err := readLibrary(*other)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ref = newIndex(*other, seqs, *k)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	for _, path := range libs {
+		seqs, err := readLibrary(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := newStats(path, seqs)
+		if ref != nil {
+			s.Overlap = ref.overlap(seqs, *containment)
+		}
+		if *jsonOut {
+			err = enc.Encode(s)
+		} else {
+			err = s.writeText(w)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// family is a library sequence.
+type family struct {
+	name  string
+	class string
+	seq   []byte
+}
+
+// readLibrary returns the sequences in the library fasta file at path in
+// file order. Sequence letters are upper-cased.
+func readLibrary(path string) ([]family, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var seqs []family
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, bufio.MaxScanTokenSize<<8)
+	for line := 1; sc.Scan(); line++ {
+		b := bytes.TrimSpace(sc.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		if b[0] != '>' {
+			if len(seqs) == 0 {
+				return nil, fmt.Errorf("%s: sequence before header at line %d", path, line)
+			}
+			seqs[len(seqs)-1].seq = append(seqs[len(seqs)-1].seq, bytes.ToUpper(b)...)
+			continue
+		}
+		fields := strings.Fields(string(b[1:]))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%s: missing sequence identifier at line %d", path, line)
+		}
+		fam := family{name: fields[0], class: unknownClass}
+		if len(fields) > 1 {
+			fam.class = fields[1]
+		}
+		seqs = append(seqs, fam)
+	}
+	return seqs, sc.Err()
+}
+
+// stats is the summary of a library.
+type stats struct {
+	Library   string  `json:"library"`
+	Families  int     `json:"families"`
+	Bases     int64   `json:"bases"`
+	Ambiguous int64   `json:"ambiguous"`
+	Empty     int     `json:"empty"`
+	PercentGC float64 `json:"percent_gc"`
+
+	Lengths lengthStats  `json:"lengths"`
+	Classes []classStats `json:"classes"`
+
+	// DuplicateIDs holds the identifiers
+	// that are used more than once and
+	// IdenticalSequences holds groups of
+	// identifiers of families that have
+	// the same sequence on either strand.
+	DuplicateIDs       []duplicate `json:"duplicate_ids,omitempty"`
+	IdenticalSequences [][]string  `json:"identical_sequences,omitempty"`
+
+	Overlap *overlap `json:"overlap,omitempty"`
+}
+
+// lengthStats is the distribution of family lengths.
+type lengthStats struct {
+	Min    int `json:"min"`
+	Q1     int `json:"q1"`
+	Median int `json:"median"`
+	Q3     int `json:"q3"`
+	Max    int `json:"max"`
+	N50    int `json:"n50"`
+
+	// Bins holds the number of families
+	// in each of lengthBins.
+	Bins []int `json:"bins"`
+}
+
+// lengthBins are the lower bounds of the family length histogram bins.
+var lengthBins = []int{0, 100, 500, 1000, 5000, 10000}
+
+// classStats is the summary of the families of a class.
+type classStats struct {
+	Class      string  `json:"class"`
+	Families   int     `json:"families"`
+	Bases      int64   `json:"bases"`
+	MeanLength float64 `json:"mean_length"`
+	PercentGC  float64 `json:"percent_gc"`
+}
+
+// duplicate is an identifier used more than once.
+type duplicate struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// overlap is the overlap of a library with another library.
+type overlap struct {
+	Library   string `json:"library"`
+	SharedIDs int    `json:"shared_ids"`
+	Identical int    `json:"identical"`
+	Contained int    `json:"contained"`
+	K         int    `json:"k"`
+
+	Containment float64 `json:"containment"`
+}
+
+// newStats returns the summary of the library seqs read from path.
+func newStats(path string, seqs []family) stats {
+	s := stats{Library: path, Families: len(seqs)}
+
+	type counts struct {
+		families int
+		bases    int64
+		gc, atgc int64
+	}
+	classes := make(map[string]*counts)
+	var gc, atgc int64
+	lengths := make([]int, 0, len(seqs))
+	ids := make(map[string]int)
+	var names []string
+	bySeq := make(map[[sha256.Size]byte][]string)
+	var digests [][sha256.Size]byte
+	for _, f := range seqs {
+		if ids[f.name] == 0 {
+			names = append(names, f.name)
+		}
+		ids[f.name]++
+
+		c, ok := classes[f.class]
+		if !ok {
+			c = &counts{}
+			classes[f.class] = c
+		}
+		c.families++
+		c.bases += int64(len(f.seq))
+		s.Bases += int64(len(f.seq))
+		lengths = append(lengths, len(f.seq))
+		if len(f.seq) == 0 {
+			s.Empty++
+			continue
+		}
+		for _, b := range f.seq {
+			switch b {
+			case 'G', 'C':
+				c.gc++
+				c.atgc++
+			case 'A', 'T':
+				c.atgc++
+			default:
+				s.Ambiguous++
+			}
+		}
+
+		d := canonicalDigest(f.seq)
+		if _, ok := bySeq[d]; !ok {
+			digests = append(digests, d)
+		}
+		bySeq[d] = append(bySeq[d], f.name)
+	}
+	for _, c := range classes {
+		gc += c.gc
+		atgc += c.atgc
+	}
+	s.PercentGC = percent(gc, atgc)
+	s.Lengths = newLengthStats(lengths)
+
+	for class, c := range classes {
+		s.Classes = append(s.Classes, classStats{
+			Class:      class,
+			Families:   c.families,
+			Bases:      c.bases,
+			MeanLength: float64(c.bases) / float64(c.families),
+			PercentGC:  percent(c.gc, c.atgc),
+		})
+	}
+	sort.Slice(s.Classes, func(i, j int) bool {
+		if s.Classes[i].Bases != s.Classes[j].Bases {
+			return s.Classes[i].Bases > s.Classes[j].Bases
+		}
+		return s.Classes[i].Class < s.Classes[j].Class
+	})
+
+	for _, n := range names {
+		if ids[n] > 1 {
+			s.DuplicateIDs = append(s.DuplicateIDs, duplicate{Name: n, Count: ids[n]})
+		}
+	}
+	for _, d := range digests {
+		if len(bySeq[d]) > 1 {
+			s.IdenticalSequences = append(s.IdenticalSequences, bySeq[d])
+		}
+	}
+	return s
+}
+
+// newLengthStats returns the distribution of the given lengths.
+func newLengthStats(lengths []int) lengthStats {
+	l := lengthStats{Bins: make([]int, len(lengthBins))}
+	if len(lengths) == 0 {
+		return l
+	}
+	sort.Ints(lengths)
+	quantile := func(q float64) int {
+		return lengths[int(q*float64(len(lengths)-1)+0.5)]
+	}
+	l.Min = lengths[0]
+	l.Q1 = quantile(0.25)
+	l.Median = quantile(0.5)
+	l.Q3 = quantile(0.75)
+	l.Max = lengths[len(lengths)-1]
+
+	var total, sum int64
+	for _, n := range lengths {
+		total += int64(n)
+	}
+	for i := len(lengths) - 1; i >= 0; i-- {
+		sum += int64(lengths[i])
+		if 2*sum >= total {
+			l.N50 = lengths[i]
+			break
+		}
+	}
+	for _, n := range lengths {
+		i := sort.Search(len(lengthBins), func(i int) bool { return lengthBins[i] > n }) - 1
+		l.Bins[i]++
+	}
+	return l
+}
+
+// percent returns n as a percentage of d, or zero if d is zero.
+func percent(n, d int64) float64 {
+	if d == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(d)
+}
+
+// canonicalDigest returns the digest of the lesser of seq and its reverse
+// complement so that identical sequences on either strand have the same
+// digest.
+func canonicalDigest(seq []byte) [sha256.Size]byte {
+	rc := revComp(seq)
+	if bytes.Compare(rc, seq) < 0 {
+		return sha256.Sum256(rc)
+	}
+	return sha256.Sum256(seq)
+}
+
+// revComp returns the reverse complement of the upper case sequence seq.
+func revComp(seq []byte) []byte {
+	rc := make([]byte, len(seq))
+	for i, b := range seq {
+		switch b {
+		case 'A':
+			b = 'T'
+		case 'C':
+			b = 'G'
+		case 'G':
+			b = 'C'
+		case 'T':
+			b = 'A'
+		}
+		rc[len(seq)-1-i] = b
+	}
+	return rc
+}
+
+// index is the k-mer and sequence index of a library used to measure the
+// overlap of other libraries with it.
+type index struct {
+	path    string
+	k       int
+	names   map[string]bool
+	digests map[[sha256.Size]byte]bool
+	kmers   map[uint64]bool
+}
+
+// newIndex returns the index of the library seqs read from path using
+// k-mers of length k.
+func newIndex(path string, seqs []family, k int) *index {
+	idx := &index{
+		path:    path,
+		k:       k,
+		names:   make(map[string]bool),
+		digests: make(map[[sha256.Size]byte]bool),
+		kmers:   make(map[uint64]bool),
+	}
+	for _, f := range seqs {
+		idx.names[f.name] = true
+		idx.digests[canonicalDigest(f.seq)] = true
+		eachKmer(f.seq, k, func(h uint64) { idx.kmers[h] = true })
+	}
+	return idx
+}
+
+// overlap returns the overlap of the library seqs with the indexed library.
+// Families are contained if at least the given fraction of their k-mers
+// are in the indexed library.
+func (idx *index) overlap(seqs []family, containment float64) *overlap {
+	o := &overlap{Library: idx.path, K: idx.k, Containment: containment}
+	for _, f := range seqs {
+		if idx.names[f.name] {
+			o.SharedIDs++
+		}
+		if len(f.seq) == 0 {
+			continue
+		}
+		if idx.digests[canonicalDigest(f.seq)] {
+			o.Identical++
+		}
+		var n, found int
+		eachKmer(f.seq, idx.k, func(h uint64) {
+			n++
+			if idx.kmers[h] {
+				found++
+			}
+		})
+		if n != 0 && float64(found) >= containment*float64(n) {
+			o.Contained++
+		}
+	}
+	return o
+}
+
+// eachKmer calls fn with the canonical two-bit encoding of each k-mer of seq
+// that has no ambiguous bases.
+func eachKmer(seq []byte, k int, fn func(uint64)) {
+	mask := uint64(1)<<(2*uint(k)) - 1
+	shift := 2 * uint(k-1)
+	var fwd, rev uint64
+	var valid int
+	for _, b := range seq {
+		var c uint64
+		switch b {
+		case 'A':
+			c = 0
+		case 'C':
+			c = 1
+		case 'G':
+			c = 2
+		case 'T':
+			c = 3
+		default:
+			valid = 0
+			continue
+		}
+		fwd = (fwd<<2 | c) & mask
+		rev = rev>>2 | (3-c)<<shift
+		valid++
+		if valid < k {
+			continue
+		}
+		if rev < fwd {
+			fn(rev)
+		} else {
+			fn(fwd)
+		}
+	}
+}
+
+// writeText writes the summary to w as text.
+func (s stats) writeText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "library:\t%s\n", s.Library)
+	fmt.Fprintf(bw, "families:\t%d\n", s.Families)
+	fmt.Fprintf(bw, "bases:\t%d\n", s.Bases)
+	fmt.Fprintf(bw, "ambiguous bases:\t%d\n", s.Ambiguous)
+	fmt.Fprintf(bw, "empty sequences:\t%d\n", s.Empty)
+	fmt.Fprintf(bw, "GC:\t%.2f%%\n", s.PercentGC)
+	l := s.Lengths
+	fmt.Fprintf(bw, "length:\tmin %d\tq1 %d\tmedian %d\tq3 %d\tmax %d\tN50 %d\n", l.Min, l.Q1, l.Median, l.Q3, l.Max, l.N50)
+	for i, n := range l.Bins {
+		if i < len(lengthBins)-1 {
+			fmt.Fprintf(bw, "\t%d-%d:\t%d\n", lengthBins[i], lengthBins[i+1]-1, n)
+		} else {
+			fmt.Fprintf(bw, "\t>=%d:\t%d\n", lengthBins[i], n)
+		}
+	}
+	fmt.Fprintln(bw, "class\tfamilies\tbases\tmean length\tGC%")
+	for _, c := range s.Classes {
+		fmt.Fprintf(bw, "%s\t%d\t%d\t%.1f\t%.2f\n", c.Class, c.Families, c.Bases, c.MeanLength, c.PercentGC)
+	}
+	for _, d := range s.DuplicateIDs {
+		fmt.Fprintf(bw, "duplicate identifier:\t%s\t%d\n", d.Name, d.Count)
+	}
+	for _, g := range s.IdenticalSequences {
+		fmt.Fprintf(bw, "identical sequences:\t%s\n", strings.Join(g, " "))
+	}
+	if o := s.Overlap; o != nil {
+		fmt.Fprintf(bw, "overlap with:\t%s\n", o.Library)
+		fmt.Fprintf(bw, "\tshared identifiers:\t%d\n", o.SharedIDs)
+		fmt.Fprintf(bw, "\tidentical sequences:\t%d\n", o.Identical)
+		fmt.Fprintf(bw, "\tcontained (k=%d, >=%.2f):\t%d\n", o.K, o.Containment, o.Contained)
+	}
+	fmt.Fprintln(bw)
+	return bw.Flush()
+}
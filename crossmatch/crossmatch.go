@@ -0,0 +1,189 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package crossmatch provides types and functions for invoking the
+// phrap cross_match aligner and interpreting the returned results.
+package crossmatch
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+
+	"github.com/biogo/external"
+
+	"github.com/kortschak/ins/blast"
+)
+
+type CrossMatch struct {
+	// Usage: cross_match query-file subject-file [options]
+	//
+	// For details relating to options and parameters, see the phrap
+	// documentation.
+	//
+	Cmd string `buildarg:"{{if .}}{{.}}{{else}}cross_match{{end}}"` // cross_match
+
+	Query   string `buildarg:"{{.}}"` // query-file
+	Subject string `buildarg:"{{.}}"` // subject-file
+
+	GapInit    int    `buildarg:"{{if .}}-gap_init{{split}}{{.}}{{end}}"`    // -gap_init <n>
+	InsGapExt  int    `buildarg:"{{if .}}-ins_gap_ext{{split}}{{.}}{{end}}"` // -ins_gap_ext <n>
+	DelGapExt  int    `buildarg:"{{if .}}-del_gap_ext{{split}}{{.}}{{end}}"` // -del_gap_ext <n>
+	MinMatch   int    `buildarg:"{{if .}}-minmatch{{split}}{{.}}{{end}}"`    // -minmatch <n>
+	MinScore   int    `buildarg:"{{if .}}-minscore{{split}}{{.}}{{end}}"`    // -minscore <n>
+	Bandwidth  int    `buildarg:"{{if .}}-bandwidth{{split}}{{.}}{{end}}"`   // -bandwidth <n>
+	MaskLevel  int    `buildarg:"{{if .}}-masklevel{{split}}{{.}}{{end}}"`   // -masklevel <n>
+	Matrix     string `buildarg:"{{with .}}-matrix{{split}}{{.}}{{end}}"`    // -matrix <s>
+	Alignments bool   `buildarg:"{{if .}}-alignments{{end}}"`                // -alignments
+	Tags       bool   `buildarg:"{{if .}}-tags{{end}}"`                      // -tags
+
+	// ExtraArgs will be passed through to cross_match as
+	// arguments without splitting.
+	ExtraArgs []string
+}
+
+func (c CrossMatch) BuildCommand() (*exec.Cmd, error) {
+	if c.Query == "" {
+		return nil, errors.New("cross_match: missing query filename")
+	}
+	if c.Subject == "" {
+		return nil, errors.New("cross_match: missing subject filename")
+	}
+	cl := external.Must(external.Build(c))
+	return exec.Command(cl[0], append(cl[1:], c.ExtraArgs...)...), nil
+}
+
+// ParseOutput returns the alignments in the cross_match output in r as
+// BLAST records. The cross_match query is taken to be the genome and the
+// subject to be the repeat library, so the returned records have the
+// library sequence as the BLAST query and the genome sequence as the BLAST
+// subject with the convention used by blast.ParseTabular for minus strand
+// alignments. Only alignment summary lines, with or without the ALIGNMENT
+// tag, are read. The Smith-Waterman score is given as the bit score, and
+// percent identity and mismatches are estimated from the substitution
+// rate.
+func ParseOutput(r io.Reader) ([]blast.Record, error) {
+	var recs []blast.Record
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		f := bytes.Fields(sc.Bytes())
+		if len(f) != 0 && string(f[0]) == "ALIGNMENT" {
+			f = f[1:]
+		}
+		if !isSummary(f) {
+			continue
+		}
+		rec, err := parseSummary(f)
+		if err != nil {
+			return recs, fmt.Errorf("line %d: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// isSummary returns whether the fields in f are an alignment summary
+// line. Summary lines start with an integer score and have 12 fields,
+// or 13 fields for complement alignments, optionally followed by a
+// marker.
+func isSummary(f [][]byte) bool {
+	if len(f) < 12 {
+		return false
+	}
+	if _, err := strconv.Atoi(string(f[0])); err != nil {
+		return false
+	}
+	if !bytes.HasPrefix(f[7], []byte("(")) {
+		return false
+	}
+	if string(f[8]) == "C" {
+		return len(f) >= 13 && bytes.HasPrefix(f[10], []byte("("))
+	}
+	return bytes.HasPrefix(f[11], []byte("("))
+}
+
+// parseSummary returns the BLAST record for the alignment summary fields
+// in f.
+func parseSummary(f [][]byte) (blast.Record, error) {
+	// column indices for alignment summary lines.
+	const (
+		Score = iota
+		PctSubs
+		PctDel
+		PctIns
+		QueryName
+		QueryStart
+		QueryEnd
+		QueryLeft
+		Complement
+	)
+
+	var r blast.Record
+	score, err := strconv.Atoi(string(f[Score]))
+	if err != nil {
+		return r, err
+	}
+	subs, err := strconv.ParseFloat(string(f[PctSubs]), 64)
+	if err != nil {
+		return r, err
+	}
+	qs, err := strconv.Atoi(string(f[QueryStart]))
+	if err != nil {
+		return r, err
+	}
+	qe, err := strconv.Atoi(string(f[QueryEnd]))
+	if err != nil {
+		return r, err
+	}
+
+	// Subject fields are "name start end (left)" for forward
+	// alignments and "C name (left) start end" for complement
+	// alignments, where start is the subject position aligned
+	// with the query start.
+	subj := f[Complement:]
+	complement := string(subj[0]) == "C"
+	var ss, se int
+	if complement {
+		subj = subj[1:]
+		ss, err = strconv.Atoi(string(subj[2]))
+		if err == nil {
+			se, err = strconv.Atoi(string(subj[3]))
+		}
+	} else {
+		ss, err = strconv.Atoi(string(subj[1]))
+		if err == nil {
+			se, err = strconv.Atoi(string(subj[2]))
+		}
+	}
+	if err != nil {
+		return r, err
+	}
+
+	length := qe - qs + 1
+	r = blast.Record{
+		QueryAccVer:     string(subj[0]),
+		SubjectAccVer:   string(f[QueryName]),
+		PctIdentity:     100 - subs,
+		AlignmentLength: length,
+		Mismatches:      int(math.Round(subs * float64(length) / 100)),
+		BitScore:        float64(score),
+		Strand:          1,
+	}
+	if complement {
+		// The library sequence is reversed, so
+		// the genome is reported as reversed.
+		r.QueryStart, r.QueryEnd = se-1, ss
+		r.SubjectStart, r.SubjectEnd = qe-1, qs
+		r.Strand = -1
+	} else {
+		r.QueryStart, r.QueryEnd = ss-1, se
+		r.SubjectStart, r.SubjectEnd = qs-1, qe
+	}
+	return r, nil
+}
@@ -8,7 +8,7 @@ require (
 	github.com/biogo/hts v1.2.1
 	github.com/biogo/store v0.0.0-20200525035639-8c94ae1e7c9c
 	github.com/edsrzf/mmap-go v1.0.0 // indirect
-	github.com/golang/snappy v0.0.2 // indirect
+	github.com/golang/snappy v0.0.2
 	gonum.org/v1/gonum v0.8.1
 	modernc.org/fileutil v1.0.0 // indirect
 	modernc.org/internal v1.0.0 // indirect
@@ -0,0 +1,203 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package classify provides normalization of repeat classification names
+// between the Dfam (RepeatMasker), RepBase and Wicker classification
+// vocabularies.
+package classify
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Classification schemes.
+const (
+	Dfam    = "dfam"    // Dfam and RepeatMasker class/family names, e.g. LINE/L1.
+	RepBase = "repbase" // RepBase superfamily names, e.g. L1.
+	Wicker  = "wicker"  // Wicker et al. 2007 class/order/superfamily names, e.g. ClassI/LINE/L1.
+)
+
+// Schemes returns the names of the built-in classification schemes.
+func Schemes() []string {
+	return []string{Dfam, RepBase, Wicker}
+}
+
+// entry is a classification in each scheme with alternative names that
+// are recognized when normalizing. A scheme name is empty if the scheme
+// does not classify the repeat, in which case the Dfam name is used.
+type entry struct {
+	dfam, repbase, wicker string
+	aliases               []string
+}
+
+// table is the built-in classification correspondence table.
+var table = []entry{
+	// Class I: LTR retrotransposons.
+	{dfam: "LTR", repbase: "LTR", wicker: "ClassI/LTR"},
+	{dfam: "LTR/Copia", repbase: "Copia", wicker: "ClassI/LTR/Copia", aliases: []string{"RLC"}},
+	{dfam: "LTR/Gypsy", repbase: "Gypsy", wicker: "ClassI/LTR/Gypsy", aliases: []string{"RLG", "LTR/Ty3"}},
+	{dfam: "LTR/Pao", repbase: "BEL", wicker: "ClassI/LTR/Bel-Pao", aliases: []string{"RLB", "LTR/Bel-Pao"}},
+	{dfam: "LTR/ERV", repbase: "ERV", wicker: "ClassI/LTR/ERV", aliases: []string{"RLE", "RLR", "LTR/Retrovirus"}},
+	{dfam: "LTR/ERV1", repbase: "ERV1", wicker: "ClassI/LTR/ERV/ERV1"},
+	{dfam: "LTR/ERVK", repbase: "ERV2", wicker: "ClassI/LTR/ERV/ERVK"},
+	{dfam: "LTR/ERVL", repbase: "ERV3", wicker: "ClassI/LTR/ERV/ERVL"},
+	{dfam: "LTR/DIRS", repbase: "DIRS", wicker: "ClassI/DIRS/DIRS", aliases: []string{"RYD", "DIRS"}},
+	{dfam: "LTR/Ngaro", repbase: "Ngaro", wicker: "ClassI/DIRS/Ngaro", aliases: []string{"RYN"}},
+
+	// Class I: non-LTR retrotransposons.
+	{dfam: "LINE", repbase: "LINE", wicker: "ClassI/LINE", aliases: []string{"nonLTR"}},
+	{dfam: "LINE/L1", repbase: "L1", wicker: "ClassI/LINE/L1", aliases: []string{"RIL"}},
+	{dfam: "LINE/RTE", repbase: "RTE", wicker: "ClassI/LINE/RTE", aliases: []string{"RIT"}},
+	{dfam: "LINE/RTE-BovB", repbase: "RTE", wicker: "ClassI/LINE/RTE"},
+	{dfam: "LINE/Jockey", repbase: "Jockey", wicker: "ClassI/LINE/Jockey", aliases: []string{"RIJ"}},
+	{dfam: "LINE/R2", repbase: "R2", wicker: "ClassI/LINE/R2", aliases: []string{"RIR"}},
+	{dfam: "LINE/I", repbase: "I", wicker: "ClassI/LINE/I", aliases: []string{"RII"}},
+	{dfam: "LINE/CR1", repbase: "CR1", wicker: "ClassI/LINE/CR1"},
+	{dfam: "LINE/L2", repbase: "L2", wicker: "ClassI/LINE/L2"},
+	{dfam: "LINE/Penelope", repbase: "Penelope", wicker: "ClassI/PLE/Penelope", aliases: []string{"RPP", "PLE", "PLE/Penelope"}},
+	{dfam: "SINE", repbase: "SINE", wicker: "ClassI/SINE"},
+	{dfam: "SINE/tRNA", repbase: "SINE2/tRNA", wicker: "ClassI/SINE/tRNA", aliases: []string{"RST", "SINE2"}},
+	{dfam: "SINE/7SL", repbase: "SINE1/7SL", wicker: "ClassI/SINE/7SL", aliases: []string{"RSL", "SINE1"}},
+	{dfam: "SINE/Alu", repbase: "SINE1/7SL", wicker: "ClassI/SINE/7SL"},
+	{dfam: "SINE/5S", repbase: "SINE3/5S", wicker: "ClassI/SINE/5S", aliases: []string{"RSS", "SINE3"}},
+	{dfam: "SINE/MIR", repbase: "SINE2/tRNA", wicker: "ClassI/SINE/tRNA"},
+
+	// Class II: DNA transposons.
+	{dfam: "DNA", repbase: "DNA", wicker: "ClassII/TIR", aliases: []string{"TIR", "DNA/TIR"}},
+	{dfam: "DNA/TcMar", repbase: "Mariner/Tc1", wicker: "ClassII/TIR/Tc1-Mariner", aliases: []string{"DTT", "Mariner", "Tc1", "DNA/Tc1-Mariner"}},
+	{dfam: "DNA/TcMar-Tc1", repbase: "Mariner/Tc1", wicker: "ClassII/TIR/Tc1-Mariner"},
+	{dfam: "DNA/TcMar-Mariner", repbase: "Mariner/Tc1", wicker: "ClassII/TIR/Tc1-Mariner"},
+	{dfam: "DNA/hAT", repbase: "hAT", wicker: "ClassII/TIR/hAT", aliases: []string{"DTA"}},
+	{dfam: "DNA/hAT-Charlie", repbase: "hAT", wicker: "ClassII/TIR/hAT"},
+	{dfam: "DNA/hAT-Tip100", repbase: "hAT", wicker: "ClassII/TIR/hAT"},
+	{dfam: "DNA/MULE-MuDR", repbase: "MuDR", wicker: "ClassII/TIR/Mutator", aliases: []string{"DTM", "Mutator", "DNA/MuDR"}},
+	{dfam: "DNA/Merlin", repbase: "Merlin", wicker: "ClassII/TIR/Merlin", aliases: []string{"DTE"}},
+	{dfam: "DNA/Transib", repbase: "Transib", wicker: "ClassII/TIR/Transib", aliases: []string{"DTR"}},
+	{dfam: "DNA/P", repbase: "P", wicker: "ClassII/TIR/P", aliases: []string{"DTP"}},
+	{dfam: "DNA/PiggyBac", repbase: "piggyBac", wicker: "ClassII/TIR/PiggyBac", aliases: []string{"DTB"}},
+	{dfam: "DNA/PIF-Harbinger", repbase: "Harbinger", wicker: "ClassII/TIR/PIF-Harbinger", aliases: []string{"DTH", "DNA/Harbinger"}},
+	{dfam: "DNA/CMC-EnSpm", repbase: "EnSpm/CACTA", wicker: "ClassII/TIR/CACTA", aliases: []string{"DTC", "CACTA", "EnSpm", "DNA/CACTA", "DNA/EnSpm"}},
+	{dfam: "DNA/Crypton", repbase: "Crypton", wicker: "ClassII/Crypton/Crypton", aliases: []string{"DYC"}},
+	{dfam: "RC/Helitron", repbase: "Helitron", wicker: "ClassII/Helitron/Helitron", aliases: []string{"DHH", "DNA/Helitron", "RC"}},
+	{dfam: "DNA/Maverick", repbase: "Polinton", wicker: "ClassII/Maverick/Maverick", aliases: []string{"DMM", "Maverick"}},
+
+	// Other repeats are not classified by
+	// Wicker and keep their Dfam names.
+	{dfam: "Satellite", repbase: "SAT", aliases: []string{"Satellite/centr"}},
+	{dfam: "Simple_repeat", repbase: "Simple"},
+	{dfam: "Low_complexity", repbase: "Low_complexity"},
+	{dfam: "rRNA", repbase: "rRNA"},
+	{dfam: "tRNA", repbase: "tRNA"},
+	{dfam: "snRNA", repbase: "snRNA"},
+	{dfam: "Unknown", repbase: "Unknown", aliases: []string{"Unclassified", "Unspecified"}},
+}
+
+// Normalizer maps classification names to a classification scheme. A nil
+// Normalizer returns names unaltered.
+type Normalizer struct {
+	to map[string]string
+}
+
+// New returns a Normalizer that maps names from any of the built-in
+// schemes to the named scheme. If scheme is empty, no name is mapped
+// until a user mapping is read.
+func New(scheme string) (*Normalizer, error) {
+	n := &Normalizer{to: make(map[string]string)}
+	if scheme == "" {
+		return n, nil
+	}
+	var target func(entry) string
+	switch strings.ToLower(scheme) {
+	case Dfam:
+		target = func(e entry) string { return e.dfam }
+	case RepBase:
+		target = func(e entry) string { return e.repbase }
+	case Wicker:
+		target = func(e entry) string { return e.wicker }
+	default:
+		return nil, fmt.Errorf("classify: unknown classification scheme: %q", scheme)
+	}
+	// Entries earlier in the table take
+	// precedence for names that are shared
+	// between entries, so that more general
+	// names are not overridden by entries
+	// mapping specific names.
+	for _, e := range table {
+		to := target(e)
+		if to == "" {
+			to = e.dfam
+		}
+		for _, name := range append([]string{e.dfam, e.repbase, e.wicker}, e.aliases...) {
+			if name == "" {
+				continue
+			}
+			key := strings.ToLower(name)
+			if _, ok := n.to[key]; !ok || strings.EqualFold(name, e.dfam) {
+				n.to[key] = to
+			}
+		}
+	}
+	return n, nil
+}
+
+// ReadTSV reads user mappings from r, overriding built-in mappings. Each
+// line holds a source name and the name it is mapped to separated by a
+// tab. Blank lines and lines starting with # are ignored.
+func (n *Normalizer) ReadTSV(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 2 || fields[0] == "" || strings.TrimSpace(fields[1]) == "" {
+			return fmt.Errorf("classify: invalid mapping at line %d: want source<TAB>target", line)
+		}
+		n.to[strings.ToLower(strings.TrimSpace(fields[0]))] = strings.TrimSpace(fields[1])
+	}
+	return sc.Err()
+}
+
+// ReadFile reads user mappings from the TSV file at path. See ReadTSV.
+func (n *Normalizer) ReadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = n.ReadTSV(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Class returns the normalized name of the classification class. Names
+// are matched without regard to case and with RepeatMasker uncertainty
+// marks removed. If class does not have a mapping, the longest leading
+// part of its slash-separated hierarchy that has a mapping is mapped and
+// the remaining levels are retained. Classes without any mapping are
+// returned unaltered.
+func (n *Normalizer) Class(class string) string {
+	if n == nil || len(n.to) == 0 || class == "" {
+		return class
+	}
+	name := strings.TrimRight(class, "?")
+	if to, ok := n.to[strings.ToLower(name)]; ok {
+		return to
+	}
+	levels := strings.Split(name, "/")
+	for i := len(levels) - 1; i > 0; i-- {
+		to, ok := n.to[strings.ToLower(strings.Join(levels[:i], "/"))]
+		if ok {
+			return to + "/" + strings.Join(levels[i:], "/")
+		}
+	}
+	return class
+}
@@ -0,0 +1,186 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package classify
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var classTests = []struct {
+	scheme string
+	class  string
+	want   string
+}{
+	// Exact names, without regard to case.
+	{scheme: RepBase, class: "LINE/L1", want: "L1"},
+	{scheme: RepBase, class: "line/l1", want: "L1"},
+	{scheme: Wicker, class: "LINE/L1", want: "ClassI/LINE/L1"},
+	{scheme: Dfam, class: "L1", want: "LINE/L1"},
+	{scheme: Dfam, class: "ClassII/TIR/hAT", want: "DNA/hAT"},
+	{scheme: Dfam, class: "LINE/L1", want: "LINE/L1"},
+	{scheme: RepBase, class: "DNA/PiggyBac", want: "piggyBac"},
+
+	// Alias names.
+	{scheme: Dfam, class: "RLC", want: "LTR/Copia"},
+	{scheme: Wicker, class: "LTR/Ty3", want: "ClassI/LTR/Gypsy"},
+	{scheme: RepBase, class: "nonLTR", want: "LINE"},
+	{scheme: Dfam, class: "DIRS", want: "LTR/DIRS"},
+	{scheme: Dfam, class: "Unclassified", want: "Unknown"},
+	{scheme: RepBase, class: "DNA/Harbinger", want: "Harbinger"},
+
+	// Many-to-one rows map to the shared name,
+	// and the shared name maps back to the
+	// first row holding it.
+	{scheme: RepBase, class: "SINE/MIR", want: "SINE2/tRNA"},
+	{scheme: RepBase, class: "SINE/tRNA", want: "SINE2/tRNA"},
+	{scheme: Wicker, class: "SINE/MIR", want: "ClassI/SINE/tRNA"},
+	{scheme: Dfam, class: "SINE2/tRNA", want: "SINE/tRNA"},
+	{scheme: RepBase, class: "SINE/Alu", want: "SINE1/7SL"},
+	{scheme: Dfam, class: "ClassI/SINE/7SL", want: "SINE/7SL"},
+	{scheme: Dfam, class: "RTE", want: "LINE/RTE"},
+	{scheme: RepBase, class: "DNA/TcMar-Tc1", want: "Mariner/Tc1"},
+	{scheme: Dfam, class: "Mariner/Tc1", want: "DNA/TcMar"},
+
+	// Repeats not classified by Wicker keep
+	// their Dfam names.
+	{scheme: Wicker, class: "SAT", want: "Satellite"},
+	{scheme: Wicker, class: "Simple_repeat", want: "Simple_repeat"},
+
+	// RepeatMasker uncertainty marks.
+	{scheme: RepBase, class: "LINE/L1?", want: "L1"},
+	{scheme: Wicker, class: "DNA?", want: "ClassII/TIR"},
+	{scheme: Dfam, class: "RLG?", want: "LTR/Gypsy"},
+
+	// Hierarchy prefix fallback.
+	{scheme: RepBase, class: "LINE/L1/Foo", want: "L1/Foo"},
+	{scheme: Wicker, class: "LINE/L1/Foo/Bar", want: "ClassI/LINE/L1/Foo/Bar"},
+	{scheme: RepBase, class: "LINE/Tad1", want: "LINE/Tad1"},
+	{scheme: Wicker, class: "LINE/Tad1?", want: "ClassI/LINE/Tad1"},
+	{scheme: Dfam, class: "ClassI/LTR/Copia/SIRE", want: "LTR/Copia/SIRE"},
+
+	// Unknown names are unaltered.
+	{scheme: RepBase, class: "Foo/Bar", want: "Foo/Bar"},
+	{scheme: RepBase, class: "Foo?", want: "Foo?"},
+	{scheme: RepBase, class: "", want: ""},
+}
+
+func TestClass(t *testing.T) {
+	for _, test := range classTests {
+		n, err := New(test.scheme)
+		if err != nil {
+			t.Fatalf("unexpected error creating %s normalizer: %v", test.scheme, err)
+		}
+		got := n.Class(test.class)
+		if got != test.want {
+			t.Errorf("unexpected %s class for %q: got:%q want:%q", test.scheme, test.class, got, test.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, scheme := range Schemes() {
+		_, err := New(strings.ToUpper(scheme))
+		if err != nil {
+			t.Errorf("unexpected error for scheme %q: %v", scheme, err)
+		}
+	}
+	_, err := New("ncbi")
+	if err == nil {
+		t.Error("expected error for unknown scheme")
+	}
+
+	var nilNorm *Normalizer
+	if got := nilNorm.Class("LINE/L1"); got != "LINE/L1" {
+		t.Errorf("unexpected class from nil normalizer: got:%q want:%q", got, "LINE/L1")
+	}
+	n, err := New("")
+	if err != nil {
+		t.Fatalf("unexpected error for empty scheme: %v", err)
+	}
+	if got := n.Class("LINE/L1"); got != "LINE/L1" {
+		t.Errorf("unexpected class from empty normalizer: got:%q want:%q", got, "LINE/L1")
+	}
+}
+
+var readTSVTests = []struct {
+	scheme  string
+	mapping string
+	classes map[string]string
+}{
+	{
+		scheme: RepBase,
+		mapping: `# Local family names.
+LINE/L1	MyL1
+
+Tad1	LINE/Tad1
+  SINE/MIR	 MIR
+`,
+		classes: map[string]string{
+			"LINE/L1":     "MyL1",
+			"line/l1?":    "MyL1",
+			"LINE/L1/Foo": "MyL1/Foo",
+			"tad1":        "LINE/Tad1",
+			"SINE/MIR":    "MIR",
+			"SINE/tRNA":   "SINE2/tRNA",
+		},
+	},
+	{
+		scheme:  "",
+		mapping: "Tad1\tLINE/Tad1\n",
+		classes: map[string]string{
+			"Tad1":    "LINE/Tad1",
+			"LINE/L1": "LINE/L1",
+		},
+	},
+}
+
+func TestReadTSV(t *testing.T) {
+	for _, test := range readTSVTests {
+		n, err := New(test.scheme)
+		if err != nil {
+			t.Fatalf("unexpected error creating %s normalizer: %v", test.scheme, err)
+		}
+		err = n.ReadTSV(strings.NewReader(test.mapping))
+		if err != nil {
+			t.Fatalf("unexpected error reading mapping: %v", err)
+		}
+		for class, want := range test.classes {
+			got := n.Class(class)
+			if got != want {
+				t.Errorf("unexpected %s class for %q: got:%q want:%q", test.scheme, class, got, want)
+			}
+		}
+	}
+}
+
+var readTSVErrorTests = []struct {
+	mapping string
+	line    int
+}{
+	{mapping: "LINE/L1 L1\n", line: 1},
+	{mapping: "# comment\n\nLINE/L1\tL1\tClassI/LINE/L1\n", line: 3},
+	{mapping: "\tL1\n", line: 1},
+	{mapping: "LINE/L1\tL1\nSINE/MIR\t \n", line: 2},
+	{mapping: "LINE/L1\n", line: 1},
+}
+
+func TestReadTSVErrors(t *testing.T) {
+	for _, test := range readTSVErrorTests {
+		n, err := New(RepBase)
+		if err != nil {
+			t.Fatalf("unexpected error creating normalizer: %v", err)
+		}
+		err = n.ReadTSV(strings.NewReader(test.mapping))
+		if err == nil {
+			t.Errorf("expected error for mapping %q", test.mapping)
+			continue
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("line %d:", test.line)) {
+			t.Errorf("unexpected error for mapping %q: got:%v want line %d", test.mapping, err, test.line)
+		}
+	}
+}
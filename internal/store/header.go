@@ -0,0 +1,251 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"modernc.org/kv"
+)
+
+// FormatVersion is the version of the store record encoding. Stores
+// without a header are format 0 and stores with format 1 headers hold
+// unversioned keys. Earlier formats may be upgraded with Migrate.
+const FormatVersion = 2
+
+// Kinds of store held by an ins working directory.
+const (
+	Forward   = "forward"   // Forward search hits.
+	Regions   = "regions"   // Merged regions.
+	Reverse   = "reverse"   // Final hits, culled or unculled.
+	Secondary = "secondary" // Secondary assignments.
+	Output    = "output"    // Hits in output order.
+)
+
+// orderOf is the name of the compare function of each kind of store.
+var orderOf = map[string]string{
+	Forward:   "GroupByQueryOrderSubjectLeft",
+	Regions:   "GroupByQueryOrderSubjectLeft",
+	Reverse:   "BySubjectPosition",
+	Secondary: "BySubjectPosition",
+	Output:    "ByOutputOrder",
+}
+
+// compareFuncs is the set of kv compare functions by name.
+var compareFuncs = map[string]func(x, y []byte) int{
+	"GroupByQueryOrderSubjectLeft": GroupByQueryOrderSubjectLeft,
+	"BySubjectPosition":            BySubjectPosition,
+	"ByOutputOrder":                ByOutputOrder,
+}
+
+// Header is the header record held by each store.
+type Header struct {
+	// Kind is the kind of data held.
+	Kind string `json:"kind"`
+	// Order is the name of the compare
+	// function ordering the store.
+	Order string `json:"order"`
+	// Format is the record encoding
+	// version.
+	Format int `json:"format"`
+	// Version is the version of ins
+	// that created the store.
+	Version string `json:"version,omitempty"`
+	// Values is the encoding of record
+	// values written to the store. Values
+	// may be in any encoding.
+	Values string `json:"values,omitempty"`
+}
+
+// headerKey is the key of the header record. It cannot be a marshaled
+// BlastRecordKey since no subject name is that long.
+var headerKey = []byte("\xff\xff\xff\xff\xff\xff\xff\xffins store header")
+
+// IsHeader returns whether key is the key of a store header record.
+func IsHeader(key []byte) bool {
+	return bytes.Equal(key, headerKey)
+}
+
+// compareHeader orders the header record before all other records. If
+// neither x nor y is a header key, ok is false.
+func compareHeader(x, y []byte) (c int, ok bool) {
+	hx, hy := IsHeader(x), IsHeader(y)
+	switch {
+	case hx && hy:
+		return 0, true
+	case hx:
+		return -1, true
+	case hy:
+		return 1, true
+	}
+	return 0, false
+}
+
+// Create creates a store of the given kind at path with a header record
+// noting that it was created by the given version of ins.
+func Create(path, kind, version string) (*kv.DB, error) {
+	order, ok := orderOf[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown store kind: %s", kind)
+	}
+	db, err := kv.Create(path, &kv.Options{Compare: compareFuncs[order]})
+	if err != nil {
+		return nil, err
+	}
+	h, err := json.Marshal(Header{Kind: kind, Order: order, Format: FormatVersion, Version: version, Values: ValueEncoding.String()})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = db.Set(headerKey, h)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Open opens the store of the given kind at path. It returns an error
+// if the store's header does not match kind and the current format.
+func Open(path, kind string) (*kv.DB, error) {
+	order, ok := orderOf[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown store kind: %s", kind)
+	}
+	db, err := kv.Open(path, &kv.Options{Compare: compareFuncs[order]})
+	if err != nil {
+		return nil, err
+	}
+	h, err := ReadHeader(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = h.check(kind, order)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// errNoHeader is returned by ReadHeader for stores created before
+// headers were added.
+var errNoHeader = errors.New("no store header: store was created by an earlier version of ins (upgrade with ins-db migrate)")
+
+// ReadHeader returns the header record of db.
+func ReadHeader(db *kv.DB) (Header, error) {
+	var h Header
+	b, err := db.Get(nil, headerKey)
+	if err != nil {
+		return h, err
+	}
+	if b == nil {
+		return h, errNoHeader
+	}
+	err = json.Unmarshal(b, &h)
+	if err != nil {
+		return h, fmt.Errorf("invalid store header: %w", err)
+	}
+	return h, nil
+}
+
+// check returns an error if h does not describe a store of the given
+// kind and order in the current format.
+func (h Header) check(kind, order string) error {
+	by := ""
+	if h.Version != "" {
+		by = " by ins " + h.Version
+	}
+	switch {
+	case h.Kind != kind:
+		return fmt.Errorf("store is a %s store created%s, not a %s store", h.Kind, by, kind)
+	case h.Order != order:
+		return fmt.Errorf("%s store is ordered by %s, not %s", kind, h.Order, order)
+	case h.Format < FormatVersion:
+		return fmt.Errorf("store format version %d created%s is older than the current version %d (upgrade with ins-db migrate)", h.Format, by, FormatVersion)
+	case h.Format > FormatVersion:
+		return fmt.Errorf("store format version %d created%s is newer than the current version %d", h.Format, by, FormatVersion)
+	}
+	return nil
+}
+
+// SeekFirst returns an enumerator positioned at the first record of db
+// after its header. If db holds no record, SeekFirst returns io.EOF.
+func SeekFirst(db *kv.DB) (*kv.Enumerator, error) {
+	it, err := db.SeekFirst()
+	if err != nil {
+		return it, err
+	}
+	k, _, err := it.Next()
+	if err != nil {
+		return nil, err
+	}
+	if !IsHeader(k) {
+		it, _, err = db.Seek(k)
+		return it, err
+	}
+	k, _, err = it.Next()
+	if err != nil {
+		return nil, err
+	}
+	it, _, err = db.Seek(k)
+	return it, err
+}
+
+// Migrate copies the records of the store of the given kind at src into
+// a new store at dst in the current format, noting that it was created
+// by the given version of ins. The store at src may be in any earlier
+// format. Migrate returns the number of records copied.
+func Migrate(dst, src, kind, version string) (int, error) {
+	order, ok := orderOf[kind]
+	if !ok {
+		return 0, fmt.Errorf("unknown store kind: %s", kind)
+	}
+	old, err := kv.Open(src, &kv.Options{Compare: compareFuncs[order]})
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+	h, err := ReadHeader(old)
+	switch err {
+	case nil:
+		if h.Kind != kind || h.Order != order {
+			return 0, fmt.Errorf("%s: store is a %s store ordered by %s, not a %s store", src, h.Kind, h.Order, kind)
+		}
+		if h.Format > FormatVersion {
+			return 0, fmt.Errorf("%s: store format version %d is newer than the current version %d", src, h.Format, FormatVersion)
+		}
+	case errNoHeader:
+	default:
+		return 0, fmt.Errorf("%s: %w", src, err)
+	}
+
+	db, err := Create(dst, kind, version)
+	if err != nil {
+		return 0, err
+	}
+	n, err := migrateRecords(db, old)
+	if err != nil {
+		db.Close()
+		return n, err
+	}
+	return n, db.Close()
+}
+
+// migrateRecords copies the records of src into dst, encoding their keys
+// in the current format.
+func migrateRecords(dst, src *kv.DB) (int, error) {
+	return copyRecords(dst, src, func(k []byte) ([]byte, error) {
+		r, err := UnmarshalBlastRecordKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return r.Marshal(), nil
+	})
+}
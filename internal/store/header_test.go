@@ -0,0 +1,195 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"modernc.org/kv"
+)
+
+// migrateKeys is the set of record keys written to stores to be
+// migrated. Keys share subjects, queries and coordinates so that
+// ordering depends on later fields.
+var migrateKeys = []BlastRecordKey{
+	{SubjectAccVer: "chr1", SubjectLeft: 100, SubjectRight: 200, QueryAccVer: "L1", QueryStart: 0, QueryEnd: 100, BitScore: 50, SumScore: 50, Strand: 1},
+	{SubjectAccVer: "chr1", SubjectLeft: 100, SubjectRight: 200, QueryAccVer: "L1", QueryStart: 100, QueryEnd: 0, BitScore: 40, SumScore: 40, Strand: -1},
+	{SubjectAccVer: "chr1", SubjectLeft: 150, SubjectRight: 300, QueryAccVer: "Alu", QueryStart: 0, QueryEnd: 150, BitScore: 60, SumScore: 70, Strand: 1},
+	{SubjectAccVer: "chr10", SubjectLeft: 0, SubjectRight: 50, QueryAccVer: "L1", QueryStart: 10, QueryEnd: 60, BitScore: 20, SumScore: 20, Strand: 1},
+	{SubjectAccVer: "chr2", SubjectLeft: 5, SubjectRight: 500, QueryAccVer: "L1M", QueryStart: 0, QueryEnd: 495, BitScore: 90, SumScore: 90, Strand: -1},
+	{SubjectAccVer: "chr2", SubjectLeft: 5, SubjectRight: 500, QueryAccVer: "L1M", QueryStart: 0, QueryEnd: 495, BitScore: 90, SumScore: 95, Strand: -1},
+}
+
+var migrateTests = []struct {
+	name string
+	kind string
+	// header is the header written to the
+	// store. A nil header is not written.
+	header *Header
+	// key returns the encoding of k
+	// written to the store.
+	key func(k BlastRecordKey) []byte
+}{
+	{
+		name: "headerless",
+		kind: Forward,
+		key:  func(k BlastRecordKey) []byte { return k.Marshal()[1:] },
+	},
+	{
+		name:   "unversioned keys",
+		kind:   Reverse,
+		header: &Header{Kind: Reverse, Order: orderOf[Reverse], Format: 1, Version: "v0.1.0"},
+		key:    func(k BlastRecordKey) []byte { return k.Marshal()[1:] },
+	},
+	{
+		name:   "current",
+		kind:   Output,
+		header: &Header{Kind: Output, Order: orderOf[Output], Format: FormatVersion, Version: "v0.2.0"},
+		key:    BlastRecordKey.Marshal,
+	},
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range migrateTests {
+		src := filepath.Join(dir, fmt.Sprintf("src-%d.db", i))
+		writeStore(t, src, test.kind, test.header, test.key)
+
+		// Collect the records of the source
+		// store in store order with their keys
+		// in the current format.
+		old, err := kv.Open(src, &kv.Options{Compare: compareFuncs[orderOf[test.kind]]})
+		if err != nil {
+			t.Fatalf("failed to open source store: %v", err)
+		}
+		var wantKeys, wantVals [][]byte
+		c := Iterate(old)
+		for c.Next() {
+			wantKeys = append(wantKeys, c.Key().Marshal())
+			wantVals = append(wantVals, append([]byte(nil), c.Value()...))
+		}
+		if c.Err() != nil {
+			t.Fatalf("unexpected error iterating over source store: %v", c.Err())
+		}
+		old.Close()
+		if len(wantKeys) != len(migrateKeys) {
+			t.Fatalf("unexpected number of source records for %s: got:%d want:%d", test.name, len(wantKeys), len(migrateKeys))
+		}
+
+		dst := filepath.Join(dir, fmt.Sprintf("dst-%d.db", i))
+		n, err := Migrate(dst, src, test.kind, "test")
+		if err != nil {
+			t.Fatalf("unexpected error migrating %s store: %v", test.name, err)
+		}
+		if n != len(migrateKeys) {
+			t.Errorf("unexpected number of records migrated for %s: got:%d want:%d", test.name, n, len(migrateKeys))
+		}
+
+		db, err := Open(dst, test.kind)
+		if err != nil {
+			t.Fatalf("failed to open migrated %s store: %v", test.name, err)
+		}
+		h, err := ReadHeader(db)
+		if err != nil {
+			t.Errorf("unexpected error reading header of migrated %s store: %v", test.name, err)
+		}
+		wantHeader := Header{Kind: test.kind, Order: orderOf[test.kind], Format: FormatVersion, Version: "test", Values: ValueEncoding.String()}
+		if h != wantHeader {
+			t.Errorf("unexpected header for migrated %s store: got:%+v want:%+v", test.name, h, wantHeader)
+		}
+
+		var i int
+		c = Iterate(db)
+		for ; c.Next(); i++ {
+			if i >= len(wantKeys) {
+				continue
+			}
+			k := c.RawKey()
+			if k[0] != keyVersion {
+				t.Errorf("unexpected key version for migrated %s record %d: got:%d want:%d", test.name, i, k[0], keyVersion)
+			}
+			if !bytes.Equal(k, wantKeys[i]) {
+				t.Errorf("unexpected key for migrated %s record %d:\ngot: %v\nwant:%v", test.name, i, c.Key(), refKey(wantKeys[i]))
+			}
+			if !bytes.Equal(c.Value(), wantVals[i]) {
+				t.Errorf("unexpected value for migrated %s record %d: got:%q want:%q", test.name, i, c.Value(), wantVals[i])
+			}
+		}
+		if c.Err() != nil {
+			t.Errorf("unexpected error iterating over migrated %s store: %v", test.name, c.Err())
+		}
+		if i != len(wantKeys) {
+			t.Errorf("unexpected number of records in migrated %s store: got:%d want:%d", test.name, i, len(wantKeys))
+		}
+		db.Close()
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "reverse.db")
+	writeStore(t, src, Reverse, &Header{Kind: Reverse, Order: orderOf[Reverse], Format: FormatVersion}, BlastRecordKey.Marshal)
+	_, err = Migrate(filepath.Join(dir, "forward.db"), src, Forward, "test")
+	want := "store is a reverse store ordered by BySubjectPosition, not a forward store"
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("unexpected error for mismatched kind: got:%v want suffix:%s", err, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "forward.db")); !os.IsNotExist(err) {
+		t.Errorf("unexpected destination store for mismatched kind: %v", err)
+	}
+
+	src = filepath.Join(dir, "future.db")
+	writeStore(t, src, Forward, &Header{Kind: Forward, Order: orderOf[Forward], Format: FormatVersion + 1}, BlastRecordKey.Marshal)
+	_, err = Migrate(filepath.Join(dir, "forward.db"), src, Forward, "test")
+	want = fmt.Sprintf("store format version %d is newer than the current version %d", FormatVersion+1, FormatVersion)
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("unexpected error for newer format: got:%v want suffix:%s", err, want)
+	}
+}
+
+// writeStore writes the migrateKeys records to a new store of the given
+// kind at path with keys encoded by key. If h is not nil it is written as
+// the store header.
+func writeStore(t *testing.T, path, kind string, h *Header, key func(BlastRecordKey) []byte) {
+	t.Helper()
+	db, err := kv.Create(path, &kv.Options{Compare: compareFuncs[orderOf[kind]]})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer db.Close()
+	if h != nil {
+		b, err := json.Marshal(h)
+		if err != nil {
+			t.Fatalf("failed to marshal header: %v", err)
+		}
+		err = db.Set(headerKey, b)
+		if err != nil {
+			t.Fatalf("failed to write header: %v", err)
+		}
+	}
+	for i, k := range migrateKeys {
+		err = db.Set(key(k), []byte(fmt.Sprintf("value %d", i)))
+		if err != nil {
+			t.Fatalf("failed to write record: %v", err)
+		}
+	}
+}
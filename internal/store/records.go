@@ -0,0 +1,462 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"modernc.org/kv"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// recordBatch is the number of records written in each transaction.
+const recordBatch = 100
+
+// PutRecord stores r in db keyed by its BlastRecordKey with the encoding
+// of r in ValueEncoding as the value.
+func PutRecord(db *kv.DB, r blast.Record) error {
+	return PutRecords(db, []blast.Record{r})
+}
+
+// PutRecords stores recs in db in the same way as PutRecord, committing
+// the records in batches.
+func PutRecords(db *kv.DB, recs []blast.Record) error {
+	return putRecords(db, len(recs), func(i int) Annotated {
+		return Annotated{Record: recs[i]}
+	})
+}
+
+// PutAnnotated stores recs with their annotations in db in the same way
+// as PutRecords.
+func PutAnnotated(db *kv.DB, recs []Annotated) error {
+	return putRecords(db, len(recs), func(i int) Annotated {
+		return recs[i]
+	})
+}
+
+// putRecords stores the n records returned by rec in db, committing the
+// records in batches.
+func putRecords(db *kv.DB, n int, rec func(i int) Annotated) error {
+	for i := 0; i < n; i++ {
+		r := rec(i)
+		if i%recordBatch == 0 {
+			err := db.BeginTransaction()
+			if err != nil {
+				return err
+			}
+		}
+		// Keep a record of the actual hit purely for
+		// correctness auditing; the key has enough
+		// information for what we need.
+		value, err := EncodeRecord(r, ValueEncoding)
+		if err != nil {
+			return err
+		}
+		err = db.Set(MarshalBlastRecordKey(r.Record), value)
+		if err != nil {
+			return err
+		}
+		if i%recordBatch == recordBatch-1 || i == n-1 {
+			err = db.Commit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PutNewRecords stores the records of recs in db, which must be ordered by
+// GroupByQueryOrderSubjectLeft, in the same way as PutRecords, omitting
+// records that duplicate a record already held by db or an earlier record
+// of recs. A record duplicates another record with the same strand, query
+// and subject if the other record overlaps at least the fraction overlap of
+// the record's subject length, so an overlap of 1 omits only contained
+// records. Within recs, higher scoring records are retained in preference
+// to lower scoring records. PutNewRecords returns the number of records
+// omitted.
+func PutNewRecords(db *kv.DB, recs []blast.Record, overlap float64) (int, error) {
+	recs = append([]blast.Record(nil), recs...)
+	sort.Slice(recs, func(i, j int) bool {
+		a, b := recs[i], recs[j]
+		switch {
+		case a.Strand != b.Strand:
+			return a.Strand > b.Strand
+		case a.QueryAccVer != b.QueryAccVer:
+			return a.QueryAccVer < b.QueryAccVer
+		case a.SubjectAccVer != b.SubjectAccVer:
+			return a.SubjectAccVer < b.SubjectAccVer
+		}
+		return a.BitScore > b.BitScore
+	})
+	var (
+		keep    []blast.Record
+		omitted int
+	)
+	for len(recs) != 0 {
+		n := 1
+		for n < len(recs) && sameRecordGroup(recs[0], recs[n]) {
+			n++
+		}
+		group := recs[:n]
+		recs = recs[n:]
+
+		held, err := groupSpans(db, group[0])
+		if err != nil {
+			return omitted, err
+		}
+		for _, r := range group {
+			s := spanOf(r)
+			if held.duplicates(s, overlap) {
+				omitted++
+				continue
+			}
+			held.insert(s)
+			keep = append(keep, r)
+		}
+	}
+	return omitted, PutRecords(db, keep)
+}
+
+// sameRecordGroup returns whether a and b share a strand, query and subject.
+func sameRecordGroup(a, b blast.Record) bool {
+	return a.Strand == b.Strand && a.QueryAccVer == b.QueryAccVer && a.SubjectAccVer == b.SubjectAccVer
+}
+
+// span is a closed subject interval.
+type span struct {
+	left, right int64
+}
+
+// spanOf returns the subject span of r.
+func spanOf(r blast.Record) span {
+	left, right := int64(r.SubjectStart), int64(r.SubjectEnd)
+	if right < left {
+		left, right = right, left
+	}
+	return span{left: left, right: right}
+}
+
+// spans is a set of spans sorted by left end with the length of the
+// longest span.
+type spans struct {
+	s      []span
+	maxLen int64
+}
+
+// groupSpans returns the spans of the records of db, which must be ordered
+// by GroupByQueryOrderSubjectLeft, sharing a strand, query and subject
+// with r.
+func groupSpans(db *kv.DB, r blast.Record) (spans, error) {
+	var held spans
+	c := &Cursor{db: db, ranges: []keyRange{{
+		from: BlastRecordKey{
+			SubjectAccVer: r.SubjectAccVer,
+			SubjectLeft:   math.MinInt64,
+			QueryAccVer:   r.QueryAccVer,
+			Strand:        r.Strand,
+		}.Marshal(),
+		within: func(k keyView) bool {
+			return k.strand == r.Strand && string(k.query) == r.QueryAccVer && string(k.subject) == r.SubjectAccVer
+		},
+	}}}
+	for c.Next() {
+		// Keys are checked by Next.
+		k, _ := viewKey(c.RawKey())
+		held.insert(span{left: k.left, right: k.right})
+	}
+	return held, c.Err()
+}
+
+// insert adds s to the set.
+func (h *spans) insert(s span) {
+	i := sort.Search(len(h.s), func(i int) bool { return h.s[i].left > s.left })
+	h.s = append(h.s, span{})
+	copy(h.s[i+1:], h.s[i:])
+	h.s[i] = s
+	if l := s.right - s.left + 1; l > h.maxLen {
+		h.maxLen = l
+	}
+}
+
+// duplicates returns whether a span in the set overlaps at least the
+// fraction overlap of the length of s.
+func (h *spans) duplicates(s span, overlap float64) bool {
+	need := overlap * float64(s.right-s.left+1)
+	i := sort.Search(len(h.s), func(i int) bool { return h.s[i].left > s.right })
+	for i--; i >= 0 && h.s[i].left > s.left-h.maxLen; i-- {
+		o := min(h.s[i].right, s.right) - max(h.s[i].left, s.left) + 1
+		if o > 0 && float64(o) >= need {
+			return true
+		}
+	}
+	return false
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Copy copies the records of src into dst, returning the number of
+// records copied.
+func Copy(dst, src *kv.DB) (int, error) {
+	return copyRecords(dst, src, nil)
+}
+
+// copyRecords copies the records of src into dst with their keys
+// transformed by rekey if it is not nil.
+func copyRecords(dst, src *kv.DB, rekey func([]byte) ([]byte, error)) (int, error) {
+	c := Iterate(src)
+	var n int
+	for c.Next() {
+		if n%recordBatch == 0 {
+			err := dst.BeginTransaction()
+			if err != nil {
+				return n, err
+			}
+		}
+		k := c.RawKey()
+		if rekey != nil {
+			var err error
+			k, err = rekey(k)
+			if err != nil {
+				return n, err
+			}
+		}
+		err := dst.Set(k, c.Value())
+		if err != nil {
+			return n, err
+		}
+		n++
+		if n%recordBatch == 0 {
+			err = dst.Commit()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	if c.Err() != nil {
+		return n, c.Err()
+	}
+	if n%recordBatch != 0 {
+		return n, dst.Commit()
+	}
+	return n, nil
+}
+
+// Cursor is an iterator over the records of a store. Records are
+// visited by calling Next until it returns false, after which Err
+// reports any error that ended the iteration.
+type Cursor struct {
+	db *kv.DB
+	it *kv.Enumerator
+
+	// ranges is the list of key ranges
+	// remaining to be iterated over. If
+	// ranges is nil, the whole store is
+	// iterated.
+	ranges []keyRange
+	within func(keyView) bool
+
+	// skip is the key of a record that is
+	// not returned if it is the first record
+	// read.
+	skip []byte
+
+	k, v []byte
+	err  error
+	done bool
+}
+
+// keyRange is a range of keys starting at the first key not less than
+// from and continuing while within returns true.
+type keyRange struct {
+	from   []byte
+	within func(keyView) bool
+}
+
+// Iterate returns a Cursor over all the records of db in store order.
+// A nil db is treated as empty.
+func Iterate(db *kv.DB) *Cursor {
+	return &Cursor{db: db}
+}
+
+// Contained returns a Cursor over the records of db, which must be ordered
+// by BySubjectPosition, that follow the record with the encoded key k on
+// the same strand and subject sequence and have left ends before its right
+// end. These are the records that may be contained by the record with key
+// k. Records may be deleted from db during the iteration.
+func Contained(db *kv.DB, k []byte) *Cursor {
+	k = append([]byte(nil), k...)
+	outer, err := viewKey(k)
+	if err != nil {
+		return &Cursor{err: err, done: true}
+	}
+	return &Cursor{
+		db:   db,
+		skip: k,
+		ranges: []keyRange{{
+			from: k,
+			within: func(v keyView) bool {
+				return v.strand == outer.strand && bytes.Equal(v.subject, outer.subject) && v.left < outer.right
+			},
+		}},
+	}
+}
+
+// Next advances the cursor to the next record, returning false if there
+// are no more records or an error occurred. A malformed record key ends
+// the iteration with an error.
+func (c *Cursor) Next() bool {
+	if c.done || c.db == nil {
+		return false
+	}
+	for {
+		if c.it == nil && !c.seek() {
+			return false
+		}
+		c.k, c.v, c.err = c.it.Next()
+		skip := c.skip
+		c.skip = nil
+		switch {
+		case c.err == io.EOF:
+			c.err = nil
+		case c.err != nil:
+			c.done = true
+			return false
+		case IsHeader(c.k), skip != nil && bytes.Equal(c.k, skip):
+			continue
+		default:
+			k, err := viewKey(c.k)
+			if err != nil {
+				c.err = fmt.Errorf("%w: %x", err, c.k)
+				c.done = true
+				return false
+			}
+			if c.within == nil || c.within(k) {
+				return true
+			}
+		}
+		if len(c.ranges) == 0 {
+			c.done = true
+			return false
+		}
+		c.it = nil
+	}
+}
+
+// seek positions the cursor at the start of the next range.
+func (c *Cursor) seek() bool {
+	if c.ranges == nil {
+		c.it, c.err = c.db.SeekFirst()
+		if c.err == io.EOF {
+			c.err = nil
+			c.done = true
+			return false
+		}
+	} else {
+		if len(c.ranges) == 0 {
+			c.done = true
+			return false
+		}
+		r := c.ranges[0]
+		c.ranges = c.ranges[1:]
+		c.within = r.within
+		c.it, _, c.err = c.db.Seek(r.from)
+	}
+	if c.err != nil {
+		c.done = true
+		return false
+	}
+	return true
+}
+
+// Key returns the key of the current record.
+func (c *Cursor) Key() BlastRecordKey {
+	// Keys are checked by Next.
+	k, _ := UnmarshalBlastRecordKey(c.k)
+	return k
+}
+
+// RawKey returns the encoded key of the current record. The returned
+// slice must not be modified.
+func (c *Cursor) RawKey() []byte { return c.k }
+
+// Value returns the value of the current record. The returned slice must
+// not be modified.
+func (c *Cursor) Value() []byte { return c.v }
+
+// Record returns the blast.Record held as the value of the current
+// record.
+func (c *Cursor) Record() (blast.Record, error) {
+	return DecodeRecord(c.v)
+}
+
+// Annotated returns the annotated record held as the value of the
+// current record.
+func (c *Cursor) Annotated() (Annotated, error) {
+	return DecodeAnnotated(c.v)
+}
+
+// Err returns the first error that occurred during iteration.
+func (c *Cursor) Err() error { return c.err }
+
+// IterGroups calls fn with each group of records of db, which must be
+// ordered by GroupByQueryOrderSubjectLeft and hold blast.Record values,
+// that share a strand, query and subject. The slice passed to fn is
+// reused between calls.
+func IterGroups(db *kv.DB, fn func(group []blast.Record) error) error {
+	var (
+		group []blast.Record
+		last  []byte
+	)
+	c := Iterate(db)
+	for c.Next() {
+		if group != nil && !sameGroup(last, c.RawKey()) {
+			err := fn(group)
+			if err != nil {
+				return err
+			}
+			group = group[:0]
+		}
+		r, err := c.Record()
+		if err != nil {
+			return err
+		}
+		group = append(group, r)
+		last = append(last[:0], c.RawKey()...)
+	}
+	if c.Err() != nil {
+		return c.Err()
+	}
+	if len(group) != 0 {
+		return fn(group)
+	}
+	return nil
+}
+
+// sameGroup returns whether the encoded keys x and y share a strand,
+// query and subject.
+func sameGroup(x, y []byte) bool {
+	// Keys are checked by Next.
+	kx, _ := viewKey(x)
+	ky, _ := viewKey(y)
+	return kx.strand == ky.strand && bytes.Equal(kx.query, ky.query) && bytes.Equal(kx.subject, ky.subject)
+}
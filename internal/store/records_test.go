@@ -0,0 +1,300 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// hit returns a forward hit of query on subject with the given subject
+// coordinates and bit score. Hits with start after end are on the (-)
+// strand.
+func hit(query, subject string, start, end int, score float64) blast.Record {
+	strand := int8(1)
+	if end < start {
+		strand = -1
+	}
+	return blast.Record{
+		QueryAccVer:   query,
+		QueryStart:    1,
+		QueryEnd:      abs(end-start) + 1,
+		SubjectAccVer: subject,
+		SubjectStart:  start,
+		SubjectEnd:    end,
+		Strand:        strand,
+		BitScore:      score,
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+var putNewRecordsTests = []struct {
+	name    string
+	held    []blast.Record
+	recs    []blast.Record
+	overlap float64
+
+	wantOmitted int
+	wantAdded   []blast.Record
+}{
+	{
+		name: "groups",
+		recs: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 200, 100, 40),
+			hit("Alu", "chr1", 100, 200, 30),
+			hit("L1", "chr2", 100, 200, 20),
+			hit("L1", "chr1", 110, 190, 10),
+		},
+		overlap:     0.5,
+		wantOmitted: 1,
+		wantAdded: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 200, 100, 40),
+			hit("Alu", "chr1", 100, 200, 30),
+			hit("L1", "chr2", 100, 200, 20),
+		},
+	},
+	{
+		name: "containment",
+		recs: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 110, 210, 40),
+			hit("L1", "chr1", 120, 180, 30),
+			hit("L1", "chr1", 100, 200, 20),
+			hit("L1", "chr1", 99, 150, 10),
+		},
+		overlap:     1,
+		wantOmitted: 2,
+		wantAdded: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 110, 210, 40),
+			hit("L1", "chr1", 99, 150, 10),
+		},
+	},
+	{
+		name: "fraction",
+		recs: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 110, 210, 40),
+			hit("L1", "chr1", 112, 212, 30),
+		},
+		overlap:     0.9,
+		wantOmitted: 1,
+		wantAdded: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 112, 212, 30),
+		},
+	},
+	{
+		name: "held",
+		held: []blast.Record{
+			hit("L1", "chr1", 100, 200, 50),
+			hit("L1", "chr1", 600, 500, 50),
+		},
+		recs: []blast.Record{
+			hit("L1", "chr1", 120, 180, 90),
+			hit("L1", "chr1", 300, 400, 10),
+			hit("L1", "chr1", 500, 600, 10),
+			hit("L1", "chr1", 580, 520, 10),
+		},
+		overlap:     1,
+		wantOmitted: 2,
+		wantAdded: []blast.Record{
+			hit("L1", "chr1", 300, 400, 10),
+			hit("L1", "chr1", 500, 600, 10),
+		},
+	},
+	{
+		name: "score precedence",
+		recs: []blast.Record{
+			hit("L1", "chr1", 100, 200, 10),
+			hit("L1", "chr1", 120, 180, 90),
+			hit("L1", "chr1", 400, 300, 10),
+			hit("L1", "chr1", 390, 310, 5),
+		},
+		overlap:     0.5,
+		wantOmitted: 2,
+		wantAdded: []blast.Record{
+			hit("L1", "chr1", 120, 180, 90),
+			hit("L1", "chr1", 400, 300, 10),
+		},
+	},
+	{
+		name: "long held span",
+		held: []blast.Record{
+			hit("L1", "chr1", 0, 1000, 50),
+			hit("L1", "chr1", 500, 510, 50),
+			hit("L1", "chr1", 600, 610, 50),
+			hit("L1", "chr1", 650, 660, 50),
+		},
+		recs: []blast.Record{
+			hit("L1", "chr1", 700, 720, 10),
+			hit("L1", "chr1", 990, 1010, 10),
+		},
+		overlap:     1,
+		wantOmitted: 1,
+		wantAdded: []blast.Record{
+			hit("L1", "chr1", 990, 1010, 10),
+		},
+	},
+}
+
+func TestPutNewRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range putNewRecordsTests {
+		db, err := Create(filepath.Join(dir, fmt.Sprintf("forward-%d.db", i)), Forward, "test")
+		if err != nil {
+			t.Fatalf("failed to create store: %v", err)
+		}
+		err = PutRecords(db, test.held)
+		if err != nil {
+			t.Fatalf("failed to store held records: %v", err)
+		}
+		// The records are stored from a search
+		// iteration in store order.
+		recs := append([]blast.Record(nil), test.recs...)
+		sort.Slice(recs, func(i, j int) bool {
+			return GroupByQueryOrderSubjectLeft(MarshalBlastRecordKey(recs[i]), MarshalBlastRecordKey(recs[j])) < 0
+		})
+		omitted, err := PutNewRecords(db, recs, test.overlap)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", test.name, err)
+		}
+		if omitted != test.wantOmitted {
+			t.Errorf("unexpected number of records omitted for %s: got:%d want:%d", test.name, omitted, test.wantOmitted)
+		}
+
+		var got []blast.Record
+		c := Iterate(db)
+		for c.Next() {
+			r, err := c.Record()
+			if err != nil {
+				t.Fatalf("failed to decode record: %v", err)
+			}
+			got = append(got, r)
+		}
+		if c.Err() != nil {
+			t.Fatalf("unexpected error iterating over store: %v", c.Err())
+		}
+		db.Close()
+
+		want := append(append([]blast.Record(nil), test.held...), test.wantAdded...)
+		sort.Slice(want, func(i, j int) bool {
+			return GroupByQueryOrderSubjectLeft(MarshalBlastRecordKey(want[i]), MarshalBlastRecordKey(want[j])) < 0
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected records for %s:\ngot: %+v\nwant:%+v", test.name, got, want)
+		}
+	}
+}
+
+var spansDuplicatesTests = []struct {
+	held    []span
+	s       span
+	overlap float64
+	want    bool
+}{
+	{held: nil, s: span{0, 9}, overlap: 0.1, want: false},
+	{held: []span{{0, 99}}, s: span{99, 99}, overlap: 1, want: true},
+	{held: []span{{0, 99}}, s: span{100, 100}, overlap: 1, want: false},
+	{held: []span{{0, 99}}, s: span{99, 100}, overlap: 1, want: false},
+	{held: []span{{0, 99}}, s: span{99, 100}, overlap: 0.5, want: true},
+	{held: []span{{0, 9}}, s: span{5, 14}, overlap: 0.5, want: true},
+	{held: []span{{0, 9}}, s: span{5, 14}, overlap: 0.6, want: false},
+
+	// The held spans to the left of s are scanned
+	// back as far as the longest held span.
+	{held: []span{{0, 99}, {50, 60}}, s: span{90, 99}, overlap: 1, want: true},
+	{held: []span{{0, 999}, {500, 510}, {600, 610}, {650, 660}}, s: span{700, 720}, overlap: 1, want: true},
+	{held: []span{{0, 9}, {20, 29}}, s: span{10, 19}, overlap: 0.1, want: false},
+	{held: []span{{0, 9}, {11, 12}}, s: span{9, 19}, overlap: 0.05, want: true},
+	{held: []span{{0, 9}, {11, 12}}, s: span{10, 19}, overlap: 0.2, want: true},
+	{held: []span{{0, 9}, {11, 12}}, s: span{10, 19}, overlap: 0.3, want: false},
+
+	// Only a single held span is considered.
+	{held: []span{{0, 99}, {200, 210}}, s: span{95, 204}, overlap: 0.05, want: false},
+	{held: []span{{0, 99}, {200, 210}}, s: span{150, 205}, overlap: 0.1, want: true},
+	{held: []span{{0, 99}, {200, 210}}, s: span{150, 205}, overlap: 0.2, want: false},
+}
+
+func TestSpansDuplicates(t *testing.T) {
+	for _, test := range spansDuplicatesTests {
+		var h spans
+		for _, s := range test.held {
+			h.insert(s)
+		}
+		got := h.duplicates(test.s, test.overlap)
+		if got != test.want {
+			t.Errorf("unexpected result for %v in %v with overlap %v: got:%t want:%t", test.s, test.held, test.overlap, got, test.want)
+		}
+	}
+}
+
+func TestCursorMalformedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ins-store-")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Create(filepath.Join(dir, "reverse.db"), Reverse, "test")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer db.Close()
+	recs := []blast.Record{
+		hit("L1", "chr1", 100, 200, 50),
+		hit("L1", "chr1", 300, 400, 50),
+	}
+	err = PutRecords(db, recs)
+	if err != nil {
+		t.Fatalf("failed to store records: %v", err)
+	}
+	// Malformed keys are ordered after all others.
+	err = db.Set(MarshalBlastRecordKey(recs[0])[:20], nil)
+	if err != nil {
+		t.Fatalf("failed to store malformed key: %v", err)
+	}
+
+	var n int
+	c := Iterate(db)
+	for c.Next() {
+		n++
+	}
+	if n != len(recs) {
+		t.Errorf("unexpected number of records before malformed key: got:%d want:%d", n, len(recs))
+	}
+	if !errors.Is(c.Err(), errMalformedKey) {
+		t.Errorf("unexpected error after malformed key: got:%v want:%v", c.Err(), errMalformedKey)
+	}
+
+	c = Contained(db, MarshalBlastRecordKey(recs[0])[:20])
+	if c.Next() {
+		t.Error("unexpected record contained by malformed key")
+	}
+	if !errors.Is(c.Err(), errMalformedKey) {
+		t.Errorf("unexpected error for malformed key: got:%v want:%v", c.Err(), errMalformedKey)
+	}
+}
@@ -7,6 +7,7 @@ package store
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"math"
 
 	"github.com/kortschak/ins/blast"
@@ -18,67 +19,69 @@ func GroupByQueryOrderSubjectLeft(x, y []byte) int {
 	if bytes.Equal(x, y) {
 		return 0
 	}
+	if c, ok := compareHeader(x, y); ok {
+		return c
+	}
 
-	rx := UnmarshalBlastRecordKey(x)
-	ry := UnmarshalBlastRecordKey(y)
+	rx, ry, c, ok := viewKeys(x, y)
+	if !ok {
+		return c
+	}
 
 	// Separate strands, (+) first.
 	switch {
-	case rx.Strand > ry.Strand:
+	case rx.strand > ry.strand:
 		return -1
-	case rx.Strand < ry.Strand:
+	case rx.strand < ry.strand:
 		return 1
 	}
 
 	// Group elements of the same type.
-	switch {
-	case rx.QueryAccVer < ry.QueryAccVer:
-		return -1
-	case rx.QueryAccVer > ry.QueryAccVer:
-		return 1
+	if c := bytes.Compare(rx.query, ry.query); c != 0 {
+		return c
 	}
 
 	// Sort by left position, with higher scoring matches first.
-	switch {
-	case rx.SubjectAccVer < ry.SubjectAccVer:
-		return -1
-	case rx.SubjectAccVer > ry.SubjectAccVer:
-		return 1
+	if c := bytes.Compare(rx.subject, ry.subject); c != 0 {
+		return c
 	}
 	switch {
-	case rx.SubjectLeft < ry.SubjectLeft:
+	case rx.left < ry.left:
 		return -1
-	case rx.SubjectLeft > ry.SubjectLeft:
+	case rx.left > ry.left:
 		return 1
 	}
 	switch {
-	case rx.SubjectRight < ry.SubjectRight:
+	case rx.right < ry.right:
 		return -1
-	case rx.SubjectRight > ry.SubjectRight:
+	case rx.right > ry.right:
 		return 1
 	}
 	switch {
-	case rx.BitScore > ry.BitScore:
+	case rx.bitScore > ry.bitScore:
 		return -1
-	case rx.BitScore < ry.BitScore:
+	case rx.bitScore < ry.bitScore:
 		return 1
 	}
 
 	// Ensure key uniqueness.
 	switch {
-	case rx.QueryStart < ry.QueryStart:
+	case rx.queryStart < ry.queryStart:
 		return -1
-	case rx.QueryStart > ry.QueryStart:
+	case rx.queryStart > ry.queryStart:
 		return 1
 	}
 	switch {
-	case rx.QueryEnd < ry.QueryEnd:
+	case rx.queryEnd < ry.queryEnd:
 		return -1
-	case rx.QueryEnd > ry.QueryEnd:
+	case rx.queryEnd > ry.queryEnd:
 		return 1
 	}
 
-	panic("unreachable")
+	// Keys that differ only in fields that
+	// are not compared, or in their format,
+	// are ordered by their encoding.
+	return bytes.Compare(x, y)
 }
 
 // BySubjectPosition is a kv compare function, ordering by strand, subject name,
@@ -87,72 +90,145 @@ func BySubjectPosition(x, y []byte) int {
 	if bytes.Equal(x, y) {
 		return 0
 	}
+	if c, ok := compareHeader(x, y); ok {
+		return c
+	}
 
-	rx := UnmarshalBlastRecordKey(x)
-	ry := UnmarshalBlastRecordKey(y)
+	rx, ry, c, ok := viewKeys(x, y)
+	if !ok {
+		return c
+	}
 
 	// Separate strands, (+) first.
 	switch {
-	case rx.Strand > ry.Strand:
+	case rx.strand > ry.strand:
 		return -1
-	case rx.Strand < ry.Strand:
+	case rx.strand < ry.strand:
 		return 1
 	}
 
 	// Sort by left position, longer repeats first,
 	// and with higher scoring matches first.
+	if c := bytes.Compare(rx.subject, ry.subject); c != 0 {
+		return c
+	}
 	switch {
-	case rx.SubjectAccVer < ry.SubjectAccVer:
+	case rx.left < ry.left:
 		return -1
-	case rx.SubjectAccVer > ry.SubjectAccVer:
+	case rx.left > ry.left:
 		return 1
 	}
 	switch {
-	case rx.SubjectLeft < ry.SubjectLeft:
+	case rx.right > ry.right:
 		return -1
-	case rx.SubjectLeft > ry.SubjectLeft:
+	case rx.right < ry.right:
 		return 1
 	}
 	switch {
-	case rx.SubjectRight > ry.SubjectRight:
+	case rx.bitScore > ry.bitScore:
 		return -1
-	case rx.SubjectRight < ry.SubjectRight:
+	case rx.bitScore < ry.bitScore:
 		return 1
 	}
 	switch {
-	case rx.BitScore > ry.BitScore:
+	case rx.sumScore > ry.sumScore:
 		return -1
-	case rx.BitScore < ry.BitScore:
+	case rx.sumScore < ry.sumScore:
 		return 1
 	}
+
+	// Ensure key uniqueness.
+	if c := bytes.Compare(rx.query, ry.query); c != 0 {
+		return c
+	}
 	switch {
-	case rx.SumScore > ry.SumScore:
+	case rx.queryStart < ry.queryStart:
 		return -1
-	case rx.SumScore < ry.SumScore:
+	case rx.queryStart > ry.queryStart:
+		return 1
+	}
+	switch {
+	case rx.queryEnd < ry.queryEnd:
+		return -1
+	case rx.queryEnd > ry.queryEnd:
 		return 1
 	}
 
-	// Ensure key uniqueness.
+	// Keys that differ only in fields that
+	// are not compared, or in their format,
+	// are ordered by their encoding.
+	return bytes.Compare(x, y)
+}
+
+// ByOutputOrder is a kv compare function, ordering by subject name, subject
+// position, query name, strand and BLAST bitscore. Keys that hold identical
+// records are ordered by their encoding, so keys may be suffixed to allow
+// identical records to be stored.
+func ByOutputOrder(x, y []byte) int {
+	if bytes.Equal(x, y) {
+		return 0
+	}
+	if c, ok := compareHeader(x, y); ok {
+		return c
+	}
+
+	rx, ry, c, ok := viewKeys(x, y)
+	if !ok {
+		return c
+	}
+
+	if c := bytes.Compare(rx.subject, ry.subject); c != 0 {
+		return c
+	}
+	switch {
+	case rx.left < ry.left:
+		return -1
+	case rx.left > ry.left:
+		return 1
+	}
+	switch {
+	case rx.right < ry.right:
+		return -1
+	case rx.right > ry.right:
+		return 1
+	}
+	if c := bytes.Compare(rx.query, ry.query); c != 0 {
+		return c
+	}
+
+	// (+) strand first.
+	switch {
+	case rx.strand > ry.strand:
+		return -1
+	case rx.strand < ry.strand:
+		return 1
+	}
 	switch {
-	case rx.QueryAccVer < ry.QueryAccVer:
+	case rx.bitScore > ry.bitScore:
 		return -1
-	case rx.QueryAccVer > ry.QueryAccVer:
+	case rx.bitScore < ry.bitScore:
 		return 1
 	}
 	switch {
-	case rx.QueryStart < ry.QueryStart:
+	case rx.sumScore > ry.sumScore:
 		return -1
-	case rx.QueryStart > ry.QueryStart:
+	case rx.sumScore < ry.sumScore:
 		return 1
 	}
 	switch {
-	case rx.QueryEnd < ry.QueryEnd:
+	case rx.queryStart < ry.queryStart:
 		return -1
-	case rx.QueryEnd > ry.QueryEnd:
+	case rx.queryStart > ry.queryStart:
+		return 1
+	}
+	switch {
+	case rx.queryEnd < ry.queryEnd:
+		return -1
+	case rx.queryEnd > ry.queryEnd:
 		return 1
 	}
 
-	panic("unreachable")
+	return bytes.Compare(x, y)
 }
 
 // MarshalInt returns a slice encoding n as an int64.
@@ -162,6 +238,12 @@ func MarshalInt(n int) []byte {
 	return buf[:]
 }
 
+// UnmarshalInt returns the int64 encoded in b by MarshalInt.
+func UnmarshalInt(b []byte) int {
+	return int(order.Uint64(b))
+}
+
+// BlastRecordKey is the decoded form of a store record key.
 type BlastRecordKey struct {
 	SubjectAccVer string
 	SubjectLeft   int64
@@ -176,14 +258,13 @@ type BlastRecordKey struct {
 
 var order = binary.BigEndian
 
+// keyVersion is the leading byte of keys in the current format. Keys
+// written before the format was versioned begin with the high byte of
+// the subject name length, which is always zero.
+const keyVersion = FormatVersion
+
+// MarshalBlastRecordKey returns the store key for r.
 func MarshalBlastRecordKey(r blast.Record) []byte {
-	var (
-		buf bytes.Buffer
-		b   [8]byte
-	)
-	order.PutUint64(b[:], uint64(len(r.SubjectAccVer)))
-	buf.Write(b[:])
-	buf.WriteString(r.SubjectAccVer)
 	left := r.SubjectStart
 	right := r.SubjectEnd
 	if right < left {
@@ -193,49 +274,151 @@ func MarshalBlastRecordKey(r blast.Record) []byte {
 		// for cases where there are matches in both orientations.
 		r.QueryStart, r.QueryEnd = r.QueryEnd, r.QueryStart
 	}
-	order.PutUint64(b[:], uint64(left))
+	return BlastRecordKey{
+		SubjectAccVer: r.SubjectAccVer,
+		SubjectLeft:   int64(left),
+		SubjectRight:  int64(right),
+		QueryAccVer:   r.QueryAccVer,
+		QueryStart:    int64(r.QueryStart),
+		QueryEnd:      int64(r.QueryEnd),
+		BitScore:      r.BitScore,
+		SumScore:      r.SumScore,
+		Strand:        r.Strand,
+	}.Marshal()
+}
+
+// Marshal returns the encoding of k in the current format.
+func (k BlastRecordKey) Marshal() []byte {
+	var (
+		buf bytes.Buffer
+		b   [8]byte
+	)
+	buf.WriteByte(keyVersion)
+	order.PutUint64(b[:], uint64(len(k.SubjectAccVer)))
+	buf.Write(b[:])
+	buf.WriteString(k.SubjectAccVer)
+	order.PutUint64(b[:], uint64(k.SubjectLeft))
 	buf.Write(b[:])
-	order.PutUint64(b[:], uint64(right))
+	order.PutUint64(b[:], uint64(k.SubjectRight))
 	buf.Write(b[:])
 
-	order.PutUint64(b[:], uint64(len(r.QueryAccVer)))
+	order.PutUint64(b[:], uint64(len(k.QueryAccVer)))
 	buf.Write(b[:])
-	buf.WriteString(r.QueryAccVer)
-	order.PutUint64(b[:], uint64(r.QueryStart))
+	buf.WriteString(k.QueryAccVer)
+	order.PutUint64(b[:], uint64(k.QueryStart))
 	buf.Write(b[:])
-	order.PutUint64(b[:], uint64(r.QueryEnd))
+	order.PutUint64(b[:], uint64(k.QueryEnd))
 	buf.Write(b[:])
-	order.PutUint64(b[:], math.Float64bits(r.BitScore))
+	order.PutUint64(b[:], math.Float64bits(k.BitScore))
 	buf.Write(b[:])
-	order.PutUint64(b[:], math.Float64bits(r.SumScore))
+	order.PutUint64(b[:], math.Float64bits(k.SumScore))
 	buf.Write(b[:])
-	buf.WriteByte(byte(r.Strand))
+	buf.WriteByte(byte(k.Strand))
 	return buf.Bytes()
 }
 
-func UnmarshalBlastRecordKey(data []byte) BlastRecordKey {
-	var k BlastRecordKey
-	n64 := binary.Size(uint64(0))
-	n := order.Uint64(data[:n64])
-	data = data[n64:]
-	k.SubjectAccVer = string(data[:n])
-	data = data[n:]
-	k.SubjectLeft = int64(order.Uint64(data[:n64]))
-	data = data[n64:]
-	k.SubjectRight = int64(order.Uint64(data[:n64]))
-	data = data[n64:]
-	n = order.Uint64(data[:n64])
-	data = data[n64:]
-	k.QueryAccVer = string(data[:n])
-	data = data[n:]
-	k.QueryStart = int64(order.Uint64(data[:n64]))
-	data = data[n64:]
-	k.QueryEnd = int64(order.Uint64(data[:n64]))
-	data = data[n64:]
-	k.BitScore = math.Float64frombits(order.Uint64(data[:n64]))
-	data = data[n64:]
-	k.SumScore = math.Float64frombits(order.Uint64(data[:n64]))
-	data = data[n64:]
-	k.Strand = int8(data[0])
-	return k
+// UnmarshalBlastRecordKey decodes a store key in the current format or
+// the unversioned format written by earlier versions of ins.
+func UnmarshalBlastRecordKey(data []byte) (BlastRecordKey, error) {
+	v, err := viewKey(data)
+	if err != nil {
+		return BlastRecordKey{}, err
+	}
+	return BlastRecordKey{
+		SubjectAccVer: string(v.subject),
+		SubjectLeft:   v.left,
+		SubjectRight:  v.right,
+		QueryAccVer:   string(v.query),
+		QueryStart:    v.queryStart,
+		QueryEnd:      v.queryEnd,
+		BitScore:      v.bitScore,
+		SumScore:      v.sumScore,
+		Strand:        v.strand,
+	}, nil
+}
+
+// keyView is the decoded form of a store key with name fields referring
+// to the bytes of the encoded key. Compare functions use keyView to avoid
+// allocating names.
+type keyView struct {
+	subject     []byte
+	left, right int64
+
+	query                []byte
+	queryStart, queryEnd int64
+
+	bitScore, sumScore float64
+	strand             int8
+}
+
+// errMalformedKey is returned when a store key is too short to hold
+// the fields of a record.
+var errMalformedKey = errors.New("malformed store key")
+
+// viewKey decodes a store key in the current format or the unversioned
+// format written by earlier versions of ins without copying.
+func viewKey(data []byte) (keyView, error) {
+	if len(data) != 0 && data[0] == keyVersion {
+		data = data[1:]
+	}
+	var k keyView
+	r := keyReader{data: data}
+	k.subject = r.next(r.uint64())
+	k.left = int64(r.uint64())
+	k.right = int64(r.uint64())
+	k.query = r.next(r.uint64())
+	k.queryStart = int64(r.uint64())
+	k.queryEnd = int64(r.uint64())
+	k.bitScore = math.Float64frombits(r.uint64())
+	k.sumScore = math.Float64frombits(r.uint64())
+	strand := r.next(1)
+	if r.short {
+		return keyView{}, errMalformedKey
+	}
+	k.strand = int8(strand[0])
+	return k, nil
+}
+
+// viewKeys decodes the store keys x and y for comparison. If either key
+// is malformed, ok is false and c is the order of the keys, with malformed
+// keys after all others and ordered by their encoding.
+func viewKeys(x, y []byte) (kx, ky keyView, c int, ok bool) {
+	kx, errx := viewKey(x)
+	ky, erry := viewKey(y)
+	switch {
+	case errx != nil && erry != nil:
+		return kx, ky, bytes.Compare(x, y), false
+	case errx != nil:
+		return kx, ky, 1, false
+	case erry != nil:
+		return kx, ky, -1, false
+	}
+	return kx, ky, 0, true
+}
+
+// keyReader reads the fields of an encoded key, noting whether the key
+// is too short to hold them.
+type keyReader struct {
+	data  []byte
+	short bool
+}
+
+// next returns the next n bytes of the key.
+func (r *keyReader) next(n uint64) []byte {
+	if r.short || uint64(len(r.data)) < n {
+		r.short = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint64 returns the next 8 bytes of the key as a uint64.
+func (r *keyReader) uint64() uint64 {
+	b := r.next(8)
+	if r.short {
+		return 0
+	}
+	return order.Uint64(b)
 }
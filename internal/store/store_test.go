@@ -0,0 +1,355 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// refKey decodes a store key in the current or unversioned format
+// independently of viewKey.
+func refKey(data []byte) BlastRecordKey {
+	if data[0] == keyVersion {
+		data = data[1:]
+	}
+	r := bytes.NewReader(data)
+	readString := func() string {
+		var n uint64
+		binary.Read(r, order, &n)
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	var k BlastRecordKey
+	k.SubjectAccVer = readString()
+	binary.Read(r, order, &k.SubjectLeft)
+	binary.Read(r, order, &k.SubjectRight)
+	k.QueryAccVer = readString()
+	binary.Read(r, order, &k.QueryStart)
+	binary.Read(r, order, &k.QueryEnd)
+	binary.Read(r, order, &k.BitScore)
+	binary.Read(r, order, &k.SumScore)
+	binary.Read(r, order, &k.Strand)
+	return k
+}
+
+func cmpString(a, b string) int { return strings.Compare(a, b) }
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// cmpFloat compares a and b, treating unordered values as equal.
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// refCompare returns a reference kv compare function that decodes keys
+// with refKey and orders them by the first non-zero result of fields,
+// falling back to the encoded keys.
+func refCompare(fields func(a, b BlastRecordKey) []int) func(x, y []byte) int {
+	return func(x, y []byte) int {
+		hx, hy := IsHeader(x), IsHeader(y)
+		switch {
+		case hx && hy:
+			return 0
+		case hx:
+			return -1
+		case hy:
+			return 1
+		}
+		for _, c := range fields(refKey(x), refKey(y)) {
+			if c != 0 {
+				return c
+			}
+		}
+		return bytes.Compare(x, y)
+	}
+}
+
+var compareTests = []struct {
+	name string
+	cmp  func(x, y []byte) int
+	ref  func(x, y []byte) int
+}{
+	{
+		name: "GroupByQueryOrderSubjectLeft",
+		cmp:  GroupByQueryOrderSubjectLeft,
+		ref: refCompare(func(a, b BlastRecordKey) []int {
+			return []int{
+				-cmpInt(int64(a.Strand), int64(b.Strand)),
+				cmpString(a.QueryAccVer, b.QueryAccVer),
+				cmpString(a.SubjectAccVer, b.SubjectAccVer),
+				cmpInt(a.SubjectLeft, b.SubjectLeft),
+				cmpInt(a.SubjectRight, b.SubjectRight),
+				-cmpFloat(a.BitScore, b.BitScore),
+				cmpInt(a.QueryStart, b.QueryStart),
+				cmpInt(a.QueryEnd, b.QueryEnd),
+			}
+		}),
+	},
+	{
+		name: "BySubjectPosition",
+		cmp:  BySubjectPosition,
+		ref: refCompare(func(a, b BlastRecordKey) []int {
+			return []int{
+				-cmpInt(int64(a.Strand), int64(b.Strand)),
+				cmpString(a.SubjectAccVer, b.SubjectAccVer),
+				cmpInt(a.SubjectLeft, b.SubjectLeft),
+				-cmpInt(a.SubjectRight, b.SubjectRight),
+				-cmpFloat(a.BitScore, b.BitScore),
+				-cmpFloat(a.SumScore, b.SumScore),
+				cmpString(a.QueryAccVer, b.QueryAccVer),
+				cmpInt(a.QueryStart, b.QueryStart),
+				cmpInt(a.QueryEnd, b.QueryEnd),
+			}
+		}),
+	},
+	{
+		name: "ByOutputOrder",
+		cmp:  ByOutputOrder,
+		ref: refCompare(func(a, b BlastRecordKey) []int {
+			return []int{
+				cmpString(a.SubjectAccVer, b.SubjectAccVer),
+				cmpInt(a.SubjectLeft, b.SubjectLeft),
+				cmpInt(a.SubjectRight, b.SubjectRight),
+				cmpString(a.QueryAccVer, b.QueryAccVer),
+				-cmpInt(int64(a.Strand), int64(b.Strand)),
+				-cmpFloat(a.BitScore, b.BitScore),
+				-cmpFloat(a.SumScore, b.SumScore),
+				cmpInt(a.QueryStart, b.QueryStart),
+				cmpInt(a.QueryEnd, b.QueryEnd),
+			}
+		}),
+	},
+}
+
+// testKeys returns n random keys drawn from small sets of field values
+// so that keys frequently share fields, names share prefixes, and
+// coordinates and scores include negative, zero, equal and NaN values.
+// Keys are in the current format or the unversioned format, and the
+// header key is included.
+func testKeys(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	names := []string{"", "L1", "L1M", "L1MA", "chr1", "chr10", "chr1_alt", "\xff"}
+	coords := []int64{math.MinInt64, -1000, -1, 0, 1, 1000, math.MaxInt64}
+	scores := []float64{math.NaN(), math.Inf(-1), -1, 0, 50, 50, math.Inf(1)}
+	keys := [][]byte{headerKey}
+	for len(keys) < n {
+		k := BlastRecordKey{
+			SubjectAccVer: names[rnd.Intn(len(names))],
+			SubjectLeft:   coords[rnd.Intn(len(coords))],
+			SubjectRight:  coords[rnd.Intn(len(coords))],
+			QueryAccVer:   names[rnd.Intn(len(names))],
+			QueryStart:    coords[rnd.Intn(len(coords))],
+			QueryEnd:      coords[rnd.Intn(len(coords))],
+			BitScore:      scores[rnd.Intn(len(scores))],
+			SumScore:      scores[rnd.Intn(len(scores))],
+			Strand:        int8(rnd.Intn(3) - 1),
+		}
+		b := k.Marshal()
+		keys = append(keys, b, b[1:])
+	}
+	return keys
+}
+
+func TestCompare(t *testing.T) {
+	keys := testKeys(400)
+	for _, test := range compareTests {
+		for _, x := range keys {
+			for _, y := range keys {
+				got := test.cmp(x, y)
+				want := test.ref(x, y)
+				if got != want {
+					t.Fatalf("unexpected %s comparison of %v and %v: got:%d want:%d",
+						test.name, refKey(x), refKey(y), got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	keys := testKeys(200)
+	for _, test := range compareTests {
+		for i := 1; i < len(keys); i += 2 {
+			// Keys holding the same record in the
+			// current and unversioned formats are
+			// ordered by their encoding.
+			x, y := keys[i], keys[i+1]
+			if got := test.cmp(x, y); got != 1 {
+				t.Errorf("unexpected %s comparison of versioned and unversioned %v: got:%d want:1",
+					test.name, refKey(x), got)
+			}
+		}
+	}
+}
+
+// malformedKeys returns truncations of the encoding of k in the current
+// and unversioned formats, and keys with name lengths beyond their end.
+func malformedKeys(k BlastRecordKey) [][]byte {
+	var keys [][]byte
+	b := k.Marshal()
+	for _, full := range [][]byte{b, b[1:]} {
+		for n := 0; n < len(full); n++ {
+			keys = append(keys, full[:n])
+		}
+	}
+	long := append([]byte(nil), b...)
+	order.PutUint64(long[1:], math.MaxUint64)
+	keys = append(keys, long)
+	long = append([]byte(nil), b...)
+	order.PutUint64(long[1:], uint64(len(b)))
+	keys = append(keys, long)
+	return keys
+}
+
+func TestUnmarshalMalformedKey(t *testing.T) {
+	want := BlastRecordKey{
+		SubjectAccVer: "chr1",
+		SubjectLeft:   -10,
+		SubjectRight:  1000,
+		QueryAccVer:   "L1HS",
+		QueryStart:    1,
+		QueryEnd:      1011,
+		BitScore:      500,
+		SumScore:      600,
+		Strand:        -1,
+	}
+	for _, b := range [][]byte{want.Marshal(), want.Marshal()[1:]} {
+		got, err := UnmarshalBlastRecordKey(b)
+		if err != nil {
+			t.Errorf("unexpected error for valid key: %v", err)
+		}
+		if got != want {
+			t.Errorf("unexpected key:\ngot: %+v\nwant:%+v", got, want)
+		}
+	}
+	for _, b := range malformedKeys(want) {
+		_, err := UnmarshalBlastRecordKey(b)
+		if err != errMalformedKey {
+			t.Errorf("unexpected error for malformed key %x: got:%v want:%v", b, err, errMalformedKey)
+		}
+	}
+}
+
+func TestCompareMalformed(t *testing.T) {
+	valid := testKeys(20)
+	malformed := malformedKeys(BlastRecordKey{SubjectAccVer: "chr1", QueryAccVer: "L1HS", Strand: 1})
+	for _, test := range compareTests {
+		for _, x := range malformed {
+			for _, y := range valid {
+				if got := test.cmp(x, y); got != 1 {
+					t.Errorf("unexpected %s comparison of malformed key %x with valid key: got:%d want:1", test.name, x, got)
+				}
+				if got := test.cmp(y, x); got != -1 {
+					t.Errorf("unexpected %s comparison of valid key with malformed key %x: got:%d want:-1", test.name, x, got)
+				}
+			}
+			for _, y := range malformed {
+				if got, want := test.cmp(x, y), bytes.Compare(x, y); got != want {
+					t.Errorf("unexpected %s comparison of malformed keys %x and %x: got:%d want:%d", test.name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// benchKeys returns n keys for hits of a human-like repeat annotation;
+// a few hundred families on 24 chromosomes, with most hits falling in
+// clusters so that neighbouring keys share their subject and position.
+func benchKeys(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	families := make([]string, 300)
+	for i := range families {
+		families[i] = fmt.Sprintf("L1MA%d#LINE/L1", i)
+	}
+	keys := make([][]byte, n)
+	var (
+		subject string
+		left    int
+	)
+	for i := range keys {
+		if i == 0 || rnd.Intn(4) == 0 {
+			subject = fmt.Sprintf("chr%d", rnd.Intn(24)+1)
+			left = rnd.Intn(250e6)
+		}
+		length := 50 + rnd.Intn(6000)
+		r := blast.Record{
+			QueryAccVer:   families[rnd.Intn(len(families))],
+			SubjectAccVer: subject,
+			QueryStart:    1 + rnd.Intn(1000),
+			SubjectStart:  left + rnd.Intn(100),
+			SubjectEnd:    left + length,
+			BitScore:      float64(50 + rnd.Intn(5000)),
+			Strand:        1,
+		}
+		r.QueryEnd = r.QueryStart + length
+		r.SumScore = r.BitScore
+		if rnd.Intn(2) == 0 {
+			r.SubjectStart, r.SubjectEnd = r.SubjectEnd, r.SubjectStart
+			r.Strand = -1
+		}
+		keys[i] = MarshalBlastRecordKey(r)
+	}
+	return keys
+}
+
+var sink int
+
+// benchmarkCompare benchmarks cmp on random pairs of keys and on keys
+// that are adjacent in cmp order, as compared during kv tree inserts.
+func benchmarkCompare(b *testing.B, cmp func(x, y []byte) int) {
+	keys := benchKeys(1 << 14)
+	b.Run("random", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink = cmp(keys[i%len(keys)], keys[(i*7919+1)%len(keys)])
+		}
+	})
+
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool { return cmp(sorted[i], sorted[j]) < 0 })
+	b.Run("neighbours", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			j := i % (len(sorted) - 1)
+			sink = cmp(sorted[j], sorted[j+1])
+		}
+	})
+}
+
+func BenchmarkGroupByQueryOrderSubjectLeft(b *testing.B) {
+	benchmarkCompare(b, GroupByQueryOrderSubjectLeft)
+}
+
+func BenchmarkBySubjectPosition(b *testing.B) {
+	benchmarkCompare(b, BySubjectPosition)
+}
+
+func BenchmarkByOutputOrder(b *testing.B) {
+	benchmarkCompare(b, ByOutputOrder)
+}
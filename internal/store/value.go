@@ -0,0 +1,240 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/golang/snappy"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// Encoding is a blast.Record value encoding.
+type Encoding int
+
+const (
+	// JSON is the JSON encoding of a blast.Record.
+	JSON Encoding = iota
+	// Binary is a compact binary encoding.
+	Binary
+	// Snappy is the Binary encoding compressed
+	// with snappy.
+	Snappy
+)
+
+// Value tags identifying the encoding of non-JSON values. JSON values
+// always begin with '{'.
+const (
+	binaryTag = 0x01
+	snappyTag = 0x02
+)
+
+// encodingNames are the names of the value encodings.
+var encodingNames = []string{
+	JSON:   "json",
+	Binary: "binary",
+	Snappy: "snappy",
+}
+
+func (e Encoding) String() string {
+	if e < 0 || int(e) >= len(encodingNames) {
+		return fmt.Sprintf("Encoding(%d)", e)
+	}
+	return encodingNames[e]
+}
+
+// ParseEncoding returns the Encoding with the given name.
+func ParseEncoding(name string) (Encoding, error) {
+	for e, n := range encodingNames {
+		if n == name {
+			return Encoding(e), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown value encoding: %q", name)
+}
+
+// Annotated is a blast.Record with the annotations added to it by the
+// ins pipeline. The annotations are held in record values with the
+// record, but are not part of the BLAST result.
+type Annotated struct {
+	blast.Record
+
+	// Truncated is the number of forward
+	// hits omitted from the merged region
+	// that gave the hit when the number of
+	// hits in the region was capped.
+	Truncated int `json:",omitempty"`
+}
+
+// ValueEncoding is the encoding used for record values written by
+// PutRecords. Values in any encoding are decoded by DecodeRecord.
+var ValueEncoding = JSON
+
+// EncodeRecord returns the encoding of r in the given encoding.
+func EncodeRecord(r Annotated, enc Encoding) ([]byte, error) {
+	switch enc {
+	case JSON:
+		return json.Marshal(r)
+	case Binary:
+		return appendRecord([]byte{binaryTag}, r), nil
+	case Snappy:
+		b := appendRecord(nil, r)
+		return append([]byte{snappyTag}, snappy.Encode(nil, b)...), nil
+	default:
+		return nil, fmt.Errorf("unknown value encoding: %v", enc)
+	}
+}
+
+// DecodeRecord decodes a record value in any encoding, discarding its
+// annotations.
+func DecodeRecord(v []byte) (blast.Record, error) {
+	r, err := DecodeAnnotated(v)
+	return r.Record, err
+}
+
+// DecodeAnnotated decodes a record value in any encoding.
+func DecodeAnnotated(v []byte) (Annotated, error) {
+	var r Annotated
+	if len(v) == 0 {
+		return r, errors.New("empty record value")
+	}
+	switch v[0] {
+	case binaryTag:
+		return readRecord(v[1:])
+	case snappyTag:
+		b, err := snappy.Decode(nil, v[1:])
+		if err != nil {
+			return r, err
+		}
+		return readRecord(b)
+	default:
+		err := json.Unmarshal(v, &r)
+		return r, err
+	}
+}
+
+// RawJSON returns v if it is a JSON encoded record value and nil
+// otherwise.
+func RawJSON(v []byte) []byte {
+	if len(v) == 0 || v[0] != '{' {
+		return nil
+	}
+	return v
+}
+
+// appendRecord appends the binary encoding of r to dst.
+func appendRecord(dst []byte, r Annotated) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	putString := func(s string) {
+		n := binary.PutUvarint(buf[:], uint64(len(s)))
+		dst = append(dst, buf[:n]...)
+		dst = append(dst, s...)
+	}
+	putInt := func(v int64) {
+		n := binary.PutVarint(buf[:], v)
+		dst = append(dst, buf[:n]...)
+	}
+	putFloat := func(f float64) {
+		order.PutUint64(buf[:8], math.Float64bits(f))
+		dst = append(dst, buf[:8]...)
+	}
+
+	putString(r.QueryAccVer)
+	putString(r.SubjectAccVer)
+	putFloat(r.PctIdentity)
+	putInt(int64(r.AlignmentLength))
+	putInt(int64(r.Mismatches))
+	putInt(int64(r.GapOpens))
+	putInt(int64(r.QueryStart))
+	putInt(int64(r.QueryEnd))
+	putInt(int64(r.SubjectStart))
+	putInt(int64(r.SubjectEnd))
+	putFloat(r.EValue)
+	putFloat(r.BitScore)
+	dst = append(dst, byte(r.Strand))
+	putInt(int64(r.QueryLength))
+	putInt(int64(r.SubjectLength))
+	putString(r.BTOP)
+	putInt(int64(r.Iteration))
+	putInt(r.UID)
+	putFloat(r.SumScore)
+	putInt(int64(r.Truncated))
+	return dst
+}
+
+// errShortValue is returned when a binary value is truncated.
+var errShortValue = errors.New("short binary record value")
+
+// readRecord decodes the binary encoding of a record from b.
+func readRecord(b []byte) (Annotated, error) {
+	var (
+		r   Annotated
+		err error
+	)
+	getString := func() string {
+		n, w := binary.Uvarint(b)
+		if w <= 0 || uint64(len(b)-w) < n {
+			err = errShortValue
+			b = nil
+			return ""
+		}
+		s := string(b[w : w+int(n)])
+		b = b[w+int(n):]
+		return s
+	}
+	getInt := func() int64 {
+		v, w := binary.Varint(b)
+		if w <= 0 {
+			err = errShortValue
+			b = nil
+			return 0
+		}
+		b = b[w:]
+		return v
+	}
+	getFloat := func() float64 {
+		if len(b) < 8 {
+			err = errShortValue
+			b = nil
+			return 0
+		}
+		f := math.Float64frombits(order.Uint64(b[:8]))
+		b = b[8:]
+		return f
+	}
+
+	r.QueryAccVer = getString()
+	r.SubjectAccVer = getString()
+	r.PctIdentity = getFloat()
+	r.AlignmentLength = int(getInt())
+	r.Mismatches = int(getInt())
+	r.GapOpens = int(getInt())
+	r.QueryStart = int(getInt())
+	r.QueryEnd = int(getInt())
+	r.SubjectStart = int(getInt())
+	r.SubjectEnd = int(getInt())
+	r.EValue = getFloat()
+	r.BitScore = getFloat()
+	if len(b) == 0 {
+		return r, errShortValue
+	}
+	r.Strand = int8(b[0])
+	b = b[1:]
+	r.QueryLength = int(getInt())
+	r.SubjectLength = int(getInt())
+	r.BTOP = getString()
+	r.Iteration = int(getInt())
+	r.UID = getInt()
+	r.SumScore = getFloat()
+	if len(b) != 0 {
+		r.Truncated = int(getInt())
+	}
+	return r, err
+}
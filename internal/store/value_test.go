@@ -0,0 +1,53 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/kortschak/ins/blast"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	want := Annotated{
+		Record: blast.Record{
+			QueryAccVer:     "L1HS",
+			QueryStart:      10,
+			QueryEnd:        210,
+			SubjectAccVer:   "chr1",
+			SubjectStart:    1200,
+			SubjectEnd:      1000,
+			Strand:          -1,
+			PctIdentity:     97.5,
+			AlignmentLength: 200,
+			Mismatches:      5,
+			EValue:          1e-80,
+			BitScore:        350,
+			UID:             7,
+			SumScore:        420.5,
+		},
+		Truncated: 3,
+	}
+	for _, enc := range []Encoding{JSON, Binary, Snappy} {
+		v, err := EncodeRecord(want, enc)
+		if err != nil {
+			t.Fatalf("unexpected error encoding %v record: %v", enc, err)
+		}
+		got, err := DecodeAnnotated(v)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %v record: %v", enc, err)
+		}
+		if got != want {
+			t.Errorf("unexpected %v round trip:\ngot: %+v\nwant:%+v", enc, got, want)
+		}
+		rec, err := DecodeRecord(v)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %v record: %v", enc, err)
+		}
+		if rec != want.Record {
+			t.Errorf("unexpected %v record:\ngot: %+v\nwant:%+v", enc, rec, want.Record)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright ©2020 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package last provides types and functions for invoking the LAST
+// aligner and interpreting the returned results.
+package last
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/biogo/external"
+
+	"github.com/kortschak/ins/blast"
+)
+
+// Version returns the version reported by the LAST executable cmd
+// when it is invoked with the --version flag.
+func Version(cmd string) (string, error) {
+	out, err := exec.Command(cmd, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", cmd, err)
+	}
+	line := out
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		line = out[:i]
+	}
+	// The first line is of the form "lastal 1219".
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		line = line[i+1:]
+	}
+	return string(bytes.TrimSpace(line)), nil
+}
+
+type DB struct {
+	// Usage: lastdb [options] out-name fasta-sequence-file(s)
+	//
+	// For details relating to options and parameters, see the LAST manual.
+	//
+	Cmd string `buildarg:"{{if .}}{{.}}{{else}}lastdb{{end}}"` // lastdb
+
+	SoftMask bool   `buildarg:"{{if .}}-c{{end}}"`                 // -c
+	Seeding  string `buildarg:"{{with .}}-u{{split}}{{.}}{{end}}"` // -u <s>
+	Threads  int    `buildarg:"{{if .}}-P{{split}}{{.}}{{end}}"`   // -P <n>
+	Out      string `buildarg:"{{.}}"`                             // out-name
+	In       string `buildarg:"{{.}}"`                             // fasta-sequence-file
+
+	// ExtraArgs will be passed through to lastdb as
+	// arguments without splitting.
+	ExtraArgs []string
+}
+
+func (d DB) BuildCommand() (*exec.Cmd, error) {
+	if d.Out == "" {
+		return nil, errors.New("lastdb: missing out name")
+	}
+	if d.In == "" {
+		return nil, errors.New("lastdb: missing sequence filename")
+	}
+	cl := external.Must(external.Build(d))
+	return command(cl, d.ExtraArgs, 2), nil
+}
+
+type Train struct {
+	// Usage: last-train [options] lastdb-name sequence-file(s)
+	//
+	// For details relating to options and parameters, see the LAST manual.
+	//
+	Cmd string `buildarg:"{{if .}}{{.}}{{else}}last-train{{end}}"` // last-train
+
+	RevSym  bool   `buildarg:"{{if .}}--revsym{{end}}"`         // --revsym
+	MatSym  bool   `buildarg:"{{if .}}--matsym{{end}}"`         // --matsym
+	GapSym  bool   `buildarg:"{{if .}}--gapsym{{end}}"`         // --gapsym
+	Threads int    `buildarg:"{{if .}}-P{{split}}{{.}}{{end}}"` // -P <n>
+	DB      string `buildarg:"{{.}}"`                           // lastdb-name
+	Query   string `buildarg:"{{.}}"`                           // sequence-file
+
+	// ExtraArgs will be passed through to last-train as
+	// arguments without splitting.
+	ExtraArgs []string
+}
+
+func (t Train) BuildCommand() (*exec.Cmd, error) {
+	if t.DB == "" {
+		return nil, errors.New("last-train: missing lastdb name")
+	}
+	if t.Query == "" {
+		return nil, errors.New("last-train: missing sequence filename")
+	}
+	cl := external.Must(external.Build(t))
+	return command(cl, t.ExtraArgs, 2), nil
+}
+
+type Align struct {
+	// Usage: lastal [options] lastdb-name fasta-sequence-file(s)
+	//
+	// For details relating to options and parameters, see the LAST manual.
+	//
+	Cmd string `buildarg:"{{if .}}{{.}}{{else}}lastal{{end}}"` // lastal
+
+	Params    string  `buildarg:"{{with .}}-p{{split}}{{.}}{{end}}"` // -p <s>
+	Format    string  `buildarg:"{{with .}}-f{{split}}{{.}}{{end}}"` // -f <s>
+	EValue    float64 `buildarg:"{{if .}}-E{{split}}{{.}}{{end}}"`   // -E <f.>
+	MaskLower int     `buildarg:"{{if .}}-R{{split}}{{.}}{{end}}"`   // -R <n>
+	Threads   int     `buildarg:"{{if .}}-P{{split}}{{.}}{{end}}"`   // -P <n>
+	DB        string  `buildarg:"{{.}}"`                             // lastdb-name
+	Query     string  `buildarg:"{{.}}"`                             // fasta-sequence-file
+
+	// ExtraArgs will be passed through to lastal as
+	// arguments without splitting.
+	ExtraArgs []string
+}
+
+func (a Align) BuildCommand() (*exec.Cmd, error) {
+	if a.DB == "" {
+		return nil, errors.New("lastal: missing lastdb name")
+	}
+	if a.Query == "" {
+		return nil, errors.New("lastal: missing sequence filename")
+	}
+	cl := external.Must(external.Build(a))
+	return command(cl, a.ExtraArgs, 2), nil
+}
+
+// command returns a command for the command line cl with extra inserted
+// before the final n positional arguments.
+func command(cl, extra []string, n int) *exec.Cmd {
+	pos := len(cl) - n
+	args := append(append(cl[1:pos:pos], extra...), cl[pos:]...)
+	return exec.Command(cl[0], args...)
+}
+
+// ParseTabular returns the alignments in the LAST BlastTab formatted
+// data in r as BLAST records. Coordinates are converted to zero-based
+// starts, and alignments are oriented so that the query is on the
+// forward strand as for BLAST output. Alignments without E-values and
+// bit scores are given zero values for those fields.
+func ParseTabular(r io.Reader, iteration int) ([]blast.Record, error) {
+	// column indices for BlastTab format.
+	const (
+		QueryAccVer = iota
+		SubjectAccVer
+		PctIdentity
+		AlignmentLength
+		Mismatches
+		GapOpens
+		QueryStart
+		QueryEnd
+		SubjectStart
+		SubjectEnd
+		EValue
+		BitScore
+		numFields
+	)
+
+	var recs []blast.Record
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 || bytes.HasPrefix(line, []byte("#")) {
+			continue
+		}
+		f := bytes.Split(line, []byte("\t"))
+		if len(f) != numFields && len(f) != EValue {
+			return recs, fmt.Errorf("unexpected number of fields: %q", f)
+		}
+		r := blast.Record{
+			QueryAccVer:   string(f[QueryAccVer]),
+			SubjectAccVer: string(f[SubjectAccVer]),
+			Iteration:     iteration,
+		}
+		var err error
+		r.PctIdentity, err = strconv.ParseFloat(string(f[PctIdentity]), 64)
+		if err != nil {
+			return recs, fmt.Errorf("error in line: %s: %w", line, err)
+		}
+		for _, v := range []struct {
+			dst *int
+			col int
+		}{
+			{&r.AlignmentLength, AlignmentLength},
+			{&r.Mismatches, Mismatches},
+			{&r.GapOpens, GapOpens},
+			{&r.QueryStart, QueryStart},
+			{&r.QueryEnd, QueryEnd},
+			{&r.SubjectStart, SubjectStart},
+			{&r.SubjectEnd, SubjectEnd},
+		} {
+			*v.dst, err = strconv.Atoi(string(f[v.col]))
+			if err != nil {
+				return recs, fmt.Errorf("error in line: %s: %w", line, err)
+			}
+		}
+		if len(f) == numFields {
+			r.EValue, err = strconv.ParseFloat(string(f[EValue]), 64)
+			if err != nil {
+				return recs, fmt.Errorf("error in line: %s: %w", line, err)
+			}
+			r.BitScore, err = strconv.ParseFloat(string(f[BitScore]), 64)
+			if err != nil {
+				return recs, fmt.Errorf("error in line: %s: %w", line, err)
+			}
+		}
+		if r.QueryEnd < r.QueryStart {
+			// Orient the alignment so that the query
+			// is on the forward strand.
+			r.QueryStart, r.QueryEnd = r.QueryEnd, r.QueryStart
+			r.SubjectStart, r.SubjectEnd = r.SubjectEnd, r.SubjectStart
+		}
+		r.QueryStart-- // Use zero-based indexing internally.
+		r.SubjectStart--
+		r.Strand = 1
+		if r.SubjectEnd < r.SubjectStart {
+			r.Strand = -1
+		}
+		recs = append(recs, r)
+	}
+	err := sc.Err()
+	return recs, err
+}